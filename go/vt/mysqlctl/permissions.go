@@ -13,25 +13,18 @@ import (
 // GetPermissions lists the permissions on the mysqld
 func GetPermissions(mysqld MysqlDaemon) (*tabletmanagerdatapb.Permissions, error) {
 	ctx := context.TODO()
-	permissions := &tabletmanagerdatapb.Permissions{}
 
 	// get Users
-	qr, err := mysqld.FetchSuperQuery(ctx, "SELECT * FROM mysql.user")
+	userResult, err := mysqld.FetchSuperQuery(ctx, "SELECT * FROM mysql.user")
 	if err != nil {
 		return nil, err
 	}
-	for _, row := range qr.Rows {
-		permissions.UserPermissions = append(permissions.UserPermissions, tmutils.NewUserPermission(qr.Fields, row))
-	}
 
 	// get Dbs
-	qr, err = mysqld.FetchSuperQuery(ctx, "SELECT * FROM mysql.db")
+	dbResult, err := mysqld.FetchSuperQuery(ctx, "SELECT * FROM mysql.db")
 	if err != nil {
 		return nil, err
 	}
-	for _, row := range qr.Rows {
-		permissions.DbPermissions = append(permissions.DbPermissions, tmutils.NewDbPermission(qr.Fields, row))
-	}
 
-	return permissions, nil
+	return tmutils.PermissionsFromResults(userResult, dbResult), nil
 }
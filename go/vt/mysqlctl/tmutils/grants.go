@@ -0,0 +1,638 @@
+// Copyright 2016, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tmutils
+
+import (
+	"fmt"
+	"hash/crc64"
+	"regexp"
+	"sort"
+	"strings"
+
+	tabletmanagerdatapb "github.com/youtube/vitess/go/vt/proto/tabletmanagerdata"
+)
+
+// This file contains helper methods to go between Permissions and
+// MySQL GRANT statements.
+
+// privilege describes a MySQL privilege, and the columns it is
+// stored in inside the mysql.user and mysql.db tables.
+type privilege struct {
+	// name is the privilege name, as used in GRANT statements.
+	name string
+	// userColumn is the column in mysql.user.
+	userColumn string
+	// dbColumn is the column in mysql.db, or "" for global only
+	// privileges.
+	dbColumn string
+}
+
+// privileges is the list of all privileges we know about, except
+// GRANT OPTION, which is handled separately (it is not part of
+// ALL PRIVILEGES). See the MySQL documentation for GRANT.
+var privileges = []privilege{
+	{"SELECT", "Select_priv", "Select_priv"},
+	{"INSERT", "Insert_priv", "Insert_priv"},
+	{"UPDATE", "Update_priv", "Update_priv"},
+	{"DELETE", "Delete_priv", "Delete_priv"},
+	{"CREATE", "Create_priv", "Create_priv"},
+	{"DROP", "Drop_priv", "Drop_priv"},
+	{"RELOAD", "Reload_priv", ""},
+	{"SHUTDOWN", "Shutdown_priv", ""},
+	{"PROCESS", "Process_priv", ""},
+	{"FILE", "File_priv", ""},
+	{"REFERENCES", "References_priv", "References_priv"},
+	{"INDEX", "Index_priv", "Index_priv"},
+	{"ALTER", "Alter_priv", "Alter_priv"},
+	{"SHOW DATABASES", "Show_db_priv", ""},
+	{"SUPER", "Super_priv", ""},
+	{"CREATE TEMPORARY TABLES", "Create_tmp_table_priv", "Create_tmp_table_priv"},
+	{"LOCK TABLES", "Lock_tables_priv", "Lock_tables_priv"},
+	{"EXECUTE", "Execute_priv", "Execute_priv"},
+	{"REPLICATION SLAVE", "Repl_slave_priv", ""},
+	{"REPLICATION CLIENT", "Repl_client_priv", ""},
+	{"CREATE VIEW", "Create_view_priv", "Create_view_priv"},
+	{"SHOW VIEW", "Show_view_priv", "Show_view_priv"},
+	{"CREATE ROUTINE", "Create_routine_priv", "Create_routine_priv"},
+	{"ALTER ROUTINE", "Alter_routine_priv", "Alter_routine_priv"},
+	{"CREATE USER", "Create_user_priv", ""},
+	{"EVENT", "Event_priv", "Event_priv"},
+	{"TRIGGER", "Trigger_priv", "Trigger_priv"},
+	{"CREATE TABLESPACE", "Create_tablespace_priv", ""},
+}
+
+const (
+	grantOption = "GRANT OPTION"
+	// grantOptionColumn is the GRANT OPTION column in both mysql.user
+	// and mysql.db.
+	grantOptionColumn = "Grant_priv"
+)
+
+// dangerousPrivileges are the names of the global privileges that give
+// access to the server itself, its files, its other accounts or its
+// replication stream, for DangerousPrivileges.
+var dangerousPrivileges = []string{
+	"SUPER",
+	"FILE",
+	"PROCESS",
+	"SHUTDOWN",
+	"RELOAD",
+	"CREATE USER",
+	"REPLICATION SLAVE",
+	grantOption,
+}
+
+// privilegeColumn returns the column of a privilege in mysql.user,
+// name being either the column name, like "File_priv", or the name
+// used in GRANT statements, like "FILE" or "GRANT OPTION", in any
+// case. Unknown names are returned as is.
+func privilegeColumn(name string) string {
+	if strings.EqualFold(name, grantOption) {
+		return grantOptionColumn
+	}
+	for _, p := range privileges {
+		if strings.EqualFold(name, p.name) {
+			return p.userColumn
+		}
+	}
+	return name
+}
+
+// HasPrivilege returns true if a user permission grants a privilege.
+// name is either the column name, like "Super_priv", or the name used
+// in GRANT statements, like "SUPER". The value of the column is
+// compared with 'Y' ignoring case and spaces.
+func HasPrivilege(up *tabletmanagerdatapb.UserPermission, name string) bool {
+	return strings.EqualFold(strings.TrimSpace(up.Privileges[privilegeColumn(name)]), "Y")
+}
+
+// HasGrantOption returns true if a user permission grants the GRANT
+// OPTION privilege.
+func HasGrantOption(up *tabletmanagerdatapb.UserPermission) bool {
+	return HasPrivilege(up, grantOption)
+}
+
+// DangerousPrivileges returns the names, as used in GRANT statements,
+// of the privileges a user permission grants among the ones that give
+// access to more than the data, like SUPER, FILE or GRANT OPTION. It
+// returns nil if it grants none of them.
+func DangerousPrivileges(up *tabletmanagerdatapb.UserPermission) []string {
+	var result []string
+	for _, name := range dangerousPrivileges {
+		if HasPrivilege(up, name) {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+var (
+	grantRegexp      = regexp.MustCompile(`(?is)^\s*GRANT\s+(.+?)\s+ON\s+(.+?)\s+TO\s+('(?:[^'\\]|\\.|'')*'|` + "`[^`]*`" + `|[^\s@]+)@('(?:[^'\\]|\\.|'')*'|` + "`[^`]*`" + `|[^\s]+)(.*?)\s*;?\s*$`)
+	targetRegexp     = regexp.MustCompile(`^(\*|` + "`[^`]*`" + `|[^\s.]+)\.(\*|` + "`[^`]*`" + `|[^\s.]+)$`)
+	identifiedRegexp = regexp.MustCompile(`(?is)^\s*IDENTIFIED\s+BY\s+PASSWORD\s+('(?:[^'\\]|\\.|'')*')`)
+	withGrantRegexp  = regexp.MustCompile(`(?is)^\s*WITH\s+GRANT\s+OPTION`)
+)
+
+// unquoteIdentifier removes the quotes around a MySQL string or identifier.
+func unquoteIdentifier(s string) string {
+	if len(s) < 2 {
+		return s
+	}
+	switch s[0] {
+	case '\'':
+		if s[len(s)-1] == '\'' {
+			s = s[1 : len(s)-1]
+			s = strings.Replace(s, "''", "'", -1)
+			return strings.Replace(s, `\'`, "'", -1)
+		}
+	case '`':
+		if s[len(s)-1] == '`' {
+			return s[1 : len(s)-1]
+		}
+	}
+	return s
+}
+
+// parsePrivilegeList returns the privileges named in a GRANT statement,
+// if ALL PRIVILEGES was used, and if GRANT OPTION was part of the list.
+func parsePrivilegeList(list string) (result []privilege, all bool, withGrantOption bool, err error) {
+	for _, p := range strings.Split(list, ",") {
+		name := strings.ToUpper(strings.Join(strings.Fields(p), " "))
+		switch name {
+		case "USAGE":
+			continue
+		case grantOption:
+			withGrantOption = true
+			continue
+		case "ALL", "ALL PRIVILEGES":
+			result = append(result, privileges...)
+			all = true
+			continue
+		}
+		found := false
+		for _, priv := range privileges {
+			if priv.name == name {
+				result = append(result, priv)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, false, false, fmt.Errorf("unknown privilege %q", strings.TrimSpace(p))
+		}
+	}
+	return result, all, withGrantOption, nil
+}
+
+// ParseGrantStatements builds Permissions out of the GRANT statements
+// returned by SHOW GRANTS. It understands global (ON *.*) grants, that
+// create UserPermission entries, and database (ON db.*) grants, that
+// create DbPermission entries. The privileges that are not granted are
+// set to 'N', like they are in the grant tables. 'ALL PRIVILEGES',
+// 'WITH GRANT OPTION' and 'IDENTIFIED BY PASSWORD' are supported.
+// GRANT PROXY statements are ignored, as Permissions doesn't contain
+// the proxy privileges. Table and column level grants are not supported.
+func ParseGrantStatements(grants []string) (*tabletmanagerdatapb.Permissions, error) {
+	users := make(map[string]*tabletmanagerdatapb.UserPermission)
+	dbs := make(map[string]*tabletmanagerdatapb.DbPermission)
+	for _, grant := range grants {
+		if strings.TrimSpace(grant) == "" {
+			continue
+		}
+		m := grantRegexp.FindStringSubmatch(grant)
+		if m == nil {
+			return nil, fmt.Errorf("cannot parse grant statement: %v", grant)
+		}
+		privList, target, user, host, rest := m[1], m[2], unquoteIdentifier(m[3]), unquoteIdentifier(m[4]), m[5]
+		if strings.ToUpper(strings.TrimSpace(privList)) == "PROXY" {
+			continue
+		}
+
+		privs, all, withGrantOption, err := parsePrivilegeList(privList)
+		if err != nil {
+			return nil, fmt.Errorf("%v in grant statement: %v", err, grant)
+		}
+
+		// parse the options
+		hasPassword := false
+		password := ""
+		for strings.TrimSpace(rest) != "" {
+			if im := identifiedRegexp.FindStringSubmatch(rest); im != nil {
+				hasPassword = true
+				password = unquoteIdentifier(im[1])
+				rest = rest[len(im[0]):]
+				continue
+			}
+			if wm := withGrantRegexp.FindString(rest); wm != "" {
+				withGrantOption = true
+				rest = rest[len(wm):]
+				continue
+			}
+			return nil, fmt.Errorf("unsupported clause %q in grant statement: %v", strings.TrimSpace(rest), grant)
+		}
+
+		tm := targetRegexp.FindStringSubmatch(strings.TrimSpace(target))
+		if tm == nil {
+			return nil, fmt.Errorf("cannot parse target %q in grant statement: %v", target, grant)
+		}
+		db, table := unquoteIdentifier(tm[1]), tm[2]
+		if table != "*" {
+			return nil, fmt.Errorf("table level grants are not supported: %v", grant)
+		}
+
+		if db == "*" {
+			// Global grant, goes into mysql.user.
+			up := &tabletmanagerdatapb.UserPermission{
+				Host:       host,
+				User:       user,
+				Privileges: make(map[string]string),
+			}
+			if existing, ok := users[UserPermissionPrimaryKey(up)]; ok {
+				up = existing
+			} else {
+				for _, priv := range privileges {
+					up.Privileges[priv.userColumn] = "N"
+				}
+				up.Privileges[grantOptionColumn] = "N"
+				users[UserPermissionPrimaryKey(up)] = up
+			}
+			for _, priv := range privs {
+				up.Privileges[priv.userColumn] = "Y"
+			}
+			if withGrantOption {
+				up.Privileges[grantOptionColumn] = "Y"
+			}
+			if hasPassword {
+				up.PasswordChecksum = crc64.Checksum(([]byte)(password), hashTable)
+			}
+			continue
+		}
+
+		// Database grant, goes into mysql.db. A password
+		// clause here is ignored, it belongs to the user.
+		dp := &tabletmanagerdatapb.DbPermission{
+			Host:       host,
+			Db:         db,
+			User:       user,
+			Privileges: make(map[string]string),
+		}
+		if existing, ok := dbs[DbPermissionPrimaryKey(dp)]; ok {
+			dp = existing
+		} else {
+			for _, priv := range privileges {
+				if priv.dbColumn != "" {
+					dp.Privileges[priv.dbColumn] = "N"
+				}
+			}
+			dp.Privileges[grantOptionColumn] = "N"
+			dbs[DbPermissionPrimaryKey(dp)] = dp
+		}
+		for _, priv := range privs {
+			if priv.dbColumn == "" {
+				if all {
+					continue
+				}
+				return nil, fmt.Errorf("privilege %v cannot be granted on a database: %v", priv.name, grant)
+			}
+			dp.Privileges[priv.dbColumn] = "Y"
+		}
+		if withGrantOption {
+			dp.Privileges[grantOptionColumn] = "Y"
+		}
+	}
+
+	permissions := &tabletmanagerdatapb.Permissions{}
+	for _, up := range users {
+		permissions.UserPermissions = append(permissions.UserPermissions, up)
+	}
+	sort.Sort(userPermissionList(permissions.UserPermissions))
+	for _, dp := range dbs {
+		permissions.DbPermissions = append(permissions.DbPermissions, dp)
+	}
+	sort.Sort(dbPermissionList(permissions.DbPermissions))
+	return permissions, nil
+}
+
+// quoteString returns s as a MySQL quoted string.
+func quoteString(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return "'" + strings.Replace(s, "'", `\'`, -1) + "'"
+}
+
+// quoteAccount returns the MySQL account name for a user and a host.
+func quoteAccount(user, host string) string {
+	return quoteString(user) + "@" + quoteString(host)
+}
+
+// quoteDbTarget returns the GRANT target for all tables of a database.
+func quoteDbTarget(db string) string {
+	return "`" + strings.Replace(db, "`", "``", -1) + "`.*"
+}
+
+// privilegeChangesSQL returns the GRANT and REVOKE statements needed
+// to go from the 'from' privileges to the 'to' privileges for the
+// given account and target. An empty 'from' map means there is nothing
+// to revoke. If warn is set, a warning is returned for each differing
+// column that is not a known privilege.
+func privilegeChangesSQL(from, to map[string]string, db bool, target, account string, warn bool) []string {
+	var grants, revokes []string
+	known := map[string]bool{grantOptionColumn: true}
+	for _, priv := range privileges {
+		column := priv.userColumn
+		if db {
+			column = priv.dbColumn
+		}
+		if column == "" {
+			continue
+		}
+		known[column] = true
+		switch {
+		case to[column] == "Y" && from[column] != "Y":
+			grants = append(grants, priv.name)
+		case to[column] != "Y" && from[column] == "Y":
+			revokes = append(revokes, priv.name)
+		}
+	}
+	withGrantOption := ""
+	switch {
+	case to[grantOptionColumn] == "Y" && from[grantOptionColumn] != "Y":
+		withGrantOption = " WITH GRANT OPTION"
+		if len(grants) == 0 {
+			grants = append(grants, "USAGE")
+		}
+	case to[grantOptionColumn] != "Y" && from[grantOptionColumn] == "Y":
+		revokes = append(revokes, grantOption)
+	}
+
+	var result []string
+	if len(revokes) > 0 {
+		result = append(result, "REVOKE "+strings.Join(revokes, ", ")+" ON "+target+" FROM "+account)
+	}
+	if len(grants) > 0 {
+		result = append(result, "GRANT "+strings.Join(grants, ", ")+" ON "+target+" TO "+account+withGrantOption)
+	}
+	if warn {
+		for _, column := range privilegeNames(from, to) {
+			fv, fok := from[column]
+			tv, tok := to[column]
+			if !known[column] && (fok != tok || fv != tv) {
+				result = append(result, warningSQLPrefix+"cannot generate SQL for the "+column+" change of "+account+" on "+target)
+			}
+		}
+	}
+	return result
+}
+
+// warningSQLPrefix starts the warnings returned by PermissionsToSQL.
+const warningSQLPrefix = "-- WARNING: "
+
+// passwordWarningSQL is the placeholder emitted instead of a password
+// change, as a password cannot be reconstructed from its checksum.
+func passwordWarningSQL(account string) string {
+	return warningSQLPrefix + "the password of " + account + " cannot be derived from its checksum, set it manually"
+}
+
+// createUserWarningSQL returns the warning for an account that has to
+// be created manually, as its password cannot be derived from its
+// checksum.
+func createUserWarningSQL(account string) string {
+	return warningSQLPrefix + "the password of " + account + " cannot be derived from its checksum, create it manually with CREATE USER " + account + " IDENTIFIED BY its password"
+}
+
+// afterCreateUserSQL turns the statements for an account that has to
+// be created manually into warnings, as running them first would
+// create the account without password.
+func afterCreateUserSQL(account string, statements []string) []string {
+	result := make([]string, len(statements))
+	for i, statement := range statements {
+		if strings.HasPrefix(statement, warningSQLPrefix) {
+			result[i] = statement
+			continue
+		}
+		result[i] = warningSQLPrefix + "after creating " + account + ": " + statement
+	}
+	return result
+}
+
+// splitUserPermissionHosts returns a copy of a user entry for each of
+// the comma-separated hosts of a DiffPermissionsOptions.IgnoreHost
+// merged entry, by host. It returns nil for a nil entry.
+func splitUserPermissionHosts(up *tabletmanagerdatapb.UserPermission) map[string]*tabletmanagerdatapb.UserPermission {
+	if up == nil {
+		return nil
+	}
+	result := make(map[string]*tabletmanagerdatapb.UserPermission)
+	for _, host := range strings.Split(up.Host, ",") {
+		c := *up
+		c.Host = host
+		result[host] = &c
+	}
+	return result
+}
+
+// perHostEvents returns the events of diff. For a diff made with
+// DiffPermissionsOptions.IgnoreHost, each user event is split into an
+// event per host, as its entries are merged across hosts: a host on
+// both sides gives a mismatch if the entries differ, a host on one
+// side gives an extra entry.
+func perHostEvents(diff *DiffPermissionsResult) []*PermissionDiffEvent {
+	if !diff.IgnoreHost {
+		return diff.Events
+	}
+	var result []*PermissionDiffEvent
+	for _, ev := range diff.Events {
+		if ev.Type == PermissionDiffConflict || (ev.LeftUser == nil && ev.RightUser == nil) {
+			result = append(result, ev)
+			continue
+		}
+		left := splitUserPermissionHosts(ev.LeftUser)
+		right := splitUserPermissionHosts(ev.RightUser)
+		var hosts []string
+		for host := range left {
+			hosts = append(hosts, host)
+		}
+		for host := range right {
+			if _, ok := left[host]; !ok {
+				hosts = append(hosts, host)
+			}
+		}
+		sort.Strings(hosts)
+		for _, host := range hosts {
+			l, r := left[host], right[host]
+			switch {
+			case l != nil && r != nil:
+				if UserPermissionEqual(l, r) {
+					continue
+				}
+				result = append(result, &PermissionDiffEvent{Type: PermissionDiffMismatch, Name: ev.Name, PrimaryKey: UserPermissionPrimaryKey(l), LeftUser: l, RightUser: r})
+			case l != nil:
+				result = append(result, &PermissionDiffEvent{Type: PermissionDiffExtra, Name: ev.Name, Side: LeftSide, PrimaryKey: UserPermissionPrimaryKey(l), LeftUser: l})
+			default:
+				result = append(result, &PermissionDiffEvent{Type: PermissionDiffExtra, Name: ev.Name, Side: RightSide, PrimaryKey: UserPermissionPrimaryKey(r), RightUser: r})
+			}
+		}
+	}
+	return result
+}
+
+// PermissionsToSQL returns the SQL statements that would make the
+// right side of the diff match its left side: CREATE USER and GRANT
+// for missing entries, DROP USER and REVOKE for extra entries, and
+// GRANT and REVOKE for differing privileges. Password changes cannot
+// be generated from a checksum, so they are returned as commented out
+// warnings. A missing account with a password is not created, as it
+// would be created without one: the CREATE USER and all the GRANT
+// statements of the account are returned as warnings, to run once the
+// account is created manually. Only the known privilege columns are
+// translated, other differing columns also produce a warning.
+// PermissionDiffConflict events are skipped, as they are not
+// differences between the sides. The user entries of a diff made with
+// DiffPermissionsOptions.IgnoreHost are split into one account per
+// host. For a diff made with DiffPermissionsOptions.MatchDbWildcards,
+// an exact db compared with a pattern is changed on the exact db, and
+// the pattern is left as it is.
+func PermissionsToSQL(diff *DiffPermissionsResult) []string {
+	var result []string
+	dropped := make(map[string]bool)
+	manual := make(map[string]bool)
+	for _, ev := range perHostEvents(diff) {
+		switch {
+		case ev.Type == PermissionDiffConflict:
+			continue
+		case ev.LeftUser != nil || ev.RightUser != nil:
+			switch {
+			case ev.Type == PermissionDiffExtra && ev.Side == LeftSide:
+				account := quoteAccount(ev.LeftUser.User, ev.LeftUser.Host)
+				grants := privilegeChangesSQL(nil, ev.LeftUser.Privileges, false, "*.*", account, false)
+				if ev.LeftUser.PasswordChecksum != 0 {
+					manual[UserPermissionPrimaryKey(ev.LeftUser)] = true
+					result = append(result, createUserWarningSQL(account))
+					result = append(result, afterCreateUserSQL(account, grants)...)
+					continue
+				}
+				result = append(result, "CREATE USER "+account)
+				result = append(result, grants...)
+			case ev.Type == PermissionDiffExtra:
+				result = append(result, "DROP USER "+quoteAccount(ev.RightUser.User, ev.RightUser.Host))
+				dropped[UserPermissionPrimaryKey(ev.RightUser)] = true
+			default:
+				account := quoteAccount(ev.LeftUser.User, ev.LeftUser.Host)
+				if ev.LeftUser.PasswordChecksum != ev.RightUser.PasswordChecksum {
+					result = append(result, passwordWarningSQL(account))
+				}
+				result = append(result, privilegeChangesSQL(ev.RightUser.Privileges, ev.LeftUser.Privileges, false, "*.*", account, true)...)
+			}
+		case ev.LeftDb != nil || ev.RightDb != nil:
+			switch {
+			case ev.Type == PermissionDiffExtra && ev.Side == LeftSide:
+				account := quoteAccount(ev.LeftDb.User, ev.LeftDb.Host)
+				grants := privilegeChangesSQL(nil, ev.LeftDb.Privileges, true, quoteDbTarget(ev.LeftDb.Db), account, false)
+				if manual[ev.LeftDb.Host+":"+ev.LeftDb.User] {
+					grants = afterCreateUserSQL(account, grants)
+				}
+				result = append(result, grants...)
+			case ev.Type == PermissionDiffExtra:
+				if dropped[ev.RightDb.Host+":"+ev.RightDb.User] {
+					// DROP USER already removed the grants.
+					continue
+				}
+				result = append(result, "REVOKE ALL PRIVILEGES, GRANT OPTION ON "+quoteDbTarget(ev.RightDb.Db)+" FROM "+quoteAccount(ev.RightDb.User, ev.RightDb.Host))
+			default:
+				account := quoteAccount(ev.LeftDb.User, ev.LeftDb.Host)
+				db, from := ev.LeftDb.Db, ev.RightDb.Privileges
+				if ev.LeftDb.Db != ev.RightDb.Db {
+					// An exact db compared with a pattern of the other
+					// side, see DiffPermissionsOptions.MatchDbWildcards:
+					// only the exact db is changed. If it is on the
+					// left, the right side has no entry for it yet.
+					if isDbPattern(ev.LeftDb.Db) {
+						db = ev.RightDb.Db
+					} else {
+						from = nil
+					}
+				}
+				grants := privilegeChangesSQL(from, ev.LeftDb.Privileges, true, quoteDbTarget(db), account, true)
+				if manual[ev.LeftDb.Host+":"+ev.LeftDb.User] {
+					grants = afterCreateUserSQL(account, grants)
+				}
+				result = append(result, grants...)
+			}
+		}
+	}
+	return result
+}
+
+// SyncPlan is the list of statements that makes a permission set
+// match another one, as returned by PlanPermissionSync.
+type SyncPlan struct {
+	// Statements are the SQL statements to run, in order.
+	Statements []string
+
+	// Warnings are the changes that cannot be made with SQL
+	// statements, like password changes, and have to be done
+	// manually.
+	Warnings []string
+}
+
+// syncStatementOrder returns the rank of a statement in a SyncPlan:
+// accounts are dropped, then created, then privileges are revoked
+// and granted.
+func syncStatementOrder(statement string) int {
+	switch {
+	case strings.HasPrefix(statement, "DROP USER "):
+		return 0
+	case strings.HasPrefix(statement, "CREATE USER "):
+		return 1
+	case strings.HasPrefix(statement, "REVOKE "):
+		return 2
+	default:
+		return 3
+	}
+}
+
+// syncStatements sorts statements with syncStatementOrder, keeping
+// the order of statements of the same rank.
+type syncStatements []string
+
+func (s syncStatements) Len() int {
+	return len(s)
+}
+
+func (s syncStatements) Less(i, j int) bool {
+	return syncStatementOrder(s[i]) < syncStatementOrder(s[j])
+}
+
+func (s syncStatements) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// PlanPermissionSync returns the statements that would make current
+// match desired, without running them, for instance to make a replica
+// match its master. They are the statements of PermissionsToSQL,
+// ordered as DROP USER, CREATE USER, REVOKE, then GRANT statements.
+// The warnings of PermissionsToSQL are returned separately, without
+// their comment prefix: they include the creation of the accounts
+// that have a password, and their grants. The plan only contains the differences, so
+// planning again once it is applied returns an empty plan. It fails
+// if either permission set doesn't pass ValidatePermissions.
+func PlanPermissionSync(current, desired *tabletmanagerdatapb.Permissions) (*SyncPlan, error) {
+	if err := ValidatePermissions(current); err != nil {
+		return nil, fmt.Errorf("invalid current permissions: %v", err)
+	}
+	if err := ValidatePermissions(desired); err != nil {
+		return nil, fmt.Errorf("invalid desired permissions: %v", err)
+	}
+
+	plan := &SyncPlan{}
+	for _, statement := range PermissionsToSQL(DiffPermissionsToResult("desired", desired, "current", current)) {
+		if strings.HasPrefix(statement, warningSQLPrefix) {
+			plan.Warnings = append(plan.Warnings, strings.TrimPrefix(statement, warningSQLPrefix))
+			continue
+		}
+		plan.Statements = append(plan.Statements, statement)
+	}
+	sort.Stable(syncStatements(plan.Statements))
+	return plan, nil
+}
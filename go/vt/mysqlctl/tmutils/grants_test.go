@@ -0,0 +1,284 @@
+// Copyright 2016, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tmutils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	tabletmanagerdatapb "github.com/youtube/vitess/go/vt/proto/tabletmanagerdata"
+)
+
+func TestParseGrantStatements(t *testing.T) {
+	p, err := ParseGrantStatements([]string{
+		"GRANT SELECT, INSERT, REPLICATION CLIENT ON *.* TO 'vt'@'%' IDENTIFIED BY PASSWORD '*A4B6157319038724E3560894F7F932C8886EBFCF'",
+		"GRANT ALL PRIVILEGES ON `vt_live`.* TO 'vt'@'%' WITH GRANT OPTION",
+		"GRANT ALL PRIVILEGES ON *.* TO 'root'@'localhost' WITH GRANT OPTION",
+		"GRANT PROXY ON ''@'' TO 'root'@'localhost' WITH GRANT OPTION",
+		"GRANT USAGE ON *.* TO 'app'@'10.0.0.%'",
+		"GRANT select, update ON `app\\_%`.* TO 'app'@'10.0.0.%'",
+	})
+	if err != nil {
+		t.Fatalf("ParseGrantStatements failed: %v", err)
+	}
+
+	if len(p.UserPermissions) != 3 || len(p.DbPermissions) != 2 {
+		t.Fatalf("ParseGrantStatements returned the wrong number of entries: %v", PermissionsString(p))
+	}
+
+	// users are sorted by primary key
+	vt := p.UserPermissions[0]
+	if UserPermissionPrimaryKey(vt) != "%:vt" || vt.PasswordChecksum == 0 {
+		t.Errorf("unexpected user: %v", UserPermissionString(vt))
+	}
+	if vt.Privileges["Select_priv"] != "Y" || vt.Privileges["Insert_priv"] != "Y" || vt.Privileges["Repl_client_priv"] != "Y" || vt.Privileges["Update_priv"] != "N" || vt.Privileges["Grant_priv"] != "N" {
+		t.Errorf("unexpected user privileges: %v", UserPermissionString(vt))
+	}
+	app := p.UserPermissions[1]
+	if UserPermissionPrimaryKey(app) != "10.0.0.%:app" || app.PasswordChecksum != 0 || app.Privileges["Select_priv"] != "N" {
+		t.Errorf("unexpected user: %v", UserPermissionString(app))
+	}
+	root := p.UserPermissions[2]
+	if UserPermissionPrimaryKey(root) != "localhost:root" || root.Privileges["Super_priv"] != "Y" || root.Privileges["Grant_priv"] != "Y" {
+		t.Errorf("unexpected user: %v", UserPermissionString(root))
+	}
+
+	appDb := p.DbPermissions[1]
+	if DbPermissionPrimaryKey(appDb) != "10.0.0.%:app\\_%:app" || appDb.Privileges["Select_priv"] != "Y" || appDb.Privileges["Update_priv"] != "Y" || appDb.Privileges["Delete_priv"] != "N" {
+		t.Errorf("unexpected db: %v", DbPermissionString(appDb))
+	}
+	vtDb := p.DbPermissions[0]
+	if DbPermissionPrimaryKey(vtDb) != "%:vt_live:vt" || vtDb.Privileges["Delete_priv"] != "Y" || vtDb.Privileges["Grant_priv"] != "Y" {
+		t.Errorf("unexpected db: %v", DbPermissionString(vtDb))
+	}
+	if _, ok := vtDb.Privileges["Super_priv"]; ok {
+		t.Errorf("global privilege in db permission: %v", DbPermissionString(vtDb))
+	}
+
+	// The same password in mysql.user gives the same checksum.
+	up := NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Password": "*A4B6157319038724E3560894F7F932C8886EBFCF"}))
+	if up.PasswordChecksum != vt.PasswordChecksum {
+		t.Errorf("password checksum mismatch: %v != %v", up.PasswordChecksum, vt.PasswordChecksum)
+	}
+}
+
+func TestParseGrantStatementsErrors(t *testing.T) {
+	for _, tc := range []struct {
+		grant string
+		want  string
+	}{
+		{"REVOKE SELECT ON *.* FROM 'vt'@'%'", "cannot parse grant statement"},
+		{"GRANT FLY ON *.* TO 'vt'@'%'", "unknown privilege \"FLY\""},
+		{"GRANT SELECT ON `vt_live`.`t1` TO 'vt'@'%'", "table level grants are not supported"},
+		{"GRANT SUPER ON `vt_live`.* TO 'vt'@'%'", "privilege SUPER cannot be granted on a database"},
+		{"GRANT SELECT ON *.* TO 'vt'@'%' REQUIRE SSL", "unsupported clause \"REQUIRE SSL\""},
+	} {
+		_, err := ParseGrantStatements([]string{tc.grant})
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("ParseGrantStatements(%v) = %v, want error containing %v", tc.grant, err, tc.want)
+		}
+	}
+}
+
+func TestPermissionsToSQL(t *testing.T) {
+	left := &tabletmanagerdatapb.Permissions{}
+	left.UserPermissions = append(left.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Password": "p1", "Select_priv": "Y", "Insert_priv": "Y", "Grant_priv": "N", "max_questions": "10"})))
+	left.UserPermissions = append(left.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "localhost", "User": "new", "Password": "p2", "Select_priv": "Y", "Grant_priv": "Y"})))
+	left.DbPermissions = append(left.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt", "Select_priv": "Y", "Delete_priv": "N"})))
+	left.DbPermissions = append(left.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "localhost", "Db": "vt_new", "User": "new", "Select_priv": "Y"})))
+
+	right := &tabletmanagerdatapb.Permissions{}
+	right.UserPermissions = append(right.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Password": "p3", "Select_priv": "Y", "Insert_priv": "N", "Grant_priv": "Y", "max_questions": "0"})))
+	right.UserPermissions = append(right.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "old", "Select_priv": "Y"})))
+	right.DbPermissions = append(right.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt", "Select_priv": "Y", "Delete_priv": "Y"})))
+	right.DbPermissions = append(right.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_old", "User": "old", "Select_priv": "Y"})))
+	right.DbPermissions = append(right.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_other", "User": "vt", "Select_priv": "Y"})))
+
+	got := PermissionsToSQL(DiffPermissionsToResult("left", left, "right", right))
+	want := []string{
+		"DROP USER 'old'@'%'",
+		"-- WARNING: the password of 'vt'@'%' cannot be derived from its checksum, set it manually",
+		"REVOKE GRANT OPTION ON *.* FROM 'vt'@'%'",
+		"GRANT INSERT ON *.* TO 'vt'@'%'",
+		"-- WARNING: cannot generate SQL for the max_questions change of 'vt'@'%' on *.*",
+		"-- WARNING: the password of 'new'@'localhost' cannot be derived from its checksum, create it manually with CREATE USER 'new'@'localhost' IDENTIFIED BY its password",
+		"-- WARNING: after creating 'new'@'localhost': GRANT SELECT ON *.* TO 'new'@'localhost' WITH GRANT OPTION",
+		"REVOKE DELETE ON `vt_live`.* FROM 'vt'@'%'",
+		"REVOKE ALL PRIVILEGES, GRANT OPTION ON `vt_other`.* FROM 'vt'@'%'",
+		"-- WARNING: after creating 'new'@'localhost': GRANT SELECT ON `vt_new`.* TO 'new'@'localhost'",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("PermissionsToSQL() =\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Applying the same diff to identical permissions is a no-op.
+	if got := PermissionsToSQL(DiffPermissionsToResult("left", left, "left", left)); len(got) != 0 {
+		t.Errorf("PermissionsToSQL(no diff) = %v", got)
+	}
+
+	// An account without password is created directly.
+	noPassword := &tabletmanagerdatapb.Permissions{}
+	noPassword.UserPermissions = append(noPassword.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "localhost", "User": "new", "Select_priv": "Y"})))
+	noPassword.DbPermissions = append(noPassword.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "localhost", "Db": "vt_new", "User": "new", "Select_priv": "Y"})))
+	got = PermissionsToSQL(DiffPermissionsToResult("left", noPassword, "right", &tabletmanagerdatapb.Permissions{}))
+	want = []string{
+		"CREATE USER 'new'@'localhost'",
+		"GRANT SELECT ON *.* TO 'new'@'localhost'",
+		"GRANT SELECT ON `vt_new`.* TO 'new'@'localhost'",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("PermissionsToSQL(no password) =\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestPermissionsToSQLIgnoreHost(t *testing.T) {
+	left := &tabletmanagerdatapb.Permissions{}
+	left.UserPermissions = append(left.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "app", "Select_priv": "Y"})))
+	left.UserPermissions = append(left.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "localhost", "User": "app", "Select_priv": "Y"})))
+	left.UserPermissions = append(left.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "new", "Select_priv": "Y"})))
+	left.UserPermissions = append(left.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "localhost", "User": "new", "Select_priv": "Y"})))
+	right := &tabletmanagerdatapb.Permissions{}
+	right.UserPermissions = append(right.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "app", "Select_priv": "N"})))
+	right.UserPermissions = append(right.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "10.0.0.1", "User": "app", "Select_priv": "N"})))
+	right.UserPermissions = append(right.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "old"})))
+	right.UserPermissions = append(right.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "localhost", "User": "old"})))
+
+	got := PermissionsToSQL(DiffPermissionsToResultWithOptions("left", left, "right", right, DiffPermissionsOptions{IgnoreHost: true}))
+	want := []string{
+		"GRANT SELECT ON *.* TO 'app'@'%'",
+		"DROP USER 'app'@'10.0.0.1'",
+		"CREATE USER 'app'@'localhost'",
+		"GRANT SELECT ON *.* TO 'app'@'localhost'",
+		"CREATE USER 'new'@'%'",
+		"GRANT SELECT ON *.* TO 'new'@'%'",
+		"CREATE USER 'new'@'localhost'",
+		"GRANT SELECT ON *.* TO 'new'@'localhost'",
+		"DROP USER 'old'@'%'",
+		"DROP USER 'old'@'localhost'",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("PermissionsToSQL(IgnoreHost) =\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestPermissionsToSQLMatchDbWildcards(t *testing.T) {
+	newDb := func(db string, privileges map[string]string) *tabletmanagerdatapb.DbPermission {
+		values := map[string]string{"Host": "%", "Db": db, "User": "app"}
+		for k, v := range privileges {
+			values[k] = v
+		}
+		return NewDbPermission(mapToSQLResults(values))
+	}
+	left := &tabletmanagerdatapb.Permissions{
+		DbPermissions: []*tabletmanagerdatapb.DbPermission{
+			newDb(`app\_%`, map[string]string{"Select_priv": "Y", "Insert_priv": "N"}),
+			newDb("web_logs", map[string]string{"Select_priv": "Y", "Insert_priv": "N"}),
+		},
+	}
+	right := &tabletmanagerdatapb.Permissions{
+		DbPermissions: []*tabletmanagerdatapb.DbPermission{
+			newDb("app_logs", map[string]string{"Select_priv": "N", "Insert_priv": "Y"}),
+			newDb(`web\_%`, map[string]string{"Select_priv": "N", "Insert_priv": "N"}),
+		},
+	}
+
+	// the exact dbs are changed, not the patterns
+	got := PermissionsToSQL(DiffPermissionsToResultWithOptions("left", left, "right", right, DiffPermissionsOptions{MatchDbWildcards: true}))
+	want := []string{
+		"REVOKE INSERT ON `app_logs`.* FROM 'app'@'%'",
+		"GRANT SELECT ON `app_logs`.* TO 'app'@'%'",
+		"GRANT SELECT ON `web_logs`.* TO 'app'@'%'",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("PermissionsToSQL(MatchDbWildcards) =\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestPlanPermissionSync(t *testing.T) {
+	desired := &tabletmanagerdatapb.Permissions{}
+	desired.UserPermissions = append(desired.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Password": "p1", "Select_priv": "Y", "Insert_priv": "Y", "Grant_priv": "N", "max_questions": "10"})))
+	desired.UserPermissions = append(desired.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "localhost", "User": "new", "Password": "p2", "Select_priv": "Y", "Grant_priv": "Y"})))
+	desired.DbPermissions = append(desired.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt", "Select_priv": "Y", "Delete_priv": "N"})))
+	desired.DbPermissions = append(desired.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "localhost", "Db": "vt_new", "User": "new", "Select_priv": "Y"})))
+
+	current := &tabletmanagerdatapb.Permissions{}
+	current.UserPermissions = append(current.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Password": "p3", "Select_priv": "Y", "Insert_priv": "N", "Grant_priv": "Y", "max_questions": "0"})))
+	current.UserPermissions = append(current.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "old", "Select_priv": "Y"})))
+	current.DbPermissions = append(current.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt", "Select_priv": "Y", "Delete_priv": "Y"})))
+	current.DbPermissions = append(current.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_other", "User": "vt", "Select_priv": "Y"})))
+
+	plan, err := PlanPermissionSync(current, desired)
+	if err != nil {
+		t.Fatalf("PlanPermissionSync failed: %v", err)
+	}
+	wantStatements := []string{
+		"DROP USER 'old'@'%'",
+		"REVOKE GRANT OPTION ON *.* FROM 'vt'@'%'",
+		"REVOKE DELETE ON `vt_live`.* FROM 'vt'@'%'",
+		"REVOKE ALL PRIVILEGES, GRANT OPTION ON `vt_other`.* FROM 'vt'@'%'",
+		"GRANT INSERT ON *.* TO 'vt'@'%'",
+	}
+	if !reflect.DeepEqual(plan.Statements, wantStatements) {
+		t.Errorf("PlanPermissionSync() statements =\n%v\nwant:\n%v", strings.Join(plan.Statements, "\n"), strings.Join(wantStatements, "\n"))
+	}
+	wantWarnings := []string{
+		"the password of 'vt'@'%' cannot be derived from its checksum, set it manually",
+		"cannot generate SQL for the max_questions change of 'vt'@'%' on *.*",
+		"the password of 'new'@'localhost' cannot be derived from its checksum, create it manually with CREATE USER 'new'@'localhost' IDENTIFIED BY its password",
+		"after creating 'new'@'localhost': GRANT SELECT ON *.* TO 'new'@'localhost' WITH GRANT OPTION",
+		"after creating 'new'@'localhost': GRANT SELECT ON `vt_new`.* TO 'new'@'localhost'",
+	}
+	if !reflect.DeepEqual(plan.Warnings, wantWarnings) {
+		t.Errorf("PlanPermissionSync() warnings =\n%v\nwant:\n%v", strings.Join(plan.Warnings, "\n"), strings.Join(wantWarnings, "\n"))
+	}
+
+	// once synced, there is nothing left to do
+	if plan, err := PlanPermissionSync(desired, desired); err != nil || len(plan.Statements) != 0 || len(plan.Warnings) != 0 {
+		t.Errorf("PlanPermissionSync(synced) = %v %v", plan, err)
+	}
+
+	invalid := &tabletmanagerdatapb.Permissions{}
+	invalid.UserPermissions = append(invalid.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Select_priv": "X"})))
+	if _, err := PlanPermissionSync(invalid, desired); err == nil || !strings.Contains(err.Error(), "invalid current permissions") {
+		t.Errorf("PlanPermissionSync(invalid current) = %v", err)
+	}
+	if _, err := PlanPermissionSync(current, invalid); err == nil || !strings.Contains(err.Error(), "invalid desired permissions") {
+		t.Errorf("PlanPermissionSync(invalid desired) = %v", err)
+	}
+}
+
+func TestHasPrivilege(t *testing.T) {
+	up := NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Select_priv": "Y", "Super_priv": " y ", "File_priv": "N", "Process_priv": "Y", "Grant_priv": "Y"}))
+	for _, tc := range []struct {
+		name string
+		want bool
+	}{
+		{"Select_priv", true},
+		{"SELECT", true},
+		{"select", true},
+		{"SUPER", true},
+		{"File_priv", false},
+		{"FILE", false},
+		{"INSERT", false},
+		{"Unknown_priv", false},
+		{"grant option", true},
+	} {
+		if got := HasPrivilege(up, tc.name); got != tc.want {
+			t.Errorf("HasPrivilege(%v) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	if !HasGrantOption(up) {
+		t.Errorf("HasGrantOption() = false")
+	}
+
+	if got, want := DangerousPrivileges(up), []string{"SUPER", "PROCESS", "GRANT OPTION"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("DangerousPrivileges() = %v, want %v", got, want)
+	}
+	app := NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "app", "Select_priv": "Y", "Grant_priv": "N"}))
+	if HasGrantOption(app) || DangerousPrivileges(app) != nil {
+		t.Errorf("unexpected dangerous privileges: %v", DangerousPrivileges(app))
+	}
+}
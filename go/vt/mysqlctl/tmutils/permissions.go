@@ -7,9 +7,16 @@
 package tmutils
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"hash/crc64"
+	"regexp"
 	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
 
 	"github.com/youtube/vitess/go/sqltypes"
 	"github.com/youtube/vitess/go/vt/concurrency"
@@ -21,18 +28,53 @@ import (
 // This file contains helper methods to deal with Permissions.
 
 var (
-	hashTable = crc64.MakeTable(crc64.ISO)
+	// defaultHashTable is the crc64 table used for password checksums
+	// by default. Changing it would invalidate all stored checksums.
+	defaultHashTable = crc64.MakeTable(crc64.ISO)
+
+	hashTable = defaultHashTable
 )
 
+// SetPasswordChecksumTable changes the crc64 table used by
+// NewUserPermission to compute password checksums, for instance to
+// use the ECMA polynomial to match an external system. A nil table
+// restores the default ISO one. It is not thread-safe, and is meant
+// to be called once at startup, before any permission is built.
+func SetPasswordChecksumTable(table *crc64.Table) {
+	if table == nil {
+		table = defaultHashTable
+	}
+	hashTable = table
+}
+
 // permissionList is an internal type to facilitate common code between the 3 permission types
 type permissionList interface {
 	Get(int) (primayKey string, value string)
 	Len() int
+	// Password returns a printable description of the password
+	// state, or "" if the permission type has no password.
+	Password(int) string
+	Privileges(int) map[string]string
+	// setEntry stores the i-th entry in the side field of ev.
+	setEntry(ev *PermissionDiffEvent, side PermissionDiffSide, i int)
 }
 
 func printPrivileges(priv map[string]string) string {
+	return printPrivilegesFiltered(priv, false)
+}
+
+// printGrantedPrivileges is printPrivileges, omitting the privileges
+// set to N.
+func printGrantedPrivileges(priv map[string]string) string {
+	return printPrivilegesFiltered(priv, true)
+}
+
+func printPrivilegesFiltered(priv map[string]string, skipDenied bool) string {
 	si := make([]string, 0, len(priv))
-	for k := range priv {
+	for k, v := range priv {
+		if skipDenied && v == "N" {
+			continue
+		}
 		si = append(si, k)
 	}
 	sort.Strings(si)
@@ -43,6 +85,70 @@ func printPrivileges(priv map[string]string) string {
 	return result
 }
 
+// privilegeNames returns the sorted names of the privileges present
+// in either map.
+func privilegeNames(left, right map[string]string) []string {
+	si := make([]string, 0, len(left)+len(right))
+	for k := range left {
+		si = append(si, k)
+	}
+	for k := range right {
+		if _, ok := left[k]; !ok {
+			si = append(si, k)
+		}
+	}
+	sort.Strings(si)
+	return si
+}
+
+// diffPrivileges describes the changes needed to go from the left
+// privileges to the right ones, sorted by privilege name. A nil map
+// and an empty map are equal.
+func diffPrivileges(left, right map[string]string) []string {
+	return diffPrivilegesMissingAs(left, right, false)
+}
+
+// diffPrivilegesMissingAs is diffPrivileges, with the privileges
+// present on one side only compared as N on the other side if
+// missingAsDenied is set.
+func diffPrivilegesMissingAs(left, right map[string]string, missingAsDenied bool) []string {
+	var result []string
+	for _, k := range privilegeNames(left, right) {
+		lv, lok := left[k]
+		rv, rok := right[k]
+		if missingAsDenied {
+			if !lok {
+				lv, lok = "N", true
+			}
+			if !rok {
+				rv, rok = "N", true
+			}
+		}
+		switch {
+		case !rok:
+			result = append(result, "removed "+k+"("+lv+")")
+		case !lok:
+			result = append(result, "added "+k+"("+rv+")")
+		case lv != rv:
+			result = append(result, k+" "+lv+"->"+rv)
+		}
+	}
+	return result
+}
+
+// privilegeValue returns the value to store for a privilege column.
+// Set-type privilege columns hold comma-separated values in any
+// order, so they are sorted to compare equal. Only the *_priv columns
+// are changed, others like ssl_cipher may have meaningful commas.
+func privilegeValue(name, value string) string {
+	if !strings.HasSuffix(name, "_priv") || !strings.Contains(value, ",") {
+		return value
+	}
+	parts := strings.Split(value, ",")
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
 // NewUserPermission is a helper method to create a tabletmanagerdatapb.UserPermission
 func NewUserPermission(fields []*querypb.Field, values []sqltypes.Value) *tabletmanagerdatapb.UserPermission {
 	up := &tabletmanagerdatapb.UserPermission{
@@ -57,26 +163,211 @@ func NewUserPermission(fields []*querypb.Field, values []sqltypes.Value) *tablet
 		case "Password":
 			up.PasswordChecksum = crc64.Checksum(([]byte)(values[i].String()), hashTable)
 		default:
-			up.Privileges[field.Name] = values[i].String()
+			up.Privileges[field.Name] = privilegeValue(field.Name, values[i].String())
+		}
+	}
+	return up
+}
+
+// HasWeakPasswordHashing returns true if the PasswordChecksum stored
+// in UserPermission is not collision resistant. It is a crc64, so two
+// different passwords may have the same checksum and a password change
+// can go unnoticed by DiffPermissions. Use PasswordDigests and
+// DiffPasswordDigests for a stricter comparison.
+func HasWeakPasswordHashing() bool {
+	return true
+}
+
+// passwordDigestLen is the number of SHA-256 bytes kept in a PasswordDigests entry.
+const passwordDigestLen = 8
+
+// PasswordDigests maps a UserPermission primary key to a hex-encoded
+// prefix of the SHA-256 of its password. It is kept next to the
+// Permissions (and not in the proto) for the stricter password
+// comparison done by DiffPasswordDigests.
+type PasswordDigests map[string]string
+
+// NewUserPermissionWithDigest is like NewUserPermission, but also
+// stores the password digest of the new UserPermission into digests.
+func NewUserPermissionWithDigest(fields []*querypb.Field, values []sqltypes.Value, digests PasswordDigests) *tabletmanagerdatapb.UserPermission {
+	up := NewUserPermission(fields, values)
+	for i, field := range fields {
+		if field.Name == "Password" {
+			sum := sha256.Sum256(([]byte)(values[i].String()))
+			digests[UserPermissionPrimaryKey(up)] = hex.EncodeToString(sum[:passwordDigestLen])
+		}
+	}
+	return up
+}
+
+// DiffPasswordDigests records an error for each user present on both
+// sides with a different password digest. Users only present on one
+// side are ignored, DiffPermissions already reports them.
+func DiffPasswordDigests(leftName string, left PasswordDigests, rightName string, right PasswordDigests, er concurrency.ErrorRecorder) {
+	keys := make([]string, 0, len(left))
+	for k := range left {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if rd, ok := right[k]; ok && rd != left[k] {
+			er.RecordError(fmt.Errorf("%v and %v disagree on user %v: password digest differs", leftName, rightName, k))
+		}
+	}
+}
+
+// PasswordChecksums maps a UserPermission primary key to a checksum
+// of its password computed with another crc64 table than the one of
+// its PasswordChecksum. It is meant for the transition from one table
+// to another with SetPasswordChecksumTable: the permissions read
+// during the transition keep the checksums for both tables, so they
+// can be compared with permissions saved with either, see
+// DiffPermissionsOptions.LeftAlternateChecksums. Like
+// PasswordDigests, it is kept next to the Permissions.
+type PasswordChecksums map[string]uint64
+
+// NewUserPermissionWithAlternateChecksum is like NewUserPermission,
+// but also stores into checksums the checksum of the password of the
+// new UserPermission computed with table.
+func NewUserPermissionWithAlternateChecksum(fields []*querypb.Field, values []sqltypes.Value, table *crc64.Table, checksums PasswordChecksums) *tabletmanagerdatapb.UserPermission {
+	up := NewUserPermission(fields, values)
+	for i, field := range fields {
+		if field.Name == "Password" {
+			checksums[UserPermissionPrimaryKey(up)] = crc64.Checksum(([]byte)(values[i].String()), table)
 		}
 	}
 	return up
 }
 
+// sameAlternatePassword returns true if the passwords of left and
+// right, which have different checksums, are the same according to
+// their alternate checksums.
+func sameAlternatePassword(left, right *tabletmanagerdatapb.UserPermission, leftAlternates, rightAlternates PasswordChecksums) bool {
+	pk := UserPermissionPrimaryKey(left)
+	la, lok := leftAlternates[pk]
+	ra, rok := rightAlternates[pk]
+	return (lok && la == right.PasswordChecksum) ||
+		(rok && ra == left.PasswordChecksum) ||
+		(lok && rok && la == ra)
+}
+
+// matchAlternateChecksums returns a copy of right where the user
+// permissions with the same password as their left entry according to
+// the alternate checksums have the PasswordChecksum of their left
+// entry, for DiffPermissionsOptions.LeftAlternateChecksums. Only the
+// changed entries are copied.
+func matchAlternateChecksums(left, right *tabletmanagerdatapb.Permissions, leftAlternates, rightAlternates PasswordChecksums) *tabletmanagerdatapb.Permissions {
+	leftUsers := make(map[string]*tabletmanagerdatapb.UserPermission, len(left.UserPermissions))
+	for _, up := range left.UserPermissions {
+		leftUsers[UserPermissionPrimaryKey(up)] = up
+	}
+	result := &tabletmanagerdatapb.Permissions{
+		UserPermissions: make([]*tabletmanagerdatapb.UserPermission, len(right.UserPermissions)),
+		DbPermissions:   right.DbPermissions,
+	}
+	for i, up := range right.UserPermissions {
+		result.UserPermissions[i] = up
+		lup, ok := leftUsers[UserPermissionPrimaryKey(up)]
+		if !ok || lup.PasswordChecksum == up.PasswordChecksum || !sameAlternatePassword(lup, up, leftAlternates, rightAlternates) {
+			continue
+		}
+		c := *up
+		c.PasswordChecksum = lup.PasswordChecksum
+		result.UserPermissions[i] = &c
+	}
+	return result
+}
+
 // UserPermissionPrimaryKey returns the sorting key for a UserPermission
 func UserPermissionPrimaryKey(up *tabletmanagerdatapb.UserPermission) string {
 	return up.Host + ":" + up.User
 }
 
-// UserPermissionString pretty-prints a UserPermission
-func UserPermissionString(up *tabletmanagerdatapb.UserPermission) string {
-	var passwd string
+// UserPermissionMySQLSortKey returns a sorting key for a
+// UserPermission that follows the order MySQL uses to match accounts:
+// literal hosts before hosts with wildcards, longer hosts before
+// shorter ones, then named users before the anonymous user. It is only
+// meant for reports, DiffPermissions always uses
+// UserPermissionPrimaryKey.
+func UserPermissionMySQLSortKey(up *tabletmanagerdatapb.UserPermission) string {
+	wildcard := 0
+	if strings.ContainsAny(up.Host, "%_") {
+		wildcard = 1
+	}
+	anonymous := 0
+	if up.User == "" {
+		anonymous = 1
+	}
+	// MySQL host names are at most 255 characters long, so the
+	// complement of the length sorts longer hosts first.
+	return fmt.Sprintf("%d:%04d:%v:%d:%v", wildcard, 9999-len(up.Host), up.Host, anonymous, up.User)
+}
+
+// UserPermissionSortOrder is an order for SortUserPermissions.
+type UserPermissionSortOrder int
+
+const (
+	// SortByPrimaryKey sorts by UserPermissionPrimaryKey, the order
+	// used by DiffPermissions.
+	SortByPrimaryKey UserPermissionSortOrder = iota
+
+	// SortByMySQLMatchOrder sorts by UserPermissionMySQLSortKey.
+	SortByMySQLMatchOrder
+)
+
+// SortUserPermissions sorts user permissions in place, in the provided
+// order.
+func SortUserPermissions(ups []*tabletmanagerdatapb.UserPermission, order UserPermissionSortOrder) {
+	key := UserPermissionPrimaryKey
+	if order == SortByMySQLMatchOrder {
+		key = UserPermissionMySQLSortKey
+	}
+	sort.Sort(userPermissionsByKey{ups, key})
+}
+
+// userPermissionsByKey sorts user permissions by the result of key.
+type userPermissionsByKey struct {
+	ups []*tabletmanagerdatapb.UserPermission
+	key func(*tabletmanagerdatapb.UserPermission) string
+}
+
+func (s userPermissionsByKey) Len() int {
+	return len(s.ups)
+}
+
+func (s userPermissionsByKey) Less(i, j int) bool {
+	return s.key(s.ups[i]) < s.key(s.ups[j])
+}
+
+func (s userPermissionsByKey) Swap(i, j int) {
+	s.ups[i], s.ups[j] = s.ups[j], s.ups[i]
+}
+
+func userPermissionPassword(up *tabletmanagerdatapb.UserPermission) string {
 	if up.PasswordChecksum == 0 {
-		passwd = "NoPassword"
-	} else {
-		passwd = fmt.Sprintf("PasswordChecksum(%v)", up.PasswordChecksum)
+		return "NoPassword"
 	}
-	return "UserPermission " + passwd + printPrivileges(up.Privileges)
+	return fmt.Sprintf("PasswordChecksum(%v)", up.PasswordChecksum)
+}
+
+// UserPermissionString pretty-prints a UserPermission
+func UserPermissionString(up *tabletmanagerdatapb.UserPermission) string {
+	return "UserPermission " + userPermissionPassword(up) + printPrivileges(up.Privileges)
+}
+
+// UserPermissionGrantedString is UserPermissionString, only printing
+// the privileges that are not set to N.
+func UserPermissionGrantedString(up *tabletmanagerdatapb.UserPermission) string {
+	return "UserPermission " + userPermissionPassword(up) + printGrantedPrivileges(up.Privileges)
+}
+
+// UserPermissionEqual returns true if both UserPermission have the
+// same primary key, password checksum and privileges. It uses the same
+// semantics as DiffPermissions: nil and empty privilege maps are equal.
+func UserPermissionEqual(left, right *tabletmanagerdatapb.UserPermission) bool {
+	return UserPermissionPrimaryKey(left) == UserPermissionPrimaryKey(right) &&
+		left.PasswordChecksum == right.PasswordChecksum &&
+		len(diffPrivileges(left.Privileges, right.Privileges)) == 0
 }
 
 type userPermissionList []*tabletmanagerdatapb.UserPermission
@@ -89,6 +380,42 @@ func (upl userPermissionList) Len() int {
 	return len(upl)
 }
 
+func (upl userPermissionList) Password(i int) string {
+	return userPermissionPassword(upl[i])
+}
+
+func (upl userPermissionList) Privileges(i int) map[string]string {
+	return upl[i].Privileges
+}
+
+func (upl userPermissionList) setEntry(ev *PermissionDiffEvent, side PermissionDiffSide, i int) {
+	if side == LeftSide {
+		ev.LeftUser = upl[i]
+	} else {
+		ev.RightUser = upl[i]
+	}
+}
+
+func (upl userPermissionList) Less(i, j int) bool {
+	return UserPermissionPrimaryKey(upl[i]) < UserPermissionPrimaryKey(upl[j])
+}
+
+func (upl userPermissionList) Swap(i, j int) {
+	upl[i], upl[j] = upl[j], upl[i]
+}
+
+// sorted returns upl if it is already sorted by primary key,
+// or a sorted copy of it otherwise. upl is never modified.
+func (upl userPermissionList) sorted() userPermissionList {
+	if sort.IsSorted(upl) {
+		return upl
+	}
+	result := make(userPermissionList, len(upl))
+	copy(result, upl)
+	sort.Sort(result)
+	return result
+}
+
 // NewDbPermission is a helper method to create a tabletmanagerdatapb.DbPermission
 func NewDbPermission(fields []*querypb.Field, values []sqltypes.Value) *tabletmanagerdatapb.DbPermission {
 	up := &tabletmanagerdatapb.DbPermission{
@@ -103,7 +430,7 @@ func NewDbPermission(fields []*querypb.Field, values []sqltypes.Value) *tabletma
 		case "User":
 			up.User = values[i].String()
 		default:
-			up.Privileges[field.Name] = values[i].String()
+			up.Privileges[field.Name] = privilegeValue(field.Name, values[i].String())
 		}
 	}
 	return up
@@ -119,6 +446,20 @@ func DbPermissionString(dp *tabletmanagerdatapb.DbPermission) string {
 	return "DbPermission" + printPrivileges(dp.Privileges)
 }
 
+// DbPermissionGrantedString is DbPermissionString, only printing the
+// privileges that are not set to N.
+func DbPermissionGrantedString(dp *tabletmanagerdatapb.DbPermission) string {
+	return "DbPermission" + printGrantedPrivileges(dp.Privileges)
+}
+
+// DbPermissionEqual returns true if both DbPermission have the same
+// primary key and privileges. It uses the same semantics as
+// DiffPermissions: nil and empty privilege maps are equal.
+func DbPermissionEqual(left, right *tabletmanagerdatapb.DbPermission) bool {
+	return DbPermissionPrimaryKey(left) == DbPermissionPrimaryKey(right) &&
+		len(diffPrivileges(left.Privileges, right.Privileges)) == 0
+}
+
 type dbPermissionList []*tabletmanagerdatapb.DbPermission
 
 func (upl dbPermissionList) Get(i int) (string, string) {
@@ -129,6 +470,153 @@ func (upl dbPermissionList) Len() int {
 	return len(upl)
 }
 
+func (upl dbPermissionList) Password(i int) string {
+	return ""
+}
+
+func (upl dbPermissionList) Privileges(i int) map[string]string {
+	return upl[i].Privileges
+}
+
+func (upl dbPermissionList) setEntry(ev *PermissionDiffEvent, side PermissionDiffSide, i int) {
+	if side == LeftSide {
+		ev.LeftDb = upl[i]
+	} else {
+		ev.RightDb = upl[i]
+	}
+}
+
+func (upl dbPermissionList) Less(i, j int) bool {
+	return DbPermissionPrimaryKey(upl[i]) < DbPermissionPrimaryKey(upl[j])
+}
+
+func (upl dbPermissionList) Swap(i, j int) {
+	upl[i], upl[j] = upl[j], upl[i]
+}
+
+// sorted returns upl if it is already sorted by primary key,
+// or a sorted copy of it otherwise. upl is never modified.
+func (upl dbPermissionList) sorted() dbPermissionList {
+	if sort.IsSorted(upl) {
+		return upl
+	}
+	result := make(dbPermissionList, len(upl))
+	copy(result, upl)
+	sort.Sort(result)
+	return result
+}
+
+// PermissionsFromResults builds a Permissions from the results of
+// 'SELECT * FROM mysql.user' and 'SELECT * FROM mysql.db', with one
+// entry per row. A nil result is treated as an empty one.
+func PermissionsFromResults(userResult, dbResult *sqltypes.Result) *tabletmanagerdatapb.Permissions {
+	permissions := &tabletmanagerdatapb.Permissions{}
+	if userResult != nil {
+		for _, row := range userResult.Rows {
+			permissions.UserPermissions = append(permissions.UserPermissions, NewUserPermission(userResult.Fields, row))
+		}
+	}
+	if dbResult != nil {
+		for _, row := range dbResult.Rows {
+			permissions.DbPermissions = append(permissions.DbPermissions, NewDbPermission(dbResult.Fields, row))
+		}
+	}
+	return permissions
+}
+
+// PermissionsFromResultsWithLimit is PermissionsFromResults, except
+// that it returns an error, without building anything, if a result
+// has more than maxEntries rows. It protects the callers from grant
+// tables with a pathological number of rows. A maxEntries of 0 or less
+// means no limit.
+func PermissionsFromResultsWithLimit(userResult, dbResult *sqltypes.Result, maxEntries int) (*tabletmanagerdatapb.Permissions, error) {
+	if maxEntries > 0 {
+		if userResult != nil && len(userResult.Rows) > maxEntries {
+			return nil, fmt.Errorf("mysql.user has %v rows, more than the limit of %v", len(userResult.Rows), maxEntries)
+		}
+		if dbResult != nil && len(dbResult.Rows) > maxEntries {
+			return nil, fmt.Errorf("mysql.db has %v rows, more than the limit of %v", len(dbResult.Rows), maxEntries)
+		}
+	}
+	return PermissionsFromResults(userResult, dbResult), nil
+}
+
+// PermissionsFromResultsPartial is PermissionsFromResults, for callers
+// that keep going when some of the grant tables can't be read: each
+// result comes with the error of its query. The tables that were read
+// are still used, and the error of each table that wasn't is returned,
+// in table order, with the table name. The Permissions are then
+// incomplete, so a diff of them should be reported as partial.
+func PermissionsFromResultsPartial(userResult *sqltypes.Result, userErr error, dbResult *sqltypes.Result, dbErr error) (*tabletmanagerdatapb.Permissions, []error) {
+	var errs []error
+	if userErr != nil {
+		errs = append(errs, fmt.Errorf("cannot read mysql.user: %v", userErr))
+		userResult = nil
+	}
+	if dbErr != nil {
+		errs = append(errs, fmt.Errorf("cannot read mysql.db: %v", dbErr))
+		dbResult = nil
+	}
+	return PermissionsFromResults(userResult, dbResult), errs
+}
+
+// UserPermissionKeys returns the sorted primary keys of the user
+// permissions, as returned by UserPermissionPrimaryKey.
+func UserPermissionKeys(permissions *tabletmanagerdatapb.Permissions) []string {
+	keys := make([]string, len(permissions.UserPermissions))
+	for i, up := range permissions.UserPermissions {
+		keys[i] = UserPermissionPrimaryKey(up)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// DbPermissionKeys returns the sorted primary keys of the db
+// permissions, as returned by DbPermissionPrimaryKey.
+func DbPermissionKeys(permissions *tabletmanagerdatapb.Permissions) []string {
+	keys := make([]string, len(permissions.DbPermissions))
+	for i, dp := range permissions.DbPermissions {
+		keys[i] = DbPermissionPrimaryKey(dp)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// EffectivePermissions summarizes what each account can do, keyed by
+// UserPermissionPrimaryKey ("host:user"). Privileges are additive in
+// MySQL, so the global privileges of the user permission are the base,
+// and each db permission adds the privileges it grants that are not
+// granted globally, named "<db>.<privilege>" (like "vt_live.Select_priv",
+// the db being a pattern if the db permission has one). Privileges a
+// db permission doesn't grant are not in the result, as they can't
+// take away a global privilege. Db permissions of accounts without a
+// user permission make an entry with only their privileges. There is
+// no host scope, as Permissions has no host permissions.
+func EffectivePermissions(permissions *tabletmanagerdatapb.Permissions) map[string]map[string]string {
+	result := make(map[string]map[string]string)
+	for _, up := range permissions.UserPermissions {
+		privileges := make(map[string]string, len(up.Privileges))
+		for k, v := range up.Privileges {
+			privileges[k] = v
+		}
+		result[UserPermissionPrimaryKey(up)] = privileges
+	}
+	for _, dp := range permissions.DbPermissions {
+		key := dp.Host + ":" + dp.User
+		privileges, ok := result[key]
+		if !ok {
+			privileges = make(map[string]string)
+			result[key] = privileges
+		}
+		for k, v := range dp.Privileges {
+			if v == "Y" && privileges[k] != "Y" {
+				privileges[dp.Db+"."+k] = v
+			}
+		}
+	}
+	return result
+}
+
 func printPermissions(name string, permissions permissionList) string {
 	result := name + " Permissions:\n"
 	for i := 0; i < permissions.Len(); i++ {
@@ -144,51 +632,727 @@ func PermissionsString(permissions *tabletmanagerdatapb.Permissions) string {
 		printPermissions("Db", dbPermissionList(permissions.DbPermissions))
 }
 
-func diffPermissions(name, leftName string, left permissionList, rightName string, right permissionList, er concurrency.ErrorRecorder) {
+// redactedMarker replaces password checksums in redacted output.
+const redactedMarker = "<redacted>"
+
+func redactedUserPermissionString(up *tabletmanagerdatapb.UserPermission) string {
+	password := "NoPassword"
+	if up.PasswordChecksum != 0 {
+		password = "PasswordChecksum(" + redactedMarker + ")"
+	}
+	return fmt.Sprintf("UserPermission %v %v privileges", password, len(up.Privileges))
+}
+
+func redactedDbPermissionString(dp *tabletmanagerdatapb.DbPermission) string {
+	return fmt.Sprintf("DbPermission %v privileges", len(dp.Privileges))
+}
+
+// RedactedPermissionString is PermissionsString without the password
+// checksums, and with only the number of privileges of each entry, so
+// it can be logged where the full dump would be too revealing.
+func RedactedPermissionString(permissions *tabletmanagerdatapb.Permissions) string {
+	result := "User Permissions:\n"
+	for _, up := range userPermissionList(permissions.UserPermissions).sorted() {
+		result += "  " + UserPermissionPrimaryKey(up) + ": " + redactedUserPermissionString(up) + "\n"
+	}
+	result += "Db Permissions:\n"
+	for _, dp := range dbPermissionList(permissions.DbPermissions).sorted() {
+		result += "  " + DbPermissionPrimaryKey(dp) + ": " + redactedDbPermissionString(dp) + "\n"
+	}
+	return result
+}
+
+// PermissionsFingerprint returns a checksum of permissions, to find
+// out cheaply if two permission sets may differ before diffing them.
+// It covers the primary keys, password checksums and privileges of all
+// the entries, and doesn't depend on the order of the entries. The
+// fingerprint itself always uses the ISO crc64 table, but the password
+// checksums it covers are computed by NewUserPermission with the table
+// of SetPasswordChecksumTable: fingerprints can only be compared
+// across processes that use the same password checksum table,
+// otherwise they differ for the same passwords.
+func PermissionsFingerprint(permissions *tabletmanagerdatapb.Permissions) uint64 {
+	data := printPermissions("User", userPermissionList(permissions.UserPermissions).sorted()) +
+		printPermissions("Db", dbPermissionList(permissions.DbPermissions).sorted())
+	return crc64.Checksum([]byte(data), defaultHashTable)
+}
+
+// PermissionDiffType is the type of a PermissionDiffEvent.
+type PermissionDiffType int
+
+const (
+	// PermissionDiffExtra means only one side has the entry.
+	PermissionDiffExtra PermissionDiffType = iota
+
+	// PermissionDiffMismatch means both sides have the entry,
+	// but with different contents.
+	PermissionDiffMismatch
+
+	// PermissionDiffConflict means one side has entries that should
+	// be the same, but are not, see DiffPermissionsOptions.IgnoreHost.
+	PermissionDiffConflict
+)
+
+// MismatchKind tells what differs in a PermissionDiffMismatch event.
+type MismatchKind int
+
+const (
+	// MismatchNone is the kind of the events that are not a
+	// PermissionDiffMismatch.
+	MismatchNone MismatchKind = iota
+
+	// MismatchPasswordChanged means only the password differs.
+	MismatchPasswordChanged
+
+	// MismatchPrivilegesChanged means only the privileges differ.
+	MismatchPrivilegesChanged
+
+	// MismatchBoth means both the password and the privileges differ.
+	MismatchBoth
+)
+
+// PermissionDiffSide designates one side of a permission diff.
+type PermissionDiffSide int
+
+const (
+	// LeftSide is the first permission set of a diff.
+	LeftSide PermissionDiffSide = iota
+
+	// RightSide is the second permission set of a diff.
+	RightSide
+)
+
+// PermissionDiffEvent describes a single difference between two
+// permission sets.
+type PermissionDiffEvent struct {
+	Type PermissionDiffType
+
+	// Name is the permission type, "user" or "db".
+	Name string
+
+	// Side is the side that has the entry, for PermissionDiffExtra
+	// and PermissionDiffConflict.
+	Side PermissionDiffSide
+
+	// PrimaryKey is the primary key of the entry.
+	PrimaryKey string
+
+	// Detail lists the changes from left to right, for
+	// PermissionDiffMismatch, and the differences between the
+	// conflicting entries, for PermissionDiffConflict.
+	Detail string
+
+	// MismatchKind tells what changed, for PermissionDiffMismatch.
+	MismatchKind MismatchKind
+
+	// LeftUser and RightUser are the entries on each side, for
+	// user permissions. They are nil when the side doesn't have it.
+	LeftUser  *tabletmanagerdatapb.UserPermission
+	RightUser *tabletmanagerdatapb.UserPermission
+
+	// LeftDb and RightDb are the entries on each side, for
+	// db permissions. They are nil when the side doesn't have it.
+	LeftDb  *tabletmanagerdatapb.DbPermission
+	RightDb *tabletmanagerdatapb.DbPermission
+
+	// LeftLabel and RightLabel are the labels of each side, from
+	// DiffPermissionsOptions.
+	LeftLabel  map[string]string
+	RightLabel map[string]string
+}
+
+// DiffPermissionsResult is the structured result of a permission diff.
+type DiffPermissionsResult struct {
+	LeftName  string
+	RightName string
+	Events    []*PermissionDiffEvent
+
+	// Redact and MissingAsDenied are the DiffPermissionsOptions
+	// fields Errors depends on.
+	Redact          bool
+	MissingAsDenied bool
+
+	// IgnoreHost is the DiffPermissionsOptions field: the user
+	// entries of the events are then merged across hosts, which
+	// PermissionsToSQL has to split again.
+	IgnoreHost bool
+}
+
+// labeledName returns the name of a side of a diff, followed by its
+// label if it has one, like "master (cell=cell1, tablet=cell1-100)".
+func labeledName(name string, label map[string]string) string {
+	if len(label) == 0 {
+		return name
+	}
+	keys := make([]string, 0, len(label))
+	for k := range label {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + "=" + label[k]
+	}
+	return name + " (" + strings.Join(parts, ", ") + ")"
+}
+
+// redactedDetail describes a mismatch without the password checksums
+// and the privilege names and values.
+func redactedDetail(ev *PermissionDiffEvent, missingAsDenied bool) string {
+	var parts []string
+	if ev.MismatchKind == MismatchPasswordChanged || ev.MismatchKind == MismatchBoth {
+		parts = append(parts, "password changed")
+	}
+	if ev.MismatchKind != MismatchPasswordChanged {
+		var left, right map[string]string
+		if ev.Name == "user" {
+			left, right = ev.LeftUser.Privileges, ev.RightUser.Privileges
+		} else {
+			left, right = ev.LeftDb.Privileges, ev.RightDb.Privileges
+		}
+		parts = append(parts, fmt.Sprintf("%v privileges changed", len(diffPrivilegesMissingAs(left, right, missingAsDenied))))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// eventError returns the error DiffPermissions records for an event,
+// diffed with opts. If opts.Redact is set, the details of a mismatch
+// are replaced by redactedDetail.
+func eventError(leftName, rightName string, ev *PermissionDiffEvent, opts DiffPermissionsOptions) error {
+	leftName = labeledName(leftName, ev.LeftLabel)
+	rightName = labeledName(rightName, ev.RightLabel)
+	if ev.Type == PermissionDiffMismatch {
+		detail := ev.Detail
+		if opts.Redact {
+			detail = redactedDetail(ev, opts.MissingAsDenied)
+		}
+		return fmt.Errorf("%v and %v disagree on %v %v: %v", leftName, rightName, ev.Name, ev.PrimaryKey, detail)
+	}
+	if ev.Type == PermissionDiffConflict {
+		name := rightName
+		if ev.Side == LeftSide {
+			name = leftName
+		}
+		detail := ev.Detail
+		if opts.Redact {
+			detail = redactedMarker
+		}
+		return fmt.Errorf("%v has conflicting %v %v across hosts: %v", name, ev.Name, ev.PrimaryKey, detail)
+	}
+	if ev.Side == LeftSide {
+		return fmt.Errorf("%v has an extra %v %v", leftName, ev.Name, ev.PrimaryKey)
+	}
+	return fmt.Errorf("%v has an extra %v %v", rightName, ev.Name, ev.PrimaryKey)
+}
+
+// Errors returns the differences as errors, as DiffPermissions would
+// record them.
+func (r *DiffPermissionsResult) Errors() []error {
+	var result []error
+	for _, ev := range r.Events {
+		result = append(result, eventError(r.LeftName, r.RightName, ev, DiffPermissionsOptions{Redact: r.Redact, MissingAsDenied: r.MissingAsDenied}))
+	}
+	return result
+}
+
+// DiffSummary has the number of differences of a permission diff, by
+// permission type, event type and mismatch kind.
+type DiffSummary struct {
+	// Users and Dbs are the number of differences on user and db
+	// permissions.
+	Users int
+	Dbs   int
+
+	// Extra, Mismatch and Conflict are the number of events of each
+	// PermissionDiffType.
+	Extra    int
+	Mismatch int
+	Conflict int
+
+	// PasswordChanged, PrivilegesChanged and BothChanged are the
+	// number of PermissionDiffMismatch events of each MismatchKind.
+	PasswordChanged   int
+	PrivilegesChanged int
+	BothChanged       int
+}
+
+// SummarizeDiff counts the differences of a permission diff.
+func SummarizeDiff(result *DiffPermissionsResult) DiffSummary {
+	var summary DiffSummary
+	for _, ev := range result.Events {
+		if ev.Name == "user" {
+			summary.Users++
+		} else {
+			summary.Dbs++
+		}
+		switch ev.Type {
+		case PermissionDiffExtra:
+			summary.Extra++
+		case PermissionDiffMismatch:
+			summary.Mismatch++
+		case PermissionDiffConflict:
+			summary.Conflict++
+		}
+		switch ev.MismatchKind {
+		case MismatchPasswordChanged:
+			summary.PasswordChanged++
+		case MismatchPrivilegesChanged:
+			summary.PrivilegesChanged++
+		case MismatchBoth:
+			summary.BothChanged++
+		}
+	}
+	return summary
+}
+
+// String returns a one-line summary, like "3 user diffs, 1 db diff".
+func (s DiffSummary) String() string {
+	plural := func(n int, name string) string {
+		if n == 1 {
+			return fmt.Sprintf("%v %v diff", n, name)
+		}
+		return fmt.Sprintf("%v %v diffs", n, name)
+	}
+	return plural(s.Users, "user") + ", " + plural(s.Dbs, "db")
+}
+
+// diffCheckInterval is how many loop iterations diffPermissions runs
+// between two checks of its context.
+const diffCheckInterval = 1000
+
+// diffPermissions merges two sorted permission lists, and calls record
+// for each difference. It returns the context error if ctx is done
+// before the end.
+func diffPermissions(ctx context.Context, name string, left permissionList, right permissionList, missingAsDenied bool, record func(*PermissionDiffEvent)) error {
+	extra := func(side PermissionDiffSide, list permissionList, i int) {
+		pk, _ := list.Get(i)
+		ev := &PermissionDiffEvent{
+			Type:       PermissionDiffExtra,
+			Name:       name,
+			Side:       side,
+			PrimaryKey: pk,
+		}
+		list.setEntry(ev, side, i)
+		record(ev)
+	}
+
+	// The indexes don't move together, so a separate counter decides
+	// when to check ctx.
+	iterations := 0
+	checkContext := func() error {
+		iterations++
+		if iterations%diffCheckInterval == 1 {
+			return ctx.Err()
+		}
+		return nil
+	}
 
 	leftIndex := 0
 	rightIndex := 0
 	for leftIndex < left.Len() && rightIndex < right.Len() {
-		lpk, lval := left.Get(leftIndex)
-		rpk, rval := right.Get(rightIndex)
+		if err := checkContext(); err != nil {
+			return err
+		}
+		lpk, _ := left.Get(leftIndex)
+		rpk, _ := right.Get(rightIndex)
 
 		// extra value on the left side
 		if lpk < rpk {
-			er.RecordError(fmt.Errorf("%v has an extra %v %v", leftName, name, lpk))
+			extra(LeftSide, left, leftIndex)
 			leftIndex++
 			continue
 		}
 
 		// extra value on the right side
 		if lpk > rpk {
-			er.RecordError(fmt.Errorf("%v has an extra %v %v", rightName, name, rpk))
+			extra(RightSide, right, rightIndex)
 			rightIndex++
 			continue
 		}
 
 		// same name, let's see content
-		if lval != rval {
-			er.RecordError(fmt.Errorf("%v and %v disagree on %v %v:\n%v\n differs from:\n%v", leftName, rightName, name, lpk, lval, rval))
+		var changes []string
+		passwordChanged := false
+		if lpw, rpw := left.Password(leftIndex), right.Password(rightIndex); lpw != rpw {
+			changes = append(changes, lpw+"->"+rpw)
+			passwordChanged = true
+		}
+		privilegeChanges := diffPrivilegesMissingAs(left.Privileges(leftIndex), right.Privileges(rightIndex), missingAsDenied)
+		changes = append(changes, privilegeChanges...)
+		if len(changes) > 0 {
+			kind := MismatchBoth
+			switch {
+			case !passwordChanged:
+				kind = MismatchPrivilegesChanged
+			case len(privilegeChanges) == 0:
+				kind = MismatchPasswordChanged
+			}
+			ev := &PermissionDiffEvent{
+				Type:         PermissionDiffMismatch,
+				Name:         name,
+				PrimaryKey:   lpk,
+				Detail:       strings.Join(changes, ", "),
+				MismatchKind: kind,
+			}
+			left.setEntry(ev, LeftSide, leftIndex)
+			right.setEntry(ev, RightSide, rightIndex)
+			record(ev)
 		}
 		leftIndex++
 		rightIndex++
 	}
 	for leftIndex < left.Len() {
-		lpk, _ := left.Get(leftIndex)
-		er.RecordError(fmt.Errorf("%v has an extra %v %v", leftName, name, lpk))
+		if err := checkContext(); err != nil {
+			return err
+		}
+		extra(LeftSide, left, leftIndex)
 		leftIndex++
 	}
 	for rightIndex < right.Len() {
-		rpk, _ := right.Get(rightIndex)
-		er.RecordError(fmt.Errorf("%v has an extra %v %v", rightName, name, rpk))
+		if err := checkContext(); err != nil {
+			return err
+		}
+		extra(RightSide, right, rightIndex)
 		rightIndex++
 	}
+	return nil
+}
+
+// DiffPermissionsOptions changes the way DiffPermissionsWithOptions
+// compares permission sets. The zero value is the default behavior of
+// DiffPermissions.
+type DiffPermissionsOptions struct {
+	// MatchDbWildcards makes a db permission whose Db is a pattern
+	// containing '%' (like 'app\_%') cover the db permissions of the
+	// other side for the same host and user whose Db matches the
+	// pattern (like 'app_logs'). Covered entries are compared with
+	// the pattern entry instead of being reported as extra, and the
+	// pattern entry is not reported as extra if it covers anything.
+	MatchDbWildcards bool
+
+	// LeftLabel and RightLabel describe where each side comes from,
+	// for instance {"cell": "cell1", "tablet": "cell1-100"}. They are
+	// stored in each PermissionDiffEvent, and added after the side
+	// names in the recorded errors.
+	LeftLabel  map[string]string
+	RightLabel map[string]string
+
+	// IgnoreHost compares the user permissions by User only, for
+	// setups where the same user is meant to have the same
+	// permissions from all hosts. On each side, the entries of a
+	// user are merged: the password checksum and privileges are the
+	// ones of its first host in sort order, except that a privilege
+	// granted (Y) from any host is granted. The merged entry has all
+	// the hosts, comma-separated, in its Host. If the hosts of a
+	// user don't agree, a PermissionDiffConflict event is also
+	// recorded for that side, before the differences between the
+	// sides. Db permissions are still compared by host.
+	IgnoreHost bool
+
+	// MissingAsDenied compares a privilege that is only in the
+	// entry of one side as N in the entry of the other side, as
+	// MySQL does for a column its grant tables don't have. It is
+	// meant for diffs between MySQL versions with different sets of
+	// privilege columns: a missing privilege is then only reported
+	// if the other side grants it.
+	MissingAsDenied bool
+
+	// CaseInsensitiveHost compares the hosts of the user and db
+	// permissions regardless of case, as MySQL does for host names
+	// (so 'LOCALHOST' and 'localhost' are the same account). The
+	// hosts are lowercased on a copy of each entry before sorting
+	// and comparing them, and the PermissionDiffEvent entries and
+	// primary keys have the lowercased hosts.
+	CaseInsensitiveHost bool
+
+	// LeftAlternateChecksums and RightAlternateChecksums are the
+	// PasswordChecksums of each side, if any, for a transition
+	// between two checksum tables. A user whose PasswordChecksum
+	// differs between the sides has the same password if the
+	// alternate checksum of one side matches the PasswordChecksum of
+	// the other side, or if both alternate checksums match. The
+	// events for such users have the left PasswordChecksum in their
+	// right entry. This is only meant to be used until all the saved
+	// permissions use the new table.
+	LeftAlternateChecksums  PasswordChecksums
+	RightAlternateChecksums PasswordChecksums
+
+	// IgnorePasswords doesn't compare the password checksums of the
+	// user permissions, for audits of privilege drift where the
+	// passwords are rotated separately. A user whose privileges
+	// differ is still reported, as a privilege mismatch. The
+	// checksums are cleared on a copy of each entry, so the
+	// PermissionDiffEvent entries have no PasswordChecksum.
+	IgnorePasswords bool
+
+	// MaxErrors, if positive, is the maximum number of differences
+	// DiffPermissionsWithOptions records. Once it is reached, the
+	// diff stops early, and a last error says it was truncated, with
+	// the number of differences found before it stopped. That number
+	// is a lower bound, as the rest of the entries are not compared.
+	MaxErrors int
+
+	// Redact keeps the password checksums and the privilege names
+	// and values out of the recorded errors: a mismatch only says
+	// whether the password changed, and how many privileges did.
+	// The PermissionDiffEvent details are not changed.
+	Redact bool
+}
+
+// diffAllPermissions diffs all the permission lists.
+// The lists don't need to be sorted: the rows are read in table-scan
+// order, so they are sorted by primary key here (on a copy) if needed.
+func diffAllPermissions(ctx context.Context, left, right *tabletmanagerdatapb.Permissions, opts DiffPermissionsOptions, recordEvent func(*PermissionDiffEvent)) error {
+	record := func(ev *PermissionDiffEvent) {
+		ev.LeftLabel = opts.LeftLabel
+		ev.RightLabel = opts.RightLabel
+		recordEvent(ev)
+	}
+	if opts.LeftAlternateChecksums != nil || opts.RightAlternateChecksums != nil {
+		right = matchAlternateChecksums(left, right, opts.LeftAlternateChecksums, opts.RightAlternateChecksums)
+	}
+	if opts.IgnorePasswords {
+		left = clearPasswordChecksums(left)
+		right = clearPasswordChecksums(right)
+	}
+	if opts.CaseInsensitiveHost {
+		left = lowercaseHosts(left)
+		right = lowercaseHosts(right)
+	}
+	if opts.IgnoreHost {
+		leftUsers := mergeUserPermissionsByUser(LeftSide, left.UserPermissions, opts.MissingAsDenied, record)
+		rightUsers := mergeUserPermissionsByUser(RightSide, right.UserPermissions, opts.MissingAsDenied, record)
+		if err := diffPermissions(ctx, "user", leftUsers, rightUsers, opts.MissingAsDenied, record); err != nil {
+			return err
+		}
+	} else if err := diffPermissions(ctx, "user", userPermissionList(left.UserPermissions).sorted(), userPermissionList(right.UserPermissions).sorted(), opts.MissingAsDenied, record); err != nil {
+		return err
+	}
+	if !opts.MatchDbWildcards {
+		return diffPermissions(ctx, "db", dbPermissionList(left.DbPermissions).sorted(), dbPermissionList(right.DbPermissions).sorted(), opts.MissingAsDenied, record)
+	}
+
+	var events []*PermissionDiffEvent
+	if err := diffPermissions(ctx, "db", dbPermissionList(left.DbPermissions).sorted(), dbPermissionList(right.DbPermissions).sorted(), opts.MissingAsDenied, func(ev *PermissionDiffEvent) {
+		events = append(events, ev)
+	}); err != nil {
+		return err
+	}
+	for _, ev := range matchDbWildcards(events, left.DbPermissions, right.DbPermissions, opts.MissingAsDenied) {
+		record(ev)
+	}
+	return nil
+}
+
+// lowercaseHosts returns a copy of permissions with the hosts of all
+// entries lowercased, for DiffPermissionsOptions.CaseInsensitiveHost.
+// The entries are shallow copies: they share their privilege maps
+// with permissions.
+func lowercaseHosts(permissions *tabletmanagerdatapb.Permissions) *tabletmanagerdatapb.Permissions {
+	result := &tabletmanagerdatapb.Permissions{
+		UserPermissions: make([]*tabletmanagerdatapb.UserPermission, len(permissions.UserPermissions)),
+		DbPermissions:   make([]*tabletmanagerdatapb.DbPermission, len(permissions.DbPermissions)),
+	}
+	for i, up := range permissions.UserPermissions {
+		c := *up
+		c.Host = strings.ToLower(c.Host)
+		result.UserPermissions[i] = &c
+	}
+	for i, dp := range permissions.DbPermissions {
+		c := *dp
+		c.Host = strings.ToLower(c.Host)
+		result.DbPermissions[i] = &c
+	}
+	return result
+}
+
+// clearPasswordChecksums returns a copy of permissions with no
+// password checksum, for DiffPermissionsOptions.IgnorePasswords. The
+// user permissions are shallow copies.
+func clearPasswordChecksums(permissions *tabletmanagerdatapb.Permissions) *tabletmanagerdatapb.Permissions {
+	result := &tabletmanagerdatapb.Permissions{
+		UserPermissions: make([]*tabletmanagerdatapb.UserPermission, len(permissions.UserPermissions)),
+		DbPermissions:   permissions.DbPermissions,
+	}
+	for i, up := range permissions.UserPermissions {
+		c := *up
+		c.PasswordChecksum = 0
+		result.UserPermissions[i] = &c
+	}
+	return result
+}
+
+// userNamePermissionList is a userPermissionList keyed by User only,
+// for DiffPermissionsOptions.IgnoreHost.
+type userNamePermissionList struct {
+	userPermissionList
+}
+
+func (upl userNamePermissionList) Get(i int) (string, string) {
+	return upl.userPermissionList[i].User, UserPermissionString(upl.userPermissionList[i])
+}
+
+// mergeUserPermissionsByUser merges the user permissions of each user,
+// as described in DiffPermissionsOptions.IgnoreHost, and records a
+// PermissionDiffConflict event for the users whose hosts don't agree.
+// The result is sorted by User.
+func mergeUserPermissionsByUser(side PermissionDiffSide, ups []*tabletmanagerdatapb.UserPermission, missingAsDenied bool, record func(*PermissionDiffEvent)) userNamePermissionList {
+	var users []string
+	byUser := make(map[string][]*tabletmanagerdatapb.UserPermission)
+	for _, up := range userPermissionList(ups).sorted() {
+		if _, ok := byUser[up.User]; !ok {
+			users = append(users, up.User)
+		}
+		byUser[up.User] = append(byUser[up.User], up)
+	}
+	sort.Strings(users)
+
+	result := make(userPermissionList, len(users))
+	for i, user := range users {
+		first := byUser[user][0]
+		merged := &tabletmanagerdatapb.UserPermission{
+			Host:             first.Host,
+			User:             user,
+			PasswordChecksum: first.PasswordChecksum,
+			Privileges:       make(map[string]string, len(first.Privileges)),
+		}
+		for k, v := range first.Privileges {
+			merged.Privileges[k] = v
+		}
+		var conflicts []string
+		for _, up := range byUser[user][1:] {
+			merged.Host += "," + up.Host
+			changes := diffPrivilegesMissingAs(first.Privileges, up.Privileges, missingAsDenied)
+			if first.PasswordChecksum != up.PasswordChecksum {
+				changes = append([]string{userPermissionPassword(first) + "->" + userPermissionPassword(up)}, changes...)
+			}
+			if len(changes) > 0 {
+				conflicts = append(conflicts, first.Host+" -> "+up.Host+": "+strings.Join(changes, ", "))
+			}
+			for k, v := range up.Privileges {
+				if v == "Y" {
+					merged.Privileges[k] = v
+				}
+			}
+		}
+		result[i] = merged
+		if len(conflicts) > 0 {
+			ev := &PermissionDiffEvent{
+				Type:       PermissionDiffConflict,
+				Name:       "user",
+				Side:       side,
+				PrimaryKey: user,
+				Detail:     strings.Join(conflicts, "; "),
+			}
+			result.setEntry(ev, side, i)
+			record(ev)
+		}
+	}
+	return userNamePermissionList{result}
 }
 
 // DiffPermissions records the errors between two permission sets
 func DiffPermissions(leftName string, left *tabletmanagerdatapb.Permissions, rightName string, right *tabletmanagerdatapb.Permissions, er concurrency.ErrorRecorder) {
-	diffPermissions("user", leftName, userPermissionList(left.UserPermissions), rightName, userPermissionList(right.UserPermissions), er)
-	diffPermissions("db", leftName, dbPermissionList(left.DbPermissions), rightName, dbPermissionList(right.DbPermissions), er)
+	DiffPermissionsContext(context.Background(), leftName, left, rightName, right, er)
+}
+
+// DiffPermissionsContext is like DiffPermissions, but stops early if
+// ctx is done. In that case, the differences found so far and the
+// context error are recorded.
+func DiffPermissionsContext(ctx context.Context, leftName string, left *tabletmanagerdatapb.Permissions, rightName string, right *tabletmanagerdatapb.Permissions, er concurrency.ErrorRecorder) {
+	DiffPermissionsWithOptions(ctx, leftName, left, rightName, right, DiffPermissionsOptions{}, er)
+}
+
+// DiffPermissionsWithOptions is like DiffPermissionsContext, with
+// options to change the comparison.
+func DiffPermissionsWithOptions(ctx context.Context, leftName string, left *tabletmanagerdatapb.Permissions, rightName string, right *tabletmanagerdatapb.Permissions, opts DiffPermissionsOptions, er concurrency.ErrorRecorder) {
+	record := func(ev *PermissionDiffEvent) {
+		er.RecordError(eventError(leftName, rightName, ev, opts))
+	}
+	more := 0
+	if opts.MaxErrors > 0 {
+		// Canceling the context makes the merge loops exit early.
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		recorded := 0
+		record = func(ev *PermissionDiffEvent) {
+			if recorded < opts.MaxErrors {
+				recorded++
+				er.RecordError(eventError(leftName, rightName, ev, opts))
+				return
+			}
+			more++
+			cancel()
+		}
+	}
+	err := diffAllPermissions(ctx, left, right, opts, record)
+	if more > 0 {
+		er.RecordError(fmt.Errorf("permissions diff between %v and %v truncated, at least %v more differences", labeledName(leftName, opts.LeftLabel), labeledName(rightName, opts.RightLabel), more))
+		return
+	}
+	if err != nil {
+		er.RecordError(fmt.Errorf("permissions diff between %v and %v interrupted: %v", labeledName(leftName, opts.LeftLabel), labeledName(rightName, opts.RightLabel), err))
+	}
+}
+
+// DiffUserPermissions records the errors between two lists of user
+// permissions, like DiffPermissions does for the user part of
+// Permissions.
+func DiffUserPermissions(leftName string, left []*tabletmanagerdatapb.UserPermission, rightName string, right []*tabletmanagerdatapb.UserPermission, er concurrency.ErrorRecorder) {
+	diffPermissions(context.Background(), "user", userPermissionList(left).sorted(), userPermissionList(right).sorted(), false, func(ev *PermissionDiffEvent) {
+		er.RecordError(eventError(leftName, rightName, ev, DiffPermissionsOptions{}))
+	})
+}
+
+// DiffDbPermissions records the errors between two lists of db
+// permissions, like DiffPermissions does for the db part of
+// Permissions.
+func DiffDbPermissions(leftName string, left []*tabletmanagerdatapb.DbPermission, rightName string, right []*tabletmanagerdatapb.DbPermission, er concurrency.ErrorRecorder) {
+	diffPermissions(context.Background(), "db", dbPermissionList(left).sorted(), dbPermissionList(right).sorted(), false, func(ev *PermissionDiffEvent) {
+		er.RecordError(eventError(leftName, rightName, ev, DiffPermissionsOptions{}))
+	})
+}
+
+// DiffPermissionsToResult diffs two sets of permissions, and returns
+// the structured difference.
+func DiffPermissionsToResult(leftName string, left *tabletmanagerdatapb.Permissions, rightName string, right *tabletmanagerdatapb.Permissions) *DiffPermissionsResult {
+	return DiffPermissionsToResultWithOptions(leftName, left, rightName, right, DiffPermissionsOptions{})
+}
+
+// DiffPermissionsToResultWithOptions is like DiffPermissionsToResult,
+// with options to change the comparison.
+func DiffPermissionsToResultWithOptions(leftName string, left *tabletmanagerdatapb.Permissions, rightName string, right *tabletmanagerdatapb.Permissions, opts DiffPermissionsOptions) *DiffPermissionsResult {
+	result := &DiffPermissionsResult{
+		LeftName:        leftName,
+		RightName:       rightName,
+		Redact:          opts.Redact,
+		MissingAsDenied: opts.MissingAsDenied,
+		IgnoreHost:      opts.IgnoreHost,
+	}
+	diffAllPermissions(context.Background(), left, right, opts, func(ev *PermissionDiffEvent) {
+		result.Events = append(result.Events, ev)
+	})
+	return result
+}
+
+// DiffPermissionsChan diffs two sets of permissions in the background,
+// and sends each difference on the returned channel as soon as it is
+// found. The channel is closed when the diff is done, or when ctx is
+// done. The caller should either read the channel until it is closed,
+// or cancel ctx.
+func DiffPermissionsChan(ctx context.Context, left, right *tabletmanagerdatapb.Permissions) <-chan PermissionDiffEvent {
+	c := make(chan PermissionDiffEvent)
+	go func() {
+		defer close(c)
+		diffAllPermissions(ctx, left, right, DiffPermissionsOptions{}, func(ev *PermissionDiffEvent) {
+			select {
+			case c <- *ev:
+			case <-ctx.Done():
+			}
+		})
+	}()
+	return c
 }
 
 // DiffPermissionsToArray difs two sets of permissions, and returns the difference
@@ -200,3 +1364,309 @@ func DiffPermissionsToArray(leftName string, left *tabletmanagerdatapb.Permissio
 	}
 	return nil
 }
+
+// jsonPermissionDiffEvent is the JSON encoding of a
+// PermissionDiffEvent, for DiffPermissionsJSONL.
+type jsonPermissionDiffEvent struct {
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Side   string `json:"side,omitempty"`
+	Key    string `json:"key"`
+	Detail string `json:"detail,omitempty"`
+	Kind   string `json:"kind,omitempty"`
+}
+
+var (
+	permissionDiffTypeNames = map[PermissionDiffType]string{
+		PermissionDiffExtra:    "extra",
+		PermissionDiffMismatch: "mismatch",
+		PermissionDiffConflict: "conflict",
+	}
+	mismatchKindNames = map[MismatchKind]string{
+		MismatchPasswordChanged:   "password",
+		MismatchPrivilegesChanged: "privileges",
+		MismatchBoth:              "both",
+	}
+)
+
+// DiffPermissionsJSONL diffs two sets of permissions, and returns one
+// JSON object per difference, in the order of DiffPermissions, like
+// {"type":"extra","name":"user","side":"master","key":"localhost:old"}.
+// type is "extra", "mismatch" or "conflict", and side is the name of
+// the side that has the entry, for extra and conflict events. Mismatch
+// events also have the detail of DiffPermissions, and a kind that is
+// "password", "privileges" or "both". The lines have no trailing
+// newline. There are none if the permissions are the same.
+func DiffPermissionsJSONL(leftName string, left *tabletmanagerdatapb.Permissions, rightName string, right *tabletmanagerdatapb.Permissions) [][]byte {
+	var result [][]byte
+	for _, ev := range DiffPermissionsToResult(leftName, left, rightName, right).Events {
+		je := jsonPermissionDiffEvent{
+			Type:   permissionDiffTypeNames[ev.Type],
+			Name:   ev.Name,
+			Key:    ev.PrimaryKey,
+			Detail: ev.Detail,
+			Kind:   mismatchKindNames[ev.MismatchKind],
+		}
+		if ev.Type != PermissionDiffMismatch {
+			je.Side = leftName
+			if ev.Side == RightSide {
+				je.Side = rightName
+			}
+		}
+		// This cannot fail, the struct only has strings.
+		line, _ := json.Marshal(&je)
+		result = append(result, line)
+	}
+	return result
+}
+
+// validatePrivileges records an error for each privilege column
+// (named '<name>_priv') that has a value other than 'Y' or 'N'.
+// Other columns (ssl_type, max_questions, ...) can hold arbitrary values.
+func validatePrivileges(name, pk string, priv map[string]string, er concurrency.ErrorRecorder) {
+	si := make([]string, 0, len(priv))
+	for k := range priv {
+		si = append(si, k)
+	}
+	sort.Strings(si)
+	for _, k := range si {
+		if !strings.HasSuffix(k, "_priv") {
+			continue
+		}
+		if v := priv[k]; v != "Y" && v != "N" {
+			er.RecordError(fmt.Errorf("%v %v has an unexpected value for %v: %q", name, pk, k, v))
+		}
+	}
+}
+
+// validatePermissionList records an error for each primary key that
+// appears more than once in the list.
+func validatePermissionList(name string, permissions permissionList, er concurrency.ErrorRecorder) {
+	seen := make(map[string]bool, permissions.Len())
+	for i := 0; i < permissions.Len(); i++ {
+		pk, _ := permissions.Get(i)
+		if seen[pk] {
+			er.RecordError(fmt.Errorf("duplicate %v %v", name, pk))
+			continue
+		}
+		seen[pk] = true
+	}
+}
+
+// ValidatePermissions checks a permission set is self-consistent:
+// no duplicate primary keys, no user permission with an empty Host,
+// and only 'Y' or 'N' values in the '*_priv' columns, the other
+// columns are not checked. Anonymous accounts, with an empty User, are
+// valid. It returns all the problems it found, or nil.
+func ValidatePermissions(permissions *tabletmanagerdatapb.Permissions) error {
+	er := concurrency.AllErrorRecorder{}
+	validatePermissionList("user", userPermissionList(permissions.UserPermissions), &er)
+	for _, up := range permissions.UserPermissions {
+		pk := UserPermissionPrimaryKey(up)
+		if up.Host == "" {
+			er.RecordError(fmt.Errorf("user %v has an empty Host", pk))
+		}
+		validatePrivileges("user", pk, up.Privileges, &er)
+	}
+	validatePermissionList("db", dbPermissionList(permissions.DbPermissions), &er)
+	for _, dp := range permissions.DbPermissions {
+		validatePrivileges("db", DbPermissionPrimaryKey(dp), dp.Privileges, &er)
+	}
+	return er.Error()
+}
+
+// GroupUsersByPasswordChecksum returns, for each non-zero password
+// checksum, the sorted list of user primary keys ('host:user') using
+// it. Accounts with no password (checksum 0) are omitted. Groups with
+// more than one entry are accounts that share the same password
+// (or, rarely, passwords with colliding checksums).
+func GroupUsersByPasswordChecksum(permissions *tabletmanagerdatapb.Permissions) map[uint64][]string {
+	result := make(map[uint64][]string)
+	for _, up := range permissions.UserPermissions {
+		if up.PasswordChecksum == 0 {
+			continue
+		}
+		result[up.PasswordChecksum] = append(result[up.PasswordChecksum], UserPermissionPrimaryKey(up))
+	}
+	for _, keys := range result {
+		sort.Strings(keys)
+	}
+	return result
+}
+
+// isDbPattern returns true if db contains an unescaped '%' wildcard.
+func isDbPattern(db string) bool {
+	for i := 0; i < len(db); i++ {
+		switch db[i] {
+		case '\\':
+			i++
+		case '%':
+			return true
+		}
+	}
+	return false
+}
+
+// dbPatternMatches returns true if the MySQL pattern matches db:
+// '%' matches any sequence of characters, '_' any single character,
+// and '\' escapes the next character.
+func dbPatternMatches(pattern, db string) bool {
+	expr := "^"
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '%':
+			expr += ".*"
+		case '_':
+			expr += "."
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			expr += regexp.QuoteMeta(pattern[i : i+1])
+		default:
+			expr += regexp.QuoteMeta(pattern[i : i+1])
+		}
+	}
+	matched, err := regexp.MatchString(expr+"$", db)
+	return err == nil && matched
+}
+
+// findDbPattern returns the first pattern entry in dps that has the
+// same host and user as dp, and matches its Db.
+func findDbPattern(dps []*tabletmanagerdatapb.DbPermission, dp *tabletmanagerdatapb.DbPermission) *tabletmanagerdatapb.DbPermission {
+	for _, candidate := range dps {
+		if candidate.Host == dp.Host && candidate.User == dp.User && isDbPattern(candidate.Db) && dbPatternMatches(candidate.Db, dp.Db) {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// matchDbWildcards rewrites the db diff events for
+// DiffPermissionsOptions.MatchDbWildcards: an extra exact entry covered
+// by a pattern on the other side is compared with that pattern, and
+// extra patterns covering something are dropped.
+func matchDbWildcards(events []*PermissionDiffEvent, left, right []*tabletmanagerdatapb.DbPermission, missingAsDenied bool) []*PermissionDiffEvent {
+	covering := make(map[*tabletmanagerdatapb.DbPermission]bool)
+	var result []*PermissionDiffEvent
+	for _, ev := range events {
+		if ev.Type != PermissionDiffExtra {
+			result = append(result, ev)
+			continue
+		}
+		dp, others := ev.LeftDb, right
+		if ev.Side == RightSide {
+			dp, others = ev.RightDb, left
+		}
+		if isDbPattern(dp.Db) {
+			result = append(result, ev)
+			continue
+		}
+		pattern := findDbPattern(others, dp)
+		if pattern == nil {
+			result = append(result, ev)
+			continue
+		}
+		covering[pattern] = true
+
+		leftDp, rightDp := dp, pattern
+		if ev.Side == RightSide {
+			leftDp, rightDp = pattern, dp
+		}
+		if changes := diffPrivilegesMissingAs(leftDp.Privileges, rightDp.Privileges, missingAsDenied); len(changes) > 0 {
+			result = append(result, &PermissionDiffEvent{
+				Type:         PermissionDiffMismatch,
+				Name:         ev.Name,
+				PrimaryKey:   ev.PrimaryKey,
+				Detail:       "covered by " + DbPermissionPrimaryKey(pattern) + ": " + strings.Join(changes, ", "),
+				MismatchKind: MismatchPrivilegesChanged,
+				LeftDb:       leftDp,
+				RightDb:      rightDp,
+			})
+		}
+	}
+
+	// drop the extra patterns that cover entries of the other side
+	filtered := result[:0]
+	for _, ev := range result {
+		if ev.Type == PermissionDiffExtra && (covering[ev.LeftDb] || covering[ev.RightDb]) {
+			continue
+		}
+		filtered = append(filtered, ev)
+	}
+	return filtered
+}
+
+// StripPrivilege removes a privilege from all the entries of
+// permissions, and returns the sorted primary keys of the user
+// permissions, then of the db permissions, that had it. privName is
+// either the column name, like "File_priv", or the name used in GRANT
+// statements, like "FILE" or "GRANT OPTION". Only the in-memory
+// permissions are changed.
+func StripPrivilege(permissions *tabletmanagerdatapb.Permissions, privName string) (removedFrom []string) {
+	column := privilegeColumn(privName)
+
+	var users, dbs []string
+	for _, up := range permissions.UserPermissions {
+		if _, ok := up.Privileges[column]; ok {
+			delete(up.Privileges, column)
+			users = append(users, UserPermissionPrimaryKey(up))
+		}
+	}
+	for _, dp := range permissions.DbPermissions {
+		if _, ok := dp.Privileges[column]; ok {
+			delete(dp.Privileges, column)
+			dbs = append(dbs, DbPermissionPrimaryKey(dp))
+		}
+	}
+	sort.Strings(users)
+	sort.Strings(dbs)
+	return append(users, dbs...)
+}
+
+// PermissionsStats has aggregate numbers about a permission set.
+type PermissionsStats struct {
+	// Users and Dbs are the number of user and db permissions.
+	Users int
+	Dbs   int
+
+	// GrantOption is the number of users with the GRANT OPTION.
+	GrantOption int
+
+	// NoPassword is the number of users without a password.
+	NoPassword int
+
+	// Privileges maps each privilege name to the number of user
+	// and db permissions that grant it ('Y').
+	Privileges map[string]int
+}
+
+// ComputePermissionsStats returns the PermissionsStats of a permission set.
+func ComputePermissionsStats(permissions *tabletmanagerdatapb.Permissions) PermissionsStats {
+	stats := PermissionsStats{
+		Users:      len(permissions.UserPermissions),
+		Dbs:        len(permissions.DbPermissions),
+		Privileges: make(map[string]int),
+	}
+	for _, up := range permissions.UserPermissions {
+		if up.Privileges[grantOptionColumn] == "Y" {
+			stats.GrantOption++
+		}
+		if up.PasswordChecksum == 0 {
+			stats.NoPassword++
+		}
+		for k, v := range up.Privileges {
+			if v == "Y" {
+				stats.Privileges[k]++
+			}
+		}
+	}
+	for _, dp := range permissions.DbPermissions {
+		for k, v := range dp.Privileges {
+			if v == "Y" {
+				stats.Privileges[k]++
+			}
+		}
+	}
+	return stats
+}
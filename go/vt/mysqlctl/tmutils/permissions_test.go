@@ -5,9 +5,17 @@
 package tmutils
 
 import (
+	"fmt"
+	"hash/crc64"
+	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
 	"github.com/youtube/vitess/go/sqltypes"
+	"github.com/youtube/vitess/go/vt/concurrency"
 	querypb "github.com/youtube/vitess/go/vt/proto/query"
 
 	tabletmanagerdatapb "github.com/youtube/vitess/go/vt/proto/tabletmanagerdata"
@@ -80,18 +88,1099 @@ func TestPermissionsDiff(t *testing.T) {
 	p2.UserPermissions = append(p2.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Password": "p1", "Select_priv": "Y", "Insert_priv": "Y"})))
 	p1.DbPermissions = append(p1.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt", "Select_priv": "Y", "Insert_priv": "N"})))
 	testPermissionsDiff(t, p1, p2, "p1", "p2", []string{
-		"p1 and p2 disagree on user %:vt:\n" +
-			"UserPermission PasswordChecksum(4831957779889520640) Insert_priv(N) Select_priv(Y)\n" +
-			" differs from:\n" +
-			"UserPermission PasswordChecksum(4831957779889520640) Insert_priv(Y) Select_priv(Y)",
-		"p1 and p2 disagree on db %:vt_live:vt:\n" +
-			"DbPermission Insert_priv(N) Select_priv(Y)\n" +
-			" differs from:\n" +
-			"DbPermission Insert_priv(Y) Select_priv(N)",
+		"p1 and p2 disagree on user %:vt: Insert_priv N->Y",
+		"p1 and p2 disagree on db %:vt_live:vt: Insert_priv N->Y, Select_priv Y->N",
+	})
+
+	p2.UserPermissions[0].PasswordChecksum = 0
+	p2.UserPermissions[0].Privileges["Delete_priv"] = "Y"
+	delete(p2.UserPermissions[0].Privileges, "Select_priv")
+	testPermissionsDiff(t, p1, p2, "p1", "p2", []string{
+		"p1 and p2 disagree on user %:vt: PasswordChecksum(4831957779889520640)->NoPassword, added Delete_priv(Y), Insert_priv N->Y, removed Select_priv(Y)",
+		"p1 and p2 disagree on db %:vt_live:vt: Insert_priv N->Y, Select_priv Y->N",
 	})
+	p2.UserPermissions[0].PasswordChecksum = p1.UserPermissions[0].PasswordChecksum
+	delete(p2.UserPermissions[0].Privileges, "Delete_priv")
+	p2.UserPermissions[0].Privileges["Select_priv"] = "Y"
 
 	p2.UserPermissions[0].Privileges["Insert_priv"] = "N"
 	p2.DbPermissions[0].Privileges["Insert_priv"] = "N"
 	p2.DbPermissions[0].Privileges["Select_priv"] = "Y"
 	testPermissionsDiff(t, p1, p2, "p1", "p2", []string{})
 }
+
+func TestValidatePermissions(t *testing.T) {
+	p := &tabletmanagerdatapb.Permissions{}
+	p.UserPermissions = append(p.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Password": "p1", "Select_priv": "Y", "max_questions": "0"})))
+	p.UserPermissions = append(p.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "localhost", "User": "", "Select_priv": "N"})))
+	p.DbPermissions = append(p.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt", "Select_priv": "N"})))
+	if err := ValidatePermissions(p); err != nil {
+		t.Errorf("ValidatePermissions(valid) = %v", err)
+	}
+
+	p.UserPermissions = append(p.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Select_priv": "X"})))
+	p.UserPermissions = append(p.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "", "User": "", "Select_priv": "Y"})))
+	p.DbPermissions = append(p.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt", "Insert_priv": "yes"})))
+	err := ValidatePermissions(p)
+	want := "duplicate user %:vt;" +
+		"user %:vt has an unexpected value for Select_priv: \"X\";" +
+		"user : has an empty Host;" +
+		"duplicate db %:vt_live:vt;" +
+		"db %:vt_live:vt has an unexpected value for Insert_priv: \"yes\""
+	if err == nil || err.Error() != want {
+		t.Errorf("ValidatePermissions(invalid) = %v, want %v", err, want)
+	}
+}
+
+func TestPermissionsDiffUnsorted(t *testing.T) {
+	newUser := func(host, user string) *tabletmanagerdatapb.UserPermission {
+		return NewUserPermission(mapToSQLResults(map[string]string{"Host": host, "User": user, "Select_priv": "Y"}))
+	}
+	newDb := func(host, db, user string) *tabletmanagerdatapb.DbPermission {
+		return NewDbPermission(mapToSQLResults(map[string]string{"Host": host, "Db": db, "User": user, "Select_priv": "Y"}))
+	}
+
+	p1 := &tabletmanagerdatapb.Permissions{
+		UserPermissions: []*tabletmanagerdatapb.UserPermission{newUser("localhost", "root"), newUser("%", "vt"), newUser("%", "app")},
+		DbPermissions:   []*tabletmanagerdatapb.DbPermission{newDb("%", "vt_live", "vt"), newDb("%", "vt_app", "app")},
+	}
+	p2 := &tabletmanagerdatapb.Permissions{
+		UserPermissions: []*tabletmanagerdatapb.UserPermission{newUser("%", "vt"), newUser("%", "app"), newUser("localhost", "root")},
+		DbPermissions:   []*tabletmanagerdatapb.DbPermission{newDb("%", "vt_app", "app"), newDb("%", "vt_live", "vt")},
+	}
+	testPermissionsDiff(t, p1, p2, "p1", "p2", []string{})
+
+	p2.UserPermissions = p2.UserPermissions[1:]
+	testPermissionsDiff(t, p1, p2, "p1", "p2", []string{
+		"p1 has an extra user %:vt",
+	})
+
+	// the input lists are left untouched
+	if got := UserPermissionPrimaryKey(p1.UserPermissions[0]); got != "localhost:root" {
+		t.Errorf("DiffPermissions modified its input: first user is %v", got)
+	}
+}
+
+func TestGroupUsersByPasswordChecksum(t *testing.T) {
+	p := &tabletmanagerdatapb.Permissions{}
+	p.UserPermissions = append(p.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "localhost", "User": "vt", "Password": "p1"})))
+	p.UserPermissions = append(p.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Password": "p1"})))
+	p.UserPermissions = append(p.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "app", "Password": "p2"})))
+	p.UserPermissions = append(p.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "nopass"})))
+
+	got := GroupUsersByPasswordChecksum(p)
+	want := map[uint64][]string{
+		p.UserPermissions[0].PasswordChecksum: {"%:vt", "localhost:vt"},
+		p.UserPermissions[2].PasswordChecksum: {"%:app"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GroupUsersByPasswordChecksum() = %v, want %v", got, want)
+	}
+}
+
+func TestDiffPasswordDigests(t *testing.T) {
+	if !HasWeakPasswordHashing() {
+		t.Errorf("HasWeakPasswordHashing() = false, want true")
+	}
+
+	d1 := PasswordDigests{}
+	d2 := PasswordDigests{}
+	fields, values := mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Password": "p1"})
+	up1 := NewUserPermissionWithDigest(fields, values, d1)
+	up2 := NewUserPermissionWithDigest(fields, values, d2)
+	if up1.PasswordChecksum != up2.PasswordChecksum || len(d1["%:vt"]) != 2*passwordDigestLen || d1["%:vt"] != d2["%:vt"] {
+		t.Fatalf("NewUserPermissionWithDigest mismatch: %v %v %v %v", up1, up2, d1, d2)
+	}
+	fields, values = mapToSQLResults(map[string]string{"Host": "%", "User": "app", "Password": "p2"})
+	NewUserPermissionWithDigest(fields, values, d1)
+
+	er := concurrency.AllErrorRecorder{}
+	DiffPasswordDigests("d1", d1, "d2", d2, &er)
+	if er.HasErrors() {
+		t.Errorf("DiffPasswordDigests(same) = %v", er.Error())
+	}
+
+	// simulate a crc64 collision: same checksum, different digests
+	d2["%:vt"] = "0000000000000000"
+	DiffPasswordDigests("d1", d1, "d2", d2, &er)
+	want := "d1 and d2 disagree on user %:vt: password digest differs"
+	if err := er.Error(); err == nil || err.Error() != want {
+		t.Errorf("DiffPasswordDigests(different) = %v, want %v", err, want)
+	}
+}
+
+func TestSetPasswordChecksumTable(t *testing.T) {
+	row := map[string]string{"Host": "%", "User": "vt", "Password": "p1"}
+	iso := NewUserPermission(mapToSQLResults(row)).PasswordChecksum
+
+	SetPasswordChecksumTable(crc64.MakeTable(crc64.ECMA))
+	ecma := NewUserPermission(mapToSQLResults(row)).PasswordChecksum
+	SetPasswordChecksumTable(nil)
+
+	if want := crc64.Checksum([]byte("p1"), crc64.MakeTable(crc64.ECMA)); ecma != want {
+		t.Errorf("ECMA checksum = %v, want %v", ecma, want)
+	}
+	if iso == ecma {
+		t.Errorf("ISO and ECMA checksums are the same: %v", iso)
+	}
+	if got := NewUserPermission(mapToSQLResults(row)).PasswordChecksum; got != iso {
+		t.Errorf("checksum after reset = %v, want %v", got, iso)
+	}
+}
+
+func TestPermissionEqual(t *testing.T) {
+	up1 := NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Password": "p1", "Select_priv": "Y"}))
+	up2 := NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Password": "p1", "Select_priv": "Y"}))
+	if !UserPermissionEqual(up1, up2) {
+		t.Errorf("UserPermissionEqual(%v, %v) = false", up1, up2)
+	}
+	up2.PasswordChecksum++
+	if UserPermissionEqual(up1, up2) {
+		t.Errorf("UserPermissionEqual with different checksums = true")
+	}
+	up2.PasswordChecksum--
+	up2.Privileges["Select_priv"] = "N"
+	if UserPermissionEqual(up1, up2) {
+		t.Errorf("UserPermissionEqual with different privileges = true")
+	}
+	if !UserPermissionEqual(&tabletmanagerdatapb.UserPermission{User: "vt"}, &tabletmanagerdatapb.UserPermission{User: "vt", Privileges: map[string]string{}}) {
+		t.Errorf("UserPermissionEqual with nil and empty privileges = false")
+	}
+
+	dp1 := NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt", "Select_priv": "Y"}))
+	dp2 := NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt", "Select_priv": "Y"}))
+	if !DbPermissionEqual(dp1, dp2) {
+		t.Errorf("DbPermissionEqual(%v, %v) = false", dp1, dp2)
+	}
+	dp2.Db = "vt_other"
+	if DbPermissionEqual(dp1, dp2) {
+		t.Errorf("DbPermissionEqual with different dbs = true")
+	}
+	if !DbPermissionEqual(&tabletmanagerdatapb.DbPermission{Db: "vt"}, &tabletmanagerdatapb.DbPermission{Db: "vt", Privileges: map[string]string{}}) {
+		t.Errorf("DbPermissionEqual with nil and empty privileges = false")
+	}
+}
+
+func TestDiffPermissionsToResult(t *testing.T) {
+	p1 := &tabletmanagerdatapb.Permissions{}
+	p1.UserPermissions = append(p1.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Select_priv": "Y"})))
+	p2 := &tabletmanagerdatapb.Permissions{}
+	p2.UserPermissions = append(p2.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Select_priv": "N"})))
+	p2.DbPermissions = append(p2.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt", "Select_priv": "N"})))
+
+	result := DiffPermissionsToResult("p1", p1, "p2", p2)
+	want := []*PermissionDiffEvent{
+		{
+			Type:         PermissionDiffMismatch,
+			Name:         "user",
+			PrimaryKey:   "%:vt",
+			Detail:       "Select_priv Y->N",
+			MismatchKind: MismatchPrivilegesChanged,
+			LeftUser:     p1.UserPermissions[0],
+			RightUser:    p2.UserPermissions[0],
+		},
+		{
+			Type:       PermissionDiffExtra,
+			Name:       "db",
+			Side:       RightSide,
+			PrimaryKey: "%:vt_live:vt",
+			RightDb:    p2.DbPermissions[0],
+		},
+	}
+	if !reflect.DeepEqual(result.Events, want) {
+		t.Errorf("DiffPermissionsToResult() = %v, want %v", result.Events, want)
+	}
+	errs := result.Errors()
+	if len(errs) != 2 || errs[1].Error() != "p2 has an extra db %:vt_live:vt" {
+		t.Errorf("DiffPermissionsResult.Errors() = %v", errs)
+	}
+}
+
+func TestDiffPermissionsContext(t *testing.T) {
+	p1 := &tabletmanagerdatapb.Permissions{}
+	p1.UserPermissions = append(p1.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt"})))
+	p2 := &tabletmanagerdatapb.Permissions{}
+	p2.UserPermissions = append(p2.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt2"})))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	er := concurrency.AllErrorRecorder{}
+	DiffPermissionsContext(ctx, "p1", p1, "p2", p2, &er)
+	want := []string{"permissions diff between p1 and p2 interrupted: context canceled"}
+	if got := er.ErrorStrings(); !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffPermissionsContext(canceled) = %v, want %v", got, want)
+	}
+
+	er = concurrency.AllErrorRecorder{}
+	DiffPermissionsContext(context.Background(), "p1", p1, "p2", p2, &er)
+	want = []string{"p1 has an extra user %:vt", "p2 has an extra user %:vt2"}
+	if got := er.ErrorStrings(); !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffPermissionsContext() = %v, want %v", got, want)
+	}
+}
+
+func TestDiffPermissionsContextDuringMerge(t *testing.T) {
+	// one extra entry at the start shifts the indexes of all the
+	// matching entries after it
+	p1 := &tabletmanagerdatapb.Permissions{}
+	p1.UserPermissions = append(p1.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "a_extra"})))
+	p2 := &tabletmanagerdatapb.Permissions{}
+	for i := 0; i < 3*diffCheckInterval; i++ {
+		up := NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": fmt.Sprintf("user%04d", i)}))
+		p1.UserPermissions = append(p1.UserPermissions, up)
+		p2.UserPermissions = append(p2.UserPermissions, up)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := 0
+	err := diffPermissions(ctx, "user", userPermissionList(p1.UserPermissions).sorted(), userPermissionList(p2.UserPermissions).sorted(), false, func(ev *PermissionDiffEvent) {
+		events++
+		cancel()
+	})
+	if err != context.Canceled || events != 1 {
+		t.Errorf("diffPermissions(canceled during merge) = %v with %v events, want %v", err, events, context.Canceled)
+	}
+}
+
+func TestDiffPermissionsMatchDbWildcards(t *testing.T) {
+	if !dbPatternMatches(`app\_%`, "app_logs") || dbPatternMatches(`app\_%`, "appXlogs") || !dbPatternMatches("app_%", "appXlogs") {
+		t.Errorf("dbPatternMatches is broken")
+	}
+	if !isDbPattern(`app\_%`) || isDbPattern("app_logs") || isDbPattern(`app\%`) {
+		t.Errorf("isDbPattern is broken")
+	}
+
+	newDb := func(db, selectPriv string) *tabletmanagerdatapb.DbPermission {
+		return NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": db, "User": "app", "Select_priv": selectPriv}))
+	}
+	p1 := &tabletmanagerdatapb.Permissions{
+		DbPermissions: []*tabletmanagerdatapb.DbPermission{newDb(`app\_%`, "Y")},
+	}
+	p2 := &tabletmanagerdatapb.Permissions{
+		DbPermissions: []*tabletmanagerdatapb.DbPermission{newDb("app_logs", "Y"), newDb("app_users", "N"), newDb("other", "Y")},
+	}
+
+	// default is unchanged
+	testPermissionsDiff(t, p1, p2, "p1", "p2", []string{
+		"p1 has an extra db %:app\\_%:app",
+		"p2 has an extra db %:app_logs:app",
+		"p2 has an extra db %:app_users:app",
+		"p2 has an extra db %:other:app",
+	})
+
+	er := concurrency.AllErrorRecorder{}
+	DiffPermissionsWithOptions(context.Background(), "p1", p1, "p2", p2, DiffPermissionsOptions{MatchDbWildcards: true}, &er)
+	want := []string{
+		"p1 and p2 disagree on db %:app_users:app: covered by %:app\\_%:app: Select_priv Y->N",
+		"p2 has an extra db %:other:app",
+	}
+	if got := er.ErrorStrings(); !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffPermissionsWithOptions(MatchDbWildcards) = %v, want %v", got, want)
+	}
+}
+
+func TestDiffPermissionsChan(t *testing.T) {
+	p1 := &tabletmanagerdatapb.Permissions{}
+	p1.UserPermissions = append(p1.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Select_priv": "Y"})))
+	p1.DbPermissions = append(p1.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt", "Select_priv": "N"})))
+	p2 := &tabletmanagerdatapb.Permissions{}
+	p2.UserPermissions = append(p2.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Select_priv": "N"})))
+
+	var got []PermissionDiffEvent
+	for ev := range DiffPermissionsChan(context.Background(), p1, p2) {
+		got = append(got, ev)
+	}
+	if len(got) != 2 ||
+		got[0].Type != PermissionDiffMismatch || got[0].PrimaryKey != "%:vt" || got[0].Detail != "Select_priv Y->N" ||
+		got[1].Type != PermissionDiffExtra || got[1].Side != LeftSide || got[1].PrimaryKey != "%:vt_live:vt" {
+		t.Errorf("DiffPermissionsChan() = %v", got)
+	}
+
+	// canceling the context closes the channel
+	ctx, cancel := context.WithCancel(context.Background())
+	c := DiffPermissionsChan(ctx, p1, p2)
+	<-c
+	cancel()
+	for range c {
+	}
+}
+
+func TestComputePermissionsStats(t *testing.T) {
+	p := &tabletmanagerdatapb.Permissions{}
+	p.UserPermissions = append(p.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Password": "p1", "Select_priv": "Y", "Grant_priv": "Y"})))
+	p.UserPermissions = append(p.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "app", "Select_priv": "Y", "Grant_priv": "N"})))
+	p.DbPermissions = append(p.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "app", "Select_priv": "Y", "Insert_priv": "Y"})))
+
+	got := ComputePermissionsStats(p)
+	want := PermissionsStats{
+		Users:       2,
+		Dbs:         1,
+		GrantOption: 1,
+		NoPassword:  1,
+		Privileges: map[string]int{
+			"Select_priv": 3,
+			"Grant_priv":  1,
+			"Insert_priv": 1,
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ComputePermissionsStats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestPermissionsFromResults(t *testing.T) {
+	userResult := &sqltypes.Result{
+		Fields: []*querypb.Field{{Name: "Host"}, {Name: "User"}, {Name: "Password"}, {Name: "Select_priv"}},
+		Rows: [][]sqltypes.Value{
+			{sqltypes.MakeString([]byte("%")), sqltypes.MakeString([]byte("vt")), sqltypes.MakeString([]byte("p1")), sqltypes.MakeString([]byte("Y"))},
+			{sqltypes.MakeString([]byte("localhost")), sqltypes.MakeString([]byte("root")), sqltypes.MakeString([]byte("")), sqltypes.MakeString([]byte("N"))},
+		},
+	}
+	dbResult := &sqltypes.Result{
+		Fields: []*querypb.Field{{Name: "Host"}, {Name: "Db"}, {Name: "User"}, {Name: "Select_priv"}},
+		Rows: [][]sqltypes.Value{
+			{sqltypes.MakeString([]byte("%")), sqltypes.MakeString([]byte("vt_live")), sqltypes.MakeString([]byte("vt")), sqltypes.MakeString([]byte("Y"))},
+		},
+	}
+	p := PermissionsFromResults(userResult, dbResult)
+	want := &tabletmanagerdatapb.Permissions{
+		UserPermissions: []*tabletmanagerdatapb.UserPermission{
+			NewUserPermission(userResult.Fields, userResult.Rows[0]),
+			NewUserPermission(userResult.Fields, userResult.Rows[1]),
+		},
+		DbPermissions: []*tabletmanagerdatapb.DbPermission{
+			NewDbPermission(dbResult.Fields, dbResult.Rows[0]),
+		},
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("PermissionsFromResults() = %v, want %v", PermissionsString(p), PermissionsString(want))
+	}
+
+	// nil and empty results give empty permissions
+	for _, p := range []*tabletmanagerdatapb.Permissions{
+		PermissionsFromResults(nil, nil),
+		PermissionsFromResults(&sqltypes.Result{}, &sqltypes.Result{Fields: dbResult.Fields}),
+	} {
+		if len(p.UserPermissions) != 0 || len(p.DbPermissions) != 0 {
+			t.Errorf("PermissionsFromResults(empty) = %v", PermissionsString(p))
+		}
+	}
+}
+
+func TestPermissionsFromResultsWithLimit(t *testing.T) {
+	userResult := &sqltypes.Result{
+		Fields: []*querypb.Field{{Name: "Host"}, {Name: "User"}},
+		Rows: [][]sqltypes.Value{
+			{sqltypes.MakeString([]byte("%")), sqltypes.MakeString([]byte("vt"))},
+			{sqltypes.MakeString([]byte("localhost")), sqltypes.MakeString([]byte("root"))},
+		},
+	}
+	dbResult := &sqltypes.Result{
+		Fields: []*querypb.Field{{Name: "Host"}, {Name: "Db"}, {Name: "User"}},
+		Rows: [][]sqltypes.Value{
+			{sqltypes.MakeString([]byte("%")), sqltypes.MakeString([]byte("vt_live")), sqltypes.MakeString([]byte("vt"))},
+			{sqltypes.MakeString([]byte("%")), sqltypes.MakeString([]byte("vt_other")), sqltypes.MakeString([]byte("vt"))},
+			{sqltypes.MakeString([]byte("%")), sqltypes.MakeString([]byte("vt_third")), sqltypes.MakeString([]byte("vt"))},
+		},
+	}
+	want := PermissionsFromResults(userResult, dbResult)
+	for _, maxEntries := range []int{0, -1, 3} {
+		if got, err := PermissionsFromResultsWithLimit(userResult, dbResult, maxEntries); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("PermissionsFromResultsWithLimit(%v) = %v %v, want %v", maxEntries, PermissionsString(got), err, PermissionsString(want))
+		}
+	}
+	if got, err := PermissionsFromResultsWithLimit(nil, nil, 1); err != nil || len(got.UserPermissions) != 0 || len(got.DbPermissions) != 0 {
+		t.Errorf("PermissionsFromResultsWithLimit(nil) = %v %v", got, err)
+	}
+
+	for _, tc := range []struct {
+		maxEntries int
+		want       string
+	}{
+		{1, "mysql.user has 2 rows, more than the limit of 1"},
+		{2, "mysql.db has 3 rows, more than the limit of 2"},
+	} {
+		if got, err := PermissionsFromResultsWithLimit(userResult, dbResult, tc.maxEntries); err == nil || err.Error() != tc.want || got != nil {
+			t.Errorf("PermissionsFromResultsWithLimit(%v) = %v %v, want error %v", tc.maxEntries, got, err, tc.want)
+		}
+	}
+}
+
+func TestPermissionStrings(t *testing.T) {
+	up := &tabletmanagerdatapb.UserPermission{
+		Host:       "%",
+		User:       "vt",
+		Privileges: map[string]string{"Select_priv": "Y", "Insert_priv": "N", "max_questions": "0"},
+	}
+	if got, want := UserPermissionString(up), "UserPermission NoPassword Insert_priv(N) Select_priv(Y) max_questions(0)"; got != want {
+		t.Errorf("UserPermissionString() = %q, want %q", got, want)
+	}
+	if got, want := UserPermissionGrantedString(up), "UserPermission NoPassword Select_priv(Y) max_questions(0)"; got != want {
+		t.Errorf("UserPermissionGrantedString() = %q, want %q", got, want)
+	}
+
+	dp := &tabletmanagerdatapb.DbPermission{
+		Host:       "%",
+		Db:         "vt_live",
+		User:       "vt",
+		Privileges: map[string]string{"Select_priv": "N", "Delete_priv": "Y"},
+	}
+	if got, want := DbPermissionString(dp), "DbPermission Delete_priv(Y) Select_priv(N)"; got != want {
+		t.Errorf("DbPermissionString() = %q, want %q", got, want)
+	}
+	if got, want := DbPermissionGrantedString(dp), "DbPermission Delete_priv(Y)"; got != want {
+		t.Errorf("DbPermissionGrantedString() = %q, want %q", got, want)
+	}
+}
+
+func TestNewPermissionSetValues(t *testing.T) {
+	left := NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Grant_priv": "Select,Insert", "ssl_cipher": "B,A"}))
+	right := NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Grant_priv": "Insert,Select", "ssl_cipher": "B,A"}))
+	if !UserPermissionEqual(left, right) {
+		t.Errorf("reordered set values differ: %v != %v", UserPermissionString(left), UserPermissionString(right))
+	}
+	if left.Privileges["Grant_priv"] != "Insert,Select" {
+		t.Errorf("Grant_priv not normalized: %v", UserPermissionString(left))
+	}
+	if left.Privileges["ssl_cipher"] != "B,A" {
+		t.Errorf("ssl_cipher was changed: %v", UserPermissionString(left))
+	}
+
+	leftDb := NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt", "Grant_priv": "Update,Delete"}))
+	rightDb := NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt", "Grant_priv": "Delete,Update"}))
+	if !DbPermissionEqual(leftDb, rightDb) {
+		t.Errorf("reordered set values differ: %v != %v", DbPermissionString(leftDb), DbPermissionString(rightDb))
+	}
+}
+
+func TestDiffUserAndDbPermissions(t *testing.T) {
+	p1 := &tabletmanagerdatapb.Permissions{}
+	p1.UserPermissions = append(p1.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Select_priv": "Y"})))
+	p1.DbPermissions = append(p1.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt", "Select_priv": "Y"})))
+	p2 := &tabletmanagerdatapb.Permissions{}
+	p2.UserPermissions = append(p2.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Select_priv": "N"})))
+
+	er := concurrency.AllErrorRecorder{}
+	DiffUserPermissions("p1", p1.UserPermissions, "p2", p2.UserPermissions, &er)
+	if got, want := er.ErrorStrings(), []string{"p1 and p2 disagree on user %:vt: Select_priv Y->N"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffUserPermissions() = %v, want %v", got, want)
+	}
+
+	er = concurrency.AllErrorRecorder{}
+	DiffDbPermissions("p1", p1.DbPermissions, "p2", p2.DbPermissions, &er)
+	if got, want := er.ErrorStrings(), []string{"p1 has an extra db %:vt_live:vt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffDbPermissions() = %v, want %v", got, want)
+	}
+}
+
+func TestDiffPermissionsLabels(t *testing.T) {
+	p1 := &tabletmanagerdatapb.Permissions{}
+	p1.UserPermissions = append(p1.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Select_priv": "Y"})))
+	p2 := &tabletmanagerdatapb.Permissions{}
+	p2.UserPermissions = append(p2.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Select_priv": "N"})))
+	p2.DbPermissions = append(p2.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt"})))
+	opts := DiffPermissionsOptions{
+		LeftLabel:  map[string]string{"tablet": "cell1-100", "cell": "cell1"},
+		RightLabel: map[string]string{"tablet": "cell2-200"},
+	}
+
+	er := concurrency.AllErrorRecorder{}
+	DiffPermissionsWithOptions(context.Background(), "master", p1, "replica", p2, opts, &er)
+	want := []string{
+		"master (cell=cell1, tablet=cell1-100) and replica (tablet=cell2-200) disagree on user %:vt: Select_priv Y->N",
+		"replica (tablet=cell2-200) has an extra db %:vt_live:vt",
+	}
+	if got := er.ErrorStrings(); !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffPermissionsWithOptions() = %v, want %v", got, want)
+	}
+
+	result := DiffPermissionsToResultWithOptions("master", p1, "replica", p2, opts)
+	if len(result.Events) != 2 {
+		t.Fatalf("DiffPermissionsToResultWithOptions() = %v", result.Events)
+	}
+	for _, ev := range result.Events {
+		if !reflect.DeepEqual(ev.LeftLabel, opts.LeftLabel) || !reflect.DeepEqual(ev.RightLabel, opts.RightLabel) {
+			t.Errorf("event labels = %v %v", ev.LeftLabel, ev.RightLabel)
+		}
+	}
+	var got []string
+	for _, err := range result.Errors() {
+		got = append(got, err.Error())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffPermissionsResult.Errors() = %v, want %v", got, want)
+	}
+}
+
+func TestDiffPermissionsMismatchKind(t *testing.T) {
+	p1 := &tabletmanagerdatapb.Permissions{}
+	p1.UserPermissions = append(p1.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "both", "Password": "p1", "Select_priv": "Y"})))
+	p1.UserPermissions = append(p1.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "password", "Password": "p1", "Select_priv": "Y"})))
+	p1.UserPermissions = append(p1.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "privileges", "Password": "p1", "Select_priv": "Y"})))
+	p1.DbPermissions = append(p1.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt", "Select_priv": "Y"})))
+	p2 := &tabletmanagerdatapb.Permissions{}
+	p2.UserPermissions = append(p2.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "both", "Password": "p2", "Select_priv": "N"})))
+	p2.UserPermissions = append(p2.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "password", "Password": "p2", "Select_priv": "Y"})))
+	p2.UserPermissions = append(p2.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "privileges", "Password": "p1", "Select_priv": "N"})))
+	p2.UserPermissions = append(p2.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "extra"})))
+	p2.DbPermissions = append(p2.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt", "Select_priv": "N"})))
+
+	got := make(map[string]MismatchKind)
+	for _, ev := range DiffPermissionsToResult("p1", p1, "p2", p2).Events {
+		got[ev.PrimaryKey] = ev.MismatchKind
+	}
+	want := map[string]MismatchKind{
+		"%:both":       MismatchBoth,
+		"%:password":   MismatchPasswordChanged,
+		"%:privileges": MismatchPrivilegesChanged,
+		"%:extra":      MismatchNone,
+		"%:vt_live:vt": MismatchPrivilegesChanged,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MismatchKind = %v, want %v", got, want)
+	}
+}
+
+func TestPermissionKeys(t *testing.T) {
+	p := &tabletmanagerdatapb.Permissions{}
+	p.UserPermissions = append(p.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "localhost", "User": "root"})))
+	p.UserPermissions = append(p.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt"})))
+	p.DbPermissions = append(p.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt"})))
+	p.DbPermissions = append(p.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_dev", "User": "vt"})))
+
+	if got, want := UserPermissionKeys(p), []string{"%:vt", "localhost:root"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("UserPermissionKeys() = %v, want %v", got, want)
+	}
+	if got, want := DbPermissionKeys(p), []string{"%:vt_dev:vt", "%:vt_live:vt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("DbPermissionKeys() = %v, want %v", got, want)
+	}
+	if got := UserPermissionKeys(&tabletmanagerdatapb.Permissions{}); len(got) != 0 {
+		t.Errorf("UserPermissionKeys(empty) = %v", got)
+	}
+}
+
+func TestSortUserPermissions(t *testing.T) {
+	var ups []*tabletmanagerdatapb.UserPermission
+	for _, hu := range [][2]string{
+		{"%", "vt"},
+		{"localhost", ""},
+		{"10.0.0.%", "app"},
+		{"localhost", "root"},
+		{"10.%", "app"},
+		{"db1.example.com", "vt"},
+	} {
+		ups = append(ups, &tabletmanagerdatapb.UserPermission{Host: hu[0], User: hu[1]})
+	}
+	keys := func() []string {
+		var result []string
+		for _, up := range ups {
+			result = append(result, UserPermissionPrimaryKey(up))
+		}
+		return result
+	}
+
+	SortUserPermissions(ups, SortByMySQLMatchOrder)
+	if got, want := keys(), []string{"db1.example.com:vt", "localhost:root", "localhost:", "10.0.0.%:app", "10.%:app", "%:vt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SortUserPermissions(SortByMySQLMatchOrder) = %v, want %v", got, want)
+	}
+	SortUserPermissions(ups, SortByPrimaryKey)
+	if got, want := keys(), []string{"%:vt", "10.%:app", "10.0.0.%:app", "db1.example.com:vt", "localhost:", "localhost:root"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SortUserPermissions(SortByPrimaryKey) = %v, want %v", got, want)
+	}
+}
+
+func TestEffectivePermissions(t *testing.T) {
+	p := &tabletmanagerdatapb.Permissions{}
+	p.UserPermissions = append(p.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Password": "p1", "Select_priv": "Y", "Insert_priv": "N", "Delete_priv": "N"})))
+	p.DbPermissions = append(p.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt", "Select_priv": "Y", "Insert_priv": "Y", "Delete_priv": "N"})))
+	p.DbPermissions = append(p.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "app\\_%", "User": "app", "Select_priv": "Y"})))
+
+	got := EffectivePermissions(p)
+	want := map[string]map[string]string{
+		"%:vt": {
+			"Select_priv":         "Y",
+			"Insert_priv":         "N",
+			"Delete_priv":         "N",
+			"vt_live.Insert_priv": "Y",
+		},
+		"%:app": {
+			"app\\_%.Select_priv": "Y",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("EffectivePermissions() = %v, want %v", got, want)
+	}
+
+	// the permissions are not modified
+	if _, ok := p.UserPermissions[0].Privileges["vt_live.Insert_priv"]; ok {
+		t.Errorf("EffectivePermissions modified its input: %v", UserPermissionString(p.UserPermissions[0]))
+	}
+}
+
+func TestDiffPermissionsRedact(t *testing.T) {
+	p1 := &tabletmanagerdatapb.Permissions{}
+	p1.UserPermissions = append(p1.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Password": "p1", "Select_priv": "Y", "Insert_priv": "Y"})))
+	p1.DbPermissions = append(p1.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt", "Select_priv": "Y"})))
+	p2 := &tabletmanagerdatapb.Permissions{}
+	p2.UserPermissions = append(p2.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Password": "p2", "Select_priv": "N", "Insert_priv": "N"})))
+	p2.DbPermissions = append(p2.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt", "Select_priv": "N"})))
+	opts := DiffPermissionsOptions{Redact: true}
+
+	er := concurrency.AllErrorRecorder{}
+	DiffPermissionsWithOptions(context.Background(), "master", p1, "replica", p2, opts, &er)
+	want := []string{
+		"master and replica disagree on user %:vt: password changed, 2 privileges changed",
+		"master and replica disagree on db %:vt_live:vt: 1 privileges changed",
+	}
+	if got := er.ErrorStrings(); !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffPermissionsWithOptions(Redact) = %v, want %v", got, want)
+	}
+
+	result := DiffPermissionsToResultWithOptions("master", p1, "replica", p2, opts)
+	var got []string
+	for _, err := range result.Errors() {
+		got = append(got, err.Error())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffPermissionsResult.Errors(Redact) = %v, want %v", got, want)
+	}
+	// the events still have the full detail
+	if len(result.Events) != 2 || !strings.Contains(result.Events[0].Detail, "PasswordChecksum(") || !strings.Contains(result.Events[0].Detail, "Insert_priv Y->N") {
+		t.Errorf("DiffPermissionsToResultWithOptions(Redact) events = %v", result.Events)
+	}
+
+	// without redaction, the errors have the full detail
+	er = concurrency.AllErrorRecorder{}
+	DiffPermissions("master", p1, "replica", p2, &er)
+	if err := er.Error(); err == nil || !strings.Contains(err.Error(), "PasswordChecksum(") || !strings.Contains(err.Error(), "Select_priv Y->N") {
+		t.Errorf("DiffPermissions() = %v", err)
+	}
+}
+
+func TestRedactedPermissionString(t *testing.T) {
+	p := &tabletmanagerdatapb.Permissions{}
+	p.UserPermissions = append(p.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "localhost", "User": "vt", "Password": "p1", "Select_priv": "Y", "Insert_priv": "N"})))
+	p.UserPermissions = append(p.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "app", "Select_priv": "Y"})))
+	p.DbPermissions = append(p.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt", "Select_priv": "Y"})))
+
+	want := "User Permissions:\n" +
+		"  %:app: UserPermission NoPassword 1 privileges\n" +
+		"  localhost:vt: UserPermission PasswordChecksum(<redacted>) 2 privileges\n" +
+		"Db Permissions:\n" +
+		"  %:vt_live:vt: DbPermission 1 privileges\n"
+	if got := RedactedPermissionString(p); got != want {
+		t.Errorf("RedactedPermissionString() =\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestDiffPermissionsIgnoreHost(t *testing.T) {
+	p1 := &tabletmanagerdatapb.Permissions{}
+	p1.UserPermissions = append(p1.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Password": "p1", "Select_priv": "Y"})))
+	p1.UserPermissions = append(p1.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "10.0.0.%", "User": "app", "Select_priv": "Y", "Insert_priv": "N"})))
+	p1.UserPermissions = append(p1.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "app", "Select_priv": "Y", "Insert_priv": "Y"})))
+	p1.UserPermissions = append(p1.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "localhost", "User": "old"})))
+	p2 := &tabletmanagerdatapb.Permissions{}
+	p2.UserPermissions = append(p2.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "10.0.0.%", "User": "vt", "Password": "p1", "Select_priv": "Y"})))
+	p2.UserPermissions = append(p2.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "localhost", "User": "vt", "Password": "p1", "Select_priv": "Y"})))
+	p2.UserPermissions = append(p2.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "app", "Select_priv": "N", "Insert_priv": "Y"})))
+	opts := DiffPermissionsOptions{IgnoreHost: true}
+
+	er := concurrency.AllErrorRecorder{}
+	DiffPermissionsWithOptions(context.Background(), "p1", p1, "p2", p2, opts, &er)
+	want := []string{
+		"p1 has conflicting user app across hosts: % -> 10.0.0.%: Insert_priv Y->N",
+		"p1 and p2 disagree on user app: Select_priv Y->N",
+		"p1 has an extra user old",
+	}
+	if got := er.ErrorStrings(); !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffPermissionsWithOptions(IgnoreHost) =\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// the merged entries have all the hosts
+	result := DiffPermissionsToResultWithOptions("p1", p1, "p2", p2, opts)
+	if len(result.Events) != 3 {
+		t.Fatalf("DiffPermissionsToResultWithOptions(IgnoreHost) = %v", result.Events)
+	}
+	conflict := result.Events[0]
+	if conflict.Type != PermissionDiffConflict || conflict.Side != LeftSide || conflict.LeftUser.Host != "%,10.0.0.%" || conflict.LeftUser.Privileges["Insert_priv"] != "Y" {
+		t.Errorf("unexpected conflict event: %v", conflict)
+	}
+	if got := PermissionsToSQL(result); len(got) == 0 || strings.Contains(strings.Join(got, "\n"), "conflict") {
+		t.Errorf("PermissionsToSQL(IgnoreHost) = %v", got)
+	}
+
+	// by default, hosts are compared
+	er = concurrency.AllErrorRecorder{}
+	DiffPermissions("p1", p1, "p2", p2, &er)
+	if got := len(er.ErrorStrings()); got != 6 {
+		t.Errorf("DiffPermissions() = %v", er.ErrorStrings())
+	}
+}
+
+func TestPermissionsFingerprint(t *testing.T) {
+	vt := NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Password": "p1", "Select_priv": "Y", "Insert_priv": "N"}))
+	app := NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "app", "Select_priv": "Y"}))
+	db := NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt", "Select_priv": "Y"}))
+	p1 := &tabletmanagerdatapb.Permissions{
+		UserPermissions: []*tabletmanagerdatapb.UserPermission{vt, app},
+		DbPermissions:   []*tabletmanagerdatapb.DbPermission{db},
+	}
+	p2 := &tabletmanagerdatapb.Permissions{
+		UserPermissions: []*tabletmanagerdatapb.UserPermission{app, vt},
+		DbPermissions:   []*tabletmanagerdatapb.DbPermission{db},
+	}
+	fingerprint := PermissionsFingerprint(p1)
+	if got := PermissionsFingerprint(p2); got != fingerprint {
+		t.Errorf("PermissionsFingerprint depends on the order: %v != %v", got, fingerprint)
+	}
+
+	// the password checksum table doesn't matter
+	SetPasswordChecksumTable(crc64.MakeTable(crc64.ECMA))
+	got := PermissionsFingerprint(p1)
+	SetPasswordChecksumTable(nil)
+	if got != fingerprint {
+		t.Errorf("PermissionsFingerprint depends on the password checksum table: %v != %v", got, fingerprint)
+	}
+
+	// any change is seen
+	for _, change := range []func(p *tabletmanagerdatapb.Permissions){
+		func(p *tabletmanagerdatapb.Permissions) { p.UserPermissions[0].Privileges["Insert_priv"] = "Y" },
+		func(p *tabletmanagerdatapb.Permissions) { p.UserPermissions[0].PasswordChecksum++ },
+		func(p *tabletmanagerdatapb.Permissions) { p.DbPermissions[0].Db = "vt_other" },
+		func(p *tabletmanagerdatapb.Permissions) { p.DbPermissions = nil },
+	} {
+		p := proto.Clone(p1).(*tabletmanagerdatapb.Permissions)
+		change(p)
+		if got := PermissionsFingerprint(p); got == fingerprint {
+			t.Errorf("PermissionsFingerprint didn't change for %v", PermissionsString(p))
+		}
+	}
+}
+
+func TestPermissionsFromResultsPartial(t *testing.T) {
+	userResult := &sqltypes.Result{
+		Fields: []*querypb.Field{{Name: "Host"}, {Name: "User"}, {Name: "Select_priv"}},
+		Rows: [][]sqltypes.Value{
+			{sqltypes.MakeString([]byte("%")), sqltypes.MakeString([]byte("vt")), sqltypes.MakeString([]byte("Y"))},
+		},
+	}
+	dbErr := fmt.Errorf("SELECT command denied")
+
+	p, errs := PermissionsFromResultsPartial(userResult, nil, nil, dbErr)
+	if len(p.UserPermissions) != 1 || len(p.DbPermissions) != 0 {
+		t.Errorf("PermissionsFromResultsPartial() = %v", PermissionsString(p))
+	}
+	if len(errs) != 1 || errs[0].Error() != "cannot read mysql.db: SELECT command denied" {
+		t.Errorf("PermissionsFromResultsPartial() errors = %v", errs)
+	}
+
+	// a result that comes with an error is not used
+	p, errs = PermissionsFromResultsPartial(userResult, dbErr, userResult, dbErr)
+	if len(p.UserPermissions) != 0 || len(p.DbPermissions) != 0 || len(errs) != 2 || !strings.Contains(errs[0].Error(), "mysql.user") {
+		t.Errorf("PermissionsFromResultsPartial(all errors) = %v %v", PermissionsString(p), errs)
+	}
+
+	if p, errs := PermissionsFromResultsPartial(userResult, nil, nil, nil); len(p.UserPermissions) != 1 || errs != nil {
+		t.Errorf("PermissionsFromResultsPartial(no error) = %v %v", PermissionsString(p), errs)
+	}
+}
+
+func TestDiffPermissionsMissingAsDenied(t *testing.T) {
+	// 5.6 doesn't have Create_role_priv, 8.0 has it
+	p56 := &tabletmanagerdatapb.Permissions{}
+	p56.UserPermissions = append(p56.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Select_priv": "Y"})))
+	p56.UserPermissions = append(p56.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "admin", "Select_priv": "Y"})))
+	p56.DbPermissions = append(p56.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt", "Select_priv": "Y", "Event_priv": "N"})))
+	p80 := &tabletmanagerdatapb.Permissions{}
+	p80.UserPermissions = append(p80.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Select_priv": "Y", "Create_role_priv": "N"})))
+	p80.UserPermissions = append(p80.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "admin", "Select_priv": "Y", "Create_role_priv": "Y"})))
+	p80.DbPermissions = append(p80.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt", "Select_priv": "Y"})))
+
+	er := concurrency.AllErrorRecorder{}
+	DiffPermissionsWithOptions(context.Background(), "5.6", p56, "8.0", p80, DiffPermissionsOptions{MissingAsDenied: true}, &er)
+	want := []string{
+		"5.6 and 8.0 disagree on user %:admin: Create_role_priv N->Y",
+	}
+	if got := er.ErrorStrings(); !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffPermissionsWithOptions(MissingAsDenied) = %v, want %v", got, want)
+	}
+
+	// by default, missing privileges are differences
+	er = concurrency.AllErrorRecorder{}
+	DiffPermissions("5.6", p56, "8.0", p80, &er)
+	want = []string{
+		"5.6 and 8.0 disagree on user %:admin: added Create_role_priv(Y)",
+		"5.6 and 8.0 disagree on user %:vt: added Create_role_priv(N)",
+		"5.6 and 8.0 disagree on db %:vt_live:vt: removed Event_priv(N)",
+	}
+	if got := er.ErrorStrings(); !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffPermissions() = %v, want %v", got, want)
+	}
+
+	// redaction counts the compared privileges
+	er = concurrency.AllErrorRecorder{}
+	DiffPermissionsWithOptions(context.Background(), "5.6", p56, "8.0", p80, DiffPermissionsOptions{MissingAsDenied: true, Redact: true}, &er)
+	if got := er.ErrorStrings(); !reflect.DeepEqual(got, []string{"5.6 and 8.0 disagree on user %:admin: 1 privileges changed"}) {
+		t.Errorf("DiffPermissionsWithOptions(MissingAsDenied, Redact) = %v", got)
+	}
+}
+
+func TestStripPrivilege(t *testing.T) {
+	p := &tabletmanagerdatapb.Permissions{}
+	p.UserPermissions = append(p.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "localhost", "User": "vt", "Select_priv": "Y", "File_priv": "Y", "Grant_priv": "Y"})))
+	p.UserPermissions = append(p.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "app", "Select_priv": "Y", "File_priv": "N"})))
+	p.UserPermissions = append(p.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "ro", "Select_priv": "Y"})))
+	p.DbPermissions = append(p.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt", "Select_priv": "Y", "Grant_priv": "Y"})))
+
+	if got, want := StripPrivilege(p, "FILE"), []string{"%:app", "localhost:vt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("StripPrivilege(FILE) = %v, want %v", got, want)
+	}
+	for _, up := range p.UserPermissions {
+		if _, ok := up.Privileges["File_priv"]; ok || up.Privileges["Select_priv"] != "Y" {
+			t.Errorf("unexpected privileges after StripPrivilege(FILE): %v", UserPermissionString(up))
+		}
+	}
+
+	if got, want := StripPrivilege(p, "GRANT OPTION"), []string{"localhost:vt", "%:vt_live:vt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("StripPrivilege(GRANT OPTION) = %v, want %v", got, want)
+	}
+	if got, want := StripPrivilege(p, "Select_priv"), []string{"%:app", "%:ro", "localhost:vt", "%:vt_live:vt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("StripPrivilege(Select_priv) = %v, want %v", got, want)
+	}
+	if got := StripPrivilege(p, "Select_priv"); got != nil {
+		t.Errorf("StripPrivilege(Select_priv) again = %v", got)
+	}
+}
+
+func TestDiffPermissionsCaseInsensitiveHost(t *testing.T) {
+	p1 := &tabletmanagerdatapb.Permissions{}
+	p1.UserPermissions = append(p1.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "LOCALHOST", "User": "vt", "Select_priv": "Y"})))
+	p1.UserPermissions = append(p1.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "Db1.Example.com", "User": "app", "Select_priv": "Y"})))
+	p1.UserPermissions = append(p1.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "app", "Select_priv": "Y"})))
+	p1.DbPermissions = append(p1.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "LocalHost", "Db": "vt_live", "User": "vt", "Select_priv": "Y"})))
+	p2 := &tabletmanagerdatapb.Permissions{}
+	p2.UserPermissions = append(p2.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "app", "Select_priv": "Y"})))
+	p2.UserPermissions = append(p2.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "db1.example.com", "User": "app", "Select_priv": "N"})))
+	p2.UserPermissions = append(p2.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "localhost", "User": "vt", "Select_priv": "Y"})))
+	p2.DbPermissions = append(p2.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "localhost", "Db": "vt_live", "User": "vt", "Select_priv": "Y"})))
+	opts := DiffPermissionsOptions{CaseInsensitiveHost: true}
+
+	er := concurrency.AllErrorRecorder{}
+	DiffPermissionsWithOptions(context.Background(), "p1", p1, "p2", p2, opts, &er)
+	want := []string{
+		"p1 and p2 disagree on user db1.example.com:app: Select_priv Y->N",
+	}
+	if got := er.ErrorStrings(); !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffPermissionsWithOptions(CaseInsensitiveHost) =\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if p1.UserPermissions[0].Host != "LOCALHOST" || p1.DbPermissions[0].Host != "LocalHost" {
+		t.Errorf("DiffPermissionsWithOptions(CaseInsensitiveHost) modified its input: %v", PermissionsString(p1))
+	}
+
+	// it works with IgnoreHost too
+	opts.IgnoreHost = true
+	er = concurrency.AllErrorRecorder{}
+	DiffPermissionsWithOptions(context.Background(), "p1", p1, "p2", p2, opts, &er)
+	want = []string{
+		"p2 has conflicting user app across hosts: % -> db1.example.com: Select_priv Y->N",
+	}
+	if got := er.ErrorStrings(); !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffPermissionsWithOptions(CaseInsensitiveHost, IgnoreHost) =\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// by default, hosts are byte-compared
+	er = concurrency.AllErrorRecorder{}
+	DiffPermissions("p1", p1, "p2", p2, &er)
+	if got := len(er.ErrorStrings()); got != 6 {
+		t.Errorf("DiffPermissions() = %v", er.ErrorStrings())
+	}
+}
+
+func TestDiffPermissionsIgnorePasswords(t *testing.T) {
+	p1 := &tabletmanagerdatapb.Permissions{}
+	p1.UserPermissions = append(p1.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "app", "Password": "p1", "Select_priv": "Y"})))
+	p1.UserPermissions = append(p1.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "ro", "Password": "p1", "Select_priv": "Y"})))
+	p1.UserPermissions = append(p1.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Password": "p1", "Select_priv": "Y"})))
+	p2 := &tabletmanagerdatapb.Permissions{}
+	// password-only drift
+	p2.UserPermissions = append(p2.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "app", "Password": "p2", "Select_priv": "Y"})))
+	// privilege-only drift
+	p2.UserPermissions = append(p2.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "ro", "Password": "p1", "Select_priv": "N"})))
+	// combined drift
+	p2.UserPermissions = append(p2.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Password": "p2", "Select_priv": "N"})))
+
+	// by default, password drift is reported
+	result := DiffPermissionsToResult("p1", p1, "p2", p2)
+	var kinds []MismatchKind
+	for _, ev := range result.Events {
+		kinds = append(kinds, ev.MismatchKind)
+	}
+	if want := []MismatchKind{MismatchPasswordChanged, MismatchPrivilegesChanged, MismatchBoth}; !reflect.DeepEqual(kinds, want) {
+		t.Errorf("DiffPermissionsToResult() kinds = %v, want %v", kinds, want)
+	}
+
+	opts := DiffPermissionsOptions{IgnorePasswords: true}
+	result = DiffPermissionsToResultWithOptions("p1", p1, "p2", p2, opts)
+	kinds = nil
+	for _, ev := range result.Events {
+		kinds = append(kinds, ev.MismatchKind)
+	}
+	if want := []MismatchKind{MismatchPrivilegesChanged, MismatchPrivilegesChanged}; !reflect.DeepEqual(kinds, want) {
+		t.Errorf("DiffPermissionsToResultWithOptions(IgnorePasswords) kinds = %v, want %v", kinds, want)
+	}
+	want := []string{
+		"p1 and p2 disagree on user %:ro: Select_priv Y->N",
+		"p1 and p2 disagree on user %:vt: Select_priv Y->N",
+	}
+	er := concurrency.AllErrorRecorder{}
+	DiffPermissionsWithOptions(context.Background(), "p1", p1, "p2", p2, opts, &er)
+	if got := er.ErrorStrings(); !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffPermissionsWithOptions(IgnorePasswords) =\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if p1.UserPermissions[0].PasswordChecksum == 0 || p2.UserPermissions[0].PasswordChecksum == 0 {
+		t.Errorf("DiffPermissionsWithOptions(IgnorePasswords) modified its input: %v %v", PermissionsString(p1), PermissionsString(p2))
+	}
+}
+
+func TestDiffPermissionsMaxErrors(t *testing.T) {
+	p1 := &tabletmanagerdatapb.Permissions{}
+	p2 := &tabletmanagerdatapb.Permissions{}
+	for i := 0; i < 3000; i++ {
+		p1.UserPermissions = append(p1.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": fmt.Sprintf("user%04d", i), "Select_priv": "Y"})))
+	}
+
+	er := concurrency.AllErrorRecorder{}
+	DiffPermissionsWithOptions(context.Background(), "p1", p1, "p2", p2, DiffPermissionsOptions{MaxErrors: 10}, &er)
+	got := er.ErrorStrings()
+	if len(got) != 11 {
+		t.Fatalf("DiffPermissionsWithOptions(MaxErrors) recorded %v errors: %v", len(got), got)
+	}
+	if got[9] != "p1 has an extra user %:user0009" {
+		t.Errorf("unexpected last difference: %v", got[9])
+	}
+	// the diff stops early, so not all the other differences are counted
+	last := got[10]
+	if !strings.HasPrefix(last, "permissions diff between p1 and p2 truncated, at least ") || strings.Contains(last, "2990") {
+		t.Errorf("unexpected truncation error: %v", last)
+	}
+
+	// under the limit, nothing is truncated
+	er = concurrency.AllErrorRecorder{}
+	DiffPermissionsWithOptions(context.Background(), "p1", p1, "p2", p2, DiffPermissionsOptions{MaxErrors: 3000}, &er)
+	if got := er.ErrorStrings(); len(got) != 3000 || strings.Contains(got[len(got)-1], "truncated") {
+		t.Errorf("DiffPermissionsWithOptions(MaxErrors: 3000) recorded %v errors", len(got))
+	}
+}
+
+func TestDiffPermissionsJSONL(t *testing.T) {
+	p1 := &tabletmanagerdatapb.Permissions{}
+	p1.UserPermissions = append(p1.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Select_priv": "Y"})))
+	p1.UserPermissions = append(p1.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "localhost", "User": "old"})))
+	p2 := &tabletmanagerdatapb.Permissions{}
+	p2.UserPermissions = append(p2.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Select_priv": "N"})))
+	p2.DbPermissions = append(p2.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt", "Select_priv": "Y"})))
+
+	var got []string
+	for _, line := range DiffPermissionsJSONL("master", p1, "replica", p2) {
+		got = append(got, string(line))
+	}
+	want := []string{
+		// encoding/json escapes '>'
+		`{"type":"mismatch","name":"user","key":"%:vt","detail":"Select_priv Y-\u003eN","kind":"privileges"}`,
+		`{"type":"extra","name":"user","side":"master","key":"localhost:old"}`,
+		`{"type":"extra","name":"db","side":"replica","key":"%:vt_live:vt"}`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffPermissionsJSONL() =\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	if got := DiffPermissionsJSONL("master", p1, "replica", p1); len(got) != 0 {
+		t.Errorf("DiffPermissionsJSONL(same) = %v", got)
+	}
+}
+
+func TestDiffPermissionsAlternateChecksums(t *testing.T) {
+	ecmaTable := crc64.MakeTable(crc64.ECMA)
+
+	// old saved permissions, with ISO checksums
+	old := &tabletmanagerdatapb.Permissions{}
+	old.UserPermissions = append(old.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Password": "p1", "Select_priv": "Y"})))
+	old.UserPermissions = append(old.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "app", "Password": "p2", "Select_priv": "Y"})))
+
+	// current permissions, with ECMA checksums and the ISO alternates
+	SetPasswordChecksumTable(ecmaTable)
+	defer SetPasswordChecksumTable(nil)
+	alternates := make(PasswordChecksums)
+	current := &tabletmanagerdatapb.Permissions{}
+	for _, row := range []map[string]string{
+		{"Host": "%", "User": "vt", "Password": "p1", "Select_priv": "Y"},
+		{"Host": "%", "User": "app", "Password": "p3", "Select_priv": "Y"},
+	} {
+		fields, values := mapToSQLResults(row)
+		current.UserPermissions = append(current.UserPermissions, NewUserPermissionWithAlternateChecksum(fields, values, defaultHashTable, alternates))
+	}
+	SetPasswordChecksumTable(nil)
+	if current.UserPermissions[0].PasswordChecksum == old.UserPermissions[0].PasswordChecksum {
+		t.Fatalf("the tables should give different checksums")
+	}
+
+	// without the alternates, all the passwords differ
+	er := concurrency.AllErrorRecorder{}
+	DiffPermissions("current", current, "old", old, &er)
+	if got := len(er.ErrorStrings()); got != 2 {
+		t.Errorf("DiffPermissions() = %v", er.ErrorStrings())
+	}
+
+	// with them, only the real change is reported, on either side
+	for _, tc := range []struct {
+		left, right *tabletmanagerdatapb.Permissions
+		opts        DiffPermissionsOptions
+	}{
+		{current, old, DiffPermissionsOptions{LeftAlternateChecksums: alternates}},
+		{old, current, DiffPermissionsOptions{RightAlternateChecksums: alternates}},
+	} {
+		er := concurrency.AllErrorRecorder{}
+		DiffPermissionsWithOptions(context.Background(), "left", tc.left, "right", tc.right, tc.opts, &er)
+		got := er.ErrorStrings()
+		if len(got) != 1 || !strings.HasPrefix(got[0], "left and right disagree on user %:app: PasswordChecksum(") {
+			t.Errorf("DiffPermissionsWithOptions(%v) = %v", tc.opts, got)
+		}
+	}
+	if old.UserPermissions[0].PasswordChecksum == current.UserPermissions[0].PasswordChecksum {
+		t.Errorf("DiffPermissionsWithOptions modified its input")
+	}
+}
+
+func TestSummarizeDiff(t *testing.T) {
+	p1 := &tabletmanagerdatapb.Permissions{}
+	p1.UserPermissions = append(p1.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Password": "p1", "Select_priv": "Y"})))
+	p1.UserPermissions = append(p1.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "app", "Password": "p1", "Select_priv": "Y"})))
+	p1.UserPermissions = append(p1.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "ro", "Password": "p1", "Select_priv": "Y"})))
+	p1.UserPermissions = append(p1.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "localhost", "User": "old"})))
+	p1.DbPermissions = append(p1.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt", "Select_priv": "Y"})))
+	p2 := &tabletmanagerdatapb.Permissions{}
+	p2.UserPermissions = append(p2.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Password": "p2", "Select_priv": "Y"})))
+	p2.UserPermissions = append(p2.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "app", "Password": "p1", "Select_priv": "N"})))
+	p2.UserPermissions = append(p2.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "ro", "Password": "p2", "Select_priv": "N"})))
+
+	got := SummarizeDiff(DiffPermissionsToResult("p1", p1, "p2", p2))
+	want := DiffSummary{
+		Users:             4,
+		Dbs:               1,
+		Extra:             2,
+		Mismatch:          3,
+		PasswordChanged:   1,
+		PrivilegesChanged: 1,
+		BothChanged:       1,
+	}
+	if got != want {
+		t.Errorf("SummarizeDiff() = %+v, want %+v", got, want)
+	}
+	if got, want := got.String(), "4 user diffs, 1 db diff"; got != want {
+		t.Errorf("DiffSummary.String() = %v, want %v", got, want)
+	}
+	if got := SummarizeDiff(DiffPermissionsToResult("p1", p1, "p1", p1)); got != (DiffSummary{}) || got.String() != "0 user diffs, 0 db diffs" {
+		t.Errorf("SummarizeDiff(same) = %+v", got)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2016, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tmutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	tabletmanagerdatapb "github.com/youtube/vitess/go/vt/proto/tabletmanagerdata"
+)
+
+// This file contains helper methods to store Permissions in a
+// portable format, independent of the proto definition, for backups.
+
+// portableFormatVersion is the version of the portable format written
+// by MarshalPermissionsPortable. It has to be changed when the format
+// changes in a way older readers can't handle.
+const portableFormatVersion = 1
+
+// portablePermissions is the envelope of the portable format.
+type portablePermissions struct {
+	FormatVersion int                      `json:"format_version"`
+	Users         []portableUserPermission `json:"users"`
+	Dbs           []portableDbPermission   `json:"dbs"`
+}
+
+type portableUserPermission struct {
+	Host string `json:"host"`
+	User string `json:"user"`
+	// PasswordChecksum is stored as a string, as a lot of JSON
+	// implementations can't represent all uint64 values.
+	PasswordChecksum uint64            `json:"password_checksum,string"`
+	Privileges       map[string]string `json:"privileges"`
+}
+
+type portableDbPermission struct {
+	Host       string            `json:"host"`
+	Db         string            `json:"db"`
+	User       string            `json:"user"`
+	Privileges map[string]string `json:"privileges"`
+}
+
+// MarshalPermissionsPortable encodes permissions in a versioned JSON
+// format that doesn't depend on the proto definition, so it can be
+// stored in backups and read back by UnmarshalPermissionsPortable.
+func MarshalPermissionsPortable(permissions *tabletmanagerdatapb.Permissions) ([]byte, error) {
+	pp := portablePermissions{
+		FormatVersion: portableFormatVersion,
+		Users:         make([]portableUserPermission, len(permissions.UserPermissions)),
+		Dbs:           make([]portableDbPermission, len(permissions.DbPermissions)),
+	}
+	for i, up := range permissions.UserPermissions {
+		pp.Users[i] = portableUserPermission{
+			Host:             up.Host,
+			User:             up.User,
+			PasswordChecksum: up.PasswordChecksum,
+			Privileges:       up.Privileges,
+		}
+	}
+	for i, dp := range permissions.DbPermissions {
+		pp.Dbs[i] = portableDbPermission{
+			Host:       dp.Host,
+			Db:         dp.Db,
+			User:       dp.User,
+			Privileges: dp.Privileges,
+		}
+	}
+	return json.MarshalIndent(&pp, "", "  ")
+}
+
+// UnmarshalPermissionsPortable decodes permissions encoded by
+// MarshalPermissionsPortable. It returns an error for a format version
+// it doesn't know about.
+func UnmarshalPermissionsPortable(data []byte) (*tabletmanagerdatapb.Permissions, error) {
+	var pp portablePermissions
+	if err := json.Unmarshal(data, &pp); err != nil {
+		return nil, fmt.Errorf("cannot decode portable permissions: %v", err)
+	}
+	if pp.FormatVersion != portableFormatVersion {
+		return nil, fmt.Errorf("unsupported portable permissions format version %v, expected %v", pp.FormatVersion, portableFormatVersion)
+	}
+
+	permissions := &tabletmanagerdatapb.Permissions{}
+	for _, up := range pp.Users {
+		permissions.UserPermissions = append(permissions.UserPermissions, &tabletmanagerdatapb.UserPermission{
+			Host:             up.Host,
+			User:             up.User,
+			PasswordChecksum: up.PasswordChecksum,
+			Privileges:       up.Privileges,
+		})
+	}
+	for _, dp := range pp.Dbs {
+		permissions.DbPermissions = append(permissions.DbPermissions, &tabletmanagerdatapb.DbPermission{
+			Host:       dp.Host,
+			Db:         dp.Db,
+			User:       dp.User,
+			Privileges: dp.Privileges,
+		})
+	}
+	return permissions, nil
+}
+
+// DiffPermissionsAgainstFile compares permissions with a baseline
+// written by MarshalPermissionsPortable, for instance a reviewed copy
+// kept in source control. It returns the differences, with the file
+// as the left side and the current permissions as the right side, or
+// nil if they match.
+func DiffPermissionsAgainstFile(current *tabletmanagerdatapb.Permissions, path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	baseline, err := UnmarshalPermissionsPortable(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read baseline %v: %v", path, err)
+	}
+	return DiffPermissionsToArray(path, baseline, "current", current), nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2016, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tmutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	tabletmanagerdatapb "github.com/youtube/vitess/go/vt/proto/tabletmanagerdata"
+)
+
+func TestPermissionsPortable(t *testing.T) {
+	p := &tabletmanagerdatapb.Permissions{}
+	p.UserPermissions = append(p.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Password": "p1", "Select_priv": "Y", "Insert_priv": "N"})))
+	p.UserPermissions = append(p.UserPermissions, &tabletmanagerdatapb.UserPermission{Host: "localhost", User: "root", PasswordChecksum: 1<<64 - 1})
+	p.DbPermissions = append(p.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt", "Select_priv": "Y"})))
+
+	data, err := MarshalPermissionsPortable(p)
+	if err != nil {
+		t.Fatalf("MarshalPermissionsPortable failed: %v", err)
+	}
+	if !strings.Contains(string(data), `"format_version": 1`) || !strings.Contains(string(data), `"password_checksum": "18446744073709551615"`) {
+		t.Errorf("unexpected portable format: %s", data)
+	}
+	got, err := UnmarshalPermissionsPortable(data)
+	if err != nil {
+		t.Fatalf("UnmarshalPermissionsPortable failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, p) {
+		t.Errorf("round trip mismatch: %v != %v", PermissionsString(got), PermissionsString(p))
+	}
+
+	for _, tc := range []struct {
+		data string
+		want string
+	}{
+		{`{"format_version": 2}`, "unsupported portable permissions format version 2"},
+		{`{"users": []}`, "unsupported portable permissions format version 0"},
+		{`not json`, "cannot decode portable permissions"},
+	} {
+		if _, err := UnmarshalPermissionsPortable([]byte(tc.data)); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("UnmarshalPermissionsPortable(%v) = %v, want error containing %v", tc.data, err, tc.want)
+		}
+	}
+}
+
+func TestDiffPermissionsAgainstFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permissions-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	baseline := &tabletmanagerdatapb.Permissions{}
+	baseline.UserPermissions = append(baseline.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Password": "p1", "Select_priv": "Y"})))
+	data, err := MarshalPermissionsPortable(baseline)
+	if err != nil {
+		t.Fatalf("MarshalPermissionsPortable failed: %v", err)
+	}
+	file := path.Join(dir, "permissions.json")
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	if got, err := DiffPermissionsAgainstFile(baseline, file); err != nil || got != nil {
+		t.Errorf("DiffPermissionsAgainstFile(baseline) = %v %v, want no difference", got, err)
+	}
+
+	current := &tabletmanagerdatapb.Permissions{}
+	current.UserPermissions = append(current.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Password": "p1", "Select_priv": "N"})))
+	got, err := DiffPermissionsAgainstFile(current, file)
+	if err != nil || len(got) != 1 || !strings.Contains(got[0], file+" and current disagree on user %:vt") {
+		t.Errorf("DiffPermissionsAgainstFile(current) = %v %v", got, err)
+	}
+
+	if _, err := DiffPermissionsAgainstFile(current, file+".missing"); !os.IsNotExist(err) {
+		t.Errorf("DiffPermissionsAgainstFile(missing) = %v, want a not exist error", err)
+	}
+	if err := ioutil.WriteFile(file, []byte(`{"format_version": 2}`), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if _, err := DiffPermissionsAgainstFile(current, file); err == nil || !strings.Contains(err.Error(), "cannot read baseline "+file) {
+		t.Errorf("DiffPermissionsAgainstFile(bad format) = %v", err)
+	}
+}
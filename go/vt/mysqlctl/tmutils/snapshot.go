@@ -0,0 +1,107 @@
+// Copyright 2016, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tmutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/topo/topoproto"
+
+	tabletmanagerdatapb "github.com/youtube/vitess/go/vt/proto/tabletmanagerdata"
+	topodatapb "github.com/youtube/vitess/go/vt/proto/topodata"
+)
+
+// This file contains helper methods to store Permissions along with
+// where and when they were read.
+
+// PermissionsSnapshot is the Permissions of a tablet at a given time.
+type PermissionsSnapshot struct {
+	// Permissions is what was read.
+	Permissions *tabletmanagerdatapb.Permissions
+
+	// CaptureTime is when the permissions were read.
+	CaptureTime time.Time
+
+	// TabletAlias is the tablet they were read from, if any.
+	TabletAlias *topodatapb.TabletAlias
+
+	// MySQLVersion is the version string of the MySQL server they
+	// were read from, like "5.6.24-log", if known.
+	MySQLVersion string
+}
+
+// jsonPermissionsSnapshot is the JSON encoding of a
+// PermissionsSnapshot. The permissions use the portable format.
+type jsonPermissionsSnapshot struct {
+	Permissions  json.RawMessage `json:"permissions"`
+	CaptureTime  time.Time       `json:"capture_time"`
+	TabletAlias  string          `json:"tablet_alias,omitempty"`
+	MySQLVersion string          `json:"mysql_version,omitempty"`
+}
+
+// NewPermissionsSnapshot returns a PermissionsSnapshot of permissions
+// read now.
+func NewPermissionsSnapshot(permissions *tabletmanagerdatapb.Permissions, tabletAlias *topodatapb.TabletAlias, mysqlVersion string) *PermissionsSnapshot {
+	return &PermissionsSnapshot{
+		Permissions:  permissions,
+		CaptureTime:  time.Now(),
+		TabletAlias:  tabletAlias,
+		MySQLVersion: mysqlVersion,
+	}
+}
+
+// Describe returns a name for the snapshot in diff reports, like
+// "master (captured 10s ago)", relative to now. The age is truncated
+// to the second.
+func (s *PermissionsSnapshot) Describe(name string, now time.Time) string {
+	age := now.Sub(s.CaptureTime)
+	age -= age % time.Second
+	return fmt.Sprintf("%v (captured %v ago)", name, age)
+}
+
+// MarshalPermissionsSnapshot encodes a PermissionsSnapshot in JSON,
+// with its permissions in the format of MarshalPermissionsPortable.
+// It can be read back by UnmarshalPermissionsSnapshot.
+func MarshalPermissionsSnapshot(s *PermissionsSnapshot) ([]byte, error) {
+	permissions, err := MarshalPermissionsPortable(s.Permissions)
+	if err != nil {
+		return nil, err
+	}
+	js := jsonPermissionsSnapshot{
+		Permissions:  permissions,
+		CaptureTime:  s.CaptureTime.UTC(),
+		MySQLVersion: s.MySQLVersion,
+	}
+	if s.TabletAlias != nil {
+		js.TabletAlias = topoproto.TabletAliasString(s.TabletAlias)
+	}
+	return json.MarshalIndent(&js, "", "  ")
+}
+
+// UnmarshalPermissionsSnapshot decodes a PermissionsSnapshot encoded
+// by MarshalPermissionsSnapshot.
+func UnmarshalPermissionsSnapshot(data []byte) (*PermissionsSnapshot, error) {
+	var js jsonPermissionsSnapshot
+	if err := json.Unmarshal(data, &js); err != nil {
+		return nil, fmt.Errorf("cannot decode permissions snapshot: %v", err)
+	}
+	permissions, err := UnmarshalPermissionsPortable(js.Permissions)
+	if err != nil {
+		return nil, err
+	}
+	s := &PermissionsSnapshot{
+		Permissions:  permissions,
+		CaptureTime:  js.CaptureTime,
+		MySQLVersion: js.MySQLVersion,
+	}
+	if js.TabletAlias != "" {
+		if s.TabletAlias, err = topoproto.ParseTabletAlias(js.TabletAlias); err != nil {
+			return nil, fmt.Errorf("cannot decode permissions snapshot: %v", err)
+		}
+	}
+	return s, nil
+}
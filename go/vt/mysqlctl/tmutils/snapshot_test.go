@@ -0,0 +1,67 @@
+// Copyright 2016, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tmutils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	tabletmanagerdatapb "github.com/youtube/vitess/go/vt/proto/tabletmanagerdata"
+	topodatapb "github.com/youtube/vitess/go/vt/proto/topodata"
+)
+
+func TestPermissionsSnapshot(t *testing.T) {
+	p := &tabletmanagerdatapb.Permissions{}
+	p.UserPermissions = append(p.UserPermissions, NewUserPermission(mapToSQLResults(map[string]string{"Host": "%", "User": "vt", "Password": "p1", "Select_priv": "Y"})))
+	p.DbPermissions = append(p.DbPermissions, NewDbPermission(mapToSQLResults(map[string]string{"Host": "%", "Db": "vt_live", "User": "vt", "Select_priv": "Y"})))
+	s := NewPermissionsSnapshot(p, &topodatapb.TabletAlias{Cell: "cell1", Uid: 100}, "5.6.24-log")
+
+	data, err := MarshalPermissionsSnapshot(s)
+	if err != nil {
+		t.Fatalf("MarshalPermissionsSnapshot failed: %v", err)
+	}
+	if !strings.Contains(string(data), `"tablet_alias": "cell1-0000000100"`) || !strings.Contains(string(data), `"format_version": 1`) {
+		t.Errorf("unexpected snapshot format: %s", data)
+	}
+	got, err := UnmarshalPermissionsSnapshot(data)
+	if err != nil {
+		t.Fatalf("UnmarshalPermissionsSnapshot failed: %v", err)
+	}
+	if !got.CaptureTime.Equal(s.CaptureTime) || got.MySQLVersion != s.MySQLVersion || !reflect.DeepEqual(got.TabletAlias, s.TabletAlias) || !reflect.DeepEqual(got.Permissions, p) {
+		t.Errorf("round trip mismatch: %v != %v", got, s)
+	}
+
+	// the tablet alias and version are optional
+	s = &PermissionsSnapshot{Permissions: p, CaptureTime: time.Unix(1000, 0)}
+	data, err = MarshalPermissionsSnapshot(s)
+	if err != nil {
+		t.Fatalf("MarshalPermissionsSnapshot failed: %v", err)
+	}
+	if strings.Contains(string(data), "tablet_alias") || strings.Contains(string(data), "mysql_version") {
+		t.Errorf("unexpected snapshot format: %s", data)
+	}
+	if got, err := UnmarshalPermissionsSnapshot(data); err != nil || got.TabletAlias != nil || !got.CaptureTime.Equal(s.CaptureTime) {
+		t.Errorf("UnmarshalPermissionsSnapshot() = %v %v", got, err)
+	}
+
+	if got, want := s.Describe("master", time.Unix(1010, 500000000)), "master (captured 10s ago)"; got != want {
+		t.Errorf("Describe() = %v, want %v", got, want)
+	}
+
+	for _, tc := range []struct {
+		data string
+		want string
+	}{
+		{`not json`, "cannot decode permissions snapshot"},
+		{`{"permissions": {"format_version": 2}}`, "unsupported portable permissions format version 2"},
+		{`{"permissions": {"format_version": 1}, "tablet_alias": "bad"}`, "invalid tablet alias"},
+	} {
+		if _, err := UnmarshalPermissionsSnapshot([]byte(tc.data)); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("UnmarshalPermissionsSnapshot(%v) = %v, want error containing %v", tc.data, err, tc.want)
+		}
+	}
+}
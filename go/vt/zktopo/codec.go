@@ -0,0 +1,157 @@
+// Copyright 2016, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package zktopo
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// SrvGraphCodec encodes and decodes the SrvKeyspace and SrvVSchema
+// nodes of the serving graph. The data written with a codec starts with
+// its Magic prefix, so readers find the codec of each node by
+// themselves, and a cell can be migrated from one codec to another
+// without switching all the readers and writers at once.
+type SrvGraphCodec interface {
+	// Name identifies the codec in error messages.
+	Name() string
+
+	// Magic is the prefix of the data written with the codec. Only
+	// JSONCodec has an empty Magic, as it is how nodes were always
+	// stored. Magic can't start with '{', or with the gzip header.
+	Magic() string
+
+	// Marshal encodes msg, without the Magic prefix.
+	Marshal(msg proto.Message) ([]byte, error)
+
+	// Unmarshal decodes data, without the Magic prefix, into msg.
+	Unmarshal(data []byte, msg proto.Message) error
+}
+
+// JSONCodec is the default SrvGraphCodec. It writes canonical JSON,
+// indented unless Compact is set.
+type JSONCodec struct {
+	Compact bool
+}
+
+// Name is part of the SrvGraphCodec interface.
+func (c JSONCodec) Name() string {
+	return "json"
+}
+
+// Magic is part of the SrvGraphCodec interface.
+func (c JSONCodec) Magic() string {
+	return ""
+}
+
+// Marshal is part of the SrvGraphCodec interface.
+func (c JSONCodec) Marshal(msg proto.Message) ([]byte, error) {
+	return canonicalJSON(msg, c.Compact)
+}
+
+// Unmarshal is part of the SrvGraphCodec interface.
+func (c JSONCodec) Unmarshal(data []byte, msg proto.Message) error {
+	return unmarshalNodeData(string(data), msg)
+}
+
+// ProtoCodec is a SrvGraphCodec storing binary protobuf, which is
+// smaller and faster to decode than JSON.
+type ProtoCodec struct{}
+
+// Name is part of the SrvGraphCodec interface.
+func (c ProtoCodec) Name() string {
+	return "proto"
+}
+
+// Magic is part of the SrvGraphCodec interface. A zero byte can't be
+// the start of a JSON document.
+func (c ProtoCodec) Magic() string {
+	return "\x00pb"
+}
+
+// Marshal is part of the SrvGraphCodec interface.
+func (c ProtoCodec) Marshal(msg proto.Message) ([]byte, error) {
+	return proto.Marshal(msg)
+}
+
+// Unmarshal is part of the SrvGraphCodec interface.
+func (c ProtoCodec) Unmarshal(data []byte, msg proto.Message) (err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			err = fmt.Errorf("panic while decoding node data: %v", x)
+		}
+	}()
+	return proto.Unmarshal(data, msg)
+}
+
+var (
+	srvGraphCodecsMutex sync.Mutex
+	srvGraphCodecs      = []SrvGraphCodec{ProtoCodec{}}
+)
+
+// RegisterSrvGraphCodec makes readers recognize the data written with
+// codec. ProtoCodec is always registered. It panics if the Magic of
+// codec is empty or is a prefix of the Magic of a registered codec, or
+// the other way around, as the codec of some nodes would be ambiguous.
+func RegisterSrvGraphCodec(codec SrvGraphCodec) {
+	srvGraphCodecsMutex.Lock()
+	defer srvGraphCodecsMutex.Unlock()
+	magic := codec.Magic()
+	if magic == "" {
+		panic(fmt.Sprintf("SrvGraphCodec %v has an empty Magic", codec.Name()))
+	}
+	for _, existing := range srvGraphCodecs {
+		if strings.HasPrefix(magic, existing.Magic()) || strings.HasPrefix(existing.Magic(), magic) {
+			panic(fmt.Sprintf("SrvGraphCodec %v has the same Magic as %v", codec.Name(), existing.Name()))
+		}
+	}
+	srvGraphCodecs = append(srvGraphCodecs, codec)
+}
+
+// srvGraphCodecForData returns the codec that wrote data, which is
+// already decompressed. Data without a registered Magic is JSON.
+func srvGraphCodecForData(data string) SrvGraphCodec {
+	srvGraphCodecsMutex.Lock()
+	defer srvGraphCodecsMutex.Unlock()
+	for _, codec := range srvGraphCodecs {
+		if strings.HasPrefix(data, codec.Magic()) {
+			return codec
+		}
+	}
+	return JSONCodec{}
+}
+
+// marshalNodeData encodes msg with codec, followed by its Magic, and
+// compresses the result if compress is set.
+func marshalNodeData(codec SrvGraphCodec, msg proto.Message, compress bool) (string, error) {
+	data, err := codec.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+	data = append([]byte(codec.Magic()), data...)
+	if compress {
+		return compressNodeData(data)
+	}
+	return string(data), nil
+}
+
+// SetSrvGraphCodec makes the Server write the SrvKeyspace and SrvVSchema
+// nodes with codec, instead of JSON. codec should be registered with
+// RegisterSrvGraphCodec in all the readers first. A nil codec goes back
+// to JSON. It has to be called before the Server is used.
+func (zkts *Server) SetSrvGraphCodec(codec SrvGraphCodec) {
+	zkts.srvGraphCodec = codec
+}
+
+// codec returns the SrvGraphCodec the Server writes with.
+func (zkts *Server) codec() SrvGraphCodec {
+	if zkts.srvGraphCodec != nil {
+		return zkts.srvGraphCodec
+	}
+	return JSONCodec{Compact: zkts.compactJSON}
+}
@@ -0,0 +1,77 @@
+// Copyright 2016, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package zktopo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+var (
+	compressSrvVSchema = flag.Bool("zk_compress_srv_vschema", false, "store SrvVSchema nodes gzip-compressed in zookeeper. Readers detect compressed data, so all of them can read it once they run a version that understands it.")
+
+	maxNodeDataSize = flag.Int("zk_max_serving_graph_data_size", 16*1024*1024, "maximum size in bytes of the data of a serving graph node, before and after decompression. Bigger nodes can't be read, so a corrupted node can't make a process run out of memory.")
+)
+
+// gzipMagic is the header every gzip stream starts with. It can't be
+// the start of a JSON document, so it is enough to tell compressed
+// nodes apart from legacy uncompressed ones.
+const gzipMagic = "\x1f\x8b"
+
+// compressNodeData returns the gzip-compressed version of data.
+func compressNodeData(data []byte) (string, error) {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(data); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// decompressNodeData returns the uncompressed contents of a node. Data
+// that doesn't start with the gzip header is returned as is. The data
+// and its uncompressed version can't be bigger than
+// -zk_max_serving_graph_data_size.
+func decompressNodeData(data string) (string, error) {
+	if len(data) > *maxNodeDataSize {
+		return "", fmt.Errorf("node data is too big: %v bytes, the maximum is %v", len(data), *maxNodeDataSize)
+	}
+	if !strings.HasPrefix(data, gzipMagic) {
+		return data, nil
+	}
+	r, err := gzip.NewReader(strings.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("cannot decompress node data: %v", err)
+	}
+	defer r.Close()
+	result, err := ioutil.ReadAll(io.LimitReader(r, int64(*maxNodeDataSize)+1))
+	if err != nil {
+		return "", fmt.Errorf("cannot decompress node data: %v", err)
+	}
+	if len(result) > *maxNodeDataSize {
+		return "", fmt.Errorf("uncompressed node data is too big: more than the maximum of %v bytes", *maxNodeDataSize)
+	}
+	return string(result), nil
+}
+
+// unmarshalNodeData is json.Unmarshal, returning an error instead of
+// panicking if the decoder fails on corrupted data.
+func unmarshalNodeData(data string, v interface{}) (err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			err = fmt.Errorf("panic while decoding node data: %v", x)
+		}
+	}()
+	return json.Unmarshal([]byte(data), v)
+}
@@ -1,7 +1,7 @@
 package zktopo
 
 import (
-	"encoding/json"
+	"fmt"
 	"path"
 	"strings"
 
@@ -39,8 +39,10 @@ const (
 
 // rawDataFromNodeValue convert the data of the given type into an []byte.
 // It is mindful of the backward compatibility, i.e. for newer objects
-// it doesn't do anything, but for old object types that were stored in JSON
-// format in converts them to proto3 binary encoding.
+// it doesn't do anything, but for old object types that were stored
+// with a SrvGraphCodec, JSON by default, it converts them to proto3
+// binary encoding. The codec is found from the magic prefix of the
+// data, like GetSrvKeyspace and GetSrvVSchema do.
 func rawDataFromNodeValue(what dataType, data string) ([]byte, error) {
 	var p proto.Message
 	switch what {
@@ -52,7 +54,13 @@ func rawDataFromNodeValue(what dataType, data string) ([]byte, error) {
 		return []byte(data), nil
 	}
 
-	if err := json.Unmarshal([]byte(data), p); err != nil {
+	data, err := decompressNodeData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	codec := srvGraphCodecForData(data)
+	if err := codec.Unmarshal([]byte(data[len(codec.Magic()):]), p); err != nil {
 		return nil, err
 	}
 
@@ -60,19 +68,29 @@ func rawDataFromNodeValue(what dataType, data string) ([]byte, error) {
 }
 
 // oldTypeAndFilePath returns the data type and old file path for a given path.
-func oldTypeAndFilePath(cell, filePath string) (dataType, string) {
+func oldTypeAndFilePath(cell, filePath string) (dataType, string, error) {
 	parts := strings.Split(filePath, "/")
 
 	// SrvKeyspace: local cell, /keyspaces/<keyspace>/SrvKeyspace
 	if len(parts) == 4 && parts[0] == "" && parts[1] == "keyspaces" && parts[3] == "SrvKeyspace" {
-		return srvKeyspaceType, zkPathForSrvKeyspace(cell, parts[2])
+		p, err := zkPathForSrvKeyspace(cell, parts[2])
+		return srvKeyspaceType, p, err
 	}
 
 	// SrvVSchema: local cell, /SrvVSchema
 	if len(parts) == 2 && parts[1] == "SrvVSchema" {
-		return srvVSchemaType, zkPathForSrvVSchema(cell)
+		p, err := zkPathForSrvVSchema(cell)
+		return srvVSchemaType, p, err
 	}
 
 	// General case.
-	return newType, path.Join("/zk", cell, "vt", filePath)
+	cellPath, err := zkPathForCell(cell)
+	if err != nil {
+		return newType, "", err
+	}
+	p := path.Join(cellPath, filePath)
+	if !strings.HasPrefix(p, cellPath+"/") {
+		return newType, "", fmt.Errorf("invalid file path %q: it is outside of cell %v", filePath, cell)
+	}
+	return newType, p, nil
 }
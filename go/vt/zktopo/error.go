@@ -5,12 +5,107 @@
 package zktopo
 
 import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
 	zookeeper "github.com/samuel/go-zookeeper/zk"
 	"golang.org/x/net/context"
 
 	"github.com/youtube/vitess/go/vt/topo"
 )
 
+// ErrEmptyNode is returned when reading a SrvKeyspace node that
+// exists, but has no data. It is different from topo.ErrNoNode,
+// returned when the node doesn't exist. An empty SrvVSchema node is
+// still reported as topo.ErrNoNode, as GetSrvVSchema always did: it
+// means no vschema was pushed to the cell, and the callers of the
+// topo.Server interface, like GetSrvVSchemaOrEmpty, only know about
+// topo.ErrNoNode.
+var ErrEmptyNode = errors.New("node is empty")
+
+// ErrSessionExpired is sent by the serving graph watches when their
+// zookeeper watch was lost because the session expired. Changes may
+// have been missed, so consumers should drop what they cached: the
+// watch subscribes again, and then sends the current value.
+var ErrSessionExpired = errors.New("zookeeper session expired, resubscribing")
+
+// isSessionExpiredEvent returns true if a watch event means the watch
+// was lost because the zookeeper session expired.
+func isSessionExpiredEvent(event zookeeper.Event) bool {
+	return event.Err == zookeeper.ErrSessionExpired || event.State == zookeeper.StateExpired
+}
+
+// isReconnectingError returns true if err is what the zookeeper client
+// returns while it is getting a new session. These errors are likely to
+// go away, for instance during a rolling restart of the ensemble, so
+// they are also the ones retry retries.
+func isReconnectingError(err error) bool {
+	switch err {
+	case zookeeper.ErrConnectionClosed, zookeeper.ErrNoServer, zookeeper.ErrSessionExpired:
+		return true
+	}
+	return false
+}
+
+// snippetLength is how many bytes of the data SrvGraphUnmarshalError
+// keeps.
+const snippetLength = 32
+
+// SrvGraphUnmarshalError is returned when the contents of a serving
+// graph node cannot be decoded. It doesn't contain the whole data,
+// which can be big, only its length and first bytes.
+type SrvGraphUnmarshalError struct {
+	// Path is the path of the node.
+	Path string
+
+	// Length is the length of the data.
+	Length int
+
+	// Offset is the position of the error in the data, as reported
+	// by the JSON decoder, or -1 if unknown.
+	Offset int64
+
+	// Snippet is the hex encoding of the first bytes of the data.
+	Snippet string
+
+	// Err is the decoding error.
+	Err error
+}
+
+// newSrvGraphUnmarshalError returns a SrvGraphUnmarshalError for a
+// failure to decode data.
+func newSrvGraphUnmarshalError(path, data string, err error) *SrvGraphUnmarshalError {
+	offset := int64(-1)
+	switch err := err.(type) {
+	case *json.SyntaxError:
+		offset = err.Offset
+	case *json.UnmarshalTypeError:
+		offset = err.Offset
+	}
+	snippet := data
+	if len(snippet) > snippetLength {
+		snippet = snippet[:snippetLength]
+	}
+	return &SrvGraphUnmarshalError{
+		Path:    path,
+		Length:  len(data),
+		Offset:  offset,
+		Snippet: hex.EncodeToString([]byte(snippet)),
+		Err:     err,
+	}
+}
+
+// Error is part of the error interface.
+func (e *SrvGraphUnmarshalError) Error() string {
+	offset := ""
+	if e.Offset >= 0 {
+		offset = fmt.Sprintf(" at offset %v", e.Offset)
+	}
+	return fmt.Sprintf("cannot unmarshal %v (%v bytes starting with %v)%v: %v", e.Path, e.Length, e.Snippet, offset, e.Err)
+}
+
 // Error codes returned by the zookeeper Go client:
 func convertError(err error) error {
 	switch err {
@@ -31,3 +126,90 @@ func convertError(err error) error {
 	}
 	return err
 }
+
+// TopoErrorKind is the category of an error returned by a zktopo
+// Server, as returned by ClassifyTopoError.
+type TopoErrorKind int
+
+const (
+	// TopoErrorNone is the kind of a nil error.
+	TopoErrorNone TopoErrorKind = iota
+
+	// TopoErrorOther is the kind of the errors not in another category.
+	TopoErrorOther
+
+	// TopoErrorNoNode means the node doesn't exist.
+	TopoErrorNoNode
+
+	// TopoErrorNodeExists means the node already exists.
+	TopoErrorNodeExists
+
+	// TopoErrorBadVersion means the node doesn't have the expected
+	// version.
+	TopoErrorBadVersion
+
+	// TopoErrorNotEmpty means the node has children.
+	TopoErrorNotEmpty
+
+	// TopoErrorTimeout means the operation or the session timed out.
+	TopoErrorTimeout
+
+	// TopoErrorInterrupted means the operation was canceled.
+	TopoErrorInterrupted
+
+	// TopoErrorConnectionLost means the connection to zookeeper was
+	// lost. The operation may or may not have been applied.
+	TopoErrorConnectionLost
+)
+
+var topoErrorKindNames = map[TopoErrorKind]string{
+	TopoErrorNone:           "None",
+	TopoErrorOther:          "Other",
+	TopoErrorNoNode:         "NoNode",
+	TopoErrorNodeExists:     "NodeExists",
+	TopoErrorBadVersion:     "BadVersion",
+	TopoErrorNotEmpty:       "NotEmpty",
+	TopoErrorTimeout:        "Timeout",
+	TopoErrorInterrupted:    "Interrupted",
+	TopoErrorConnectionLost: "ConnectionLost",
+}
+
+// String is part of the fmt.Stringer interface.
+func (k TopoErrorKind) String() string {
+	if name, ok := topoErrorKindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("TopoErrorKind(%d)", int(k))
+}
+
+// ClassifyTopoError returns the kind of err. It accepts both the
+// errors returned by the Server, and the raw errors of the zookeeper
+// client, which are mapped like the Server does. An expired session is
+// a TopoErrorTimeout, whether it is the raw zookeeper error, the
+// topo.ErrTimeout the Server returns for it, or the ErrSessionExpired
+// sent by the watches.
+func ClassifyTopoError(err error) TopoErrorKind {
+	switch err {
+	case nil:
+		return TopoErrorNone
+	case zookeeper.ErrConnectionClosed, zookeeper.ErrNoServer:
+		return TopoErrorConnectionLost
+	case ErrSessionExpired:
+		return TopoErrorTimeout
+	}
+	switch convertError(err) {
+	case topo.ErrNoNode:
+		return TopoErrorNoNode
+	case topo.ErrNodeExists:
+		return TopoErrorNodeExists
+	case topo.ErrBadVersion:
+		return TopoErrorBadVersion
+	case topo.ErrNotEmpty:
+		return TopoErrorNotEmpty
+	case topo.ErrTimeout:
+		return TopoErrorTimeout
+	case topo.ErrInterrupted:
+		return TopoErrorInterrupted
+	}
+	return TopoErrorOther
+}
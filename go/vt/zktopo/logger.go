@@ -0,0 +1,45 @@
+// Copyright 2016, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package zktopo
+
+import (
+	"time"
+)
+
+// ServingGraphOperation describes a serving graph operation, for the
+// Logger.
+type ServingGraphOperation struct {
+	// Operation is the name of the operation, like
+	// "GetSrvKeyspace", as used in the ZkTopoServingGraph stats.
+	Operation string
+
+	// Cell is the cell of the operation.
+	Cell string
+
+	// Keyspace is the keyspace of the operation, or "" for the
+	// operations on a whole cell, like GetSrvKeyspaceNames.
+	Keyspace string
+
+	// Duration is how long the operation took.
+	Duration time.Duration
+
+	// Err is the error returned by the operation, if any.
+	Err error
+}
+
+// Logger is called by the Server after each serving graph read, write
+// and delete, with the same operations as the ZkTopoServingGraph stats.
+// It is called synchronously, from the goroutine of the caller, so it
+// should be fast.
+type Logger interface {
+	LogServingGraphOperation(op *ServingGraphOperation)
+}
+
+// SetLogger sets the Logger of the serving graph operations. The
+// default nil Logger doesn't log anything. It has to be called before
+// the Server is used.
+func (zkts *Server) SetLogger(logger Logger) {
+	zkts.logger = logger
+}
@@ -0,0 +1,80 @@
+// Copyright 2016, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package zktopo
+
+import (
+	"flag"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	retryAttempts   = flag.Int("zk_retry_attempts", 3, "number of attempts for zookeeper serving graph operations that fail with a transient error")
+	retryBackoff    = flag.Duration("zk_retry_backoff", 100*time.Millisecond, "wait time before the first retry of a zookeeper operation, doubled after each attempt")
+	retryMaxBackoff = flag.Duration("zk_retry_max_backoff", 2*time.Second, "maximum wait time between retries of a zookeeper operation")
+)
+
+// RetryPolicy describes how operations that fail with a transient
+// zookeeper error are retried.
+type RetryPolicy struct {
+	// Attempts is the total number of attempts, 1 means no retry.
+	Attempts int
+
+	// Backoff is the wait time before the first retry. It
+	// doubles after each retry, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Sleep is used to wait between attempts. If nil, the wait is
+	// abandoned when the context of the operation is done. Tests can
+	// replace it to not wait.
+	Sleep func(time.Duration)
+}
+
+// SetRetryPolicy changes the retry policy of the Server. By default,
+// the policy is built from the -zk_retry_* flags. It has to be called
+// before the Server is used.
+func (zkts *Server) SetRetryPolicy(policy RetryPolicy) {
+	zkts.retryPolicy = &policy
+}
+
+// retry runs f until it succeeds, returns a permanent error, or the
+// attempts of the retry policy are exhausted. The transient errors are
+// the ones of isReconnectingError. It returns the last
+// error of f, not converted.
+func (zkts *Server) retry(ctx context.Context, f func() error) error {
+	policy := RetryPolicy{
+		Attempts:   *retryAttempts,
+		Backoff:    *retryBackoff,
+		MaxBackoff: *retryMaxBackoff,
+	}
+	if zkts.retryPolicy != nil {
+		policy = *zkts.retryPolicy
+	}
+	backoff := policy.Backoff
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || !isReconnectingError(err) || attempt >= policy.Attempts {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if policy.Sleep != nil {
+			policy.Sleep(backoff)
+		} else {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+		}
+		backoff *= 2
+		if backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
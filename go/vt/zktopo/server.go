@@ -18,6 +18,31 @@ import (
 // Server is the zookeeper topo.Server implementation.
 type Server struct {
 	zconn zk.Conn
+
+	// retryPolicy overrides the default retry policy, see
+	// SetRetryPolicy.
+	retryPolicy *RetryPolicy
+
+	// srvKeyspaceNamesCache is set by EnableSrvKeyspaceNamesCache.
+	srvKeyspaceNamesCache *srvKeyspaceNamesCache
+
+	// srvKeyspaceCache is set by EnableSrvKeyspaceCache.
+	srvKeyspaceCache *srvKeyspaceCache
+
+	// srvKeyspaceStaleCache is used by GetSrvKeyspaceCached.
+	srvKeyspaceStaleCache srvKeyspaceStaleCache
+
+	// acl is set by SetServingGraphACL.
+	acl []zookeeper.ACL
+
+	// compactJSON is set by SetCompactJSON.
+	compactJSON bool
+
+	// srvGraphCodec is set by SetSrvGraphCodec, nil means JSON.
+	srvGraphCodec SrvGraphCodec
+
+	// logger is set by SetLogger.
+	logger Logger
 }
 
 // Close is part of topo.Server interface.
@@ -5,16 +5,28 @@
 package zktopo
 
 import (
+	"bytes"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash/crc64"
+	"math/rand"
 	"path"
+	"reflect"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	zookeeper "github.com/samuel/go-zookeeper/zk"
 	"golang.org/x/net/context"
 
+	"github.com/youtube/vitess/go/sync2"
+	"github.com/youtube/vitess/go/vt/concurrency"
+	"github.com/youtube/vitess/go/vt/key"
 	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/topo/topoproto"
 	"github.com/youtube/vitess/go/zk"
 
 	topodatapb "github.com/youtube/vitess/go/vt/proto/topodata"
@@ -27,28 +39,97 @@ import (
 // can change it.
 var WatchSleepDuration = 30 * time.Second
 
+// WatchSleepJitter is the fraction of WatchSleepDuration by which each
+// poll interval is randomly moved, up or down, so watchers started
+// together don't all poll at the same time. 0.2 means intervals are
+// between 80% and 120% of WatchSleepDuration. The default, 0, always
+// uses WatchSleepDuration.
+var WatchSleepJitter = 0.0
+
+// NextWatchSleepDuration returns how long a watch should sleep before
+// polling again, WatchSleepDuration with WatchSleepJitter applied.
+func NextWatchSleepDuration() time.Duration {
+	if WatchSleepJitter <= 0 {
+		return WatchSleepDuration
+	}
+	factor := 1 + WatchSleepJitter*(2*rand.Float64()-1)
+	return time.Duration(float64(WatchSleepDuration) * factor)
+}
+
 /*
 This file contains the serving graph management code of zktopo.Server
 */
-func zkPathForCell(cell string) string {
-	return fmt.Sprintf("/zk/%v/vt", cell)
+// checkPathComponent returns an error if name can't be used as a
+// single component of a zookeeper path, as it would then point outside
+// of the intended node.
+func checkPathComponent(kind, name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("empty %v name", kind)
+	case name == "." || name == "..":
+		return fmt.Errorf("invalid %v name %q: dot segments are not allowed", kind, name)
+	case strings.Contains(name, "/"):
+		return fmt.Errorf("invalid %v name %q: path separators are not allowed", kind, name)
+	}
+	return nil
 }
 
-func zkPathForSrvKeyspaces(cell string) string {
-	return path.Join(zkPathForCell(cell), "ns")
+func zkPathForCell(cell string) (string, error) {
+	if err := checkPathComponent("cell", cell); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("/zk/%v/vt", cell), nil
+}
+
+func zkPathForSrvKeyspaces(cell string) (string, error) {
+	cellPath, err := zkPathForCell(cell)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(cellPath, "ns"), nil
 }
 
-func zkPathForSrvKeyspace(cell, keyspace string) string {
-	return path.Join(zkPathForSrvKeyspaces(cell), keyspace)
+func zkPathForSrvKeyspace(cell, keyspace string) (string, error) {
+	if err := checkPathComponent("keyspace", keyspace); err != nil {
+		return "", err
+	}
+	keyspacesPath, err := zkPathForSrvKeyspaces(cell)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(keyspacesPath, keyspace), nil
 }
 
-func zkPathForSrvVSchema(cell string) string {
-	return path.Join(zkPathForCell(cell), "vschema")
+func zkPathForSrvVSchema(cell string) (string, error) {
+	cellPath, err := zkPathForCell(cell)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(cellPath, "vschema"), nil
 }
 
-// GetSrvKeyspaceNames is part of the topo.Server interface
+// GetSrvKeyspaceNames is part of the topo.Server interface.
+// It uses the cache enabled by EnableSrvKeyspaceNamesCache, if any.
 func (zkts *Server) GetSrvKeyspaceNames(ctx context.Context, cell string) ([]string, error) {
-	children, _, err := zkts.zconn.Children(zkPathForSrvKeyspaces(cell))
+	if zkts.srvKeyspaceNamesCache != nil {
+		return zkts.srvKeyspaceNamesCache.get(ctx, zkts, cell)
+	}
+	return zkts.GetSrvKeyspaceNamesUncached(ctx, cell)
+}
+
+// GetSrvKeyspaceNamesUncached is GetSrvKeyspaceNames, always reading
+// from zookeeper.
+func (zkts *Server) GetSrvKeyspaceNamesUncached(ctx context.Context, cell string) (_ []string, err error) {
+	defer zkts.recordServingGraphStats("GetSrvKeyspaceNames", cell, "", time.Now(), &err)
+	path, err := zkPathForSrvKeyspaces(cell)
+	if err != nil {
+		return nil, err
+	}
+	var children []string
+	err = zkts.retry(ctx, func() (err error) {
+		children, _, err = zkts.zconn.Children(path)
+		return err
+	})
 	switch err {
 	case nil:
 		sort.Strings(children)
@@ -60,74 +141,1504 @@ func (zkts *Server) GetSrvKeyspaceNames(ctx context.Context, cell string) ([]str
 	}
 }
 
+// CellExists returns true if the zookeeper directory of a cell
+// exists. GetSrvKeyspaceNames returns no keyspace for a cell that
+// doesn't exist, CellExists tells it apart from an empty cell.
+func (zkts *Server) CellExists(ctx context.Context, cell string) (bool, error) {
+	path, err := zkPathForCell(cell)
+	if err != nil {
+		return false, err
+	}
+	var stat *zookeeper.Stat
+	err = zkts.retry(ctx, func() (err error) {
+		stat, err = zkts.zconn.Exists(path)
+		return err
+	})
+	switch err {
+	case nil:
+		return stat != nil, nil
+	case zookeeper.ErrNoNode:
+		return false, nil
+	default:
+		return false, convertError(err)
+	}
+}
+
+// CheckServingGraph does a round-trip to zookeeper by listing the
+// SrvKeyspace nodes of a cell, and returns an error if it fails. A cell
+// without a serving graph is healthy. It doesn't retry, and returns when
+// ctx is done even if zookeeper doesn't answer, so it can be used as a
+// cheap liveness probe.
+func (zkts *Server) CheckServingGraph(ctx context.Context, cell string) error {
+	path, err := zkPathForSrvKeyspaces(cell)
+	if err != nil {
+		return err
+	}
+	err = runWithContext(ctx, func() error {
+		_, _, err := zkts.zconn.Children(path)
+		return err
+	})
+	switch err {
+	case nil, zookeeper.ErrNoNode:
+		return nil
+	default:
+		return convertError(err)
+	}
+}
+
+// SetCompactJSON makes the Server write the SrvKeyspace and SrvVSchema
+// nodes as compact JSON, instead of indented JSON. Both are read back
+// the same way. It has to be called before the Server is used.
+func (zkts *Server) SetCompactJSON(compact bool) {
+	zkts.compactJSON = compact
+}
+
+// SetServingGraphACL sets the ACL of the serving graph nodes the
+// Server creates. Their parent directories get the same ACL, with
+// directory permissions. The default is
+// zookeeper.WorldACL(zookeeper.PermAll). It has to be called before
+// the Server is used.
+func (zkts *Server) SetServingGraphACL(acl []zookeeper.ACL) {
+	zkts.acl = acl
+}
+
+// servingGraphACL returns the ACL for new serving graph nodes.
+func (zkts *Server) servingGraphACL() []zookeeper.ACL {
+	if zkts.acl != nil {
+		return zkts.acl
+	}
+	return zookeeper.WorldACL(zookeeper.PermAll)
+}
+
+// UpdateSrvKeyspaceOptions modifies the behavior of
+// UpdateSrvKeyspaceWithOptions.
+type UpdateSrvKeyspaceOptions struct {
+	// SkipValidation stores the SrvKeyspace even if its partitions
+	// are not consistent. It is meant for callers that knowingly
+	// store partial data.
+	SkipValidation bool
+
+	// Compress stores the SrvKeyspace gzip-compressed. Readers
+	// detect compressed data.
+	Compress bool
+
+	// CheckKeyRangeCoverage also checks, unless SkipValidation is
+	// set, that each partition covers the whole keyspace id range,
+	// with CheckSrvKeyspaceKeyRangeCoverage.
+	CheckKeyRangeCoverage bool
+}
+
+// WriteResult says what a write to the serving graph did.
+type WriteResult int
+
+const (
+	// WriteCreated means the node didn't exist, and was created.
+	WriteCreated WriteResult = iota
+
+	// WriteUpdated means the existing node was changed.
+	WriteUpdated
+
+	// WriteUnchanged means the node already had the same data, and
+	// was not written.
+	WriteUnchanged
+)
+
+// String is part of the fmt.Stringer interface.
+func (r WriteResult) String() string {
+	switch r {
+	case WriteCreated:
+		return "Created"
+	case WriteUpdated:
+		return "Updated"
+	case WriteUnchanged:
+		return "Unchanged"
+	}
+	return fmt.Sprintf("WriteResult(%d)", int(r))
+}
+
 // UpdateSrvKeyspace is part of the topo.Server interface
 func (zkts *Server) UpdateSrvKeyspace(ctx context.Context, cell, keyspace string, srvKeyspace *topodatapb.SrvKeyspace) error {
-	path := zkPathForSrvKeyspace(cell, keyspace)
-	data, err := json.MarshalIndent(srvKeyspace, "", "  ")
+	return zkts.UpdateSrvKeyspaceWithOptions(ctx, cell, keyspace, srvKeyspace, UpdateSrvKeyspaceOptions{})
+}
+
+// UpdateSrvKeyspaceResult is UpdateSrvKeyspace, and also returns
+// whether the node was created, updated, or left unchanged because it
+// already had the same marshaled data. The result is only meaningful
+// if there is no error.
+func (zkts *Server) UpdateSrvKeyspaceResult(ctx context.Context, cell, keyspace string, srvKeyspace *topodatapb.SrvKeyspace) (WriteResult, error) {
+	return zkts.updateSrvKeyspace(ctx, cell, keyspace, srvKeyspace, UpdateSrvKeyspaceOptions{})
+}
+
+// UpdateSrvKeyspaceWithOptions is UpdateSrvKeyspace with options.
+// Unless opts.SkipValidation is set, the SrvKeyspace is checked with
+// ValidateSrvKeyspace first, and not stored if it is invalid.
+func (zkts *Server) UpdateSrvKeyspaceWithOptions(ctx context.Context, cell, keyspace string, srvKeyspace *topodatapb.SrvKeyspace, opts UpdateSrvKeyspaceOptions) error {
+	_, err := zkts.updateSrvKeyspace(ctx, cell, keyspace, srvKeyspace, opts)
+	return err
+}
+
+// updateSrvKeyspace implements UpdateSrvKeyspaceWithOptions and
+// UpdateSrvKeyspaceResult.
+func (zkts *Server) updateSrvKeyspace(ctx context.Context, cell, keyspace string, srvKeyspace *topodatapb.SrvKeyspace, opts UpdateSrvKeyspaceOptions) (_ WriteResult, err error) {
+	defer zkts.recordServingGraphStats("UpdateSrvKeyspace", cell, keyspace, time.Now(), &err)
+	if !opts.SkipValidation {
+		if err := ValidateSrvKeyspace(srvKeyspace); err != nil {
+			return WriteUnchanged, fmt.Errorf("invalid SrvKeyspace for %v in cell %v: %v", keyspace, cell, err)
+		}
+		if opts.CheckKeyRangeCoverage {
+			er := concurrency.AllErrorRecorder{}
+			for _, err := range CheckSrvKeyspaceKeyRangeCoverage(srvKeyspace) {
+				er.RecordError(err)
+			}
+			if er.HasErrors() {
+				return WriteUnchanged, fmt.Errorf("invalid SrvKeyspace for %v in cell %v: %v", keyspace, cell, er.Error())
+			}
+		}
+	}
+	path, err := zkPathForSrvKeyspace(cell, keyspace)
+	if err != nil {
+		return WriteUnchanged, err
+	}
+	data, err := marshalSrvKeyspace(srvKeyspace, opts.Compress, zkts.codec())
+	if err != nil {
+		return WriteUnchanged, err
+	}
+
+	return zkts.writeSrvKeyspaceData(ctx, path, data)
+}
+
+// writeSrvKeyspaceData stores marshaled SrvKeyspace data at path,
+// creating the node if needed.
+func (zkts *Server) writeSrvKeyspaceData(ctx context.Context, path, data string) (WriteResult, error) {
+	// Don't bump the version and trigger watches if nothing changed.
+	// This is racy, but at worst we write the same data twice.
+	result := WriteUnchanged
+	err := zkts.retry(ctx, func() error {
+		if existing, _, err := zkts.zconn.Get(path); err == nil && existing == data {
+			result = WriteUnchanged
+			return nil
+		}
+		created, err := setOrCreate(ctx, zkts.zconn, path, data, zkts.servingGraphACL())
+		result = WriteUpdated
+		if created {
+			result = WriteCreated
+		}
+		return err
+	})
+	return result, convertError(err)
+}
+
+// UpdateSrvKeyspaceInCells stores the same SrvKeyspace in all the
+// provided cells, as UpdateSrvKeyspace would. It is validated and
+// marshaled once, and written to the cells concurrently. The returned
+// map has the error of each cell, nil for the cells that were updated.
+func (zkts *Server) UpdateSrvKeyspaceInCells(ctx context.Context, cells []string, keyspace string, srvKeyspace *topodatapb.SrvKeyspace) map[string]error {
+	result := make(map[string]error, len(cells))
+	if err := ValidateSrvKeyspace(srvKeyspace); err != nil {
+		for _, cell := range cells {
+			result[cell] = fmt.Errorf("invalid SrvKeyspace for %v in cell %v: %v", keyspace, cell, err)
+		}
+		return result
+	}
+	data, err := marshalSrvKeyspace(srvKeyspace, false, zkts.codec())
+	if err != nil {
+		for _, cell := range cells {
+			result[cell] = err
+		}
+		return result
+	}
+
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+	for _, cell := range cells {
+		wg.Add(1)
+		go func(cell string) {
+			defer wg.Done()
+			err := zkts.updateSrvKeyspaceData(ctx, cell, keyspace, data)
+			mu.Lock()
+			result[cell] = err
+			mu.Unlock()
+		}(cell)
+	}
+	wg.Wait()
+	return result
+}
+
+// updateSrvKeyspaceData writes the marshaled SrvKeyspace of keyspace
+// in a cell, for UpdateSrvKeyspaceInCells.
+func (zkts *Server) updateSrvKeyspaceData(ctx context.Context, cell, keyspace, data string) (err error) {
+	defer zkts.recordServingGraphStats("UpdateSrvKeyspace", cell, keyspace, time.Now(), &err)
+	path, err := zkPathForSrvKeyspace(cell, keyspace)
+	if err != nil {
+		return err
+	}
+	_, err = zkts.writeSrvKeyspaceData(ctx, path, data)
+	return err
+}
+
+// UpdateSrvKeyspaceDryRun returns the data UpdateSrvKeyspace would
+// write, and whether it differs from the current content of the node,
+// without changing anything. The current node is decoded and compared
+// with srvKeyspace, so a node stored compressed or with another codec
+// but with the same content doesn't count as a change. A node that
+// cannot be decoded does.
+func (zkts *Server) UpdateSrvKeyspaceDryRun(ctx context.Context, cell, keyspace string, srvKeyspace *topodatapb.SrvKeyspace) (wouldChange bool, newData []byte, err error) {
+	if err := ValidateSrvKeyspace(srvKeyspace); err != nil {
+		return false, nil, fmt.Errorf("invalid SrvKeyspace for %v in cell %v: %v", keyspace, cell, err)
+	}
+	path, err := zkPathForSrvKeyspace(cell, keyspace)
+	if err != nil {
+		return false, nil, err
+	}
+	data, err := marshalSrvKeyspace(srvKeyspace, false, zkts.codec())
+	if err != nil {
+		return false, nil, err
+	}
+
+	var existing string
+	err = zkts.retry(ctx, func() (err error) {
+		existing, _, err = zkts.zconn.Get(path)
+		return err
+	})
+	switch err {
+	case nil:
+		current, err := unmarshalSrvKeyspace(path, existing)
+		if err != nil {
+			return true, []byte(data), nil
+		}
+		return !proto.Equal(current, srvKeyspace), []byte(data), nil
+	case zookeeper.ErrNoNode:
+		return true, []byte(data), nil
+	default:
+		return false, nil, convertError(err)
+	}
+}
+
+// setOrCreate sets the data of a node, creating it and its parents if
+// needed. The node is created with its data in a single operation, so
+// readers never see it empty. If a concurrent writer creates it first,
+// the data is set on top of the other writer's. New nodes get the
+// provided ACL. Creating the node and its parents takes multiple round
+// trips, so it is abandoned when ctx is done. It returns true if it
+// created the node.
+func setOrCreate(ctx context.Context, zconn zk.Conn, path, data string, acl []zookeeper.ACL) (created bool, err error) {
+	_, err = zconn.Set(path, data, -1)
+	if err != zookeeper.ErrNoNode {
+		return false, err
+	}
+	err = runWithContext(ctx, func() error {
+		_, err := zk.CreateRecursive(zconn, path, data, 0, acl)
+		return err
+	})
+	if err != zookeeper.ErrNodeExists {
+		return err == nil, err
+	}
+	_, err = zconn.Set(path, data, -1)
+	return false, err
+}
+
+// runWithContext runs f, and returns its error, or an error wrapping
+// ctx.Err() if ctx is done first. In that case f keeps running in the
+// background, as zookeeper calls can't be interrupted.
+func runWithContext(ctx context.Context, f func() error) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- f()
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("zookeeper operation abandoned: %v", ctx.Err())
+	}
+}
+
+// ValidateSrvKeyspace checks a SrvKeyspace would not break routing:
+// each tablet type is served by at most one partition and one
+// served-from entry, and the shards of a partition don't overlap and
+// have no gap between them. A partition doesn't have to span the whole
+// keyspace id range, as that is normal while a keyspace is being built.
+func ValidateSrvKeyspace(srvKeyspace *topodatapb.SrvKeyspace) error {
+	servedTypes := make(map[topodatapb.TabletType]bool)
+	for _, partition := range srvKeyspace.Partitions {
+		tabletType := partition.ServedType
+		if servedTypes[tabletType] {
+			return fmt.Errorf("duplicate partition for %v", tabletType)
+		}
+		servedTypes[tabletType] = true
+
+		// sort a copy, we don't want to change the stored version
+		shardReferences := make(topoproto.ShardReferenceArray, len(partition.ShardReferences))
+		copy(shardReferences, partition.ShardReferences)
+		shardReferences.Sort()
+		for i := 1; i < len(shardReferences); i++ {
+			prevShard := shardReferences[i-1]
+			currShard := shardReferences[i]
+			prevHasKeyRange := prevShard.KeyRange != nil
+			currHasKeyRange := currShard.KeyRange != nil
+			if prevHasKeyRange != currHasKeyRange {
+				return fmt.Errorf("shards with inconsistent KeyRanges for %v: %v, %v", tabletType, prevShard.Name, currShard.Name)
+			}
+			if !prevHasKeyRange {
+				// this is the custom sharding case, all KeyRanges are nil
+				continue
+			}
+			c := bytes.Compare(prevShard.KeyRange.End, currShard.KeyRange.Start)
+			switch {
+			case len(prevShard.KeyRange.End) == 0 || c > 0:
+				return fmt.Errorf("overlapping KeyRange values for %v: shards %v and %v", tabletType, prevShard.Name, currShard.Name)
+			case c < 0:
+				return fmt.Errorf("gap in KeyRange values for %v between shards %v and %v: %v != %v", tabletType, prevShard.Name, currShard.Name, hex.EncodeToString(prevShard.KeyRange.End), hex.EncodeToString(currShard.KeyRange.Start))
+			}
+		}
+	}
+
+	servedFromTypes := make(map[topodatapb.TabletType]bool)
+	for _, servedFrom := range srvKeyspace.ServedFrom {
+		if servedFromTypes[servedFrom.TabletType] {
+			return fmt.Errorf("duplicate served from entry for %v", servedFrom.TabletType)
+		}
+		servedFromTypes[servedFrom.TabletType] = true
+	}
+	return nil
+}
+
+// CheckSrvKeyspaceKeyRangeCoverage checks the shards of each partition
+// of a SrvKeyspace cover the whole keyspace id range: ordered by
+// KeyRange, they start at the minimum, end at the maximum, and have no
+// gap or overlap between them. It returns all the problems it finds.
+// Partitions whose shards have no KeyRange, for unsharded and custom
+// sharded keyspaces, are not checked.
+func CheckSrvKeyspaceKeyRangeCoverage(srvKeyspace *topodatapb.SrvKeyspace) []error {
+	var errs []error
+	for _, partition := range srvKeyspace.Partitions {
+		tabletType := partition.ServedType
+		if len(partition.ShardReferences) == 0 {
+			errs = append(errs, fmt.Errorf("partition for %v has no shard", tabletType))
+			continue
+		}
+
+		// sort a copy, we don't want to change the stored version
+		shardReferences := make(topoproto.ShardReferenceArray, len(partition.ShardReferences))
+		copy(shardReferences, partition.ShardReferences)
+		shardReferences.Sort()
+		withKeyRange := 0
+		for _, shardReference := range shardReferences {
+			if shardReference.KeyRange != nil {
+				withKeyRange++
+			}
+		}
+		if withKeyRange == 0 {
+			continue
+		}
+		if withKeyRange != len(shardReferences) {
+			errs = append(errs, fmt.Errorf("partition for %v has shards with and without KeyRange", tabletType))
+			continue
+		}
+
+		first := shardReferences[0]
+		if len(first.KeyRange.Start) != 0 {
+			errs = append(errs, fmt.Errorf("KeyRange for %v starts at %v with shard %v, not at the minimum", tabletType, hex.EncodeToString(first.KeyRange.Start), first.Name))
+		}
+		for i := 1; i < len(shardReferences); i++ {
+			prevShard := shardReferences[i-1]
+			currShard := shardReferences[i]
+			c := bytes.Compare(prevShard.KeyRange.End, currShard.KeyRange.Start)
+			switch {
+			case len(prevShard.KeyRange.End) == 0 || c > 0:
+				errs = append(errs, fmt.Errorf("overlap in KeyRange values for %v between shards %v and %v: %v > %v", tabletType, prevShard.Name, currShard.Name, keyRangeEndString(prevShard.KeyRange.End), hex.EncodeToString(currShard.KeyRange.Start)))
+			case c < 0:
+				errs = append(errs, fmt.Errorf("gap in KeyRange values for %v between shards %v and %v: %v != %v", tabletType, prevShard.Name, currShard.Name, hex.EncodeToString(prevShard.KeyRange.End), hex.EncodeToString(currShard.KeyRange.Start)))
+			}
+		}
+		last := shardReferences[len(shardReferences)-1]
+		if len(last.KeyRange.End) != 0 {
+			errs = append(errs, fmt.Errorf("KeyRange for %v ends at %v with shard %v, not at the maximum", tabletType, hex.EncodeToString(last.KeyRange.End), last.Name))
+		}
+	}
+	return errs
+}
+
+// keyRangeEndString returns the hex encoding of a KeyRange end, which
+// is the maximum when empty.
+func keyRangeEndString(end []byte) string {
+	if len(end) == 0 {
+		return "max"
+	}
+	return hex.EncodeToString(end)
+}
+
+// CoalesceShardReferences merges the ShardReferences that point to the
+// same shard and have adjacent KeyRanges, as a partition can have
+// after a merge resharding. The result is ordered by KeyRange, and the
+// provided ShardReferences are not changed. It returns an error if two
+// KeyRanges overlap. A ShardReference without KeyRange, as used by
+// unsharded keyspaces, covers the whole range.
+func CoalesceShardReferences(shards []*topodatapb.ShardReference) ([]*topodatapb.ShardReference, error) {
+	sorted := make(topoproto.ShardReferenceArray, len(shards))
+	copy(sorted, shards)
+	sorted.Sort()
+
+	var result []*topodatapb.ShardReference
+	for _, shard := range sorted {
+		if len(result) == 0 {
+			result = append(result, shard)
+			continue
+		}
+		prev := result[len(result)-1]
+		if prev.KeyRange == nil || shard.KeyRange == nil {
+			return nil, fmt.Errorf("cannot coalesce shards %v and %v: a shard without KeyRange covers the whole range", prev.Name, shard.Name)
+		}
+		c := bytes.Compare(prev.KeyRange.End, shard.KeyRange.Start)
+		if len(prev.KeyRange.End) == 0 || c > 0 {
+			return nil, fmt.Errorf("overlap in KeyRange values between shards %v and %v: %v > %v", prev.Name, shard.Name, keyRangeEndString(prev.KeyRange.End), hex.EncodeToString(shard.KeyRange.Start))
+		}
+		if c == 0 && prev.Name == shard.Name {
+			result[len(result)-1] = &topodatapb.ShardReference{
+				Name: prev.Name,
+				KeyRange: &topodatapb.KeyRange{
+					Start: prev.KeyRange.Start,
+					End:   shard.KeyRange.End,
+				},
+			}
+			continue
+		}
+		result = append(result, shard)
+	}
+	return result, nil
+}
+
+// FindShardForKey returns the shard of the partition for servedType
+// of srvKeyspace whose KeyRange contains the keyspace id. The shards are
+// binary-searched in KeyRange order. It fails if servedType has no
+// partition, or if the keyspace id is in a gap between the shards.
+func FindShardForKey(srvKeyspace *topodatapb.SrvKeyspace, servedType topodatapb.TabletType, id []byte) (*topodatapb.ShardReference, error) {
+	partition := topoproto.SrvKeyspaceGetPartition(srvKeyspace, servedType)
+	if partition == nil || len(partition.ShardReferences) == 0 {
+		return nil, fmt.Errorf("no partition for %v", servedType)
+	}
+	shards := topoproto.ShardReferenceArray(partition.ShardReferences)
+	if !sort.IsSorted(shards) {
+		shards = make(topoproto.ShardReferenceArray, len(partition.ShardReferences))
+		copy(shards, partition.ShardReferences)
+		shards.Sort()
+	}
+
+	// i is the first shard that starts after id, so only the
+	// shard before it can contain id.
+	i := sort.Search(len(shards), func(i int) bool {
+		kr := shards[i].KeyRange
+		return kr != nil && bytes.Compare(kr.Start, id) > 0
+	})
+	if i > 0 && key.KeyRangeContains(shards[i-1].KeyRange, id) {
+		return shards[i-1], nil
+	}
+	return nil, fmt.Errorf("keyspace id %v is not in any shard of the partition for %v", hex.EncodeToString(id), servedType)
+}
+
+// SrvVSchemaStats has aggregate numbers about a SrvVSchema, as
+// computed by ComputeSrvVSchemaStats.
+type SrvVSchemaStats struct {
+	// Keyspaces is the number of keyspaces.
+	Keyspaces int
+
+	// Tables and Vindexes are the number of tables and vindexes of
+	// all the keyspaces.
+	Tables   int
+	Vindexes int
+
+	// JSONSize is the size in bytes of the SrvVSchema in the default
+	// indented JSON format, before any compression.
+	JSONSize int
+}
+
+// ComputeSrvVSchemaStats returns the SrvVSchemaStats of a SrvVSchema,
+// for instance to see how close it is to the maximum node size.
+func ComputeSrvVSchemaStats(srvVSchema *vschemapb.SrvVSchema) SrvVSchemaStats {
+	stats := SrvVSchemaStats{
+		Keyspaces: len(srvVSchema.Keyspaces),
+	}
+	for _, ks := range srvVSchema.Keyspaces {
+		if ks == nil {
+			continue
+		}
+		stats.Tables += len(ks.Tables)
+		stats.Vindexes += len(ks.Vindexes)
+	}
+	// This cannot fail, a SrvVSchema only has basic types.
+	data, _ := canonicalJSON(srvVSchema, false)
+	stats.JSONSize = len(data)
+	return stats
+}
+
+// ValidateSrvVSchema checks the tables of a SrvVSchema can be routed:
+// in a sharded keyspace, each table has at least one column vindex,
+// the first being its primary vindex, and in all keyspaces the column
+// vindexes are defined in the keyspace of the table.
+func ValidateSrvVSchema(srvVSchema *vschemapb.SrvVSchema) error {
+	keyspaces := make([]string, 0, len(srvVSchema.Keyspaces))
+	for name := range srvVSchema.Keyspaces {
+		keyspaces = append(keyspaces, name)
+	}
+	sort.Strings(keyspaces)
+	for _, keyspaceName := range keyspaces {
+		keyspace := srvVSchema.Keyspaces[keyspaceName]
+		if keyspace == nil {
+			continue
+		}
+		tables := make([]string, 0, len(keyspace.Tables))
+		for name := range keyspace.Tables {
+			tables = append(tables, name)
+		}
+		sort.Strings(tables)
+		for _, tableName := range tables {
+			table := keyspace.Tables[tableName]
+			if table == nil || len(table.ColumnVindexes) == 0 {
+				if keyspace.Sharded {
+					return fmt.Errorf("table %v in sharded keyspace %v has no primary vindex", tableName, keyspaceName)
+				}
+				continue
+			}
+			for _, columnVindex := range table.ColumnVindexes {
+				if _, ok := keyspace.Vindexes[columnVindex.Name]; !ok {
+					return fmt.Errorf("table %v in keyspace %v uses vindex %v, which is not defined in the keyspace", tableName, keyspaceName, columnVindex.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// AddSrvKeyspacePartitionShards adds shards to the partition for
+// servedType of a SrvKeyspace, creating the partition if needed. An
+// existing shard is removed if it has the same name as one of the new
+// shards, or if its KeyRange is covered by the KeyRanges of the new
+// shards, so "0" can be replaced by "-80" and "80-". The shards of the
+// partition are then sorted by KeyRange, and the result has to pass
+// ValidateSrvKeyspace, and to cover the whole keyspace id range with
+// CheckSrvKeyspaceKeyRangeCoverage, so shards that would overlap or
+// leave a gap are rejected. The SrvKeyspace is only written if it
+// wasn't changed since it was read, otherwise the change is applied
+// again to the new version, at most maxUpdateAttempts times.
+func (zkts *Server) AddSrvKeyspacePartitionShards(ctx context.Context, cell, keyspace string, servedType topodatapb.TabletType, shards []*topodatapb.ShardReference) error {
+	return zkts.updateSrvKeyspaceFunc(ctx, cell, keyspace, fmt.Sprintf("add shards to the %v partition", servedType), func(srvKeyspace *topodatapb.SrvKeyspace) error {
+		partition := addPartitionShards(srvKeyspace, servedType, shards)
+		er := concurrency.AllErrorRecorder{}
+		for _, err := range CheckSrvKeyspaceKeyRangeCoverage(&topodatapb.SrvKeyspace{
+			Partitions: []*topodatapb.SrvKeyspace_KeyspacePartition{partition},
+		}) {
+			er.RecordError(err)
+		}
+		return er.Error()
+	})
+}
+
+// UpdateSrvKeyspacePartition replaces the partition for servedType of
+// a SrvKeyspace, adding it if needed, and leaves the other partitions
+// as they are. A nil partition removes the partition for servedType.
+// A copy of partition is stored, with its ServedType set to
+// servedType, and partition itself is not changed. Like
+// AddSrvKeyspacePartitionShards, the result has to pass
+// ValidateSrvKeyspace, and is only written if the SrvKeyspace wasn't
+// changed since it was read.
+func (zkts *Server) UpdateSrvKeyspacePartition(ctx context.Context, cell, keyspace string, servedType topodatapb.TabletType, partition *topodatapb.SrvKeyspace_KeyspacePartition) error {
+	return zkts.updateSrvKeyspaceFunc(ctx, cell, keyspace, fmt.Sprintf("update the %v partition", servedType), func(srvKeyspace *topodatapb.SrvKeyspace) error {
+		var newPartition *topodatapb.SrvKeyspace_KeyspacePartition
+		if partition != nil {
+			newPartition = proto.Clone(partition).(*topodatapb.SrvKeyspace_KeyspacePartition)
+			newPartition.ServedType = servedType
+		}
+		var partitions []*topodatapb.SrvKeyspace_KeyspacePartition
+		replaced := false
+		for _, existing := range srvKeyspace.Partitions {
+			if existing.ServedType != servedType {
+				partitions = append(partitions, existing)
+				continue
+			}
+			if newPartition != nil && !replaced {
+				partitions = append(partitions, newPartition)
+				replaced = true
+			}
+		}
+		if newPartition != nil && !replaced {
+			partitions = append(partitions, newPartition)
+		}
+		srvKeyspace.Partitions = partitions
+		return nil
+	})
+}
+
+// updateSrvKeyspaceFunc reads the SrvKeyspace of keyspace in cell,
+// changes it with update, validates it, and writes it back if the node
+// wasn't changed in the meantime. Otherwise it tries again with the new
+// version, at most maxUpdateAttempts times. action describes the change
+// in the errors of update and of the validation. The compression of the
+// node is kept.
+func (zkts *Server) updateSrvKeyspaceFunc(ctx context.Context, cell, keyspace, action string, update func(*topodatapb.SrvKeyspace) error) error {
+	path, err := zkPathForSrvKeyspace(cell, keyspace)
 	if err != nil {
 		return err
 	}
-	_, err = zkts.zconn.Set(path, string(data), -1)
-	if err == zookeeper.ErrNoNode {
-		_, err = zk.CreateRecursive(zkts.zconn, path, string(data), 0, zookeeper.WorldACL(zookeeper.PermAll))
+	for attempt := 1; ; attempt++ {
+		var data string
+		var stat *zookeeper.Stat
+		err := zkts.retry(ctx, func() (err error) {
+			data, stat, err = zkts.zconn.Get(path)
+			return err
+		})
+		if err != nil {
+			return convertError(err)
+		}
+		srvKeyspace, err := unmarshalSrvKeyspace(path, data)
+		if err != nil {
+			return err
+		}
+
+		if err := update(srvKeyspace); err != nil {
+			return fmt.Errorf("cannot %v of SrvKeyspace %v in cell %v: %v", action, keyspace, cell, err)
+		}
+		if err := ValidateSrvKeyspace(srvKeyspace); err != nil {
+			return fmt.Errorf("cannot %v of SrvKeyspace %v in cell %v: %v", action, keyspace, cell, err)
+		}
+		newData, err := marshalSrvKeyspace(srvKeyspace, strings.HasPrefix(data, gzipMagic), zkts.codec())
+		if err != nil {
+			return err
+		}
+		_, err = zkts.zconn.Set(path, newData, stat.Version)
+		if err != zookeeper.ErrBadVersion {
+			return convertError(err)
+		}
+		if attempt >= maxUpdateAttempts {
+			return fmt.Errorf("cannot update SrvKeyspace %v in cell %v: changed concurrently %v times", keyspace, cell, attempt)
+		}
+		if ctx.Err() != nil {
+			return convertError(ctx.Err())
+		}
+	}
+}
+
+// addPartitionShards adds shards to the partition for servedType of
+// srvKeyspace, see AddSrvKeyspacePartitionShards. It returns the
+// partition.
+func addPartitionShards(srvKeyspace *topodatapb.SrvKeyspace, servedType topodatapb.TabletType, shards []*topodatapb.ShardReference) *topodatapb.SrvKeyspace_KeyspacePartition {
+	partition := topoproto.SrvKeyspaceGetPartition(srvKeyspace, servedType)
+	if partition == nil {
+		partition = &topodatapb.SrvKeyspace_KeyspacePartition{
+			ServedType: servedType,
+		}
+		srvKeyspace.Partitions = append(srvKeyspace.Partitions, partition)
+	}
+
+	names := make(map[string]bool, len(shards))
+	sorted := make(topoproto.ShardReferenceArray, len(shards))
+	copy(sorted, shards)
+	sorted.Sort()
+	var keyRanges []*topodatapb.KeyRange
+	for _, shard := range sorted {
+		names[shard.Name] = true
+		if shard.KeyRange != nil {
+			keyRanges = append(keyRanges, shard.KeyRange)
+		}
+	}
+
+	var shardReferences []*topodatapb.ShardReference
+	for _, existing := range partition.ShardReferences {
+		if names[existing.Name] || (len(keyRanges) > 0 && keyRangeCovered(existing.KeyRange, keyRanges)) {
+			continue
+		}
+		shardReferences = append(shardReferences, existing)
+	}
+	partition.ShardReferences = append(shardReferences, shards...)
+	topoproto.ShardReferenceArray(partition.ShardReferences).Sort()
+	return partition
+}
+
+// keyRangeCovered returns true if the union of keyRanges, sorted by
+// Start, includes kr. A nil kr is the whole keyspace id range.
+func keyRangeCovered(kr *topodatapb.KeyRange, keyRanges []*topodatapb.KeyRange) bool {
+	var start, end []byte
+	if kr != nil {
+		start, end = kr.Start, kr.End
+	}
+	for _, keyRange := range keyRanges {
+		if bytes.Compare(keyRange.Start, start) > 0 {
+			// there is a gap before keyRange
+			return false
+		}
+		if len(keyRange.End) == 0 {
+			return true
+		}
+		if bytes.Compare(keyRange.End, start) > 0 {
+			start = keyRange.End
+		}
+		if len(end) != 0 && bytes.Compare(start, end) >= 0 {
+			return true
+		}
 	}
-	return convertError(err)
+	return false
 }
 
 // DeleteSrvKeyspace is part of the topo.Server interface
-func (zkts *Server) DeleteSrvKeyspace(ctx context.Context, cell, keyspace string) error {
-	path := zkPathForSrvKeyspace(cell, keyspace)
-	err := zkts.zconn.Delete(path, -1)
+func (zkts *Server) DeleteSrvKeyspace(ctx context.Context, cell, keyspace string) (err error) {
+	defer zkts.recordServingGraphStats("DeleteSrvKeyspace", cell, keyspace, time.Now(), &err)
+	path, err := zkPathForSrvKeyspace(cell, keyspace)
+	if err != nil {
+		return err
+	}
+	err = zkts.zconn.Delete(path, -1)
 	if err != nil {
 		return convertError(err)
 	}
 	return nil
 }
 
+// DeleteAllSrvKeyspaces deletes all the SrvKeyspaces of a cell,
+// concurrently. It returns the sorted keyspaces that were deleted, and
+// the errors for the others. A SrvKeyspace that is already gone counts
+// as deleted, so it can be run again after a partial failure.
+func (zkts *Server) DeleteAllSrvKeyspaces(ctx context.Context, cell string) (deleted []string, errs []error) {
+	keyspaces, err := zkts.GetSrvKeyspaceNamesUncached(ctx, cell)
+	if err != nil {
+		return nil, []error{fmt.Errorf("GetSrvKeyspaceNames(%v) failed: %v", cell, err)}
+	}
+
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+	for _, keyspace := range keyspaces {
+		wg.Add(1)
+		go func(keyspace string) {
+			defer wg.Done()
+			err := zkts.DeleteSrvKeyspace(ctx, cell, keyspace)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil && err != topo.ErrNoNode {
+				errs = append(errs, fmt.Errorf("DeleteSrvKeyspace(%v, %v) failed: %v", cell, keyspace, err))
+				return
+			}
+			deleted = append(deleted, keyspace)
+		}(keyspace)
+	}
+	wg.Wait()
+	sort.Strings(deleted)
+	return deleted, errs
+}
+
 // GetSrvKeyspace is part of the topo.Server interface
 func (zkts *Server) GetSrvKeyspace(ctx context.Context, cell, keyspace string) (*topodatapb.SrvKeyspace, error) {
-	path := zkPathForSrvKeyspace(cell, keyspace)
-	data, _, err := zkts.zconn.Get(path)
+	srvKeyspace, _, err := zkts.GetSrvKeyspaceWithStat(ctx, cell, keyspace)
+	return srvKeyspace, err
+}
+
+// SrvKeyspaceStat describes the zookeeper node of a SrvKeyspace.
+type SrvKeyspaceStat struct {
+	// Version is the version of the node, changed by each update.
+	Version int64
+
+	// Mtime is the time of the last update of the node.
+	Mtime time.Time
+}
+
+// GetSrvKeyspaceWithStat is GetSrvKeyspace, also returning the
+// version and modification time of the node.
+func (zkts *Server) GetSrvKeyspaceWithStat(ctx context.Context, cell, keyspace string) (_ *topodatapb.SrvKeyspace, _ *SrvKeyspaceStat, err error) {
+	defer zkts.recordServingGraphStats("GetSrvKeyspace", cell, keyspace, time.Now(), &err)
+	path, err := zkPathForSrvKeyspace(cell, keyspace)
 	if err != nil {
-		return nil, convertError(err)
+		return nil, nil, err
+	}
+	if zkts.srvKeyspaceCache != nil {
+		srvKeyspace, stat, err := zkts.srvKeyspaceCache.get(ctx, zkts, cell, path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return srvKeyspace, newSrvKeyspaceStat(stat), nil
+	}
+	var data string
+	var stat *zookeeper.Stat
+	err = zkts.retry(ctx, func() (err error) {
+		data, stat, err = zkts.zconn.Get(path)
+		return err
+	})
+	if err != nil {
+		return nil, nil, convertError(err)
+	}
+	srvKeyspace, err := unmarshalSrvKeyspace(path, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return srvKeyspace, newSrvKeyspaceStat(stat), nil
+}
+
+func newSrvKeyspaceStat(stat *zookeeper.Stat) *SrvKeyspaceStat {
+	return &SrvKeyspaceStat{
+		Version: int64(stat.Version),
+		Mtime:   zk.Time(stat.Mtime),
+	}
+}
+
+// GetSrvKeyspaceRaw returns the contents of the SrvKeyspace node of a
+// keyspace as stored, without decoding or decompressing them, and the
+// version and modification time of the node.
+func (zkts *Server) GetSrvKeyspaceRaw(ctx context.Context, cell, keyspace string) ([]byte, *SrvKeyspaceStat, error) {
+	path, err := zkPathForSrvKeyspace(cell, keyspace)
+	if err != nil {
+		return nil, nil, err
+	}
+	var data string
+	var stat *zookeeper.Stat
+	err = zkts.retry(ctx, func() (err error) {
+		data, stat, err = zkts.zconn.Get(path)
+		return err
+	})
+	if err != nil {
+		return nil, nil, convertError(err)
+	}
+	return []byte(data), newSrvKeyspaceStat(stat), nil
+}
+
+// GetSrvKeyspaces reads the SrvKeyspace of all the provided keyspaces
+// in a cell, concurrently. Keyspaces that can't be read are not in the
+// returned map, and their errors are combined in the returned error.
+func (zkts *Server) GetSrvKeyspaces(ctx context.Context, cell string, keyspaces []string) (map[string]*topodatapb.SrvKeyspace, error) {
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+	er := concurrency.AllErrorRecorder{}
+	result := make(map[string]*topodatapb.SrvKeyspace, len(keyspaces))
+	for _, keyspace := range keyspaces {
+		wg.Add(1)
+		go func(keyspace string) {
+			defer wg.Done()
+			srvKeyspace, err := zkts.GetSrvKeyspace(ctx, cell, keyspace)
+			if err != nil {
+				er.RecordError(fmt.Errorf("GetSrvKeyspace(%v, %v) failed: %v", cell, keyspace, err))
+				return
+			}
+			mu.Lock()
+			result[keyspace] = srvKeyspace
+			mu.Unlock()
+		}(keyspace)
+	}
+	wg.Wait()
+	return result, er.Error()
+}
+
+// GetAllSrvKeyspaces reads the SrvKeyspace of all the keyspaces in a
+// cell. See GetSrvKeyspaces for the error semantics.
+func (zkts *Server) GetAllSrvKeyspaces(ctx context.Context, cell string) (map[string]*topodatapb.SrvKeyspace, error) {
+	keyspaces, err := zkts.GetSrvKeyspaceNames(ctx, cell)
+	if err != nil {
+		return nil, err
+	}
+	return zkts.GetSrvKeyspaces(ctx, cell, keyspaces)
+}
+
+// GetServingKeyspaceNames returns the sorted names of the keyspaces
+// of a cell that have a partition for servedType. The SrvKeyspaces are
+// read concurrently, see GetSrvKeyspaces for the error semantics.
+func (zkts *Server) GetServingKeyspaceNames(ctx context.Context, cell string, servedType topodatapb.TabletType) ([]string, error) {
+	srvKeyspaces, err := zkts.GetAllSrvKeyspaces(ctx, cell)
+	var result []string
+	for keyspace, srvKeyspace := range srvKeyspaces {
+		if topoproto.SrvKeyspaceGetPartition(srvKeyspace, servedType) != nil {
+			result = append(result, keyspace)
+		}
+	}
+	sort.Strings(result)
+	return result, err
+}
+
+// CellServingGraph is the serving graph of a cell, as returned by
+// GetCellServingGraph.
+type CellServingGraph struct {
+	// SrvVSchema is the SrvVSchema of the cell, or nil if it has none.
+	SrvVSchema *vschemapb.SrvVSchema
+
+	// SrvKeyspaces maps the keyspace names to their SrvKeyspace, for
+	// the keyspaces that could be read.
+	SrvKeyspaces map[string]*topodatapb.SrvKeyspace
+
+	// Errors maps the keyspace names to the error returned when
+	// reading their SrvKeyspace, for the others.
+	Errors map[string]error
+}
+
+// GetCellServingGraph reads the SrvVSchema and all the SrvKeyspaces of
+// a cell, concurrently, to look at the serving graph as a whole. The
+// SrvKeyspaces that can't be read are in the Errors of the result,
+// only failing to list the keyspaces or to read the SrvVSchema is an
+// error.
+func (zkts *Server) GetCellServingGraph(ctx context.Context, cell string) (*CellServingGraph, error) {
+	var srvVSchema *vschemapb.SrvVSchema
+	var srvVSchemaErr error
+	vschemaDone := make(chan struct{})
+	go func() {
+		defer close(vschemaDone)
+		srvVSchema, srvVSchemaErr = zkts.GetSrvVSchema(ctx, cell)
+		if srvVSchemaErr == topo.ErrNoNode {
+			srvVSchemaErr = nil
+		}
+	}()
+
+	keyspaces, err := zkts.GetSrvKeyspaceNames(ctx, cell)
+	if err != nil {
+		<-vschemaDone
+		return nil, fmt.Errorf("GetSrvKeyspaceNames(%v) failed: %v", cell, err)
+	}
+
+	result := &CellServingGraph{
+		SrvKeyspaces: make(map[string]*topodatapb.SrvKeyspace, len(keyspaces)),
+		Errors:       make(map[string]error),
+	}
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+	for _, keyspace := range keyspaces {
+		wg.Add(1)
+		go func(keyspace string) {
+			defer wg.Done()
+			srvKeyspace, err := zkts.GetSrvKeyspace(ctx, cell, keyspace)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				result.Errors[keyspace] = err
+				return
+			}
+			result.SrvKeyspaces[keyspace] = srvKeyspace
+		}(keyspace)
 	}
+	wg.Wait()
+
+	<-vschemaDone
+	if srvVSchemaErr != nil {
+		return nil, fmt.Errorf("GetSrvVSchema(%v) failed: %v", cell, srvVSchemaErr)
+	}
+	result.SrvVSchema = srvVSchema
+	return result, nil
+}
+
+// GetCellsServingKeyspace returns the cells, among the provided ones,
+// that have a SrvKeyspace for keyspace, in the same order. The cells
+// are checked concurrently. Cells that can't be checked are not in the
+// result, and their errors are combined in the returned error.
+func (zkts *Server) GetCellsServingKeyspace(ctx context.Context, cells []string, keyspace string) ([]string, error) {
+	return zkts.getCellsWithNode(ctx, cells, func(cell string) (string, error) {
+		return zkPathForSrvKeyspace(cell, keyspace)
+	}, func(cell string) string {
+		return fmt.Sprintf("SrvKeyspace(%v, %v)", cell, keyspace)
+	})
+}
+
+// GetCellsWithServingGraph returns the cells, among the provided ones,
+// that have a SrvKeyspaces directory, in the same order. A cell
+// without one is not populated, which is not an error. The cells are
+// checked concurrently, see GetCellsServingKeyspace for the error
+// semantics. It is meant for the jobs that go through all the cells,
+// to skip the empty ones.
+func (zkts *Server) GetCellsWithServingGraph(ctx context.Context, candidateCells []string) ([]string, error) {
+	return zkts.getCellsWithNode(ctx, candidateCells, zkPathForSrvKeyspaces, func(cell string) string {
+		return fmt.Sprintf("SrvKeyspaces of cell %v", cell)
+	})
+}
+
+// getCellsWithNode returns the cells for which the node at
+// nodePath(cell) exists, in the same order. The cells are checked
+// concurrently, and the errors of those that can't be checked are
+// combined in the returned error. describe names the node of a cell
+// in the errors.
+func (zkts *Server) getCellsWithNode(ctx context.Context, cells []string, nodePath func(cell string) (string, error), describe func(cell string) string) ([]string, error) {
+	wg := sync.WaitGroup{}
+	er := concurrency.AllErrorRecorder{}
+	exists := make([]bool, len(cells))
+	for i, cell := range cells {
+		wg.Add(1)
+		go func(i int, cell string) {
+			defer wg.Done()
+			path, err := nodePath(cell)
+			if err != nil {
+				er.RecordError(err)
+				return
+			}
+			var stat *zookeeper.Stat
+			err = zkts.retry(ctx, func() (err error) {
+				stat, err = zkts.zconn.Exists(path)
+				return err
+			})
+			switch {
+			case err == zookeeper.ErrNoNode:
+				// doesn't exist
+			case err != nil:
+				er.RecordError(fmt.Errorf("cannot check %v: %v", describe(cell), convertError(err)))
+			default:
+				exists[i] = stat != nil
+			}
+		}(i, cell)
+	}
+	wg.Wait()
+
+	var result []string
+	for i, cell := range cells {
+		if exists[i] {
+			result = append(result, cell)
+		}
+	}
+	return result, er.Error()
+}
+
+// FindOrphanedSrvKeyspaces returns, for each of the provided cells,
+// the sorted names of its SrvKeyspaces that are not for one of
+// liveKeyspaces. Cells without any are not in the result. The cells
+// are checked concurrently. Cells that can't be checked are skipped,
+// and their errors are combined in the returned error.
+func (zkts *Server) FindOrphanedSrvKeyspaces(ctx context.Context, cells []string, liveKeyspaces []string) (map[string][]string, error) {
+	live := make(map[string]bool, len(liveKeyspaces))
+	for _, keyspace := range liveKeyspaces {
+		live[keyspace] = true
+	}
+
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+	er := concurrency.AllErrorRecorder{}
+	result := make(map[string][]string)
+	for _, cell := range cells {
+		wg.Add(1)
+		go func(cell string) {
+			defer wg.Done()
+			names, err := zkts.GetSrvKeyspaceNames(ctx, cell)
+			if err != nil {
+				er.RecordError(fmt.Errorf("cannot list SrvKeyspaces of cell %v: %v", cell, err))
+				return
+			}
+			var orphans []string
+			for _, name := range names {
+				if !live[name] {
+					orphans = append(orphans, name)
+				}
+			}
+			if len(orphans) == 0 {
+				return
+			}
+			sort.Strings(orphans)
+			mu.Lock()
+			result[cell] = orphans
+			mu.Unlock()
+		}(cell)
+	}
+	wg.Wait()
+	return result, er.Error()
+}
+
+// ValidateAllSrvKeyspacesConcurrency is the maximum number of
+// SrvKeyspaces ValidateAllSrvKeyspaces reads at the same time.
+var ValidateAllSrvKeyspacesConcurrency = 8
+
+// ValidateAllSrvKeyspaces reads all the SrvKeyspaces of a cell and
+// checks them with ValidateSrvKeyspace and
+// CheckSrvKeyspaceKeyRangeCoverage, to find the corrupted ones in one
+// scan. At most ValidateAllSrvKeyspacesConcurrency SrvKeyspaces are
+// read at the same time. It returns the problems of each keyspace,
+// including failing to read its SrvKeyspace; the keyspaces without
+// any are not in the result. If the keyspaces of the cell can't be
+// listed, the error is returned for the empty keyspace name.
+func (zkts *Server) ValidateAllSrvKeyspaces(ctx context.Context, cell string) map[string][]error {
+	keyspaces, err := zkts.GetSrvKeyspaceNames(ctx, cell)
+	if err != nil {
+		return map[string][]error{"": {fmt.Errorf("GetSrvKeyspaceNames(%v) failed: %v", cell, err)}}
+	}
+
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+	sem := sync2.NewSemaphore(ValidateAllSrvKeyspacesConcurrency, 0)
+	result := make(map[string][]error)
+	for _, keyspace := range keyspaces {
+		wg.Add(1)
+		go func(keyspace string) {
+			defer wg.Done()
+			sem.Acquire()
+			srvKeyspace, err := zkts.GetSrvKeyspace(ctx, cell, keyspace)
+			sem.Release()
+
+			var errs []error
+			if err != nil {
+				errs = append(errs, fmt.Errorf("GetSrvKeyspace(%v, %v) failed: %v", cell, keyspace, err))
+			} else {
+				if err := ValidateSrvKeyspace(srvKeyspace); err != nil {
+					errs = append(errs, err)
+				}
+				errs = append(errs, CheckSrvKeyspaceKeyRangeCoverage(srvKeyspace)...)
+			}
+			if len(errs) == 0 {
+				return
+			}
+			mu.Lock()
+			result[keyspace] = errs
+			mu.Unlock()
+		}(keyspace)
+	}
+	wg.Wait()
+	return result
+}
+
+// marshalSrvKeyspace encodes a SrvKeyspace for storage with codec.
+func marshalSrvKeyspace(srvKeyspace *topodatapb.SrvKeyspace, compress bool, codec SrvGraphCodec) (string, error) {
+	return marshalNodeData(codec, srvKeyspace, compress)
+}
+
+// srvKeyspaceHashTable is the crc64 table for SrvKeyspaceContentHash.
+var srvKeyspaceHashTable = crc64.MakeTable(crc64.ISO)
+
+// SrvKeyspaceContentHash returns a hash of the content of a
+// SrvKeyspace. It is computed on the canonical encoding also used to
+// store it, so it is the same in all processes, and callers can cache
+// it to skip updates that wouldn't change anything.
+func SrvKeyspaceContentHash(srvKeyspace *topodatapb.SrvKeyspace) uint64 {
+	data, err := canonicalJSON(srvKeyspace, false)
+	if err != nil {
+		// Can't happen with a SrvKeyspace, all its fields can
+		// be encoded.
+		panic(fmt.Errorf("cannot encode SrvKeyspace: %v", err))
+	}
+	return crc64.Checksum(data, srvKeyspaceHashTable)
+}
+
+// canonicalJSON returns the JSON encoding of v, indented unless
+// compact is set, with all the object keys sorted. Unlike the field
+// order of generated structs, it doesn't change between versions of
+// the proto library, so the same value always has the same encoding.
+func canonicalJSON(v interface{}, compact bool) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	// Maps are always encoded with sorted keys.
+	var generic interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+	if compact {
+		return json.Marshal(generic)
+	}
+	return json.MarshalIndent(generic, "", "  ")
+}
+
+// unmarshalSrvKeyspace decodes the contents of a SrvKeyspace node,
+// compressed or not, written with any registered codec.
+func unmarshalSrvKeyspace(path, data string) (*topodatapb.SrvKeyspace, error) {
 	if len(data) == 0 {
-		return nil, topo.ErrNoNode
+		return nil, ErrEmptyNode
 	}
+	uncompressed, err := decompressNodeData(data)
+	if err != nil {
+		return nil, newSrvGraphUnmarshalError(path, data, err)
+	}
+	codec := srvGraphCodecForData(uncompressed)
 	srvKeyspace := &topodatapb.SrvKeyspace{}
-	if err := json.Unmarshal([]byte(data), srvKeyspace); err != nil {
-		return nil, fmt.Errorf("SrvKeyspace unmarshal failed: %v %v", data, err)
+	if err := codec.Unmarshal([]byte(uncompressed[len(codec.Magic()):]), srvKeyspace); err != nil {
+		return nil, newSrvGraphUnmarshalError(path, uncompressed, err)
+	}
+	if *strictSrvKeyspace && codec.Magic() == "" {
+		if err := checkUnknownFields([]byte(uncompressed), reflect.TypeOf(srvKeyspace)); err != nil {
+			return nil, newSrvGraphUnmarshalError(path, uncompressed, err)
+		}
 	}
 	return srvKeyspace, nil
 }
 
+// UpdateSrvVSchemaOptions modifies the behavior of
+// UpdateSrvVSchemaWithOptions.
+type UpdateSrvVSchemaOptions struct {
+	// SkipValidation stores the SrvVSchema even if it has dangling
+	// vindex references. It is meant for callers that knowingly
+	// store partial data, for instance during a migration.
+	SkipValidation bool
+}
+
 // UpdateSrvVSchema is part of the topo.Server interface
 func (zkts *Server) UpdateSrvVSchema(ctx context.Context, cell string, srvVSchema *vschemapb.SrvVSchema) error {
-	path := zkPathForSrvVSchema(cell)
-	data, err := json.MarshalIndent(srvVSchema, "", "  ")
+	return zkts.UpdateSrvVSchemaWithOptions(ctx, cell, srvVSchema, UpdateSrvVSchemaOptions{})
+}
+
+// UpdateSrvVSchemaWithOptions is UpdateSrvVSchema with options.
+// Unless opts.SkipValidation is set, the SrvVSchema is checked with
+// ValidateSrvVSchema first, and not stored if it is invalid.
+func (zkts *Server) UpdateSrvVSchemaWithOptions(ctx context.Context, cell string, srvVSchema *vschemapb.SrvVSchema, opts UpdateSrvVSchemaOptions) (err error) {
+	defer zkts.recordServingGraphStats("UpdateSrvVSchema", cell, "", time.Now(), &err)
+	if !opts.SkipValidation {
+		if err := ValidateSrvVSchema(srvVSchema); err != nil {
+			return fmt.Errorf("invalid SrvVSchema in cell %v: %v", cell, err)
+		}
+	}
+	path, err := zkPathForSrvVSchema(cell)
+	if err != nil {
+		return err
+	}
+	data, err := marshalSrvVSchema(srvVSchema, zkts.codec())
+	if err != nil {
+		return err
+	}
+	return convertError(zkts.retry(ctx, func() error {
+		_, err := setOrCreate(ctx, zkts.zconn, path, data, zkts.servingGraphACL())
+		return err
+	}))
+}
+
+// UpdateSrvVSchemaWithVersion updates the SrvVSchema of a cell only if
+// the node is still at existingVersion, as returned by
+// GetSrvVSchemaWithVersion. It returns topo.ErrBadVersion if the node
+// was changed in the meantime, and topo.ErrNoNode if it doesn't exist.
+// It returns the new version of the node. It is not retried on
+// transient errors, as the failed attempt may have been applied. The
+// SrvVSchema is checked with ValidateSrvVSchema first.
+func (zkts *Server) UpdateSrvVSchemaWithVersion(ctx context.Context, cell string, srvVSchema *vschemapb.SrvVSchema, existingVersion int64) (int64, error) {
+	if err := ValidateSrvVSchema(srvVSchema); err != nil {
+		return -1, fmt.Errorf("invalid SrvVSchema in cell %v: %v", cell, err)
+	}
+	path, err := zkPathForSrvVSchema(cell)
+	if err != nil {
+		return -1, err
+	}
+	data, err := marshalSrvVSchema(srvVSchema, zkts.codec())
+	if err != nil {
+		return -1, err
+	}
+	stat, err := zkts.zconn.Set(path, data, int32(existingVersion))
+	if err != nil {
+		return -1, convertError(err)
+	}
+	return int64(stat.Version), nil
+}
+
+// maxUpdateAttempts is how many times the read-modify-write updates,
+// like UpdateSrvVSchemaFunc, try to apply their change when the node
+// is changed concurrently.
+const maxUpdateAttempts = 5
+
+// UpdateSrvVSchemaFunc reads the SrvVSchema of a cell, calls update to
+// modify it, and stores the result if the node wasn't changed in the
+// meantime. Otherwise it starts again, with the new value, at most
+// maxUpdateAttempts times. A missing or empty node is passed
+// to update as an empty SrvVSchema, and created if needed. If update
+// returns an error, nothing is stored and the error is returned as is.
+func (zkts *Server) UpdateSrvVSchemaFunc(ctx context.Context, cell string, update func(*vschemapb.SrvVSchema) error) error {
+	path, err := zkPathForSrvVSchema(cell)
 	if err != nil {
 		return err
 	}
-	_, err = zkts.zconn.Set(path, string(data), -1)
-	if err == zookeeper.ErrNoNode {
-		_, err = zk.CreateRecursive(zkts.zconn, path, string(data), 0, zookeeper.WorldACL(zookeeper.PermAll))
+	for attempt := 1; ; attempt++ {
+		var data string
+		var stat *zookeeper.Stat
+		err := zkts.retry(ctx, func() (err error) {
+			data, stat, err = zkts.zconn.Get(path)
+			return err
+		})
+		srvVSchema := &vschemapb.SrvVSchema{}
+		switch {
+		case err == zookeeper.ErrNoNode:
+			stat = nil
+		case err != nil:
+			return convertError(err)
+		case len(data) > 0:
+			if srvVSchema, err = unmarshalSrvVSchema(path, data); err != nil {
+				return err
+			}
+		}
+
+		if err := update(srvVSchema); err != nil {
+			return err
+		}
+
+		if stat != nil {
+			_, err = zkts.UpdateSrvVSchemaWithVersion(ctx, cell, srvVSchema, int64(stat.Version))
+		} else {
+			err = zkts.createSrvVSchema(ctx, path, srvVSchema)
+		}
+		if err != topo.ErrBadVersion && err != topo.ErrNodeExists {
+			return err
+		}
+		if attempt >= maxUpdateAttempts {
+			return fmt.Errorf("cannot update SrvVSchema in cell %v: changed concurrently %v times", cell, attempt)
+		}
+		if ctx.Err() != nil {
+			return convertError(ctx.Err())
+		}
+	}
+}
+
+// createSrvVSchema creates the SrvVSchema node at path, and returns
+// topo.ErrNodeExists if it already exists.
+func (zkts *Server) createSrvVSchema(ctx context.Context, path string, srvVSchema *vschemapb.SrvVSchema) error {
+	if err := ValidateSrvVSchema(srvVSchema); err != nil {
+		return fmt.Errorf("invalid SrvVSchema %v: %v", path, err)
+	}
+	data, err := marshalSrvVSchema(srvVSchema, zkts.codec())
+	if err != nil {
+		return err
+	}
+	return convertError(runWithContext(ctx, func() error {
+		_, err := zk.CreateRecursive(zkts.zconn, path, data, 0, zkts.servingGraphACL())
+		return err
+	}))
+}
+
+// DeleteSrvVSchema deletes the SrvVSchema of a cell.
+func (zkts *Server) DeleteSrvVSchema(ctx context.Context, cell string) (err error) {
+	defer zkts.recordServingGraphStats("DeleteSrvVSchema", cell, "", time.Now(), &err)
+	path, err := zkPathForSrvVSchema(cell)
+	if err != nil {
+		return err
+	}
+	err = zkts.zconn.Delete(path, -1)
+	if err != nil {
+		return convertError(err)
 	}
-	return convertError(err)
+	return nil
 }
 
 // GetSrvVSchema is part of the topo.Server interface
 func (zkts *Server) GetSrvVSchema(ctx context.Context, cell string) (*vschemapb.SrvVSchema, error) {
-	path := zkPathForSrvVSchema(cell)
-	data, _, err := zkts.zconn.Get(path)
+	srvVSchema, _, err := zkts.GetSrvVSchemaWithVersion(ctx, cell)
+	return srvVSchema, err
+}
+
+// GetSrvVSchemaOrEmpty is GetSrvVSchema, except that it returns an empty
+// SrvVSchema if the cell doesn't have one. Its Keyspaces map is never
+// nil, so callers can add keyspaces to it directly.
+func (zkts *Server) GetSrvVSchemaOrEmpty(ctx context.Context, cell string) (*vschemapb.SrvVSchema, error) {
+	srvVSchema, err := zkts.GetSrvVSchema(ctx, cell)
+	switch err {
+	case nil:
+	case topo.ErrNoNode:
+		srvVSchema = &vschemapb.SrvVSchema{}
+	default:
+		return nil, err
+	}
+	if srvVSchema.Keyspaces == nil {
+		srvVSchema.Keyspaces = make(map[string]*vschemapb.Keyspace)
+	}
+	return srvVSchema, nil
+}
+
+// GetSrvVSchemaWithVersion returns the SrvVSchema of a cell, and the
+// version of its node, to use with UpdateSrvVSchemaWithVersion.
+func (zkts *Server) GetSrvVSchemaWithVersion(ctx context.Context, cell string) (_ *vschemapb.SrvVSchema, _ int64, err error) {
+	defer zkts.recordServingGraphStats("GetSrvVSchema", cell, "", time.Now(), &err)
+	path, data, stat, err := zkts.readSrvVSchema(ctx, cell)
 	if err != nil {
-		return nil, convertError(err)
+		return nil, 0, err
+	}
+	srvVSchema, err := unmarshalSrvVSchema(path, data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return srvVSchema, int64(stat.Version), nil
+}
+
+// GetSrvVSchemaInto is GetSrvVSchema, except that it decodes into dst
+// instead of allocating a new SrvVSchema, for the callers that read
+// it often. dst is reset before decoding: the entries of its
+// Keyspaces map are deleted, and the map is reused. dst is not
+// changed if the node cannot be read, but it may be partially filled
+// if the data cannot be decoded.
+func (zkts *Server) GetSrvVSchemaInto(ctx context.Context, cell string, dst *vschemapb.SrvVSchema) (err error) {
+	defer zkts.recordServingGraphStats("GetSrvVSchema", cell, "", time.Now(), &err)
+	path, data, _, err := zkts.readSrvVSchema(ctx, cell)
+	if err != nil {
+		return err
+	}
+	return unmarshalSrvVSchemaInto(path, data, dst)
+}
+
+// readSrvVSchema returns the path, contents and stat of the SrvVSchema
+// node of a cell. An empty node is reported as topo.ErrNoNode, not as
+// ErrEmptyNode, see ErrEmptyNode.
+func (zkts *Server) readSrvVSchema(ctx context.Context, cell string) (path, data string, stat *zookeeper.Stat, err error) {
+	path, err = zkPathForSrvVSchema(cell)
+	if err != nil {
+		return "", "", nil, err
+	}
+	err = zkts.retry(ctx, func() (err error) {
+		data, stat, err = zkts.zconn.Get(path)
+		return err
+	})
+	if err != nil {
+		return "", "", nil, convertError(err)
 	}
 	if len(data) == 0 {
-		return nil, topo.ErrNoNode
+		return "", "", nil, topo.ErrNoNode
+	}
+	return path, data, stat, nil
+}
+
+// ValidateSrvVSchemaConsistency checks the SrvVSchema of a cell and
+// its SrvKeyspaces match: every keyspace in the SrvVSchema has a
+// SrvKeyspace, and every SrvKeyspace is in the SrvVSchema. It returns
+// all the problems it finds.
+func (zkts *Server) ValidateSrvVSchemaConsistency(ctx context.Context, cell string) []error {
+	var errs []error
+	srvVSchema, err := zkts.GetSrvVSchema(ctx, cell)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("GetSrvVSchema(%v) failed: %v", cell, err))
+	}
+	keyspaces, err := zkts.GetSrvKeyspaceNames(ctx, cell)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("GetSrvKeyspaceNames(%v) failed: %v", cell, err))
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	serving := make(map[string]bool, len(keyspaces))
+	for _, keyspace := range keyspaces {
+		serving[keyspace] = true
+	}
+	vschemaKeyspaces := make([]string, 0, len(srvVSchema.Keyspaces))
+	for keyspace := range srvVSchema.Keyspaces {
+		vschemaKeyspaces = append(vschemaKeyspaces, keyspace)
+	}
+	sort.Strings(vschemaKeyspaces)
+	for _, keyspace := range vschemaKeyspaces {
+		if !serving[keyspace] {
+			errs = append(errs, fmt.Errorf("keyspace %v is in the SrvVSchema of cell %v but has no SrvKeyspace", keyspace, cell))
+		}
+	}
+	for _, keyspace := range keyspaces {
+		if _, ok := srvVSchema.Keyspaces[keyspace]; !ok {
+			errs = append(errs, fmt.Errorf("keyspace %v has a SrvKeyspace in cell %v but is not in the SrvVSchema", keyspace, cell))
+		}
 	}
+	return errs
+}
+
+// marshalSrvVSchema encodes a SrvVSchema for storage with codec,
+// compressed if -zk_compress_srv_vschema is set.
+func marshalSrvVSchema(srvVSchema *vschemapb.SrvVSchema, codec SrvGraphCodec) (string, error) {
+	return marshalNodeData(codec, srvVSchema, *compressSrvVSchema)
+}
+
+// unmarshalSrvVSchema decodes the contents of a SrvVSchema node,
+// compressed or not, written with any registered codec.
+func unmarshalSrvVSchema(path, data string) (*vschemapb.SrvVSchema, error) {
 	srvVSchema := &vschemapb.SrvVSchema{}
-	if err := json.Unmarshal([]byte(data), srvVSchema); err != nil {
-		return nil, fmt.Errorf("SrvVSchema unmarshal failed: %v %v", data, err)
+	if err := unmarshalSrvVSchemaInto(path, data, srvVSchema); err != nil {
+		return nil, err
 	}
 	return srvVSchema, nil
 }
+
+// unmarshalSrvVSchemaInto is unmarshalSrvVSchema, decoding into dst
+// after resetting it, for GetSrvVSchemaInto. The JSON codec would
+// otherwise merge the keyspaces into the existing ones.
+func unmarshalSrvVSchemaInto(path, data string, dst *vschemapb.SrvVSchema) error {
+	uncompressed, err := decompressNodeData(data)
+	if err != nil {
+		return newSrvGraphUnmarshalError(path, data, err)
+	}
+	for keyspace := range dst.Keyspaces {
+		delete(dst.Keyspaces, keyspace)
+	}
+	codec := srvGraphCodecForData(uncompressed)
+	if err := codec.Unmarshal([]byte(uncompressed[len(codec.Magic()):]), dst); err != nil {
+		return newSrvGraphUnmarshalError(path, uncompressed, err)
+	}
+	return nil
+}
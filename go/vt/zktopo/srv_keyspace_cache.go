@@ -0,0 +1,93 @@
+// Copyright 2016, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package zktopo
+
+import (
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	zookeeper "github.com/samuel/go-zookeeper/zk"
+	"golang.org/x/net/context"
+
+	topodatapb "github.com/youtube/vitess/go/vt/proto/topodata"
+)
+
+// srvKeyspaceCache caches the decoded SrvKeyspace of each node, with
+// the stat of the node it was read from. A cached value is used as
+// long as the node was not modified since, so it is never stale. This
+// is checked with the zxid of the last modification, Mzxid: a node
+// deleted and created again can have the same version.
+type srvKeyspaceCache struct {
+	mu      sync.Mutex
+	entries map[string]*srvKeyspaceCacheEntry
+}
+
+type srvKeyspaceCacheEntry struct {
+	srvKeyspace *topodatapb.SrvKeyspace
+	stat        *zookeeper.Stat
+}
+
+// EnableSrvKeyspaceCache makes GetSrvKeyspace and GetSrvKeyspaceWithStat
+// cache the decoded SrvKeyspaces. Each read then only checks the stat
+// of the node, and only downloads and decodes it again if it was
+// modified. The hits and misses are counted in the
+// ZkTopoSrvKeyspaceCache stats. It has to be called before the Server
+// is used.
+func (zkts *Server) EnableSrvKeyspaceCache() {
+	zkts.srvKeyspaceCache = &srvKeyspaceCache{
+		entries: make(map[string]*srvKeyspaceCacheEntry),
+	}
+}
+
+// get returns a copy of the SrvKeyspace at path, in cell, and the stat
+// of its node, reading and caching it if the node was modified since it
+// was cached.
+func (c *srvKeyspaceCache) get(ctx context.Context, zkts *Server, cell, path string) (*topodatapb.SrvKeyspace, *zookeeper.Stat, error) {
+	var stat *zookeeper.Stat
+	err := zkts.retry(ctx, func() (err error) {
+		stat, err = zkts.zconn.Exists(path)
+		return err
+	})
+	if err == nil && stat == nil {
+		err = zookeeper.ErrNoNode
+	}
+	if err != nil {
+		if err == zookeeper.ErrNoNode {
+			c.mu.Lock()
+			delete(c.entries, path)
+			c.mu.Unlock()
+		}
+		return nil, nil, convertError(err)
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[path]
+	c.mu.Unlock()
+	if ok && entry.stat.Mzxid == stat.Mzxid {
+		srvKeyspaceCacheStats.Add([]string{cell, "Hit"}, 1)
+		return proto.Clone(entry.srvKeyspace).(*topodatapb.SrvKeyspace), entry.stat, nil
+	}
+	srvKeyspaceCacheStats.Add([]string{cell, "Miss"}, 1)
+
+	var data string
+	err = zkts.retry(ctx, func() (err error) {
+		data, stat, err = zkts.zconn.Get(path)
+		return err
+	})
+	if err != nil {
+		return nil, nil, convertError(err)
+	}
+	srvKeyspace, err := unmarshalSrvKeyspace(path, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.mu.Lock()
+	c.entries[path] = &srvKeyspaceCacheEntry{
+		srvKeyspace: srvKeyspace,
+		stat:        stat,
+	}
+	c.mu.Unlock()
+	return proto.Clone(srvKeyspace).(*topodatapb.SrvKeyspace), stat, nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2016, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package zktopo
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/youtube/vitess/go/vt/concurrency"
+	"github.com/youtube/vitess/go/vt/key"
+	"github.com/youtube/vitess/go/vt/topo/topoproto"
+
+	topodatapb "github.com/youtube/vitess/go/vt/proto/topodata"
+)
+
+// tabletTypeList is used to sort tablet types.
+type tabletTypeList []topodatapb.TabletType
+
+func (l tabletTypeList) Len() int           { return len(l) }
+func (l tabletTypeList) Less(i, j int) bool { return l[i] < l[j] }
+func (l tabletTypeList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// DiffSrvKeyspace diffs two SrvKeyspaces, and returns the changes from
+// left to right: sharding column, partitions, their shards and key
+// ranges, and served-from entries.
+func DiffSrvKeyspace(left, right *topodatapb.SrvKeyspace) (result []string) {
+	er := concurrency.AllErrorRecorder{}
+	diffSrvKeyspace(left, right, &er)
+	if er.HasErrors() {
+		return er.ErrorStrings()
+	}
+	return nil
+}
+
+// diffSrvKeyspace records the differences between two SrvKeyspaces.
+func diffSrvKeyspace(left, right *topodatapb.SrvKeyspace, er concurrency.ErrorRecorder) {
+	if left.ShardingColumnName != right.ShardingColumnName {
+		er.RecordError(fmt.Errorf("sharding column name changed from %q to %q", left.ShardingColumnName, right.ShardingColumnName))
+	}
+	if left.ShardingColumnType != right.ShardingColumnType {
+		er.RecordError(fmt.Errorf("sharding column type changed from %v to %v", left.ShardingColumnType, right.ShardingColumnType))
+	}
+
+	var servedTypes tabletTypeList
+	seen := make(map[topodatapb.TabletType]bool)
+	for _, srvKeyspace := range []*topodatapb.SrvKeyspace{left, right} {
+		for _, partition := range srvKeyspace.Partitions {
+			if !seen[partition.ServedType] {
+				seen[partition.ServedType] = true
+				servedTypes = append(servedTypes, partition.ServedType)
+			}
+		}
+	}
+	sort.Sort(servedTypes)
+	for _, servedType := range servedTypes {
+		leftPartition := topoproto.SrvKeyspaceGetPartition(left, servedType)
+		rightPartition := topoproto.SrvKeyspaceGetPartition(right, servedType)
+		switch {
+		case leftPartition == nil:
+			er.RecordError(fmt.Errorf("partition for %v added", servedType))
+		case rightPartition == nil:
+			er.RecordError(fmt.Errorf("partition for %v removed", servedType))
+		default:
+			diffShardReferences(servedType, leftPartition.ShardReferences, rightPartition.ShardReferences, er)
+		}
+	}
+
+	leftServedFrom := make(map[topodatapb.TabletType]string)
+	for _, servedFrom := range left.ServedFrom {
+		leftServedFrom[servedFrom.TabletType] = servedFrom.Keyspace
+	}
+	rightServedFrom := make(map[topodatapb.TabletType]string)
+	for _, servedFrom := range right.ServedFrom {
+		rightServedFrom[servedFrom.TabletType] = servedFrom.Keyspace
+	}
+	var servedFromTypes tabletTypeList
+	for tabletType := range leftServedFrom {
+		servedFromTypes = append(servedFromTypes, tabletType)
+	}
+	for tabletType := range rightServedFrom {
+		if _, ok := leftServedFrom[tabletType]; !ok {
+			servedFromTypes = append(servedFromTypes, tabletType)
+		}
+	}
+	sort.Sort(servedFromTypes)
+	for _, tabletType := range servedFromTypes {
+		leftKeyspace, leftOk := leftServedFrom[tabletType]
+		rightKeyspace, rightOk := rightServedFrom[tabletType]
+		switch {
+		case !leftOk:
+			er.RecordError(fmt.Errorf("%v added a served from %v", tabletType, rightKeyspace))
+		case !rightOk:
+			er.RecordError(fmt.Errorf("%v removed its served from %v", tabletType, leftKeyspace))
+		case leftKeyspace != rightKeyspace:
+			er.RecordError(fmt.Errorf("%v served from changed from %v to %v", tabletType, leftKeyspace, rightKeyspace))
+		}
+	}
+}
+
+// diffShardReferences records the changes in the shards of a partition.
+func diffShardReferences(servedType topodatapb.TabletType, left, right []*topodatapb.ShardReference, er concurrency.ErrorRecorder) {
+	rightByName := make(map[string]*topodatapb.ShardReference, len(right))
+	for _, shardReference := range right {
+		rightByName[shardReference.Name] = shardReference
+	}
+	leftByName := make(map[string]*topodatapb.ShardReference, len(left))
+	for _, leftShard := range left {
+		leftByName[leftShard.Name] = leftShard
+		rightShard, ok := rightByName[leftShard.Name]
+		if !ok {
+			er.RecordError(fmt.Errorf("partition for %v: shard %v removed", servedType, leftShard.Name))
+			continue
+		}
+		if !key.KeyRangeEqual(leftShard.KeyRange, rightShard.KeyRange) {
+			er.RecordError(fmt.Errorf("partition for %v: shard %v KeyRange changed from %v to %v", servedType, leftShard.Name, key.KeyRangeString(leftShard.KeyRange), key.KeyRangeString(rightShard.KeyRange)))
+		}
+	}
+	for _, rightShard := range right {
+		if _, ok := leftByName[rightShard.Name]; !ok {
+			er.RecordError(fmt.Errorf("partition for %v: shard %v added", servedType, rightShard.Name))
+		}
+	}
+}
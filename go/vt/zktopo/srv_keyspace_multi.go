@@ -0,0 +1,154 @@
+// Copyright 2016, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package zktopo
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	zookeeper "github.com/samuel/go-zookeeper/zk"
+	"golang.org/x/net/context"
+
+	"github.com/youtube/vitess/go/zk"
+
+	topodatapb "github.com/youtube/vitess/go/vt/proto/topodata"
+)
+
+// PartialUpdateError is returned by UpdateSrvKeyspacesMulti when the
+// connection doesn't support multi operations, and one of the
+// SrvKeyspaces written one by one could not be stored.
+type PartialUpdateError struct {
+	// Cell is the cell of the update.
+	Cell string
+
+	// Updated are the keyspaces that were written before the
+	// failure, in order. If it is empty, nothing was changed.
+	Updated []string
+
+	// Failed is the keyspace that could not be written, with Err.
+	Failed string
+	Err    error
+
+	// NotAttempted are the keyspaces after Failed, left unchanged.
+	NotAttempted []string
+}
+
+// Error is part of the error interface.
+func (e *PartialUpdateError) Error() string {
+	return fmt.Sprintf("partial SrvKeyspace update in cell %v: updated %v, failed to update %v: %v, not attempted %v", e.Cell, e.Updated, e.Failed, e.Err, e.NotAttempted)
+}
+
+// UpdateSrvKeyspacesMulti stores the SrvKeyspaces of several keyspaces
+// of a cell, as close to atomically as possible. They are all
+// validated and marshaled first, and nothing is written if one is
+// invalid. If the connection supports multi operations, they are
+// written in a single transaction: they are all changed, or none is.
+// If another writer changed one of the nodes since it was read, the
+// transaction fails with topo.ErrBadVersion or topo.ErrNodeExists.
+// The directory of the SrvKeyspaces is created before the transaction
+// if needed, and is not part of it.
+// Otherwise they are written one by one in keyspace order, stopping
+// at the first failure, which is returned as a *PartialUpdateError.
+func (zkts *Server) UpdateSrvKeyspacesMulti(ctx context.Context, cell string, updates map[string]*topodatapb.SrvKeyspace) (err error) {
+	defer zkts.recordServingGraphStats("UpdateSrvKeyspacesMulti", cell, "", time.Now(), &err)
+	keyspaces := make([]string, 0, len(updates))
+	for keyspace := range updates {
+		keyspaces = append(keyspaces, keyspace)
+	}
+	sort.Strings(keyspaces)
+
+	paths := make([]string, len(keyspaces))
+	datas := make([]string, len(keyspaces))
+	for i, keyspace := range keyspaces {
+		if err := ValidateSrvKeyspace(updates[keyspace]); err != nil {
+			return fmt.Errorf("invalid SrvKeyspace for %v in cell %v: %v", keyspace, cell, err)
+		}
+		paths[i], err = zkPathForSrvKeyspace(cell, keyspace)
+		if err != nil {
+			return err
+		}
+		datas[i], err = marshalSrvKeyspace(updates[keyspace], false, zkts.codec())
+		if err != nil {
+			return err
+		}
+	}
+
+	multiConn, ok := zkts.zconn.(zk.MultiConn)
+	if !ok {
+		return zkts.updateSrvKeyspacesSequential(ctx, cell, keyspaces, datas)
+	}
+	err = zkts.retry(ctx, func() error {
+		return zkts.writeSrvKeyspacesMulti(ctx, multiConn, cell, paths, datas)
+	})
+	return convertError(err)
+}
+
+// writeSrvKeyspacesMulti writes marshaled SrvKeyspaces in a single
+// multi transaction. The nodes that already have their data are left
+// out. The others are set at the version that was read, or created,
+// so a concurrent change makes the whole transaction fail.
+func (zkts *Server) writeSrvKeyspacesMulti(ctx context.Context, multiConn zk.MultiConn, cell string, paths, datas []string) error {
+	acl := zkts.servingGraphACL()
+	var ops []interface{}
+	for i, path := range paths {
+		existing, stat, err := zkts.zconn.Get(path)
+		switch err {
+		case nil:
+			if existing != datas[i] {
+				ops = append(ops, &zookeeper.SetDataRequest{Path: path, Data: []byte(datas[i]), Version: stat.Version})
+			}
+		case zookeeper.ErrNoNode:
+			ops = append(ops, &zookeeper.CreateRequest{Path: path, Data: []byte(datas[i]), Acl: acl})
+		default:
+			return err
+		}
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+
+	// The keyspaces directory and its parents are created first if
+	// needed, outside of the transaction: this step is not atomic,
+	// and they stay if the transaction then fails. They are empty,
+	// so this doesn't change what readers see.
+	keyspacesPath, err := zkPathForSrvKeyspaces(cell)
+	if err != nil {
+		return err
+	}
+	dirACL := make([]zookeeper.ACL, len(acl))
+	for i, a := range acl {
+		dirACL[i] = a
+		dirACL[i].Perms = zk.PermDirectory
+	}
+	err = runWithContext(ctx, func() error {
+		_, err := zk.CreateRecursive(zkts.zconn, keyspacesPath, "", 0, dirACL)
+		return err
+	})
+	if err != nil && err != zookeeper.ErrNodeExists {
+		return err
+	}
+
+	_, err = multiConn.Multi(ops...)
+	return err
+}
+
+// updateSrvKeyspacesSequential writes marshaled SrvKeyspaces one by
+// one, for UpdateSrvKeyspacesMulti when the connection doesn't support
+// multi operations.
+func (zkts *Server) updateSrvKeyspacesSequential(ctx context.Context, cell string, keyspaces, datas []string) error {
+	for i, keyspace := range keyspaces {
+		if err := zkts.updateSrvKeyspaceData(ctx, cell, keyspace, datas[i]); err != nil {
+			return &PartialUpdateError{
+				Cell:         cell,
+				Updated:      keyspaces[:i],
+				Failed:       keyspace,
+				Err:          err,
+				NotAttempted: keyspaces[i+1:],
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2016, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package zktopo
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	zookeeper "github.com/samuel/go-zookeeper/zk"
+	"golang.org/x/net/context"
+)
+
+// srvKeyspaceNamesCache caches the result of GetSrvKeyspaceNames per
+// cell. An entry is dropped when it is older than ttl, or when the
+// children watch of its cell fires. There is at most one watch per
+// cell: the refills done while it is set don't set another one.
+type srvKeyspaceNamesCache struct {
+	ttl time.Duration
+
+	mu       sync.Mutex
+	entries  map[string]*srvKeyspaceNamesEntry
+	watching map[string]bool
+}
+
+type srvKeyspaceNamesEntry struct {
+	names   []string
+	expires time.Time
+}
+
+// EnableSrvKeyspaceNamesCache makes GetSrvKeyspaceNames cache its
+// results for at most ttl. Use GetSrvKeyspaceNamesUncached to bypass
+// the cache. It has to be called before the Server is used.
+func (zkts *Server) EnableSrvKeyspaceNamesCache(ttl time.Duration) {
+	zkts.srvKeyspaceNamesCache = &srvKeyspaceNamesCache{
+		ttl:      ttl,
+		entries:  make(map[string]*srvKeyspaceNamesEntry),
+		watching: make(map[string]bool),
+	}
+}
+
+// get returns a copy of the cached names for cell, reading and caching
+// them if necessary.
+func (c *srvKeyspaceNamesCache) get(ctx context.Context, zkts *Server, cell string) (_ []string, err error) {
+	c.mu.Lock()
+	entry, ok := c.entries[cell]
+	watching := c.watching[cell]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return copyNames(entry.names), nil
+	}
+
+	defer zkts.recordServingGraphStats("GetSrvKeyspaceNames", cell, "", time.Now(), &err)
+	path, err := zkPathForSrvKeyspaces(cell)
+	if err != nil {
+		return nil, err
+	}
+	var children []string
+	var watch <-chan zookeeper.Event
+	err = zkts.retry(ctx, func() (err error) {
+		if watching {
+			children, _, err = zkts.zconn.Children(path)
+			return err
+		}
+		children, _, watch, err = zkts.zconn.ChildrenW(path)
+		return err
+	})
+	switch err {
+	case nil:
+		sort.Strings(children)
+	case zookeeper.ErrNoNode:
+		// There is nothing to watch, the entry only expires.
+		children = nil
+	default:
+		return nil, convertError(err)
+	}
+
+	entry = &srvKeyspaceNamesEntry{
+		names:   children,
+		expires: time.Now().Add(c.ttl),
+	}
+	c.mu.Lock()
+	c.entries[cell] = entry
+	if watch != nil {
+		// Concurrent refills may each have set a watch, they
+		// all fire on the next change.
+		c.watching[cell] = true
+	}
+	c.mu.Unlock()
+	if watch != nil {
+		go func() {
+			<-watch
+			c.invalidate(cell)
+		}()
+	}
+	return copyNames(children), nil
+}
+
+// invalidate removes the entry for cell, when its watch fires. The
+// next read sets a new watch.
+func (c *srvKeyspaceNamesCache) invalidate(cell string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, cell)
+	delete(c.watching, cell)
+}
+
+// copyNames returns a copy of names, so callers can't change the
+// cached version.
+func copyNames(names []string) []string {
+	if names == nil {
+		return nil
+	}
+	result := make([]string, len(names))
+	copy(result, names)
+	return result
+}
@@ -0,0 +1,63 @@
+// Copyright 2016, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package zktopo
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	topodatapb "github.com/youtube/vitess/go/vt/proto/topodata"
+)
+
+// srvKeyspaceStaleCache caches the SrvKeyspaces read by
+// GetSrvKeyspaceCached, with the time they were read. Its zero value
+// is an empty cache.
+type srvKeyspaceStaleCache struct {
+	mu      sync.Mutex
+	entries map[string]*srvKeyspaceStaleEntry
+}
+
+type srvKeyspaceStaleEntry struct {
+	srvKeyspace *topodatapb.SrvKeyspace
+	readTime    time.Time
+}
+
+// GetSrvKeyspaceCached is GetSrvKeyspace, but returns the value it
+// read last time for the same cell and keyspace if it was read less
+// than maxStaleness ago, instead of reading it again. It is meant for
+// the callers that can use slightly stale routing data to put less
+// load on zookeeper. Errors are not cached. The hits and misses are
+// counted in the ZkTopoSrvKeyspaceStaleCache stats.
+func (zkts *Server) GetSrvKeyspaceCached(ctx context.Context, cell, keyspace string, maxStaleness time.Duration) (*topodatapb.SrvKeyspace, error) {
+	c := &zkts.srvKeyspaceStaleCache
+	key := cell + "/" + keyspace
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && time.Since(entry.readTime) < maxStaleness {
+		srvKeyspaceStaleCacheStats.Add([]string{cell, "Hit"}, 1)
+		return proto.Clone(entry.srvKeyspace).(*topodatapb.SrvKeyspace), nil
+	}
+	srvKeyspaceStaleCacheStats.Add([]string{cell, "Miss"}, 1)
+
+	readTime := time.Now()
+	srvKeyspace, err := zkts.GetSrvKeyspace(ctx, cell, keyspace)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.entries == nil {
+		c.entries = make(map[string]*srvKeyspaceStaleEntry)
+	}
+	c.entries[key] = &srvKeyspaceStaleEntry{
+		srvKeyspace: proto.Clone(srvKeyspace).(*topodatapb.SrvKeyspace),
+		readTime:    readTime,
+	}
+	c.mu.Unlock()
+	return srvKeyspace, nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2016, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package zktopo
+
+import (
+	"time"
+
+	"github.com/youtube/vitess/go/stats"
+)
+
+var (
+	// servingGraphTimings has the count and latency histogram
+	// of the serving graph operations.
+	servingGraphTimings = stats.NewMultiTimings("ZkTopoServingGraph", []string{"Operation", "Cell"})
+
+	// servingGraphErrors counts the failed serving graph operations.
+	servingGraphErrors = stats.NewMultiCounters("ZkTopoServingGraphErrors", []string{"Operation", "Cell", "Category"})
+
+	// srvKeyspaceCacheStats counts the hits and misses of the
+	// SrvKeyspace cache, see EnableSrvKeyspaceCache.
+	srvKeyspaceCacheStats = stats.NewMultiCounters("ZkTopoSrvKeyspaceCache", []string{"Cell", "Result"})
+
+	// srvKeyspaceStaleCacheStats counts the hits and misses of
+	// GetSrvKeyspaceCached.
+	srvKeyspaceStaleCacheStats = stats.NewMultiCounters("ZkTopoSrvKeyspaceStaleCache", []string{"Cell", "Result"})
+)
+
+// errorCategory returns the category of an error returned by
+// convertError, for servingGraphErrors.
+func errorCategory(err error) string {
+	return ClassifyTopoError(err).String()
+}
+
+// recordServingGraphStats records the outcome of a serving graph
+// operation, and passes it to the Logger if there is one. keyspace is
+// "" for the operations on a whole cell. It is meant to be deferred,
+// with a pointer to the returned error.
+func (zkts *Server) recordServingGraphStats(operation, cell, keyspace string, startTime time.Time, err *error) {
+	servingGraphTimings.Record([]string{operation, cell}, startTime)
+	if *err != nil {
+		servingGraphErrors.Add([]string{operation, cell, errorCategory(*err)}, 1)
+	}
+	if zkts.logger != nil {
+		zkts.logger.LogServingGraphOperation(&ServingGraphOperation{
+			Operation: operation,
+			Cell:      cell,
+			Keyspace:  keyspace,
+			Duration:  time.Since(startTime),
+			Err:       *err,
+		})
+	}
+}
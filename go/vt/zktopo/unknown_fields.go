@@ -0,0 +1,120 @@
+// Copyright 2016, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package zktopo
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+var (
+	strictSrvKeyspace = flag.Bool("zk_strict_srv_keyspace", false, "fail reading SrvKeyspace nodes that contain fields this binary doesn't know about, instead of ignoring them. Useful to catch version skew during upgrades.")
+)
+
+// checkUnknownFields returns an error if the JSON object in data has
+// fields that json.Unmarshal would ignore when decoding into a value
+// of type t.
+func checkUnknownFields(data []byte, t reflect.Type) error {
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return err
+	}
+	return checkValueFields("", generic, t)
+}
+
+// checkValueFields is the recursive part of checkUnknownFields. path
+// is the location of v in the object, for error messages.
+func checkValueFields(path string, v interface{}, t reflect.Type) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		fields := jsonFields(t)
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fieldType, ok := fields[key]
+			if !ok {
+				// json.Unmarshal also accepts case insensitive matches.
+				for name, ft := range fields {
+					if strings.EqualFold(name, key) {
+						fieldType, ok = ft, true
+						break
+					}
+				}
+			}
+			if !ok {
+				return fmt.Errorf("unknown field %v", joinFieldPath(path, key))
+			}
+			if err := checkValueFields(joinFieldPath(path, key), obj[key], fieldType); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		arr, ok := v.([]interface{})
+		if !ok {
+			// []byte is encoded as a string
+			return nil
+		}
+		for i, e := range arr {
+			if err := checkValueFields(fmt.Sprintf("%v[%v]", path, i), e, t.Elem()); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for key, e := range obj {
+			if err := checkValueFields(fmt.Sprintf("%v[%v]", path, key), e, t.Elem()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// jsonFields returns the JSON names of the fields of a struct type,
+// and their types.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	result := make(map[string]reflect.Type, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if name == "" {
+			name = f.Name
+		}
+		result[name] = f.Type
+	}
+	return result
+}
+
+func joinFieldPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -2,8 +2,11 @@ package zktopo
 
 import (
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
+	log "github.com/golang/glog"
 	zookeeper "github.com/samuel/go-zookeeper/zk"
 	"golang.org/x/net/context"
 
@@ -25,8 +28,10 @@ func newWatchData(valueType dataType, data string, stats *zookeeper.Stat) *topo.
 // Watch is part of the topo.Backend interface
 func (zkts *Server) Watch(ctx context.Context, cell, filePath string) (*topo.WatchData, <-chan *topo.WatchData, topo.CancelFunc) {
 	// Special paths where we need to be backward compatible.
-	var valueType dataType
-	valueType, filePath = oldTypeAndFilePath(cell, filePath)
+	valueType, filePath, err := oldTypeAndFilePath(cell, filePath)
+	if err != nil {
+		return &topo.WatchData{Err: err}, nil, nil
+	}
 
 	// Get the initial value, set the initial watch
 	data, stats, watch, err := zkts.zconn.GetW(filePath)
@@ -101,3 +106,403 @@ func (zkts *Server) Watch(ctx context.Context, cell, filePath string) (*topo.Wat
 
 	return wd, c, cancel
 }
+
+// nodeWatchData is sent by watchNode for each new value of a node.
+// Exactly one of data or err is set.
+type nodeWatchData struct {
+	data string
+	err  error
+}
+
+// watchNode watches the contents of a serving graph node. Unlike
+// Watch, it doesn't stop when the node (or its parent) doesn't exist:
+// it then sends topo.ErrNoNode once, and polls every
+// WatchSleepDuration until the node is created. When the session
+// expires, it sends ErrSessionExpired, and reads the node again,
+// polling while the connection is not back. Any other error is
+// final: it is sent, and the channel is closed. If the initial read
+// fails with an error other than topo.ErrNoNode, the returned channel
+// and cancel function are nil.
+//
+// Each value is read with GetW, which reads the node and sets the
+// next watch in a single operation, so no change can happen between
+// them: a change made right after a read is always sent, and is sent
+// once. Changes made while the previous one is being read may be sent
+// as a single value, the latest one. A value is not sent again if the
+// node wasn't modified, except after the session expires. This is
+// checked with the zxid of the last modification, Mzxid, not with the
+// version, so a node deleted and created again with the same version
+// is sent.
+func (zkts *Server) watchNode(ctx context.Context, filePath string) (*nodeWatchData, <-chan *nodeWatchData, topo.CancelFunc) {
+	data, stat, watch, err := zkts.zconn.GetW(filePath)
+	var current *nodeWatchData
+	var mzxid int64
+	switch err {
+	case nil:
+		current = &nodeWatchData{data: data}
+		mzxid = stat.Mzxid
+	case zookeeper.ErrNoNode:
+		current = &nodeWatchData{err: topo.ErrNoNode}
+		watch = nil
+	default:
+		return &nodeWatchData{err: convertError(err)}, nil, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	c := make(chan *nodeWatchData, 10)
+	go func() {
+		defer close(c)
+
+		missing := watch == nil
+		resubscribing := false
+		for {
+			if watch == nil {
+				// The node doesn't exist, poll for it.
+				select {
+				case <-time.After(NextWatchSleepDuration()):
+				case <-ctx.Done():
+					c <- &nodeWatchData{err: topo.ErrInterrupted}
+					return
+				}
+			} else {
+				// Act on the watch, or on ctx being done.
+				select {
+				case event, ok := <-watch:
+					if !ok {
+						c <- &nodeWatchData{err: fmt.Errorf("watch on %v was closed", filePath)}
+						return
+					}
+					if isSessionExpiredEvent(event) {
+						c <- &nodeWatchData{err: ErrSessionExpired}
+						resubscribing = true
+						break
+					}
+					if event.Err != nil {
+						c <- &nodeWatchData{err: fmt.Errorf("received a non-OK event for %v: %v", filePath, event.Err)}
+						return
+					}
+				case <-ctx.Done():
+					c <- &nodeWatchData{err: topo.ErrInterrupted}
+					return
+				}
+			}
+
+			// Get the value again, and set the next watch.
+			data, stat, watch, err = zkts.zconn.GetW(filePath)
+			switch {
+			case err == nil:
+				if !missing && !resubscribing && stat.Mzxid == mzxid {
+					// The watch fired, but the node didn't change.
+					continue
+				}
+				c <- &nodeWatchData{data: data}
+				mzxid = stat.Mzxid
+				missing = false
+				resubscribing = false
+			case err == zookeeper.ErrNoNode:
+				watch = nil
+				if !missing || resubscribing {
+					c <- &nodeWatchData{err: topo.ErrNoNode}
+					missing = true
+				}
+				resubscribing = false
+			case resubscribing && isReconnectingError(err):
+				// The new session is not there yet, try again.
+				watch = nil
+			default:
+				c <- &nodeWatchData{err: convertError(err)}
+				return
+			}
+		}
+	}()
+
+	return current, c, topo.CancelFunc(cancel)
+}
+
+// WatchSrvKeyspace sets a watch on the SrvKeyspace of a keyspace in a
+// cell. It returns the current value, and a channel on which each new
+// value is sent. When the node doesn't exist (initially, or after it
+// is deleted), topo.ErrNoNode is returned or sent, and the watch polls
+// every WatchSleepDuration until the node is created. Any other error
+// is final: it is sent, and the channel is closed. If the initial read
+// fails with an error other than topo.ErrNoNode, the returned channel
+// and cancel function are nil. When the zookeeper session expires,
+// ErrSessionExpired is sent, followed by the current value once the
+// watch is set again. Calling cancel, or canceling ctx, sends
+// topo.ErrInterrupted and closes the channel. If the channel is full
+// by then, the values that don't fit, topo.ErrInterrupted included,
+// are dropped, so a consumer can stop reading after calling cancel.
+//
+// The initial value is read along with setting the watch, so a change
+// made right after it is read is sent exactly once on the channel,
+// see watchNode.
+func (zkts *Server) WatchSrvKeyspace(ctx context.Context, cell, keyspace string) (*topo.WatchSrvKeyspaceData, <-chan *topo.WatchSrvKeyspaceData, topo.CancelFunc) {
+	path, err := zkPathForSrvKeyspace(cell, keyspace)
+	if err != nil {
+		return &topo.WatchSrvKeyspaceData{Err: err}, nil, nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	current, wdChannel, watchCancel := zkts.watchNode(ctx, path)
+	if wdChannel == nil {
+		cancel()
+		return &topo.WatchSrvKeyspaceData{Err: current.err}, nil, nil
+	}
+
+	// toWatchData translates a node value. It returns true if the
+	// error is final.
+	toWatchData := func(wd *nodeWatchData) (*topo.WatchSrvKeyspaceData, bool) {
+		if wd.err != nil {
+			return &topo.WatchSrvKeyspaceData{Err: wd.err}, false
+		}
+		value, err := unmarshalSrvKeyspace(path, wd.data)
+		if err != nil {
+			return &topo.WatchSrvKeyspaceData{Err: err}, err != ErrEmptyNode
+		}
+		return &topo.WatchSrvKeyspaceData{Value: value}, false
+	}
+
+	initial, final := toWatchData(current)
+	if final {
+		// Cancel the watch, drain channel.
+		cancel()
+		for range wdChannel {
+		}
+		return initial, nil, nil
+	}
+
+	changes := make(chan *topo.WatchSrvKeyspaceData, 10)
+	go func() {
+		defer close(changes)
+
+		// send sends a value, unless the channel is full and ctx
+		// is done: the consumer may have stopped reading.
+		send := func(value *topo.WatchSrvKeyspaceData) bool {
+			select {
+			case changes <- value:
+				return true
+			default:
+			}
+			select {
+			case changes <- value:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		// A final error from watchNode is followed by the
+		// channel being closed, so we just propagate it.
+		for wd := range wdChannel {
+			value, final := toWatchData(wd)
+			if final {
+				watchCancel()
+				for range wdChannel {
+				}
+				send(value)
+				return
+			}
+			if !send(value) {
+				for range wdChannel {
+				}
+				return
+			}
+		}
+	}()
+
+	return initial, changes, topo.CancelFunc(cancel)
+}
+
+// WatchSrvVSchema sets a watch on the SrvVSchema of a cell. It behaves
+// like WatchSrvKeyspace, an empty node being reported as
+// topo.ErrNoNode, like GetSrvVSchema does.
+func (zkts *Server) WatchSrvVSchema(ctx context.Context, cell string) (*topo.WatchSrvVSchemaData, <-chan *topo.WatchSrvVSchemaData, topo.CancelFunc) {
+	path, err := zkPathForSrvVSchema(cell)
+	if err != nil {
+		return &topo.WatchSrvVSchemaData{Err: err}, nil, nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	current, wdChannel, watchCancel := zkts.watchNode(ctx, path)
+	if wdChannel == nil {
+		cancel()
+		return &topo.WatchSrvVSchemaData{Err: current.err}, nil, nil
+	}
+
+	// toWatchData translates a node value. It returns true if the
+	// error is final.
+	toWatchData := func(wd *nodeWatchData) (*topo.WatchSrvVSchemaData, bool) {
+		if wd.err != nil {
+			return &topo.WatchSrvVSchemaData{Err: wd.err}, false
+		}
+		if len(wd.data) == 0 {
+			return &topo.WatchSrvVSchemaData{Err: topo.ErrNoNode}, false
+		}
+		value, err := unmarshalSrvVSchema(path, wd.data)
+		if err != nil {
+			return &topo.WatchSrvVSchemaData{Err: err}, true
+		}
+		return &topo.WatchSrvVSchemaData{Value: value}, false
+	}
+
+	initial, final := toWatchData(current)
+	if final {
+		// Cancel the watch, drain channel.
+		cancel()
+		for range wdChannel {
+		}
+		return initial, nil, nil
+	}
+
+	changes := make(chan *topo.WatchSrvVSchemaData, 10)
+	go func() {
+		defer close(changes)
+
+		// send sends a value, unless the channel is full and ctx
+		// is done: the consumer may have stopped reading.
+		send := func(value *topo.WatchSrvVSchemaData) bool {
+			select {
+			case changes <- value:
+				return true
+			default:
+			}
+			select {
+			case changes <- value:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		// A final error from watchNode is followed by the
+		// channel being closed, so we just propagate it.
+		for wd := range wdChannel {
+			value, final := toWatchData(wd)
+			if final {
+				watchCancel()
+				for range wdChannel {
+				}
+				send(value)
+				return
+			}
+			if !send(value) {
+				for range wdChannel {
+				}
+				return
+			}
+		}
+	}()
+
+	return initial, changes, topo.CancelFunc(cancel)
+}
+
+// WatchSrvKeyspaceNames watches the names of the keyspaces that have a
+// SrvKeyspace in a cell. It returns the current sorted names, and a
+// channel that receives the new sorted names each time they change.
+// While the cell has no SrvKeyspace, the names are empty and the watch
+// polls every WatchSleepDuration. After the session expires, the watch
+// subscribes again, and sends the names even if they didn't change, so
+// consumers can reset what they cached. The channel is closed when cancel is
+// called or ctx is done, or after an error, which is logged. If the
+// initial read fails with an error other than topo.ErrNoNode, it is
+// returned, and the channel and cancel function are nil.
+func (zkts *Server) WatchSrvKeyspaceNames(ctx context.Context, cell string) ([]string, <-chan []string, topo.CancelFunc, error) {
+	path, err := zkPathForSrvKeyspaces(cell)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// list returns the sorted children of path, and the watch on
+	// them, which is nil if path doesn't exist.
+	list := func() ([]string, <-chan zookeeper.Event, error) {
+		children, _, watch, err := zkts.zconn.ChildrenW(path)
+		switch err {
+		case nil:
+			sort.Strings(children)
+			return children, watch, nil
+		case zookeeper.ErrNoNode:
+			return nil, nil, nil
+		default:
+			return nil, nil, err
+		}
+	}
+
+	current, watch, err := list()
+	if err != nil {
+		return nil, nil, nil, convertError(err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	changes := make(chan []string, 10)
+	go func(last []string) {
+		defer close(changes)
+
+		resubscribing := false
+		for {
+			if watch == nil {
+				// The directory doesn't exist, poll for it.
+				select {
+				case <-time.After(NextWatchSleepDuration()):
+				case <-ctx.Done():
+					return
+				}
+			} else {
+				// Act on the watch, or on ctx being done.
+				select {
+				case event, ok := <-watch:
+					if !ok {
+						log.Warningf("watch on %v was closed", path)
+						return
+					}
+					if isSessionExpiredEvent(event) {
+						log.Infof("session expired while watching %v, resubscribing", path)
+						resubscribing = true
+						break
+					}
+					if event.Err != nil {
+						log.Warningf("received a non-OK event for %v: %v", path, event.Err)
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			// List the names again, and set the next watch.
+			names, nextWatch, err := list()
+			watch = nextWatch
+			if err != nil {
+				if resubscribing && isReconnectingError(err) {
+					// The new session is not there yet, try again.
+					continue
+				}
+				log.Warningf("cannot list %v: %v", path, err)
+				return
+			}
+			if namesEqual(names, last) && !resubscribing {
+				continue
+			}
+			select {
+			case changes <- names:
+				last = names
+				resubscribing = false
+			case <-ctx.Done():
+				return
+			}
+		}
+	}(current)
+
+	return current, changes, topo.CancelFunc(cancel), nil
+}
+
+// namesEqual returns true if both lists have the same names in the
+// same order. A nil list and an empty list are equal.
+func namesEqual(left, right []string) bool {
+	if len(left) != len(right) {
+		return false
+	}
+	for i := range left {
+		if left[i] != right[i] {
+			return false
+		}
+	}
+	return true
+}
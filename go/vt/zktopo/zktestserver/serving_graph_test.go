@@ -0,0 +1,3529 @@
+package zktestserver
+
+import (
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	zookeeper "github.com/samuel/go-zookeeper/zk"
+	"golang.org/x/net/context"
+
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/zktopo"
+	"github.com/youtube/vitess/go/zk"
+	"github.com/youtube/vitess/go/zk/fakezk"
+
+	topodatapb "github.com/youtube/vitess/go/vt/proto/topodata"
+	vschemapb "github.com/youtube/vitess/go/vt/proto/vschema"
+)
+
+// TestGetSrvKeyspaceEmptyNode is a ZK specific unit test
+func TestGetSrvKeyspaceEmptyNode(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	if _, err := zkts.GetSrvKeyspace(ctx, "test", "test_keyspace"); err != topo.ErrNoNode {
+		t.Errorf("GetSrvKeyspace(missing) = %v, want ErrNoNode", err)
+	}
+
+	if _, err := zk.CreateRecursive(zkts.GetZConn(), "/zk/test/vt/ns/test_keyspace", "", 0, zookeeper.WorldACL(zookeeper.PermAll)); err != nil {
+		t.Fatalf("CreateRecursive: %v", err)
+	}
+	if _, err := zkts.GetSrvKeyspace(ctx, "test", "test_keyspace"); err != zktopo.ErrEmptyNode {
+		t.Errorf("GetSrvKeyspace(empty) = %v, want ErrEmptyNode", err)
+	}
+}
+
+// TestWatchSrvKeyspace is a ZK specific unit test
+func TestWatchSrvKeyspace(t *testing.T) {
+	zktopo.WatchSleepDuration = 2 * time.Millisecond
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	// watching a missing node polls for it
+	current, changes, cancel := zkts.WatchSrvKeyspace(ctx, "test", "test_keyspace")
+	if current.Err != topo.ErrNoNode || changes == nil {
+		t.Fatalf("WatchSrvKeyspace(missing) = %v %v", current, changes)
+	}
+	srvKeyspace := &topodatapb.SrvKeyspace{ShardingColumnName: "col1"}
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	if wd := <-changes; wd.Err != nil || !proto.Equal(wd.Value, srvKeyspace) {
+		t.Fatalf("unexpected first change: %v", wd)
+	}
+
+	// updates are sent
+	srvKeyspace.ShardingColumnName = "col2"
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	if wd := <-changes; wd.Err != nil || !proto.Equal(wd.Value, srvKeyspace) {
+		t.Fatalf("unexpected second change: %v", wd)
+	}
+
+	// deleting the node sends ErrNoNode, and recreating it works
+	if err := zkts.DeleteSrvKeyspace(ctx, "test", "test_keyspace"); err != nil {
+		t.Fatalf("DeleteSrvKeyspace: %v", err)
+	}
+	if wd := <-changes; wd.Err != topo.ErrNoNode {
+		t.Fatalf("unexpected change after delete: %v", wd)
+	}
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	if wd := <-changes; wd.Err != nil || !proto.Equal(wd.Value, srvKeyspace) {
+		t.Fatalf("unexpected change after re-create: %v", wd)
+	}
+
+	// cancel sends ErrInterrupted and closes the channel
+	cancel()
+	if wd := <-changes; wd.Err != topo.ErrInterrupted {
+		t.Fatalf("unexpected change after cancel: %v", wd)
+	}
+	if wd, ok := <-changes; ok {
+		t.Fatalf("channel not closed after cancel: %v", wd)
+	}
+
+	// a corrupted initial value is a final error
+	if _, err := zkts.GetZConn().Set("/zk/test/vt/ns/test_keyspace", "not json", -1); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if current, changes, _ := zkts.WatchSrvKeyspace(ctx, "test", "test_keyspace"); current.Err == nil || changes != nil {
+		t.Fatalf("WatchSrvKeyspace(corrupted) = %v %v", current, changes)
+	}
+}
+
+// TestSrvVSchemaCompression is a ZK specific unit test
+func TestSrvVSchemaCompression(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	srvVSchema := &vschemapb.SrvVSchema{
+		Keyspaces: map[string]*vschemapb.Keyspace{
+			"test_keyspace": {Sharded: true},
+		},
+	}
+
+	// uncompressed data is stored as JSON
+	if err := zkts.UpdateSrvVSchema(ctx, "test", srvVSchema); err != nil {
+		t.Fatalf("UpdateSrvVSchema: %v", err)
+	}
+	data, _, err := zkts.GetZConn().Get("/zk/test/vt/vschema")
+	if err != nil || !strings.HasPrefix(data, "{") {
+		t.Fatalf("unexpected uncompressed data: %q %v", data, err)
+	}
+	if got, err := zkts.GetSrvVSchema(ctx, "test"); err != nil || !proto.Equal(got, srvVSchema) {
+		t.Errorf("GetSrvVSchema(uncompressed) = %v %v", got, err)
+	}
+
+	// compressed data is not, but reads the same
+	if err := flag.Set("zk_compress_srv_vschema", "true"); err != nil {
+		t.Fatalf("flag.Set: %v", err)
+	}
+	defer flag.Set("zk_compress_srv_vschema", "false")
+	if err := zkts.UpdateSrvVSchema(ctx, "test", srvVSchema); err != nil {
+		t.Fatalf("UpdateSrvVSchema: %v", err)
+	}
+	data, _, err = zkts.GetZConn().Get("/zk/test/vt/vschema")
+	if err != nil || !strings.HasPrefix(data, "\x1f\x8b") {
+		t.Fatalf("unexpected compressed data: %q %v", data, err)
+	}
+	if got, err := zkts.GetSrvVSchema(ctx, "test"); err != nil || !proto.Equal(got, srvVSchema) {
+		t.Errorf("GetSrvVSchema(compressed) = %v %v", got, err)
+	}
+	current, _, cancel := topo.Server{Impl: ts}.WatchSrvVSchema(ctx, "test")
+	if current.Err != nil || !proto.Equal(current.Value, srvVSchema) {
+		t.Errorf("WatchSrvVSchema(compressed) = %v", current)
+	}
+	if cancel != nil {
+		cancel()
+	}
+
+	// a truncated compressed node is an error
+	if _, err := zkts.GetZConn().Set("/zk/test/vt/vschema", data[:len(data)/2], -1); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if _, err := zkts.GetSrvVSchema(ctx, "test"); err == nil {
+		t.Errorf("GetSrvVSchema(truncated) worked")
+	}
+}
+
+// TestGetSrvKeyspaces is a ZK specific unit test
+func TestGetSrvKeyspaces(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	ks1 := &topodatapb.SrvKeyspace{ShardingColumnName: "col1"}
+	ks2 := &topodatapb.SrvKeyspace{ShardingColumnName: "col2"}
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "ks1", ks1); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "ks2", ks2); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+
+	all, err := zkts.GetAllSrvKeyspaces(ctx, "test")
+	if err != nil || len(all) != 2 || !proto.Equal(all["ks1"], ks1) || !proto.Equal(all["ks2"], ks2) {
+		t.Errorf("GetAllSrvKeyspaces() = %v %v", all, err)
+	}
+
+	// a missing keyspace doesn't prevent reading the others
+	got, err := zkts.GetSrvKeyspaces(ctx, "test", []string{"ks1", "missing"})
+	if err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("GetSrvKeyspaces(missing) returned wrong error: %v", err)
+	}
+	if len(got) != 1 || !proto.Equal(got["ks1"], ks1) {
+		t.Errorf("GetSrvKeyspaces(missing) = %v", got)
+	}
+}
+
+func shardReference(name string, start, end []byte) *topodatapb.ShardReference {
+	return &topodatapb.ShardReference{
+		Name: name,
+		KeyRange: &topodatapb.KeyRange{
+			Start: start,
+			End:   end,
+		},
+	}
+}
+
+// TestValidateSrvKeyspace is a ZK specific unit test
+func TestValidateSrvKeyspace(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		shardReferences []*topodatapb.ShardReference
+		servedFrom      []*topodatapb.SrvKeyspace_ServedFrom
+		want            string
+	}{
+		{
+			name: "contiguous",
+			shardReferences: []*topodatapb.ShardReference{
+				shardReference("80-", []byte{0x80}, nil),
+				shardReference("-40", nil, []byte{0x40}),
+				shardReference("40-80", []byte{0x40}, []byte{0x80}),
+			},
+		},
+		{
+			name: "partial",
+			shardReferences: []*topodatapb.ShardReference{
+				shardReference("-80", nil, []byte{0x80}),
+			},
+		},
+		{
+			name: "custom sharding",
+			shardReferences: []*topodatapb.ShardReference{
+				{Name: "0"},
+				{Name: "1"},
+			},
+		},
+		{
+			name: "overlapping",
+			shardReferences: []*topodatapb.ShardReference{
+				shardReference("-80", nil, []byte{0x80}),
+				shardReference("40-", []byte{0x40}, nil),
+			},
+			want: "overlapping KeyRange values for MASTER: shards -80 and 40-",
+		},
+		{
+			name: "overlapping unsharded",
+			shardReferences: []*topodatapb.ShardReference{
+				shardReference("0", nil, nil),
+				shardReference("80-", []byte{0x80}, nil),
+			},
+			want: "overlapping KeyRange values",
+		},
+		{
+			name: "gapped",
+			shardReferences: []*topodatapb.ShardReference{
+				shardReference("-40", nil, []byte{0x40}),
+				shardReference("80-", []byte{0x80}, nil),
+			},
+			want: "gap in KeyRange values for MASTER between shards -40 and 80-: 40 != 80",
+		},
+		{
+			name: "inconsistent",
+			shardReferences: []*topodatapb.ShardReference{
+				{Name: "0"},
+				shardReference("80-", []byte{0x80}, nil),
+			},
+			want: "shards with inconsistent KeyRanges",
+		},
+		{
+			name: "duplicate served from",
+			servedFrom: []*topodatapb.SrvKeyspace_ServedFrom{
+				{TabletType: topodatapb.TabletType_REPLICA, Keyspace: "ks1"},
+				{TabletType: topodatapb.TabletType_REPLICA, Keyspace: "ks2"},
+			},
+			want: "duplicate served from entry for REPLICA",
+		},
+	} {
+		srvKeyspace := &topodatapb.SrvKeyspace{
+			Partitions: []*topodatapb.SrvKeyspace_KeyspacePartition{
+				{
+					ServedType:      topodatapb.TabletType_MASTER,
+					ShardReferences: tc.shardReferences,
+				},
+			},
+			ServedFrom: tc.servedFrom,
+		}
+		err := zktopo.ValidateSrvKeyspace(srvKeyspace)
+		if tc.want == "" {
+			if err != nil {
+				t.Errorf("ValidateSrvKeyspace(%v) failed: %v", tc.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("ValidateSrvKeyspace(%v) = %v, want error containing %v", tc.name, err, tc.want)
+		}
+	}
+
+	// duplicate partitions are also invalid
+	srvKeyspace := &topodatapb.SrvKeyspace{
+		Partitions: []*topodatapb.SrvKeyspace_KeyspacePartition{
+			{ServedType: topodatapb.TabletType_RDONLY},
+			{ServedType: topodatapb.TabletType_RDONLY},
+		},
+	}
+	if err := zktopo.ValidateSrvKeyspace(srvKeyspace); err == nil || !strings.Contains(err.Error(), "duplicate partition for RDONLY") {
+		t.Errorf("ValidateSrvKeyspace(duplicate partitions) = %v", err)
+	}
+}
+
+// TestUpdateSrvKeyspaceValidation is a ZK specific unit test
+func TestUpdateSrvKeyspaceValidation(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	srvKeyspace := &topodatapb.SrvKeyspace{
+		Partitions: []*topodatapb.SrvKeyspace_KeyspacePartition{
+			{
+				ServedType: topodatapb.TabletType_MASTER,
+				ShardReferences: []*topodatapb.ShardReference{
+					shardReference("-80", nil, []byte{0x80}),
+					shardReference("40-", []byte{0x40}, nil),
+				},
+			},
+		},
+	}
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", srvKeyspace); err == nil || !strings.Contains(err.Error(), "invalid SrvKeyspace for test_keyspace in cell test") {
+		t.Errorf("UpdateSrvKeyspace(overlapping) = %v", err)
+	}
+	if _, err := zkts.GetSrvKeyspace(ctx, "test", "test_keyspace"); err != topo.ErrNoNode {
+		t.Errorf("invalid SrvKeyspace was stored: %v", err)
+	}
+
+	// with validation disabled, it is stored
+	if err := zkts.UpdateSrvKeyspaceWithOptions(ctx, "test", "test_keyspace", srvKeyspace, zktopo.UpdateSrvKeyspaceOptions{SkipValidation: true}); err != nil {
+		t.Fatalf("UpdateSrvKeyspaceWithOptions: %v", err)
+	}
+	if got, err := zkts.GetSrvKeyspace(ctx, "test", "test_keyspace"); err != nil || !proto.Equal(got, srvKeyspace) {
+		t.Errorf("GetSrvKeyspace() = %v %v", got, err)
+	}
+}
+
+// TestUpdateSrvVSchemaWithVersion is a ZK specific unit test
+func TestUpdateSrvVSchemaWithVersion(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	srvVSchema := &vschemapb.SrvVSchema{
+		Keyspaces: map[string]*vschemapb.Keyspace{
+			"ks1": {},
+		},
+	}
+	if _, err := zkts.UpdateSrvVSchemaWithVersion(ctx, "test", srvVSchema, 0); err != topo.ErrNoNode {
+		t.Errorf("UpdateSrvVSchemaWithVersion(missing) = %v, want ErrNoNode", err)
+	}
+	if err := zkts.UpdateSrvVSchema(ctx, "test", srvVSchema); err != nil {
+		t.Fatalf("UpdateSrvVSchema: %v", err)
+	}
+
+	got, version, err := zkts.GetSrvVSchemaWithVersion(ctx, "test")
+	if err != nil || !proto.Equal(got, srvVSchema) {
+		t.Fatalf("GetSrvVSchemaWithVersion() = %v %v", got, err)
+	}
+
+	// read-modify-write works with the right version
+	got.Keyspaces["ks2"] = &vschemapb.Keyspace{Sharded: true}
+	newVersion, err := zkts.UpdateSrvVSchemaWithVersion(ctx, "test", got, version)
+	if err != nil || newVersion == version {
+		t.Fatalf("UpdateSrvVSchemaWithVersion() = %v %v", newVersion, err)
+	}
+
+	// and fails with an old one
+	if _, err := zkts.UpdateSrvVSchemaWithVersion(ctx, "test", srvVSchema, version); err != topo.ErrBadVersion {
+		t.Errorf("UpdateSrvVSchemaWithVersion(old version) = %v, want ErrBadVersion", err)
+	}
+	if current, currentVersion, err := zkts.GetSrvVSchemaWithVersion(ctx, "test"); err != nil || currentVersion != newVersion || !proto.Equal(current, got) {
+		t.Errorf("GetSrvVSchemaWithVersion() = %v %v %v", current, currentVersion, err)
+	}
+}
+
+// TestDeleteSrvVSchema is a ZK specific unit test
+func TestDeleteSrvVSchema(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	if err := zkts.DeleteSrvVSchema(ctx, "test"); err != topo.ErrNoNode {
+		t.Errorf("DeleteSrvVSchema(missing) = %v, want ErrNoNode", err)
+	}
+	if err := zkts.UpdateSrvVSchema(ctx, "test", &vschemapb.SrvVSchema{}); err != nil {
+		t.Fatalf("UpdateSrvVSchema: %v", err)
+	}
+	if err := zkts.DeleteSrvVSchema(ctx, "test"); err != nil {
+		t.Fatalf("DeleteSrvVSchema: %v", err)
+	}
+	if _, err := zkts.GetSrvVSchema(ctx, "test"); err != topo.ErrNoNode {
+		t.Errorf("GetSrvVSchema(deleted) = %v, want ErrNoNode", err)
+	}
+}
+
+// TestUpdateSrvKeyspaceUnchanged is a ZK specific unit test
+func TestUpdateSrvKeyspaceUnchanged(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	srvKeyspace := &topodatapb.SrvKeyspace{
+		ShardingColumnName: "user_id",
+		ServedFrom: []*topodatapb.SrvKeyspace_ServedFrom{
+			{TabletType: topodatapb.TabletType_REPLICA, Keyspace: "other_keyspace"},
+		},
+	}
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	data, stat, err := zkts.GetZConn().Get("/zk/test/vt/ns/test_keyspace")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if !strings.Contains(data, "\"served_from\": [\n    {\n      \"keyspace\": \"other_keyspace\",\n      \"tablet_type\": 2\n    }\n  ],\n  \"sharding_column_name\"") {
+		t.Errorf("keys are not sorted: %v", data)
+	}
+
+	// the same content doesn't change the node
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", proto.Clone(srvKeyspace).(*topodatapb.SrvKeyspace)); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	if _, stat2, err := zkts.GetZConn().Get("/zk/test/vt/ns/test_keyspace"); err != nil || stat2.Version != stat.Version {
+		t.Errorf("identical update changed the version: %v -> %v (%v)", stat.Version, stat2.Version, err)
+	}
+
+	// a different content does
+	srvKeyspace.ShardingColumnName = "new_user_id"
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	if _, stat2, err := zkts.GetZConn().Get("/zk/test/vt/ns/test_keyspace"); err != nil || stat2.Version == stat.Version {
+		t.Errorf("update didn't change the version: %v -> %v (%v)", stat.Version, stat2.Version, err)
+	}
+}
+
+// flakyConn is a zk.Conn that fails the first Get calls.
+type flakyConn struct {
+	zk.Conn
+	err      error
+	failures int
+	calls    int
+}
+
+func (conn *flakyConn) Get(path string) (string, *zookeeper.Stat, error) {
+	conn.calls++
+	if conn.calls <= conn.failures {
+		return "", nil, conn.err
+	}
+	return conn.Conn.Get(path)
+}
+
+// TestRetry is a ZK specific unit test
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	var sleeps []time.Duration
+	policy := zktopo.RetryPolicy{
+		Attempts:   4,
+		Backoff:    10 * time.Millisecond,
+		MaxBackoff: 15 * time.Millisecond,
+		Sleep: func(d time.Duration) {
+			sleeps = append(sleeps, d)
+		},
+	}
+	srvKeyspace := &topodatapb.SrvKeyspace{ShardingColumnName: "user_id"}
+
+	for _, tc := range []struct {
+		name      string
+		err       error
+		failures  int
+		wantErr   error
+		wantCalls int
+	}{
+		{"transient", zookeeper.ErrConnectionClosed, 3, nil, 4},
+		{"no server", zookeeper.ErrNoServer, 3, nil, 4},
+		{"too many transient", zookeeper.ErrSessionExpired, 4, topo.ErrTimeout, 4},
+		{"permanent", zookeeper.ErrNoAuth, 3, zookeeper.ErrNoAuth, 1},
+	} {
+		conn := &flakyConn{Conn: fakezk.NewConn(), err: tc.err, failures: tc.failures}
+		zkts := zktopo.NewServer(conn).(*zktopo.Server)
+		zkts.SetRetryPolicy(policy)
+		if _, err := zk.CreateRecursive(conn, "/zk/test/vt/ns/test_keyspace", "{\"sharding_column_name\": \"user_id\"}", 0, zookeeper.WorldACL(zookeeper.PermAll)); err != nil {
+			t.Fatalf("CreateRecursive: %v", err)
+		}
+
+		sleeps = nil
+		got, err := zkts.GetSrvKeyspace(ctx, "test", "test_keyspace")
+		if err != tc.wantErr || (err == nil && !proto.Equal(got, srvKeyspace)) {
+			t.Errorf("%v: GetSrvKeyspace() = %v %v, want error %v", tc.name, got, err, tc.wantErr)
+		}
+		if conn.calls != tc.wantCalls {
+			t.Errorf("%v: got %v calls, want %v", tc.name, conn.calls, tc.wantCalls)
+		}
+		if len(sleeps) != tc.wantCalls-1 {
+			t.Errorf("%v: unexpected sleeps: %v", tc.name, sleeps)
+		}
+	}
+
+	// the backoff doubles, up to the maximum
+	want := []time.Duration{10 * time.Millisecond, 15 * time.Millisecond, 15 * time.Millisecond}
+	conn := &flakyConn{Conn: fakezk.NewConn(), err: zookeeper.ErrConnectionClosed, failures: 3}
+	zkts := zktopo.NewServer(conn).(*zktopo.Server)
+	zkts.SetRetryPolicy(policy)
+	sleeps = nil
+	if _, err := zkts.GetSrvKeyspace(ctx, "test", "test_keyspace"); err != topo.ErrNoNode {
+		t.Errorf("GetSrvKeyspace(missing) = %v, want ErrNoNode", err)
+	}
+	if !reflect.DeepEqual(sleeps, want) {
+		t.Errorf("got sleeps %v, want %v", sleeps, want)
+	}
+
+	// the wait between attempts stops when ctx is done
+	conn = &flakyConn{Conn: fakezk.NewConn(), err: zookeeper.ErrConnectionClosed, failures: 3}
+	zkts = zktopo.NewServer(conn).(*zktopo.Server)
+	zkts.SetRetryPolicy(zktopo.RetryPolicy{
+		Attempts:   4,
+		Backoff:    time.Hour,
+		MaxBackoff: time.Hour,
+	})
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := zkts.GetSrvKeyspace(timeoutCtx, "test", "test_keyspace"); err != topo.ErrTimeout {
+		t.Errorf("GetSrvKeyspace(timeout) = %v, want ErrTimeout", err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed > 5*time.Second {
+		t.Errorf("GetSrvKeyspace(timeout) took %v", elapsed)
+	}
+	if conn.calls != 1 {
+		t.Errorf("got %v calls, want 1", conn.calls)
+	}
+}
+
+// TestServingGraphStats is a ZK specific unit test
+func TestServingGraphStats(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"stats_cell"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	if _, err := zkts.GetSrvKeyspace(ctx, "stats_cell", "test_keyspace"); err != topo.ErrNoNode {
+		t.Fatalf("GetSrvKeyspace(missing) = %v", err)
+	}
+	if err := zkts.UpdateSrvKeyspace(ctx, "stats_cell", "test_keyspace", &topodatapb.SrvKeyspace{}); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	if _, err := zkts.GetSrvKeyspace(ctx, "stats_cell", "test_keyspace"); err != nil {
+		t.Fatalf("GetSrvKeyspace: %v", err)
+	}
+
+	timings := expvar.Get("ZkTopoServingGraph").String()
+	for _, want := range []string{"\"GetSrvKeyspace.stats_cell\":{", "\"UpdateSrvKeyspace.stats_cell\":{"} {
+		if !strings.Contains(timings, want) {
+			t.Errorf("ZkTopoServingGraph doesn't contain %v: %v", want, timings)
+		}
+	}
+	if got, want := expvar.Get("ZkTopoServingGraphErrors").String(), "\"GetSrvKeyspace.stats_cell.NoNode\": 1"; !strings.Contains(got, want) {
+		t.Errorf("ZkTopoServingGraphErrors doesn't contain %v: %v", want, got)
+	}
+}
+
+// TestSrvKeyspaceNamesCache is a ZK specific unit test
+func TestSrvKeyspaceNamesCache(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+	zkts.EnableSrvKeyspaceNamesCache(time.Hour)
+
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "ks1", &topodatapb.SrvKeyspace{}); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	names, err := zkts.GetSrvKeyspaceNames(ctx, "test")
+	if err != nil || !reflect.DeepEqual(names, []string{"ks1"}) {
+		t.Fatalf("GetSrvKeyspaceNames() = %v %v", names, err)
+	}
+
+	// callers can't change the cached value
+	names[0] = "changed"
+	if names, err := zkts.GetSrvKeyspaceNames(ctx, "test"); err != nil || !reflect.DeepEqual(names, []string{"ks1"}) {
+		t.Fatalf("GetSrvKeyspaceNames() = %v %v", names, err)
+	}
+
+	// a new keyspace invalidates the cache through the watch
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "ks2", &topodatapb.SrvKeyspace{}); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	if names, err := zkts.GetSrvKeyspaceNamesUncached(ctx, "test"); err != nil || !reflect.DeepEqual(names, []string{"ks1", "ks2"}) {
+		t.Fatalf("GetSrvKeyspaceNamesUncached() = %v %v", names, err)
+	}
+	timeout := time.After(5 * time.Second)
+	for {
+		names, err := zkts.GetSrvKeyspaceNames(ctx, "test")
+		if err != nil {
+			t.Fatalf("GetSrvKeyspaceNames: %v", err)
+		}
+		if reflect.DeepEqual(names, []string{"ks1", "ks2"}) {
+			break
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("cache was not invalidated: %v", names)
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// countingChildrenWConn is a zk.Conn that counts its ChildrenW calls.
+type countingChildrenWConn struct {
+	zk.Conn
+	mu        sync.Mutex
+	childrenW int
+}
+
+func (conn *countingChildrenWConn) ChildrenW(path string) ([]string, *zookeeper.Stat, <-chan zookeeper.Event, error) {
+	conn.mu.Lock()
+	conn.childrenW++
+	conn.mu.Unlock()
+	return conn.Conn.ChildrenW(path)
+}
+
+func (conn *countingChildrenWConn) count() int {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.childrenW
+}
+
+// TestSrvKeyspaceNamesCacheSingleWatch is a ZK specific unit test
+func TestSrvKeyspaceNamesCacheSingleWatch(t *testing.T) {
+	ctx := context.Background()
+	conn := &countingChildrenWConn{Conn: fakezk.NewConn()}
+	zkts := zktopo.NewServer(conn).(*zktopo.Server)
+	zkts.EnableSrvKeyspaceNamesCache(time.Nanosecond)
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "ks1", &topodatapb.SrvKeyspace{}); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+
+	// the entry expires on each read, but the watch stays set
+	for i := 0; i < 10; i++ {
+		if names, err := zkts.GetSrvKeyspaceNames(ctx, "test"); err != nil || !reflect.DeepEqual(names, []string{"ks1"}) {
+			t.Fatalf("GetSrvKeyspaceNames() = %v %v", names, err)
+		}
+	}
+	if got := conn.count(); got != 1 {
+		t.Errorf("ChildrenW was called %v times, want 1", got)
+	}
+
+	// once the watch fires, the next read sets a new one
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "ks2", &topodatapb.SrvKeyspace{}); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	timeout := time.After(5 * time.Second)
+	for conn.count() != 2 {
+		if _, err := zkts.GetSrvKeyspaceNames(ctx, "test"); err != nil {
+			t.Fatalf("GetSrvKeyspaceNames: %v", err)
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("no new watch was set")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	if names, err := zkts.GetSrvKeyspaceNames(ctx, "test"); err != nil || !reflect.DeepEqual(names, []string{"ks1", "ks2"}) {
+		t.Errorf("GetSrvKeyspaceNames() = %v %v", names, err)
+	}
+}
+
+// TestUpdateSrvKeyspaceConcurrentCreate is a ZK specific unit test
+func TestUpdateSrvKeyspaceConcurrentCreate(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	for i := 0; i < 20; i++ {
+		if err := zkts.DeleteSrvKeyspace(ctx, "test", "test_keyspace"); err != nil && err != topo.ErrNoNode {
+			t.Fatalf("DeleteSrvKeyspace: %v", err)
+		}
+
+		done := make(chan struct{})
+		readerErrors := make(chan error, 1)
+		go func() {
+			defer close(readerErrors)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, err := zkts.GetSrvKeyspace(ctx, "test", "test_keyspace"); err != nil && err != topo.ErrNoNode {
+					readerErrors <- err
+					return
+				}
+			}
+		}()
+
+		start := make(chan struct{})
+		wg := sync.WaitGroup{}
+		for j := 0; j < 5; j++ {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				<-start
+				srvKeyspace := &topodatapb.SrvKeyspace{ShardingColumnName: fmt.Sprintf("col%v", j)}
+				if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", srvKeyspace); err != nil {
+					t.Errorf("concurrent UpdateSrvKeyspace failed: %v", err)
+				}
+			}(j)
+		}
+		close(start)
+		wg.Wait()
+		close(done)
+		if err := <-readerErrors; err != nil {
+			t.Fatalf("GetSrvKeyspace saw an intermediate value: %v", err)
+		}
+		if _, err := zkts.GetSrvKeyspace(ctx, "test", "test_keyspace"); err != nil {
+			t.Fatalf("GetSrvKeyspace: %v", err)
+		}
+	}
+}
+
+// racingConn is a zk.Conn where another writer creates the node
+// right before each Create.
+type racingConn struct {
+	zk.Conn
+}
+
+func (conn *racingConn) Create(path, value string, flags int, aclv []zookeeper.ACL) (string, error) {
+	if _, err := conn.Conn.Create(path, "{}", flags, aclv); err != nil && err != zookeeper.ErrNoNode {
+		return "", err
+	}
+	return conn.Conn.Create(path, value, flags, aclv)
+}
+
+func (conn *slowConn) Children(path string) ([]string, *zookeeper.Stat, error) {
+	<-conn.release
+	return conn.Conn.Children(path)
+}
+
+// TestUpdateSrvKeyspaceRacingCreate is a ZK specific unit test
+func TestUpdateSrvKeyspaceRacingCreate(t *testing.T) {
+	ctx := context.Background()
+	conn := &racingConn{Conn: fakezk.NewConn()}
+	zkts := zktopo.NewServer(conn).(*zktopo.Server)
+
+	srvKeyspace := &topodatapb.SrvKeyspace{ShardingColumnName: "user_id"}
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	if got, err := zkts.GetSrvKeyspace(ctx, "test", "test_keyspace"); err != nil || !proto.Equal(got, srvKeyspace) {
+		t.Errorf("GetSrvKeyspace() = %v %v", got, err)
+	}
+}
+
+// TestGetSrvKeyspaceWithStat is a ZK specific unit test
+func TestGetSrvKeyspaceWithStat(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	if _, _, err := zkts.GetSrvKeyspaceWithStat(ctx, "test", "test_keyspace"); err != topo.ErrNoNode {
+		t.Errorf("GetSrvKeyspaceWithStat(missing) = %v, want ErrNoNode", err)
+	}
+
+	before := time.Now().Add(-time.Second)
+	srvKeyspace := &topodatapb.SrvKeyspace{ShardingColumnName: "user_id"}
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	got, stat, err := zkts.GetSrvKeyspaceWithStat(ctx, "test", "test_keyspace")
+	if err != nil || !proto.Equal(got, srvKeyspace) {
+		t.Fatalf("GetSrvKeyspaceWithStat() = %v %v", got, err)
+	}
+	if stat.Mtime.Before(before) || stat.Mtime.After(time.Now()) {
+		t.Errorf("unexpected Mtime: %v", stat.Mtime)
+	}
+
+	srvKeyspace.ShardingColumnName = "new_user_id"
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	if _, stat2, err := zkts.GetSrvKeyspaceWithStat(ctx, "test", "test_keyspace"); err != nil || stat2.Version != stat.Version+1 {
+		t.Errorf("GetSrvKeyspaceWithStat() returned version %v, want %v (%v)", stat2.Version, stat.Version+1, err)
+	}
+}
+
+// TestUpdateSrvKeyspaceDryRun is a ZK specific unit test
+func TestUpdateSrvKeyspaceDryRun(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	srvKeyspace := &topodatapb.SrvKeyspace{ShardingColumnName: "user_id"}
+	wouldChange, data, err := zkts.UpdateSrvKeyspaceDryRun(ctx, "test", "test_keyspace", srvKeyspace)
+	if err != nil || !wouldChange || !strings.Contains(string(data), "\"sharding_column_name\": \"user_id\"") {
+		t.Errorf("UpdateSrvKeyspaceDryRun(missing) = %v %q %v", wouldChange, data, err)
+	}
+	if _, err := zkts.GetSrvKeyspace(ctx, "test", "test_keyspace"); err != topo.ErrNoNode {
+		t.Errorf("UpdateSrvKeyspaceDryRun created the node: %v", err)
+	}
+
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	stored, _, err := zkts.GetZConn().Get("/zk/test/vt/ns/test_keyspace")
+	if err != nil || stored != string(data) {
+		t.Errorf("UpdateSrvKeyspace wrote %q, dry run returned %q (%v)", stored, data, err)
+	}
+	if wouldChange, _, err := zkts.UpdateSrvKeyspaceDryRun(ctx, "test", "test_keyspace", srvKeyspace); err != nil || wouldChange {
+		t.Errorf("UpdateSrvKeyspaceDryRun(same) = %v %v", wouldChange, err)
+	}
+
+	srvKeyspace.ShardingColumnName = "new_user_id"
+	if wouldChange, _, err := zkts.UpdateSrvKeyspaceDryRun(ctx, "test", "test_keyspace", srvKeyspace); err != nil || !wouldChange {
+		t.Errorf("UpdateSrvKeyspaceDryRun(changed) = %v %v", wouldChange, err)
+	}
+	if got, err := zkts.GetSrvKeyspace(ctx, "test", "test_keyspace"); err != nil || got.ShardingColumnName != "user_id" {
+		t.Errorf("UpdateSrvKeyspaceDryRun changed the node: %v %v", got, err)
+	}
+
+	// the same content stored compressed, or with another codec, is
+	// not a change
+	srvKeyspace.ShardingColumnName = "user_id"
+	if err := zkts.UpdateSrvKeyspaceWithOptions(ctx, "test", "test_keyspace", srvKeyspace, zktopo.UpdateSrvKeyspaceOptions{Compress: true}); err != nil {
+		t.Fatalf("UpdateSrvKeyspaceWithOptions: %v", err)
+	}
+	if wouldChange, _, err := zkts.UpdateSrvKeyspaceDryRun(ctx, "test", "test_keyspace", srvKeyspace); err != nil || wouldChange {
+		t.Errorf("UpdateSrvKeyspaceDryRun(same, compressed) = %v %v", wouldChange, err)
+	}
+	zkts.SetSrvGraphCodec(zktopo.ProtoCodec{})
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	zkts.SetSrvGraphCodec(nil)
+	if wouldChange, _, err := zkts.UpdateSrvKeyspaceDryRun(ctx, "test", "test_keyspace", srvKeyspace); err != nil || wouldChange {
+		t.Errorf("UpdateSrvKeyspaceDryRun(same, proto) = %v %v", wouldChange, err)
+	}
+
+	// a node that cannot be decoded is a change
+	if _, err := zkts.GetZConn().Set("/zk/test/vt/ns/test_keyspace", "{bad json", -1); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if wouldChange, _, err := zkts.UpdateSrvKeyspaceDryRun(ctx, "test", "test_keyspace", srvKeyspace); err != nil || !wouldChange {
+		t.Errorf("UpdateSrvKeyspaceDryRun(bad data) = %v %v", wouldChange, err)
+	}
+}
+
+// TestGetCellsServingKeyspace is a ZK specific unit test
+func TestGetCellsServingKeyspace(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"cell1", "cell2", "cell3"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	for _, cell := range []string{"cell3", "cell1"} {
+		if err := zkts.UpdateSrvKeyspace(ctx, cell, "test_keyspace", &topodatapb.SrvKeyspace{}); err != nil {
+			t.Fatalf("UpdateSrvKeyspace: %v", err)
+		}
+	}
+	if err := zkts.UpdateSrvKeyspace(ctx, "cell2", "other_keyspace", &topodatapb.SrvKeyspace{}); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+
+	// cell4 doesn't even exist
+	got, err := zkts.GetCellsServingKeyspace(ctx, []string{"cell1", "cell2", "cell3", "cell4"}, "test_keyspace")
+	if err != nil || !reflect.DeepEqual(got, []string{"cell1", "cell3"}) {
+		t.Errorf("GetCellsServingKeyspace() = %v %v", got, err)
+	}
+	if got, err := zkts.GetCellsServingKeyspace(ctx, []string{"cell1", "cell2"}, "missing_keyspace"); err != nil || got != nil {
+		t.Errorf("GetCellsServingKeyspace(missing) = %v %v", got, err)
+	}
+}
+
+// TestGetCellsWithServingGraph is a ZK specific unit test
+func TestGetCellsWithServingGraph(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"cell1", "cell2", "cell3"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	for _, cell := range []string{"cell3", "cell1"} {
+		if err := zkts.UpdateSrvKeyspace(ctx, cell, "test_keyspace", &topodatapb.SrvKeyspace{}); err != nil {
+			t.Fatalf("UpdateSrvKeyspace: %v", err)
+		}
+	}
+
+	// cell2 has no serving graph, cell4 doesn't even exist, and
+	// bad/cell can't be checked
+	got, err := zkts.GetCellsWithServingGraph(ctx, []string{"cell1", "cell2", "cell3", "cell4", "bad/cell"})
+	if !reflect.DeepEqual(got, []string{"cell1", "cell3"}) {
+		t.Errorf("GetCellsWithServingGraph() = %v", got)
+	}
+	if err == nil || !strings.Contains(err.Error(), "path separators are not allowed") {
+		t.Errorf("GetCellsWithServingGraph() error = %v", err)
+	}
+
+	if got, err := zkts.GetCellsWithServingGraph(ctx, []string{"cell2", "cell4"}); err != nil || got != nil {
+		t.Errorf("GetCellsWithServingGraph(empty cells) = %v %v", got, err)
+	}
+}
+
+// barrierSetConn is a zk.Conn whose first two Set calls wait for each
+// other, so two concurrent writers both find a new node missing.
+type barrierSetConn struct {
+	zk.Conn
+	mu      sync.Mutex
+	sets    int
+	release chan struct{}
+}
+
+func (conn *barrierSetConn) Set(path, value string, version int32) (*zookeeper.Stat, error) {
+	conn.mu.Lock()
+	conn.sets++
+	n := conn.sets
+	if n == 2 {
+		close(conn.release)
+	}
+	conn.mu.Unlock()
+	if n <= 2 {
+		<-conn.release
+	}
+	return conn.Conn.Set(path, value, version)
+}
+
+// TestUpdateSrvKeyspaceConcurrentCreateParents is a ZK specific unit test
+func TestUpdateSrvKeyspaceConcurrentCreateParents(t *testing.T) {
+	ctx := context.Background()
+	conn := &barrierSetConn{Conn: fakezk.NewConn(), release: make(chan struct{})}
+	zkts := zktopo.NewServer(conn).(*zktopo.Server)
+
+	// neither the keyspace node nor its parents exist
+	values := []*topodatapb.SrvKeyspace{
+		{ShardingColumnName: "user_id"},
+		{ShardingColumnName: "other_id"},
+	}
+	wg := sync.WaitGroup{}
+	errs := make([]error, len(values))
+	for i, value := range values {
+		wg.Add(1)
+		go func(i int, value *topodatapb.SrvKeyspace) {
+			defer wg.Done()
+			errs[i] = zkts.UpdateSrvKeyspace(ctx, "new_cell", "test_keyspace", value)
+		}(i, value)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("UpdateSrvKeyspace(%v) failed: %v", i, err)
+		}
+	}
+
+	got, err := zkts.GetSrvKeyspace(ctx, "new_cell", "test_keyspace")
+	if err != nil || !(proto.Equal(got, values[0]) || proto.Equal(got, values[1])) {
+		t.Errorf("GetSrvKeyspace() = %v %v", got, err)
+	}
+}
+
+// concurrentWriteMultiConn is a zk.Conn that sets a node before each
+// Multi call, as a concurrent writer would.
+type concurrentWriteMultiConn struct {
+	zk.Conn
+	path string
+}
+
+func (conn *concurrentWriteMultiConn) Multi(ops ...interface{}) ([]zookeeper.MultiResponse, error) {
+	if _, err := conn.Conn.Set(conn.path, "", -1); err != nil {
+		return nil, err
+	}
+	return conn.Conn.(zk.MultiConn).Multi(ops...)
+}
+
+// TestUpdateSrvKeyspacesMulti is a ZK specific unit test
+func TestUpdateSrvKeyspacesMulti(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "ks1", &topodatapb.SrvKeyspace{ShardingColumnName: "col1"}); err != nil {
+		t.Fatalf("UpdateSrvKeyspace failed: %v", err)
+	}
+	updates := map[string]*topodatapb.SrvKeyspace{
+		"ks1": {ShardingColumnName: "new_col1"},
+		"ks2": {ShardingColumnName: "new_col2"},
+	}
+	if err := zkts.UpdateSrvKeyspacesMulti(ctx, "test", updates); err != nil {
+		t.Fatalf("UpdateSrvKeyspacesMulti failed: %v", err)
+	}
+	for keyspace, want := range updates {
+		if got, err := zkts.GetSrvKeyspace(ctx, "test", keyspace); err != nil || !proto.Equal(got, want) {
+			t.Errorf("GetSrvKeyspace(%v) = %v %v, want %v", keyspace, got, err, want)
+		}
+	}
+
+	// nothing is written if one of them is invalid
+	invalid := map[string]*topodatapb.SrvKeyspace{
+		"ks1": {ShardingColumnName: "col1"},
+		"ks2": {Partitions: []*topodatapb.SrvKeyspace_KeyspacePartition{
+			{ServedType: topodatapb.TabletType_MASTER},
+			{ServedType: topodatapb.TabletType_MASTER},
+		}},
+	}
+	if err := zkts.UpdateSrvKeyspacesMulti(ctx, "test", invalid); err == nil || !strings.Contains(err.Error(), "invalid SrvKeyspace for ks2") {
+		t.Errorf("UpdateSrvKeyspacesMulti(invalid) = %v", err)
+	}
+	if got, err := zkts.GetSrvKeyspace(ctx, "test", "ks1"); err != nil || !proto.Equal(got, updates["ks1"]) {
+		t.Errorf("GetSrvKeyspace(ks1) = %v %v, want %v", got, err, updates["ks1"])
+	}
+
+	// a concurrent change of one node fails the whole transaction
+	conflictTS := zktopo.NewServer(&concurrentWriteMultiConn{Conn: zkts.GetZConn(), path: "/zk/test/vt/ns/ks2"}).(*zktopo.Server)
+	conflicting := map[string]*topodatapb.SrvKeyspace{
+		"ks1": {ShardingColumnName: "col1"},
+		"ks2": {ShardingColumnName: "col2"},
+	}
+	if err := conflictTS.UpdateSrvKeyspacesMulti(ctx, "test", conflicting); err != topo.ErrBadVersion {
+		t.Errorf("UpdateSrvKeyspacesMulti(concurrent change) = %v, want %v", err, topo.ErrBadVersion)
+	}
+	if got, err := zkts.GetSrvKeyspace(ctx, "test", "ks1"); err != nil || !proto.Equal(got, updates["ks1"]) {
+		t.Errorf("GetSrvKeyspace(ks1) = %v %v, want %v", got, err, updates["ks1"])
+	}
+}
+
+// failingSetConn is a zk.Conn without Multi, whose Set fails for a
+// path.
+type failingSetConn struct {
+	zk.Conn
+	path string
+}
+
+func (conn *failingSetConn) Set(path, value string, version int32) (*zookeeper.Stat, error) {
+	if path == conn.path {
+		return nil, fmt.Errorf("cannot set %v", path)
+	}
+	return conn.Conn.Set(path, value, version)
+}
+
+// TestUpdateSrvKeyspacesMultiSequential is a ZK specific unit test
+func TestUpdateSrvKeyspacesMultiSequential(t *testing.T) {
+	ctx := context.Background()
+	conn := &failingSetConn{Conn: fakezk.NewConn()}
+	zkts := zktopo.NewServer(conn).(*zktopo.Server)
+	if _, ok := zkts.GetZConn().(zk.MultiConn); ok {
+		t.Fatalf("failingSetConn should not implement zk.MultiConn")
+	}
+
+	updates := map[string]*topodatapb.SrvKeyspace{
+		"ks1": {ShardingColumnName: "col1"},
+		"ks2": {ShardingColumnName: "col2"},
+		"ks3": {ShardingColumnName: "col3"},
+	}
+	if err := zkts.UpdateSrvKeyspacesMulti(ctx, "test", updates); err != nil {
+		t.Fatalf("UpdateSrvKeyspacesMulti failed: %v", err)
+	}
+	for keyspace, want := range updates {
+		if got, err := zkts.GetSrvKeyspace(ctx, "test", keyspace); err != nil || !proto.Equal(got, want) {
+			t.Errorf("GetSrvKeyspace(%v) = %v %v, want %v", keyspace, got, err, want)
+		}
+	}
+
+	conn.path = "/zk/test/vt/ns/ks2"
+	newUpdates := map[string]*topodatapb.SrvKeyspace{
+		"ks1": {ShardingColumnName: "new_col1"},
+		"ks2": {ShardingColumnName: "new_col2"},
+		"ks3": {ShardingColumnName: "new_col3"},
+	}
+	err := zkts.UpdateSrvKeyspacesMulti(ctx, "test", newUpdates)
+	partialErr, ok := err.(*zktopo.PartialUpdateError)
+	if !ok {
+		t.Fatalf("UpdateSrvKeyspacesMulti(failing ks2) = %v, want a *PartialUpdateError", err)
+	}
+	if !reflect.DeepEqual(partialErr.Updated, []string{"ks1"}) || partialErr.Failed != "ks2" || !reflect.DeepEqual(partialErr.NotAttempted, []string{"ks3"}) {
+		t.Errorf("unexpected PartialUpdateError: %v", partialErr)
+	}
+	if want := "partial SrvKeyspace update in cell test: updated [ks1], failed to update ks2: cannot set /zk/test/vt/ns/ks2, not attempted [ks3]"; err.Error() != want {
+		t.Errorf("PartialUpdateError.Error() = %v, want %v", err.Error(), want)
+	}
+	for keyspace, want := range map[string]*topodatapb.SrvKeyspace{
+		"ks1": newUpdates["ks1"],
+		"ks2": updates["ks2"],
+		"ks3": updates["ks3"],
+	} {
+		if got, err := zkts.GetSrvKeyspace(ctx, "test", keyspace); err != nil || !proto.Equal(got, want) {
+			t.Errorf("GetSrvKeyspace(%v) = %v %v, want %v", keyspace, got, err, want)
+		}
+	}
+}
+
+// TestUpdateSrvKeyspaceInCells is a ZK specific unit test
+func TestUpdateSrvKeyspaceInCells(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"cell1", "cell2"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	want := &topodatapb.SrvKeyspace{
+		Partitions: []*topodatapb.SrvKeyspace_KeyspacePartition{
+			{
+				ServedType: topodatapb.TabletType_MASTER,
+				ShardReferences: []*topodatapb.ShardReference{
+					{Name: "0"},
+				},
+			},
+		},
+	}
+	errs := zkts.UpdateSrvKeyspaceInCells(ctx, []string{"cell1", "cell2", "bad/cell"}, "test_keyspace", want)
+	if len(errs) != 3 || errs["cell1"] != nil || errs["cell2"] != nil || errs["bad/cell"] == nil || !strings.Contains(errs["bad/cell"].Error(), "path separators are not allowed") {
+		t.Errorf("UpdateSrvKeyspaceInCells() = %v", errs)
+	}
+	for _, cell := range []string{"cell1", "cell2"} {
+		got, err := zkts.GetSrvKeyspace(ctx, cell, "test_keyspace")
+		if err != nil || !proto.Equal(got, want) {
+			t.Errorf("GetSrvKeyspace(%v) = %v %v, want %v", cell, got, err, want)
+		}
+	}
+
+	// An invalid SrvKeyspace is not stored anywhere.
+	invalid := &topodatapb.SrvKeyspace{
+		Partitions: []*topodatapb.SrvKeyspace_KeyspacePartition{
+			{ServedType: topodatapb.TabletType_MASTER},
+			{ServedType: topodatapb.TabletType_MASTER},
+		},
+	}
+	errs = zkts.UpdateSrvKeyspaceInCells(ctx, []string{"cell1", "cell2"}, "test_keyspace", invalid)
+	if len(errs) != 2 || errs["cell1"] == nil || errs["cell2"] == nil || !strings.Contains(errs["cell1"].Error(), "invalid SrvKeyspace for test_keyspace in cell cell1") {
+		t.Errorf("UpdateSrvKeyspaceInCells(invalid) = %v", errs)
+	}
+	if got, err := zkts.GetSrvKeyspace(ctx, "cell2", "test_keyspace"); err != nil || !proto.Equal(got, want) {
+		t.Errorf("GetSrvKeyspace(cell2) after invalid update = %v %v, want %v", got, err, want)
+	}
+}
+
+// TestGetSrvVSchemaOrEmpty is a ZK specific unit test
+func TestGetSrvVSchemaOrEmpty(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	if _, err := zkts.GetSrvVSchema(ctx, "test"); err != topo.ErrNoNode {
+		t.Errorf("GetSrvVSchema(missing) = %v, want ErrNoNode", err)
+	}
+	got, err := zkts.GetSrvVSchemaOrEmpty(ctx, "test")
+	if err != nil || got.Keyspaces == nil || len(got.Keyspaces) != 0 {
+		t.Fatalf("GetSrvVSchemaOrEmpty(missing) = %v %v", got, err)
+	}
+
+	// an existing SrvVSchema is returned
+	got.Keyspaces["ks1"] = &vschemapb.Keyspace{Sharded: true}
+	if err := zkts.UpdateSrvVSchema(ctx, "test", got); err != nil {
+		t.Fatalf("UpdateSrvVSchema: %v", err)
+	}
+	if got2, err := zkts.GetSrvVSchemaOrEmpty(ctx, "test"); err != nil || !proto.Equal(got, got2) {
+		t.Errorf("GetSrvVSchemaOrEmpty() = %v %v, want %v", got2, err, got)
+	}
+
+	// an empty node is missing, unlike an empty SrvKeyspace
+	if _, err := zkts.GetZConn().Set("/zk/test/vt/vschema", "", -1); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if _, err := zkts.GetSrvVSchema(ctx, "test"); err != topo.ErrNoNode {
+		t.Errorf("GetSrvVSchema(empty) = %v, want ErrNoNode", err)
+	}
+	if got, err := zkts.GetSrvVSchemaOrEmpty(ctx, "test"); err != nil || got.Keyspaces == nil || len(got.Keyspaces) != 0 {
+		t.Errorf("GetSrvVSchemaOrEmpty(empty) = %v %v", got, err)
+	}
+
+	// other errors are returned
+	if _, err := zkts.GetSrvVSchemaOrEmpty(ctx, "bad/cell"); err == nil || !strings.Contains(err.Error(), "path separators are not allowed") {
+		t.Errorf("GetSrvVSchemaOrEmpty(bad/cell) = %v", err)
+	}
+}
+
+// TestGetSrvVSchemaInto is a ZK specific unit test
+func TestGetSrvVSchemaInto(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	dst := &vschemapb.SrvVSchema{
+		Keyspaces: map[string]*vschemapb.Keyspace{
+			"stale": {Sharded: true},
+		},
+	}
+	if err := zkts.GetSrvVSchemaInto(ctx, "test", dst); err != topo.ErrNoNode {
+		t.Errorf("GetSrvVSchemaInto(missing) = %v, want ErrNoNode", err)
+	}
+	if _, ok := dst.Keyspaces["stale"]; !ok {
+		t.Errorf("GetSrvVSchemaInto(missing) changed dst: %v", dst)
+	}
+
+	want := &vschemapb.SrvVSchema{
+		Keyspaces: map[string]*vschemapb.Keyspace{
+			"ks1": {Sharded: true},
+			"ks2": {},
+		},
+	}
+	if err := zkts.UpdateSrvVSchema(ctx, "test", want); err != nil {
+		t.Fatalf("UpdateSrvVSchema: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := zkts.GetSrvVSchemaInto(ctx, "test", dst); err != nil || !proto.Equal(dst, want) {
+			t.Errorf("GetSrvVSchemaInto() = %v %v, want %v", dst, err, want)
+		}
+	}
+
+	// a nil Keyspaces map is filled
+	dst = &vschemapb.SrvVSchema{}
+	if err := zkts.GetSrvVSchemaInto(ctx, "test", dst); err != nil || !proto.Equal(dst, want) {
+		t.Errorf("GetSrvVSchemaInto(empty dst) = %v %v, want %v", dst, err, want)
+	}
+}
+
+// TestFindOrphanedSrvKeyspaces is a ZK specific unit test
+func TestFindOrphanedSrvKeyspaces(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"cell1", "cell2", "cell3"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	for cell, keyspaces := range map[string][]string{
+		"cell1": {"ks1", "old2", "old1"},
+		"cell2": {"ks1", "ks2"},
+	} {
+		for _, keyspace := range keyspaces {
+			if err := zkts.UpdateSrvKeyspace(ctx, cell, keyspace, &topodatapb.SrvKeyspace{}); err != nil {
+				t.Fatalf("UpdateSrvKeyspace: %v", err)
+			}
+		}
+	}
+
+	// cell3 has no SrvKeyspace, and bad/cell can't be checked
+	got, err := zkts.FindOrphanedSrvKeyspaces(ctx, []string{"cell1", "cell2", "cell3", "bad/cell"}, []string{"ks1", "ks2"})
+	want := map[string][]string{
+		"cell1": {"old1", "old2"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FindOrphanedSrvKeyspaces() = %v, want %v", got, want)
+	}
+	if err == nil || !strings.Contains(err.Error(), "cannot list SrvKeyspaces of cell bad/cell") {
+		t.Errorf("FindOrphanedSrvKeyspaces() error = %v", err)
+	}
+
+	if got, err := zkts.FindOrphanedSrvKeyspaces(ctx, []string{"cell1", "cell2"}, []string{"ks1", "ks2", "old1", "old2"}); err != nil || len(got) != 0 {
+		t.Errorf("FindOrphanedSrvKeyspaces(all live) = %v %v", got, err)
+	}
+}
+
+// TestValidateAllSrvKeyspaces is a ZK specific unit test
+func TestValidateAllSrvKeyspaces(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	good := &topodatapb.SrvKeyspace{
+		Partitions: []*topodatapb.SrvKeyspace_KeyspacePartition{
+			{ServedType: topodatapb.TabletType_MASTER, ShardReferences: []*topodatapb.ShardReference{{Name: "0"}}},
+		},
+	}
+	gap := &topodatapb.SrvKeyspace{
+		Partitions: []*topodatapb.SrvKeyspace_KeyspacePartition{
+			{ServedType: topodatapb.TabletType_MASTER, ShardReferences: []*topodatapb.ShardReference{{Name: "-80", KeyRange: &topodatapb.KeyRange{End: []byte{0x80}}}}},
+		},
+	}
+	for keyspace, srvKeyspace := range map[string]*topodatapb.SrvKeyspace{
+		"good":    good,
+		"gap":     gap,
+		"overlap": good,
+		"corrupt": good,
+	} {
+		if err := zkts.UpdateSrvKeyspace(ctx, "test", keyspace, srvKeyspace); err != nil {
+			t.Fatalf("UpdateSrvKeyspace(%v): %v", keyspace, err)
+		}
+	}
+
+	// UpdateSrvKeyspace doesn't write invalid data, so write it directly
+	overlap := &topodatapb.SrvKeyspace{
+		Partitions: []*topodatapb.SrvKeyspace_KeyspacePartition{
+			{ServedType: topodatapb.TabletType_MASTER, ShardReferences: []*topodatapb.ShardReference{
+				{Name: "-80", KeyRange: &topodatapb.KeyRange{End: []byte{0x80}}},
+				{Name: "-", KeyRange: &topodatapb.KeyRange{}},
+			}},
+		},
+	}
+	data, err := json.Marshal(overlap)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	if _, err := zkts.GetZConn().Set("/zk/test/vt/ns/overlap", string(data), -1); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if _, err := zkts.GetZConn().Set("/zk/test/vt/ns/corrupt", "not json", -1); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	zktopo.ValidateAllSrvKeyspacesConcurrency = 2
+	defer func() { zktopo.ValidateAllSrvKeyspacesConcurrency = 8 }()
+	result := zkts.ValidateAllSrvKeyspaces(ctx, "test")
+	if len(result) != 3 {
+		t.Errorf("ValidateAllSrvKeyspaces() = %v", result)
+	}
+	for keyspace, want := range map[string][]string{
+		"gap":     {"KeyRange for MASTER ends at 80 with shard -80, not at the maximum"},
+		"overlap": {"overlapping KeyRange values for MASTER", "overlap in KeyRange values for MASTER", "not at the maximum"},
+		"corrupt": {"GetSrvKeyspace(test, corrupt) failed"},
+	} {
+		errs := result[keyspace]
+		if len(errs) != len(want) {
+			t.Errorf("ValidateAllSrvKeyspaces()[%v] = %v, want %v", keyspace, errs, want)
+			continue
+		}
+		for i, err := range errs {
+			if !strings.Contains(err.Error(), want[i]) {
+				t.Errorf("ValidateAllSrvKeyspaces()[%v][%v] = %v, want %v", keyspace, i, err, want[i])
+			}
+		}
+	}
+
+	if result := zkts.ValidateAllSrvKeyspaces(ctx, "bad/cell"); len(result[""]) != 1 {
+		t.Errorf("ValidateAllSrvKeyspaces(bad/cell) = %v", result)
+	}
+}
+
+// TestUpdateSrvKeyspaceResult is a ZK specific unit test
+func TestUpdateSrvKeyspaceResult(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	for _, tc := range []struct {
+		srvKeyspace *topodatapb.SrvKeyspace
+		want        zktopo.WriteResult
+	}{
+		{&topodatapb.SrvKeyspace{ShardingColumnName: "user_id"}, zktopo.WriteCreated},
+		{&topodatapb.SrvKeyspace{ShardingColumnName: "user_id"}, zktopo.WriteUnchanged},
+		{&topodatapb.SrvKeyspace{ShardingColumnName: "id"}, zktopo.WriteUpdated},
+	} {
+		if got, err := zkts.UpdateSrvKeyspaceResult(ctx, "test", "test_keyspace", tc.srvKeyspace); err != nil || got != tc.want {
+			t.Errorf("UpdateSrvKeyspaceResult(%v) = %v %v, want %v", tc.srvKeyspace, got, err, tc.want)
+		}
+	}
+
+	invalid := &topodatapb.SrvKeyspace{
+		Partitions: []*topodatapb.SrvKeyspace_KeyspacePartition{
+			{ServedType: topodatapb.TabletType_MASTER},
+			{ServedType: topodatapb.TabletType_MASTER},
+		},
+	}
+	if _, err := zkts.UpdateSrvKeyspaceResult(ctx, "test", "test_keyspace", invalid); err == nil || !strings.Contains(err.Error(), "invalid SrvKeyspace") {
+		t.Errorf("UpdateSrvKeyspaceResult(invalid) = %v", err)
+	}
+	if got := zktopo.WriteUpdated.String(); got != "Updated" {
+		t.Errorf("WriteUpdated.String() = %v", got)
+	}
+}
+
+// afterGetWConn is a zk.Conn running a function once, right after the
+// first GetW call.
+type afterGetWConn struct {
+	zk.Conn
+	once  sync.Once
+	after func()
+}
+
+func (conn *afterGetWConn) GetW(path string) (string, *zookeeper.Stat, <-chan zookeeper.Event, error) {
+	data, stat, watch, err := conn.Conn.GetW(path)
+	conn.once.Do(conn.after)
+	return data, stat, watch, err
+}
+
+// TestWatchSrvKeyspaceInitialValue is a ZK specific unit test
+func TestWatchSrvKeyspaceInitialValue(t *testing.T) {
+	ctx := context.Background()
+	conn := &afterGetWConn{Conn: fakezk.NewConn()}
+	zkts := zktopo.NewServer(conn).(*zktopo.Server)
+
+	srvKeyspace := &topodatapb.SrvKeyspace{ShardingColumnName: "user_id"}
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	updated := &topodatapb.SrvKeyspace{ShardingColumnName: "other_id"}
+	conn.after = func() {
+		// update the node right after the initial read
+		if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", updated); err != nil {
+			t.Errorf("UpdateSrvKeyspace: %v", err)
+		}
+	}
+
+	current, changes, cancel := zkts.WatchSrvKeyspace(ctx, "test", "test_keyspace")
+	if current.Err != nil || !proto.Equal(current.Value, srvKeyspace) {
+		t.Fatalf("WatchSrvKeyspace() = %v", current)
+	}
+	defer cancel()
+
+	// the update is sent exactly once
+	select {
+	case wd := <-changes:
+		if wd.Err != nil || !proto.Equal(wd.Value, updated) {
+			t.Fatalf("unexpected change: %v", wd)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the update was not sent")
+	}
+	select {
+	case wd := <-changes:
+		t.Fatalf("unexpected second change: %v", wd)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the next update is sent too
+	srvKeyspace.ShardingColumnName = "third_id"
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	if wd := <-changes; wd.Err != nil || !proto.Equal(wd.Value, srvKeyspace) {
+		t.Fatalf("unexpected change: %v", wd)
+	}
+}
+
+// beforeGetWConn is a zk.Conn running a function before each GetW
+// call after the first one.
+type beforeGetWConn struct {
+	zk.Conn
+	mu     sync.Mutex
+	calls  int
+	before func()
+}
+
+func (conn *beforeGetWConn) GetW(path string) (string, *zookeeper.Stat, <-chan zookeeper.Event, error) {
+	conn.mu.Lock()
+	conn.calls++
+	if conn.calls > 1 && conn.before != nil {
+		conn.before()
+		conn.before = nil
+	}
+	conn.mu.Unlock()
+	return conn.Conn.GetW(path)
+}
+
+// TestWatchSrvKeyspaceRecreated is a ZK specific unit test
+func TestWatchSrvKeyspaceRecreated(t *testing.T) {
+	ctx := context.Background()
+	conn := &beforeGetWConn{Conn: fakezk.NewConn()}
+	zkts := zktopo.NewServer(conn).(*zktopo.Server)
+
+	srvKeyspace := &topodatapb.SrvKeyspace{ShardingColumnName: "user_id"}
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	current, changes, cancel := zkts.WatchSrvKeyspace(ctx, "test", "test_keyspace")
+	if current.Err != nil || !proto.Equal(current.Value, srvKeyspace) {
+		t.Fatalf("WatchSrvKeyspace() = %v", current)
+	}
+	defer cancel()
+
+	// the node is deleted, and created again with the same version
+	// before it is read: the new value is still sent
+	recreated := &topodatapb.SrvKeyspace{ShardingColumnName: "other_id"}
+	conn.mu.Lock()
+	conn.before = func() {
+		if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", recreated); err != nil {
+			t.Errorf("UpdateSrvKeyspace: %v", err)
+		}
+	}
+	conn.mu.Unlock()
+	if err := zkts.DeleteSrvKeyspace(ctx, "test", "test_keyspace"); err != nil {
+		t.Fatalf("DeleteSrvKeyspace: %v", err)
+	}
+	select {
+	case wd := <-changes:
+		if wd.Err != nil || !proto.Equal(wd.Value, recreated) {
+			t.Fatalf("unexpected change: %v", wd)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the recreated node was not sent")
+	}
+	_, stat, err := zkts.GetZConn().Get("/zk/test/vt/ns/test_keyspace")
+	if err != nil || stat.Version != 0 {
+		t.Errorf("Get(recreated) = %v %v, want version 0", stat, err)
+	}
+}
+
+// TestSrvGraphCodecBackendWatch is a ZK specific unit test
+func TestSrvGraphCodecBackendWatch(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+	zkts.SetSrvGraphCodec(zktopo.ProtoCodec{})
+
+	srvKeyspace := &topodatapb.SrvKeyspace{ShardingColumnName: "user_id"}
+	srvVSchema := &vschemapb.SrvVSchema{Keyspaces: map[string]*vschemapb.Keyspace{"ks1": {Sharded: true}}}
+	if err := zkts.UpdateSrvKeyspaceWithOptions(ctx, "test", "test_keyspace", srvKeyspace, zktopo.UpdateSrvKeyspaceOptions{Compress: true}); err != nil {
+		t.Fatalf("UpdateSrvKeyspaceWithOptions: %v", err)
+	}
+	if err := zkts.UpdateSrvVSchema(ctx, "test", srvVSchema); err != nil {
+		t.Fatalf("UpdateSrvVSchema: %v", err)
+	}
+
+	// the Backend returns proto3 binary, whatever the codec
+	for _, tc := range []struct {
+		filePath string
+		got      proto.Message
+		want     proto.Message
+	}{
+		{"/keyspaces/test_keyspace/SrvKeyspace", &topodatapb.SrvKeyspace{}, srvKeyspace},
+		{"/SrvVSchema", &vschemapb.SrvVSchema{}, srvVSchema},
+	} {
+		current, _, cancel := zkts.Watch(ctx, "test", tc.filePath)
+		if current.Err != nil {
+			t.Errorf("Watch(%v) = %v", tc.filePath, current.Err)
+			continue
+		}
+		cancel()
+		if err := proto.Unmarshal(current.Contents, tc.got); err != nil || !proto.Equal(tc.got, tc.want) {
+			t.Errorf("Watch(%v) contents = %v %v, want %v", tc.filePath, tc.got, err, tc.want)
+		}
+	}
+}
+
+// TestWatchSrvKeyspaceCancelFull is a ZK specific unit test
+func TestWatchSrvKeyspaceCancelFull(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	srvKeyspace := &topodatapb.SrvKeyspace{ShardingColumnName: "user_id"}
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	current, changes, cancel := zkts.WatchSrvKeyspace(ctx, "test", "test_keyspace")
+	if current.Err != nil {
+		t.Fatalf("WatchSrvKeyspace() = %v", current)
+	}
+
+	// fill the channel without reading it
+	for i := 0; len(changes) < cap(changes); i++ {
+		srvKeyspace.ShardingColumnName = fmt.Sprintf("column_%v", i)
+		if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", srvKeyspace); err != nil {
+			t.Fatalf("UpdateSrvKeyspace: %v", err)
+		}
+		for start := time.Now(); len(changes) <= i && time.Now().Sub(start) < 5*time.Second; {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// the watch doesn't wait for the consumer to read after cancel:
+	// topo.ErrInterrupted is dropped, and the channel is closed
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	count := 0
+	for wd := range changes {
+		if wd.Err != nil {
+			t.Errorf("unexpected error after cancel: %v", wd.Err)
+		}
+		count++
+	}
+	if count != cap(changes) {
+		t.Errorf("got %v values after cancel, want %v", count, cap(changes))
+	}
+}
+
+// TestComputeSrvVSchemaStats is a ZK specific unit test
+func TestComputeSrvVSchemaStats(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	srvVSchema := &vschemapb.SrvVSchema{
+		Keyspaces: map[string]*vschemapb.Keyspace{
+			"user": {
+				Sharded: true,
+				Vindexes: map[string]*vschemapb.Vindex{
+					"user_index": {Type: "hash"},
+					"name_index": {Type: "lookup_hash"},
+				},
+				Tables: map[string]*vschemapb.Table{
+					"user":  {ColumnVindexes: []*vschemapb.ColumnVindex{{Column: "id", Name: "user_index"}}},
+					"names": {ColumnVindexes: []*vschemapb.ColumnVindex{{Column: "name", Name: "name_index"}}},
+				},
+			},
+			"lookup": {
+				Tables: map[string]*vschemapb.Table{"name_user_idx": {}},
+			},
+			"empty": nil,
+		},
+	}
+	stats := zktopo.ComputeSrvVSchemaStats(srvVSchema)
+	if stats.Keyspaces != 3 || stats.Tables != 3 || stats.Vindexes != 2 {
+		t.Errorf("ComputeSrvVSchemaStats() = %+v", stats)
+	}
+
+	// the size is the one of the stored node
+	delete(srvVSchema.Keyspaces, "empty")
+	if err := zkts.UpdateSrvVSchema(ctx, "test", srvVSchema); err != nil {
+		t.Fatalf("UpdateSrvVSchema: %v", err)
+	}
+	data, _, err := zkts.GetZConn().Get("/zk/test/vt/vschema")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if stats := zktopo.ComputeSrvVSchemaStats(srvVSchema); stats.JSONSize != len(data) {
+		t.Errorf("ComputeSrvVSchemaStats().JSONSize = %v, want %v", stats.JSONSize, len(data))
+	}
+
+	if stats := zktopo.ComputeSrvVSchemaStats(&vschemapb.SrvVSchema{}); stats.Keyspaces != 0 || stats.Tables != 0 || stats.JSONSize == 0 {
+		t.Errorf("ComputeSrvVSchemaStats(empty) = %+v", stats)
+	}
+}
+
+// TestSrvGraphCodec is a ZK specific unit test
+func TestSrvGraphCodec(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	srvKeyspace := &topodatapb.SrvKeyspace{ShardingColumnName: "user_id"}
+	srvVSchema := &vschemapb.SrvVSchema{Keyspaces: map[string]*vschemapb.Keyspace{"ks1": {Sharded: true}}}
+
+	// existing JSON data is still read with the proto codec
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "json_keyspace", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	zkts.SetSrvGraphCodec(zktopo.ProtoCodec{})
+	if got, err := zkts.GetSrvKeyspace(ctx, "test", "json_keyspace"); err != nil || !proto.Equal(got, srvKeyspace) {
+		t.Errorf("GetSrvKeyspace(json) = %v %v", got, err)
+	}
+
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "proto_keyspace", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	if err := zkts.UpdateSrvKeyspaceWithOptions(ctx, "test", "compressed_keyspace", srvKeyspace, zktopo.UpdateSrvKeyspaceOptions{Compress: true}); err != nil {
+		t.Fatalf("UpdateSrvKeyspaceWithOptions: %v", err)
+	}
+	if err := zkts.UpdateSrvVSchema(ctx, "test", srvVSchema); err != nil {
+		t.Fatalf("UpdateSrvVSchema: %v", err)
+	}
+	data, _, err := zkts.GetSrvKeyspaceRaw(ctx, "test", "proto_keyspace")
+	if err != nil || !strings.HasPrefix(string(data), "\x00pb") {
+		t.Errorf("proto SrvKeyspace encoding = %q %v", data, err)
+	}
+	vdata, _, err := zkts.GetZConn().Get("/zk/test/vt/vschema")
+	if err != nil || !strings.HasPrefix(vdata, "\x00pb") {
+		t.Errorf("proto SrvVSchema encoding = %q %v", vdata, err)
+	}
+
+	// a JSON writer reads all of them
+	zkts.SetSrvGraphCodec(nil)
+	for _, keyspace := range []string{"json_keyspace", "proto_keyspace", "compressed_keyspace"} {
+		if got, err := zkts.GetSrvKeyspace(ctx, "test", keyspace); err != nil || !proto.Equal(got, srvKeyspace) {
+			t.Errorf("GetSrvKeyspace(%v) = %v %v", keyspace, got, err)
+		}
+	}
+	if got, err := zkts.GetSrvVSchema(ctx, "test"); err != nil || !proto.Equal(got, srvVSchema) {
+		t.Errorf("GetSrvVSchema(proto) = %v %v", got, err)
+	}
+
+	// corrupted proto data is an error
+	if _, err := zkts.GetZConn().Set("/zk/test/vt/ns/proto_keyspace", "\x00pb\xff\xff", -1); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if _, err := zkts.GetSrvKeyspace(ctx, "test", "proto_keyspace"); err == nil {
+		t.Errorf("GetSrvKeyspace(corrupted proto) worked")
+	}
+}
+
+// TestRegisterSrvGraphCodec is a ZK specific unit test
+func TestRegisterSrvGraphCodec(t *testing.T) {
+	for _, codec := range []zktopo.SrvGraphCodec{
+		zktopo.JSONCodec{},
+		magicCodec("\x00p"),
+	} {
+		func() {
+			defer func() {
+				if x := recover(); x == nil {
+					t.Errorf("RegisterSrvGraphCodec(%q) didn't panic", codec.Magic())
+				}
+			}()
+			zktopo.RegisterSrvGraphCodec(codec)
+		}()
+	}
+}
+
+// magicCodec is a JSON SrvGraphCodec with a custom Magic.
+type magicCodec string
+
+func (c magicCodec) Name() string {
+	return "magic"
+}
+
+func (c magicCodec) Magic() string {
+	return string(c)
+}
+
+func (c magicCodec) Marshal(msg proto.Message) ([]byte, error) {
+	return zktopo.JSONCodec{}.Marshal(msg)
+}
+
+func (c magicCodec) Unmarshal(data []byte, msg proto.Message) error {
+	return zktopo.JSONCodec{}.Unmarshal(data, msg)
+}
+
+// TestFindShardForKey is a ZK specific unit test
+func TestCoalesceShardReferences(t *testing.T) {
+	input := []*topodatapb.ShardReference{
+		shardReference("80-", []byte{0xc0}, nil),
+		shardReference("-80", nil, []byte{0x40}),
+		shardReference("80-", []byte{0x80}, []byte{0xc0}),
+		shardReference("-80", []byte{0x40}, []byte{0x80}),
+	}
+	got, err := zktopo.CoalesceShardReferences(input)
+	if err != nil {
+		t.Fatalf("CoalesceShardReferences failed: %v", err)
+	}
+	want := []*topodatapb.ShardReference{
+		shardReference("-80", nil, []byte{0x80}),
+		shardReference("80-", []byte{0x80}, nil),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("CoalesceShardReferences() = %v, want %v", got, want)
+	}
+	if input[0].KeyRange.Start[0] != 0xc0 || input[1].KeyRange.End[0] != 0x40 {
+		t.Errorf("CoalesceShardReferences changed its input: %v", input)
+	}
+
+	// adjacent ranges of different shards are kept apart
+	split := []*topodatapb.ShardReference{
+		shardReference("40-80", []byte{0x40}, []byte{0x80}),
+		shardReference("-40", nil, []byte{0x40}),
+	}
+	got, err = zktopo.CoalesceShardReferences(split)
+	if err != nil || !reflect.DeepEqual(got, []*topodatapb.ShardReference{split[1], split[0]}) {
+		t.Errorf("CoalesceShardReferences(split) = %v %v", got, err)
+	}
+
+	// with gaps, only the adjacent ranges are merged
+	gap := []*topodatapb.ShardReference{
+		shardReference("0", nil, []byte{0x40}),
+		shardReference("0", []byte{0x80}, nil),
+	}
+	got, err = zktopo.CoalesceShardReferences(gap)
+	if err != nil || !reflect.DeepEqual(got, gap) {
+		t.Errorf("CoalesceShardReferences(gap) = %v %v", got, err)
+	}
+
+	// unsharded
+	unsharded := []*topodatapb.ShardReference{{Name: "0"}}
+	got, err = zktopo.CoalesceShardReferences(unsharded)
+	if err != nil || !reflect.DeepEqual(got, unsharded) {
+		t.Errorf("CoalesceShardReferences(unsharded) = %v %v", got, err)
+	}
+
+	for _, tc := range []struct {
+		shards []*topodatapb.ShardReference
+		want   string
+	}{
+		{
+			shards: []*topodatapb.ShardReference{
+				shardReference("-80", nil, []byte{0x80}),
+				shardReference("-80", []byte{0x40}, nil),
+			},
+			want: "overlap in KeyRange values between shards -80 and -80: 80 > 40",
+		},
+		{
+			shards: []*topodatapb.ShardReference{
+				shardReference("-", nil, nil),
+				shardReference("80-", []byte{0x80}, nil),
+			},
+			want: "overlap in KeyRange values between shards - and 80-: max > 80",
+		},
+		{
+			shards: []*topodatapb.ShardReference{
+				{Name: "0"},
+				shardReference("80-", []byte{0x80}, nil),
+			},
+			want: "cannot coalesce shards 0 and 80-: a shard without KeyRange covers the whole range",
+		},
+	} {
+		if _, err := zktopo.CoalesceShardReferences(tc.shards); err == nil || err.Error() != tc.want {
+			t.Errorf("CoalesceShardReferences(%v) = %v, want %v", tc.shards, err, tc.want)
+		}
+	}
+}
+
+func TestFindShardForKey(t *testing.T) {
+	srvKeyspace := &topodatapb.SrvKeyspace{
+		Partitions: []*topodatapb.SrvKeyspace_KeyspacePartition{
+			{
+				ServedType: topodatapb.TabletType_MASTER,
+				ShardReferences: []*topodatapb.ShardReference{
+					shardReference("80-c0", []byte{0x80}, []byte{0xc0}),
+					shardReference("-40", nil, []byte{0x40}),
+					shardReference("40-80", []byte{0x40}, []byte{0x80}),
+					shardReference("c0-", []byte{0xc0}, nil),
+				},
+			},
+			{
+				ServedType: topodatapb.TabletType_REPLICA,
+				ShardReferences: []*topodatapb.ShardReference{
+					shardReference("-40", nil, []byte{0x40}),
+					shardReference("80-", []byte{0x80}, nil),
+				},
+			},
+			{
+				ServedType: topodatapb.TabletType_RDONLY,
+				ShardReferences: []*topodatapb.ShardReference{
+					{Name: "0"},
+				},
+			},
+		},
+	}
+	for _, tc := range []struct {
+		servedType topodatapb.TabletType
+		id         []byte
+		want       string
+	}{
+		{topodatapb.TabletType_MASTER, nil, "-40"},
+		{topodatapb.TabletType_MASTER, []byte{0x3f, 0xff}, "-40"},
+		{topodatapb.TabletType_MASTER, []byte{0x40}, "40-80"},
+		{topodatapb.TabletType_MASTER, []byte{0x80, 0x01}, "80-c0"},
+		{topodatapb.TabletType_MASTER, []byte{0xff, 0xff}, "c0-"},
+		{topodatapb.TabletType_REPLICA, []byte{0x90}, "80-"},
+		{topodatapb.TabletType_RDONLY, []byte{0x90}, "0"},
+	} {
+		got, err := zktopo.FindShardForKey(srvKeyspace, tc.servedType, tc.id)
+		if err != nil || got.Name != tc.want {
+			t.Errorf("FindShardForKey(%v, %x) = %v %v, want %v", tc.servedType, tc.id, got, err, tc.want)
+		}
+	}
+
+	if _, err := zktopo.FindShardForKey(srvKeyspace, topodatapb.TabletType_REPLICA, []byte{0x50}); err == nil || err.Error() != "keyspace id 50 is not in any shard of the partition for REPLICA" {
+		t.Errorf("FindShardForKey(gap) = %v", err)
+	}
+	if _, err := zktopo.FindShardForKey(srvKeyspace, topodatapb.TabletType_SPARE, []byte{0x50}); err == nil || err.Error() != "no partition for SPARE" {
+		t.Errorf("FindShardForKey(no partition) = %v", err)
+	}
+	// the partition is not modified
+	if got := srvKeyspace.Partitions[0].ShardReferences[0].Name; got != "80-c0" {
+		t.Errorf("FindShardForKey sorted the partition: %v", got)
+	}
+}
+
+// TestValidateSrvVSchemaConsistency is a ZK specific unit test
+func TestValidateSrvVSchemaConsistency(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	if errs := zkts.ValidateSrvVSchemaConsistency(ctx, "test"); len(errs) != 1 || !strings.Contains(errs[0].Error(), "GetSrvVSchema(test) failed") {
+		t.Errorf("ValidateSrvVSchemaConsistency(no vschema) = %v", errs)
+	}
+
+	for _, keyspace := range []string{"ks1", "ks3"} {
+		if err := zkts.UpdateSrvKeyspace(ctx, "test", keyspace, &topodatapb.SrvKeyspace{}); err != nil {
+			t.Fatalf("UpdateSrvKeyspace: %v", err)
+		}
+	}
+	srvVSchema := &vschemapb.SrvVSchema{
+		Keyspaces: map[string]*vschemapb.Keyspace{
+			"ks1": {},
+			"ks2": {},
+		},
+	}
+	if err := zkts.UpdateSrvVSchema(ctx, "test", srvVSchema); err != nil {
+		t.Fatalf("UpdateSrvVSchema: %v", err)
+	}
+	var got []string
+	for _, err := range zkts.ValidateSrvVSchemaConsistency(ctx, "test") {
+		got = append(got, err.Error())
+	}
+	want := []string{
+		"keyspace ks2 is in the SrvVSchema of cell test but has no SrvKeyspace",
+		"keyspace ks3 has a SrvKeyspace in cell test but is not in the SrvVSchema",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ValidateSrvVSchemaConsistency() = %v, want %v", got, want)
+	}
+
+	srvVSchema.Keyspaces["ks3"] = &vschemapb.Keyspace{}
+	delete(srvVSchema.Keyspaces, "ks2")
+	if err := zkts.UpdateSrvVSchema(ctx, "test", srvVSchema); err != nil {
+		t.Fatalf("UpdateSrvVSchema: %v", err)
+	}
+	if errs := zkts.ValidateSrvVSchemaConsistency(ctx, "test"); len(errs) != 0 {
+		t.Errorf("ValidateSrvVSchemaConsistency(consistent) = %v", errs)
+	}
+}
+
+// TestSrvKeyspaceCompression is a ZK specific unit test
+func TestSrvKeyspaceCompression(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	srvKeyspace := &topodatapb.SrvKeyspace{
+		Partitions: []*topodatapb.SrvKeyspace_KeyspacePartition{
+			{
+				ServedType: topodatapb.TabletType_MASTER,
+				ShardReferences: []*topodatapb.ShardReference{
+					shardReference("-80", nil, []byte{0x80}),
+					shardReference("80-", []byte{0x80}, nil),
+				},
+			},
+		},
+		ShardingColumnName: "user_id",
+	}
+	for _, compress := range []bool{false, true} {
+		if err := zkts.UpdateSrvKeyspaceWithOptions(ctx, "test", "test_keyspace", srvKeyspace, zktopo.UpdateSrvKeyspaceOptions{Compress: compress}); err != nil {
+			t.Fatalf("UpdateSrvKeyspaceWithOptions(%v): %v", compress, err)
+		}
+		data, _, err := zkts.GetZConn().Get("/zk/test/vt/ns/test_keyspace")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if strings.HasPrefix(data, "\x1f\x8b") != compress {
+			t.Errorf("unexpected data for compress=%v: %q", compress, data)
+		}
+		if got, err := zkts.GetSrvKeyspace(ctx, "test", "test_keyspace"); err != nil || !proto.Equal(got, srvKeyspace) {
+			t.Errorf("GetSrvKeyspace(compress=%v) = %v %v", compress, got, err)
+		}
+		current, _, cancel := topo.Server{Impl: ts}.WatchSrvKeyspace(ctx, "test", "test_keyspace")
+		if current.Err != nil || !proto.Equal(current.Value, srvKeyspace) {
+			t.Errorf("WatchSrvKeyspace(compress=%v) = %v", compress, current)
+		}
+		if cancel != nil {
+			cancel()
+		}
+	}
+}
+
+// TestDeleteAllSrvKeyspaces is a ZK specific unit test
+func TestDeleteAllSrvKeyspaces(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	for _, keyspace := range []string{"ks2", "ks1", "ks3"} {
+		if err := zkts.UpdateSrvKeyspace(ctx, "test", keyspace, &topodatapb.SrvKeyspace{}); err != nil {
+			t.Fatalf("UpdateSrvKeyspace: %v", err)
+		}
+	}
+
+	// a node with children can't be deleted
+	if _, err := zk.CreateRecursive(zkts.GetZConn(), "/zk/test/vt/ns/ks3/child", "", 0, zookeeper.WorldACL(zookeeper.PermAll)); err != nil {
+		t.Fatalf("CreateRecursive: %v", err)
+	}
+	deleted, errs := zkts.DeleteAllSrvKeyspaces(ctx, "test")
+	if !reflect.DeepEqual(deleted, []string{"ks1", "ks2"}) || len(errs) != 1 || !strings.Contains(errs[0].Error(), "DeleteSrvKeyspace(test, ks3) failed") {
+		t.Errorf("DeleteAllSrvKeyspaces() = %v %v", deleted, errs)
+	}
+
+	// running it again after fixing the problem finishes the job
+	if err := zkts.GetZConn().Delete("/zk/test/vt/ns/ks3/child", -1); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	deleted, errs = zkts.DeleteAllSrvKeyspaces(ctx, "test")
+	if !reflect.DeepEqual(deleted, []string{"ks3"}) || len(errs) != 0 {
+		t.Errorf("DeleteAllSrvKeyspaces() = %v %v", deleted, errs)
+	}
+	if names, err := zkts.GetSrvKeyspaceNames(ctx, "test"); err != nil || len(names) != 0 {
+		t.Errorf("GetSrvKeyspaceNames() = %v %v", names, err)
+	}
+	if deleted, errs := zkts.DeleteAllSrvKeyspaces(ctx, "test"); len(deleted) != 0 || len(errs) != 0 {
+		t.Errorf("DeleteAllSrvKeyspaces(empty) = %v %v", deleted, errs)
+	}
+}
+
+// TestNextWatchSleepDuration is a ZK specific unit test
+func TestNextWatchSleepDuration(t *testing.T) {
+	defer func(d time.Duration, j float64) {
+		zktopo.WatchSleepDuration = d
+		zktopo.WatchSleepJitter = j
+	}(zktopo.WatchSleepDuration, zktopo.WatchSleepJitter)
+	zktopo.WatchSleepDuration = 100 * time.Millisecond
+
+	zktopo.WatchSleepJitter = 0
+	if got := zktopo.NextWatchSleepDuration(); got != zktopo.WatchSleepDuration {
+		t.Errorf("NextWatchSleepDuration(no jitter) = %v, want %v", got, zktopo.WatchSleepDuration)
+	}
+
+	zktopo.WatchSleepJitter = 0.2
+	different := false
+	for i := 0; i < 100; i++ {
+		got := zktopo.NextWatchSleepDuration()
+		if got < 80*time.Millisecond || got > 120*time.Millisecond {
+			t.Fatalf("NextWatchSleepDuration(0.2 jitter) = %v, want between 80ms and 120ms", got)
+		}
+		if got != zktopo.WatchSleepDuration {
+			different = true
+		}
+	}
+	if !different {
+		t.Errorf("NextWatchSleepDuration(0.2 jitter) always returned %v", zktopo.WatchSleepDuration)
+	}
+}
+
+// TestWatchSrvVSchema is a ZK specific unit test
+func TestWatchSrvVSchema(t *testing.T) {
+	zktopo.WatchSleepDuration = 2 * time.Millisecond
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	// watching a missing node polls for it
+	current, changes, cancel := zkts.WatchSrvVSchema(ctx, "test")
+	if current.Err != topo.ErrNoNode || changes == nil {
+		t.Fatalf("WatchSrvVSchema(missing) = %v %v", current, changes)
+	}
+	srvVSchema := &vschemapb.SrvVSchema{
+		Keyspaces: map[string]*vschemapb.Keyspace{
+			"ks1": {},
+		},
+	}
+	if err := zkts.UpdateSrvVSchema(ctx, "test", srvVSchema); err != nil {
+		t.Fatalf("UpdateSrvVSchema: %v", err)
+	}
+	if wd := <-changes; wd.Err != nil || !proto.Equal(wd.Value, srvVSchema) {
+		t.Fatalf("unexpected first change: %v", wd)
+	}
+
+	// updates are sent
+	srvVSchema.Keyspaces["ks2"] = &vschemapb.Keyspace{Sharded: true}
+	if err := zkts.UpdateSrvVSchema(ctx, "test", srvVSchema); err != nil {
+		t.Fatalf("UpdateSrvVSchema: %v", err)
+	}
+	if wd := <-changes; wd.Err != nil || !proto.Equal(wd.Value, srvVSchema) {
+		t.Fatalf("unexpected second change: %v", wd)
+	}
+
+	// deleting the node sends ErrNoNode
+	if err := zkts.DeleteSrvVSchema(ctx, "test"); err != nil {
+		t.Fatalf("DeleteSrvVSchema: %v", err)
+	}
+	if wd := <-changes; wd.Err != topo.ErrNoNode {
+		t.Fatalf("unexpected change after delete: %v", wd)
+	}
+
+	// cancel sends ErrInterrupted and closes the channel
+	cancel()
+	if wd := <-changes; wd.Err != topo.ErrInterrupted {
+		t.Fatalf("unexpected change after cancel: %v", wd)
+	}
+	if wd, ok := <-changes; ok {
+		t.Fatalf("channel not closed after cancel: %v", wd)
+	}
+
+	// a corrupted initial value is a final error
+	if _, err := zk.CreateRecursive(zkts.GetZConn(), "/zk/test/vt/vschema", "not json", 0, zookeeper.WorldACL(zookeeper.PermAll)); err != nil {
+		t.Fatalf("CreateRecursive: %v", err)
+	}
+	if current, changes, _ := zkts.WatchSrvVSchema(ctx, "test"); current.Err == nil || changes != nil {
+		t.Fatalf("WatchSrvVSchema(corrupted) = %v %v", current, changes)
+	}
+}
+
+// TestSrvGraphUnmarshalError is a ZK specific unit test
+func TestSrvGraphUnmarshalError(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	data := "{\"sharding_column_name\": \"user_id\", oops" + strings.Repeat(" ", 1000) + "}"
+	if _, err := zk.CreateRecursive(zkts.GetZConn(), "/zk/test/vt/ns/test_keyspace", data, 0, zookeeper.WorldACL(zookeeper.PermAll)); err != nil {
+		t.Fatalf("CreateRecursive: %v", err)
+	}
+	_, err := zkts.GetSrvKeyspace(ctx, "test", "test_keyspace")
+	uerr, ok := err.(*zktopo.SrvGraphUnmarshalError)
+	if !ok {
+		t.Fatalf("GetSrvKeyspace(corrupted) returned %#v, want a SrvGraphUnmarshalError", err)
+	}
+	if uerr.Path != "/zk/test/vt/ns/test_keyspace" || uerr.Length != len(data) || uerr.Offset != 37 || uerr.Snippet != "7b227368617264696e675f636f6c756d6e5f6e616d65223a2022757365725f69" {
+		t.Errorf("unexpected error: %#v", uerr)
+	}
+	if strings.Contains(err.Error(), "oops") || !strings.Contains(err.Error(), "cannot unmarshal /zk/test/vt/ns/test_keyspace (1041 bytes starting with 7b22") || !strings.Contains(err.Error(), "at offset 37") {
+		t.Errorf("unexpected error message: %v", err)
+	}
+
+	// the same for SrvVSchema
+	if _, err := zk.CreateRecursive(zkts.GetZConn(), "/zk/test/vt/vschema", "[]", 0, zookeeper.WorldACL(zookeeper.PermAll)); err != nil {
+		t.Fatalf("CreateRecursive: %v", err)
+	}
+	if _, err := zkts.GetSrvVSchema(ctx, "test"); err == nil || err.(*zktopo.SrvGraphUnmarshalError).Path != "/zk/test/vt/vschema" {
+		t.Errorf("GetSrvVSchema(corrupted) = %v", err)
+	}
+}
+
+// TestStrictSrvKeyspace is a ZK specific unit test
+func TestStrictSrvKeyspace(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	data := `{
+  "partitions": [
+    {
+      "served_type": 1,
+      "shard_references": [
+        {"name": "0", "new_field": 12}
+      ]
+    }
+  ],
+  "Sharding_Column_Name": "user_id"
+}`
+	if _, err := zk.CreateRecursive(zkts.GetZConn(), "/zk/test/vt/ns/test_keyspace", data, 0, zookeeper.WorldACL(zookeeper.PermAll)); err != nil {
+		t.Fatalf("CreateRecursive: %v", err)
+	}
+
+	// lenient by default
+	got, err := zkts.GetSrvKeyspace(ctx, "test", "test_keyspace")
+	if err != nil || got.ShardingColumnName != "user_id" || got.Partitions[0].ShardReferences[0].Name != "0" {
+		t.Errorf("GetSrvKeyspace(lenient) = %v %v", got, err)
+	}
+
+	if err := flag.Set("zk_strict_srv_keyspace", "true"); err != nil {
+		t.Fatalf("flag.Set: %v", err)
+	}
+	defer flag.Set("zk_strict_srv_keyspace", "false")
+	if _, err := zkts.GetSrvKeyspace(ctx, "test", "test_keyspace"); err == nil || !strings.Contains(err.Error(), "unknown field partitions[0].shard_references[0].new_field") {
+		t.Errorf("GetSrvKeyspace(strict) = %v", err)
+	}
+
+	// known fields are fine
+	srvKeyspace := &topodatapb.SrvKeyspace{
+		Partitions: []*topodatapb.SrvKeyspace_KeyspacePartition{
+			{
+				ServedType: topodatapb.TabletType_MASTER,
+				ShardReferences: []*topodatapb.ShardReference{
+					shardReference("-80", nil, []byte{0x80}),
+				},
+			},
+		},
+		ShardingColumnName: "user_id",
+	}
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	if got, err := zkts.GetSrvKeyspace(ctx, "test", "test_keyspace"); err != nil || !proto.Equal(got, srvKeyspace) {
+		t.Errorf("GetSrvKeyspace(strict, known fields) = %v %v", got, err)
+	}
+}
+
+// TestSrvKeyspaceContentHash is a ZK specific unit test
+func TestSrvKeyspaceContentHash(t *testing.T) {
+	srvKeyspace := &topodatapb.SrvKeyspace{
+		Partitions: []*topodatapb.SrvKeyspace_KeyspacePartition{
+			{
+				ServedType: topodatapb.TabletType_MASTER,
+				ShardReferences: []*topodatapb.ShardReference{
+					shardReference("-80", nil, []byte{0x80}),
+					shardReference("80-", []byte{0x80}, nil),
+				},
+			},
+		},
+		ShardingColumnName: "user_id",
+	}
+	hash := zktopo.SrvKeyspaceContentHash(srvKeyspace)
+	if hash == 0 {
+		t.Errorf("SrvKeyspaceContentHash() = 0")
+	}
+	if got := zktopo.SrvKeyspaceContentHash(proto.Clone(srvKeyspace).(*topodatapb.SrvKeyspace)); got != hash {
+		t.Errorf("SrvKeyspaceContentHash(copy) = %v, want %v", got, hash)
+	}
+	srvKeyspace.Partitions[0].ShardReferences[1].Name = "80-c0"
+	if got := zktopo.SrvKeyspaceContentHash(srvKeyspace); got == hash {
+		t.Errorf("SrvKeyspaceContentHash(changed) didn't change")
+	}
+}
+
+// aclConn is a zk.Conn that records the ACL of the created nodes.
+type aclConn struct {
+	zk.Conn
+	acls map[string][]zookeeper.ACL
+}
+
+func (conn *aclConn) Create(path, value string, flags int, aclv []zookeeper.ACL) (string, error) {
+	conn.acls[path] = aclv
+	return conn.Conn.Create(path, value, flags, aclv)
+}
+
+// TestServingGraphACL is a ZK specific unit test
+func TestServingGraphACL(t *testing.T) {
+	ctx := context.Background()
+	acl := zookeeper.DigestACL(zookeeper.PermAll, "vitess", "secret")
+
+	for _, tc := range []struct {
+		acl  []zookeeper.ACL
+		want []zookeeper.ACL
+	}{
+		{nil, zookeeper.WorldACL(zookeeper.PermAll)},
+		{acl, acl},
+	} {
+		conn := &aclConn{Conn: fakezk.NewConn(), acls: make(map[string][]zookeeper.ACL)}
+		zkts := zktopo.NewServer(conn).(*zktopo.Server)
+		if tc.acl != nil {
+			zkts.SetServingGraphACL(tc.acl)
+		}
+		if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", &topodatapb.SrvKeyspace{}); err != nil {
+			t.Fatalf("UpdateSrvKeyspace: %v", err)
+		}
+		if err := zkts.UpdateSrvVSchema(ctx, "test", &vschemapb.SrvVSchema{}); err != nil {
+			t.Fatalf("UpdateSrvVSchema: %v", err)
+		}
+		for _, path := range []string{"/zk/test/vt/ns/test_keyspace", "/zk/test/vt/vschema"} {
+			if got := conn.acls[path]; !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("%v created with ACL %v, want %v", path, got, tc.want)
+			}
+		}
+		if got := conn.acls["/zk/test/vt/ns"]; len(got) != 1 || got[0].Scheme != tc.want[0].Scheme || got[0].Perms != zk.PermDirectory {
+			t.Errorf("/zk/test/vt/ns created with ACL %v", got)
+		}
+	}
+}
+
+// TestGetServingKeyspaceNames is a ZK specific unit test
+func TestGetServingKeyspaceNames(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	for keyspace, servedTypes := range map[string][]topodatapb.TabletType{
+		"ks1": {topodatapb.TabletType_MASTER, topodatapb.TabletType_REPLICA},
+		"ks2": {topodatapb.TabletType_MASTER},
+		"ks3": {topodatapb.TabletType_REPLICA, topodatapb.TabletType_RDONLY},
+		"ks4": nil,
+	} {
+		srvKeyspace := &topodatapb.SrvKeyspace{}
+		for _, servedType := range servedTypes {
+			srvKeyspace.Partitions = append(srvKeyspace.Partitions, &topodatapb.SrvKeyspace_KeyspacePartition{
+				ServedType: servedType,
+			})
+		}
+		if err := zkts.UpdateSrvKeyspace(ctx, "test", keyspace, srvKeyspace); err != nil {
+			t.Fatalf("UpdateSrvKeyspace: %v", err)
+		}
+	}
+
+	for servedType, want := range map[topodatapb.TabletType][]string{
+		topodatapb.TabletType_MASTER:  {"ks1", "ks2"},
+		topodatapb.TabletType_REPLICA: {"ks1", "ks3"},
+		topodatapb.TabletType_RDONLY:  {"ks3"},
+		topodatapb.TabletType_BACKUP:  nil,
+	} {
+		if got, err := zkts.GetServingKeyspaceNames(ctx, "test", servedType); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("GetServingKeyspaceNames(%v) = %v %v, want %v", servedType, got, err, want)
+		}
+	}
+}
+
+// TestDiffSrvKeyspace is a ZK specific unit test
+func TestDiffSrvKeyspace(t *testing.T) {
+	left := &topodatapb.SrvKeyspace{
+		Partitions: []*topodatapb.SrvKeyspace_KeyspacePartition{
+			{
+				ServedType: topodatapb.TabletType_MASTER,
+				ShardReferences: []*topodatapb.ShardReference{
+					shardReference("0", nil, nil),
+				},
+			},
+			{
+				ServedType: topodatapb.TabletType_REPLICA,
+				ShardReferences: []*topodatapb.ShardReference{
+					shardReference("-80", nil, []byte{0x80}),
+					shardReference("80-", []byte{0x80}, nil),
+				},
+			},
+			{
+				ServedType: topodatapb.TabletType_BACKUP,
+			},
+		},
+		ShardingColumnName: "user_id",
+		ServedFrom: []*topodatapb.SrvKeyspace_ServedFrom{
+			{TabletType: topodatapb.TabletType_RDONLY, Keyspace: "source"},
+			{TabletType: topodatapb.TabletType_MASTER, Keyspace: "source"},
+		},
+	}
+	if got := zktopo.DiffSrvKeyspace(left, proto.Clone(left).(*topodatapb.SrvKeyspace)); got != nil {
+		t.Errorf("DiffSrvKeyspace(same) = %v", got)
+	}
+
+	right := &topodatapb.SrvKeyspace{
+		Partitions: []*topodatapb.SrvKeyspace_KeyspacePartition{
+			{
+				ServedType: topodatapb.TabletType_RDONLY,
+			},
+			{
+				ServedType: topodatapb.TabletType_MASTER,
+				ShardReferences: []*topodatapb.ShardReference{
+					shardReference("-80", nil, []byte{0x80}),
+					shardReference("80-", []byte{0x80}, nil),
+				},
+			},
+			{
+				ServedType: topodatapb.TabletType_REPLICA,
+				ShardReferences: []*topodatapb.ShardReference{
+					shardReference("-80", nil, []byte{0x80}),
+					shardReference("80-", []byte{0x90}, nil),
+				},
+			},
+		},
+		ShardingColumnName: "user_id",
+		ShardingColumnType: topodatapb.KeyspaceIdType_UINT64,
+		ServedFrom: []*topodatapb.SrvKeyspace_ServedFrom{
+			{TabletType: topodatapb.TabletType_MASTER, Keyspace: "other_source"},
+			{TabletType: topodatapb.TabletType_REPLICA, Keyspace: "source"},
+		},
+	}
+	want := []string{
+		"sharding column type changed from UNSET to UINT64",
+		"partition for MASTER: shard 0 removed",
+		"partition for MASTER: shard -80 added",
+		"partition for MASTER: shard 80- added",
+		"partition for REPLICA: shard 80- KeyRange changed from 80- to 90-",
+		"partition for RDONLY added",
+		"partition for BACKUP removed",
+		"MASTER served from changed from source to other_source",
+		"REPLICA added a served from source",
+		"RDONLY removed its served from source",
+	}
+	if got := zktopo.DiffSrvKeyspace(left, right); !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffSrvKeyspace() =\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// slowConn is a zk.Conn where Create and Children block until release
+// is closed.
+type slowConn struct {
+	zk.Conn
+	release chan struct{}
+}
+
+func (conn *slowConn) Create(path, value string, flags int, aclv []zookeeper.ACL) (string, error) {
+	<-conn.release
+	return conn.Conn.Create(path, value, flags, aclv)
+}
+
+// TestUpdateSrvKeyspaceCreateTimeout is a ZK specific unit test
+func TestUpdateSrvKeyspaceCreateTimeout(t *testing.T) {
+	conn := &slowConn{Conn: fakezk.NewConn(), release: make(chan struct{})}
+	defer close(conn.release)
+	zkts := zktopo.NewServer(conn).(*zktopo.Server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", &topodatapb.SrvKeyspace{})
+	if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Errorf("UpdateSrvKeyspace(slow) = %v, want a deadline error", err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed > 5*time.Second {
+		t.Errorf("UpdateSrvKeyspace(slow) took %v", elapsed)
+	}
+}
+
+// TestGetSrvKeyspaceRaw is a ZK specific unit test
+func TestGetSrvKeyspaceRaw(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	if _, _, err := zkts.GetSrvKeyspaceRaw(ctx, "test", "test_keyspace"); err != topo.ErrNoNode {
+		t.Errorf("GetSrvKeyspaceRaw(missing) = %v, want ErrNoNode", err)
+	}
+
+	// even corrupted data can be read
+	if _, err := zk.CreateRecursive(zkts.GetZConn(), "/zk/test/vt/ns/test_keyspace", "not json", 0, zookeeper.WorldACL(zookeeper.PermAll)); err != nil {
+		t.Fatalf("CreateRecursive: %v", err)
+	}
+	data, stat, err := zkts.GetSrvKeyspaceRaw(ctx, "test", "test_keyspace")
+	if err != nil || string(data) != "not json" || stat.Version != 0 {
+		t.Errorf("GetSrvKeyspaceRaw(corrupted) = %q %v %v", data, stat, err)
+	}
+
+	srvKeyspace := &topodatapb.SrvKeyspace{ShardingColumnName: "user_id"}
+	if err := zkts.UpdateSrvKeyspaceWithOptions(ctx, "test", "test_keyspace", srvKeyspace, zktopo.UpdateSrvKeyspaceOptions{Compress: true}); err != nil {
+		t.Fatalf("UpdateSrvKeyspaceWithOptions: %v", err)
+	}
+	data, stat, err = zkts.GetSrvKeyspaceRaw(ctx, "test", "test_keyspace")
+	if err != nil || !strings.HasPrefix(string(data), "\x1f\x8b") || stat.Version != 1 {
+		t.Errorf("GetSrvKeyspaceRaw(compressed) = %q %v %v", data, stat, err)
+	}
+}
+
+// TestCheckServingGraph is a ZK specific unit test
+func TestCheckServingGraph(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	// no serving graph yet
+	if err := zkts.CheckServingGraph(ctx, "test"); err != nil {
+		t.Errorf("CheckServingGraph(empty) = %v", err)
+	}
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", &topodatapb.SrvKeyspace{}); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	if err := zkts.CheckServingGraph(ctx, "test"); err != nil {
+		t.Errorf("CheckServingGraph = %v", err)
+	}
+
+	flaky := &flakyChildrenConn{Conn: fakezk.NewConn()}
+	if err := zktopo.NewServer(flaky).(*zktopo.Server).CheckServingGraph(ctx, "test"); err != zookeeper.ErrConnectionClosed {
+		t.Errorf("CheckServingGraph(closed) = %v, want ErrConnectionClosed", err)
+	}
+
+	conn := &slowConn{Conn: fakezk.NewConn(), release: make(chan struct{})}
+	defer close(conn.release)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	err := zktopo.NewServer(conn).(*zktopo.Server).CheckServingGraph(timeoutCtx, "test")
+	if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Errorf("CheckServingGraph(slow) = %v, want a deadline error", err)
+	}
+}
+
+// flakyChildrenConn is a zk.Conn where Children always fails with
+// ErrConnectionClosed.
+type flakyChildrenConn struct {
+	zk.Conn
+}
+
+func (conn *flakyChildrenConn) Children(path string) ([]string, *zookeeper.Stat, error) {
+	return nil, nil, zookeeper.ErrConnectionClosed
+}
+
+// expiringConn is a zk.Conn that can simulate a session expiry: expire
+// sends the session expired event to all the current watches, and the
+// next failures calls to GetW and ChildrenW then fail with
+// ErrConnectionClosed, as if the new session was not there yet.
+type expiringConn struct {
+	zk.Conn
+
+	mu       sync.Mutex
+	watches  []chan zookeeper.Event
+	failures int
+}
+
+func (conn *expiringConn) wrap(watch <-chan zookeeper.Event) <-chan zookeeper.Event {
+	result := make(chan zookeeper.Event, 1)
+	conn.watches = append(conn.watches, result)
+	go func() {
+		if event, ok := <-watch; ok {
+			select {
+			case result <- event:
+			default:
+			}
+		}
+	}()
+	return result
+}
+
+func (conn *expiringConn) expire(failures int) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.failures = failures
+	for _, watch := range conn.watches {
+		select {
+		case watch <- zookeeper.Event{Type: zookeeper.EventNotWatching, State: zookeeper.StateDisconnected, Err: zookeeper.ErrSessionExpired}:
+		default:
+		}
+	}
+	conn.watches = nil
+}
+
+func (conn *expiringConn) fail() bool {
+	if conn.failures > 0 {
+		conn.failures--
+		return true
+	}
+	return false
+}
+
+func (conn *expiringConn) GetW(path string) (string, *zookeeper.Stat, <-chan zookeeper.Event, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.fail() {
+		return "", nil, nil, zookeeper.ErrConnectionClosed
+	}
+	data, stat, watch, err := conn.Conn.GetW(path)
+	if err != nil {
+		return data, stat, watch, err
+	}
+	return data, stat, conn.wrap(watch), nil
+}
+
+func (conn *expiringConn) ChildrenW(path string) ([]string, *zookeeper.Stat, <-chan zookeeper.Event, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.fail() {
+		return nil, nil, nil, zookeeper.ErrConnectionClosed
+	}
+	children, stat, watch, err := conn.Conn.ChildrenW(path)
+	if err != nil {
+		return children, stat, watch, err
+	}
+	return children, stat, conn.wrap(watch), nil
+}
+
+// TestWatchSessionExpiry is a ZK specific unit test
+func TestWatchSessionExpiry(t *testing.T) {
+	zktopo.WatchSleepDuration = 2 * time.Millisecond
+	ctx := context.Background()
+	conn := &expiringConn{Conn: fakezk.NewConn()}
+	zkts := zktopo.NewServer(conn).(*zktopo.Server)
+
+	srvKeyspace := &topodatapb.SrvKeyspace{ShardingColumnName: "user_id"}
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	current, changes, cancel := zkts.WatchSrvKeyspace(ctx, "test", "test_keyspace")
+	if current.Err != nil || !proto.Equal(current.Value, srvKeyspace) {
+		t.Fatalf("WatchSrvKeyspace() = %v", current)
+	}
+	defer cancel()
+	names, namesChanges, namesCancel, err := zkts.WatchSrvKeyspaceNames(ctx, "test")
+	if err != nil || !reflect.DeepEqual(names, []string{"test_keyspace"}) {
+		t.Fatalf("WatchSrvKeyspaceNames() = %v %v", names, err)
+	}
+	defer namesCancel()
+
+	// the expiry is sent, and the value is sent again once the
+	// connection is back
+	conn.expire(2)
+	if wd := <-changes; wd.Err != zktopo.ErrSessionExpired {
+		t.Fatalf("unexpected change after expiry: %v", wd)
+	}
+	if wd := <-changes; wd.Err != nil || !proto.Equal(wd.Value, srvKeyspace) {
+		t.Fatalf("unexpected change after resubscribing: %v", wd)
+	}
+	if names := <-namesChanges; !reflect.DeepEqual(names, []string{"test_keyspace"}) {
+		t.Fatalf("unexpected names after resubscribing: %v", names)
+	}
+	if kind := zktopo.ClassifyTopoError(zktopo.ErrSessionExpired); kind != zktopo.ClassifyTopoError(zookeeper.ErrSessionExpired) {
+		t.Errorf("ClassifyTopoError(ErrSessionExpired) = %v", kind)
+	}
+
+	// the watches still work
+	srvKeyspace.ShardingColumnName = "other_id"
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	if wd := <-changes; wd.Err != nil || !proto.Equal(wd.Value, srvKeyspace) {
+		t.Fatalf("unexpected change after update: %v", wd)
+	}
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "other_keyspace", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	if names := <-namesChanges; !reflect.DeepEqual(names, []string{"other_keyspace", "test_keyspace"}) {
+		t.Fatalf("unexpected names after update: %v", names)
+	}
+}
+
+// TestServingGraphInvalidNames is a ZK specific unit test
+func TestServingGraphInvalidNames(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	for _, tc := range []struct {
+		cell     string
+		keyspace string
+		want     string
+	}{
+		{"", "test_keyspace", "empty cell name"},
+		{"..", "test_keyspace", "dot segments are not allowed"},
+		{"test/../../global", "test_keyspace", "path separators are not allowed"},
+		{"/test", "test_keyspace", "path separators are not allowed"},
+		{"test/", "test_keyspace", "path separators are not allowed"},
+		{"test", "", "empty keyspace name"},
+		{"test", ".", "dot segments are not allowed"},
+		{"test", "..", "dot segments are not allowed"},
+		{"test", "../vschema", "path separators are not allowed"},
+		{"test", "a/b", "path separators are not allowed"},
+	} {
+		if err := zkts.UpdateSrvKeyspace(ctx, tc.cell, tc.keyspace, &topodatapb.SrvKeyspace{}); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("UpdateSrvKeyspace(%q, %q) = %v, want error containing %q", tc.cell, tc.keyspace, err, tc.want)
+		}
+		if _, err := zkts.GetSrvKeyspace(ctx, tc.cell, tc.keyspace); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("GetSrvKeyspace(%q, %q) = %v, want error containing %q", tc.cell, tc.keyspace, err, tc.want)
+		}
+		if err := zkts.DeleteSrvKeyspace(ctx, tc.cell, tc.keyspace); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("DeleteSrvKeyspace(%q, %q) = %v, want error containing %q", tc.cell, tc.keyspace, err, tc.want)
+		}
+		if current, _, _ := zkts.WatchSrvKeyspace(ctx, tc.cell, tc.keyspace); current.Err == nil || !strings.Contains(current.Err.Error(), tc.want) {
+			t.Errorf("WatchSrvKeyspace(%q, %q) = %v, want error containing %q", tc.cell, tc.keyspace, current.Err, tc.want)
+		}
+	}
+
+	for _, cell := range []string{"", ".", "..", "test/..", "../test"} {
+		if _, err := zkts.GetSrvKeyspaceNames(ctx, cell); err == nil {
+			t.Errorf("GetSrvKeyspaceNames(%q) worked", cell)
+		}
+		if err := zkts.UpdateSrvVSchema(ctx, cell, &vschemapb.SrvVSchema{}); err == nil {
+			t.Errorf("UpdateSrvVSchema(%q) worked", cell)
+		}
+		if _, err := zkts.GetSrvVSchema(ctx, cell); err == nil {
+			t.Errorf("GetSrvVSchema(%q) worked", cell)
+		}
+		if err := zkts.CheckServingGraph(ctx, cell); err == nil {
+			t.Errorf("CheckServingGraph(%q) worked", cell)
+		}
+	}
+
+	if current, _, _ := zkts.Watch(ctx, "test", "/../../global/vt/keyspaces"); current.Err == nil || !strings.Contains(current.Err.Error(), "outside of cell test") {
+		t.Errorf("Watch(escaping) = %v", current.Err)
+	}
+
+	// nothing was written outside of the cell
+	if children, _, err := zkts.GetZConn().Children("/zk"); err != nil || len(children) != 2 {
+		t.Errorf("Children(/zk) = %v %v", children, err)
+	}
+}
+
+// TestWatchSrvKeyspaceNames is a ZK specific unit test
+func TestWatchSrvKeyspaceNames(t *testing.T) {
+	zktopo.WatchSleepDuration = 2 * time.Millisecond
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	// watching a cell without SrvKeyspace polls for them
+	current, changes, cancel, err := zkts.WatchSrvKeyspaceNames(ctx, "test")
+	if err != nil || len(current) != 0 || changes == nil {
+		t.Fatalf("WatchSrvKeyspaceNames(empty) = %v %v %v", current, changes, err)
+	}
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "ks2", &topodatapb.SrvKeyspace{}); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	if names := <-changes; !reflect.DeepEqual(names, []string{"ks2"}) {
+		t.Fatalf("unexpected first change: %v", names)
+	}
+
+	// new keyspaces are sent, sorted
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "ks1", &topodatapb.SrvKeyspace{}); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	if names := <-changes; !reflect.DeepEqual(names, []string{"ks1", "ks2"}) {
+		t.Fatalf("unexpected second change: %v", names)
+	}
+
+	// so are removed ones
+	if err := zkts.DeleteSrvKeyspace(ctx, "test", "ks2"); err != nil {
+		t.Fatalf("DeleteSrvKeyspace: %v", err)
+	}
+	if names := <-changes; !reflect.DeepEqual(names, []string{"ks1"}) {
+		t.Fatalf("unexpected change after delete: %v", names)
+	}
+
+	// cancel closes the channel
+	cancel()
+	for range changes {
+	}
+
+	// a new watch starts with the current names
+	current, _, cancel, err = zkts.WatchSrvKeyspaceNames(ctx, "test")
+	if err != nil || !reflect.DeepEqual(current, []string{"ks1"}) {
+		t.Fatalf("WatchSrvKeyspaceNames = %v %v", current, err)
+	}
+	cancel()
+
+	if _, _, _, err := zkts.WatchSrvKeyspaceNames(ctx, "../test"); err == nil {
+		t.Errorf("WatchSrvKeyspaceNames(invalid cell) worked")
+	}
+}
+
+// TestClassifyTopoError is a ZK specific unit test
+func TestClassifyTopoError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want zktopo.TopoErrorKind
+	}{
+		{nil, zktopo.TopoErrorNone},
+		{fmt.Errorf("something else"), zktopo.TopoErrorOther},
+		{topo.ErrNoNode, zktopo.TopoErrorNoNode},
+		{zookeeper.ErrNoNode, zktopo.TopoErrorNoNode},
+		{zookeeper.ErrNodeExists, zktopo.TopoErrorNodeExists},
+		{topo.ErrBadVersion, zktopo.TopoErrorBadVersion},
+		{zookeeper.ErrNotEmpty, zktopo.TopoErrorNotEmpty},
+		{zookeeper.ErrSessionExpired, zktopo.TopoErrorTimeout},
+		{zktopo.ErrSessionExpired, zktopo.TopoErrorTimeout},
+		{context.DeadlineExceeded, zktopo.TopoErrorTimeout},
+		{context.Canceled, zktopo.TopoErrorInterrupted},
+		{topo.ErrInterrupted, zktopo.TopoErrorInterrupted},
+		{zookeeper.ErrConnectionClosed, zktopo.TopoErrorConnectionLost},
+	} {
+		if got := zktopo.ClassifyTopoError(tc.err); got != tc.want {
+			t.Errorf("ClassifyTopoError(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+
+	// errors returned by the Server are classified
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	_, err := ts.GetSrvKeyspace(context.Background(), "test", "missing")
+	if got := zktopo.ClassifyTopoError(err); got != zktopo.TopoErrorNoNode {
+		t.Errorf("ClassifyTopoError(%v) = %v, want NoNode", err, got)
+	}
+}
+
+// TestCompactJSON is a ZK specific unit test
+func TestCompactJSON(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	srvKeyspace := &topodatapb.SrvKeyspace{ShardingColumnName: "user_id"}
+	srvVSchema := &vschemapb.SrvVSchema{Keyspaces: map[string]*vschemapb.Keyspace{"ks1": {Sharded: true}}}
+
+	// indented by default
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	data, _, err := zkts.GetSrvKeyspaceRaw(ctx, "test", "test_keyspace")
+	if err != nil || !strings.Contains(string(data), "\n") {
+		t.Errorf("default SrvKeyspace encoding = %q %v", data, err)
+	}
+	hash := zktopo.SrvKeyspaceContentHash(srvKeyspace)
+
+	zkts.SetCompactJSON(true)
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	data, _, err = zkts.GetSrvKeyspaceRaw(ctx, "test", "test_keyspace")
+	if err != nil || strings.ContainsAny(string(data), "\n ") {
+		t.Errorf("compact SrvKeyspace encoding = %q %v", data, err)
+	}
+	if got, err := zkts.GetSrvKeyspace(ctx, "test", "test_keyspace"); err != nil || !proto.Equal(got, srvKeyspace) {
+		t.Errorf("GetSrvKeyspace(compact) = %v %v", got, err)
+	}
+	if got := zktopo.SrvKeyspaceContentHash(srvKeyspace); got != hash {
+		t.Errorf("SrvKeyspaceContentHash depends on SetCompactJSON: %v != %v", got, hash)
+	}
+
+	if err := zkts.UpdateSrvVSchema(ctx, "test", srvVSchema); err != nil {
+		t.Fatalf("UpdateSrvVSchema: %v", err)
+	}
+	vdata, _, err := zkts.GetZConn().Get("/zk/test/vt/vschema")
+	if err != nil || strings.ContainsAny(vdata, "\n ") {
+		t.Errorf("compact SrvVSchema encoding = %q %v", vdata, err)
+	}
+	if got, err := zkts.GetSrvVSchema(ctx, "test"); err != nil || !proto.Equal(got, srvVSchema) {
+		t.Errorf("GetSrvVSchema(compact) = %v %v", got, err)
+	}
+}
+
+// TestValidateSrvVSchema is a ZK specific unit test
+func TestValidateSrvVSchema(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	valid := &vschemapb.SrvVSchema{
+		Keyspaces: map[string]*vschemapb.Keyspace{
+			"user": {
+				Sharded: true,
+				Vindexes: map[string]*vschemapb.Vindex{
+					"user_index": {Type: "hash"},
+				},
+				Tables: map[string]*vschemapb.Table{
+					"user": {ColumnVindexes: []*vschemapb.ColumnVindex{{Column: "id", Name: "user_index"}}},
+				},
+			},
+			"lookup": {
+				Tables: map[string]*vschemapb.Table{
+					"seq": {Type: "sequence"},
+				},
+			},
+			"empty": {Sharded: true},
+		},
+	}
+	if err := zktopo.ValidateSrvVSchema(valid); err != nil {
+		t.Errorf("ValidateSrvVSchema(valid) = %v", err)
+	}
+	if err := zkts.UpdateSrvVSchema(ctx, "test", valid); err != nil {
+		t.Errorf("UpdateSrvVSchema(valid) = %v", err)
+	}
+
+	dangling := proto.Clone(valid).(*vschemapb.SrvVSchema)
+	dangling.Keyspaces["user"].Tables["user_extra"] = &vschemapb.Table{
+		ColumnVindexes: []*vschemapb.ColumnVindex{{Column: "user_id", Name: "user_index"}, {Column: "email", Name: "email_index"}},
+	}
+	noVindex := proto.Clone(valid).(*vschemapb.SrvVSchema)
+	noVindex.Keyspaces["user"].Tables["music"] = &vschemapb.Table{}
+	for _, tc := range []struct {
+		srvVSchema *vschemapb.SrvVSchema
+		want       string
+	}{
+		{dangling, "table user_extra in keyspace user uses vindex email_index, which is not defined in the keyspace"},
+		{noVindex, "table music in sharded keyspace user has no primary vindex"},
+	} {
+		if err := zktopo.ValidateSrvVSchema(tc.srvVSchema); err == nil || err.Error() != tc.want {
+			t.Errorf("ValidateSrvVSchema() = %v, want %v", err, tc.want)
+		}
+		if err := zkts.UpdateSrvVSchema(ctx, "test", tc.srvVSchema); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("UpdateSrvVSchema() = %v, want %v", err, tc.want)
+		}
+		if _, err := zkts.UpdateSrvVSchemaWithVersion(ctx, "test", tc.srvVSchema, -1); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("UpdateSrvVSchemaWithVersion() = %v, want %v", err, tc.want)
+		}
+	}
+	if got, err := zkts.GetSrvVSchema(ctx, "test"); err != nil || !proto.Equal(got, valid) {
+		t.Errorf("invalid SrvVSchema was stored: %v %v", got, err)
+	}
+
+	// validation can be skipped
+	if err := zkts.UpdateSrvVSchemaWithOptions(ctx, "test", dangling, zktopo.UpdateSrvVSchemaOptions{SkipValidation: true}); err != nil {
+		t.Errorf("UpdateSrvVSchemaWithOptions(SkipValidation) = %v", err)
+	}
+	if got, err := zkts.GetSrvVSchema(ctx, "test"); err != nil || !proto.Equal(got, dangling) {
+		t.Errorf("GetSrvVSchema = %v %v, want %v", got, err, dangling)
+	}
+}
+
+// TestGetCellServingGraph is a ZK specific unit test
+func TestGetCellServingGraph(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	// empty cell
+	graph, err := zkts.GetCellServingGraph(ctx, "test")
+	if err != nil || graph.SrvVSchema != nil || len(graph.SrvKeyspaces) != 0 || len(graph.Errors) != 0 {
+		t.Fatalf("GetCellServingGraph(empty) = %v %v", graph, err)
+	}
+
+	srvVSchema := &vschemapb.SrvVSchema{Keyspaces: map[string]*vschemapb.Keyspace{"ks1": {}}}
+	if err := zkts.UpdateSrvVSchema(ctx, "test", srvVSchema); err != nil {
+		t.Fatalf("UpdateSrvVSchema: %v", err)
+	}
+	srvKeyspace := &topodatapb.SrvKeyspace{ShardingColumnName: "user_id"}
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "ks1", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	if _, err := zk.CreateRecursive(zkts.GetZConn(), "/zk/test/vt/ns/ks2", "not json", 0, zookeeper.WorldACL(zookeeper.PermAll)); err != nil {
+		t.Fatalf("CreateRecursive: %v", err)
+	}
+
+	// a corrupted SrvKeyspace is not fatal
+	graph, err = zkts.GetCellServingGraph(ctx, "test")
+	if err != nil {
+		t.Fatalf("GetCellServingGraph = %v", err)
+	}
+	if !proto.Equal(graph.SrvVSchema, srvVSchema) {
+		t.Errorf("SrvVSchema = %v, want %v", graph.SrvVSchema, srvVSchema)
+	}
+	if len(graph.SrvKeyspaces) != 1 || !proto.Equal(graph.SrvKeyspaces["ks1"], srvKeyspace) {
+		t.Errorf("SrvKeyspaces = %v", graph.SrvKeyspaces)
+	}
+	if len(graph.Errors) != 1 || graph.Errors["ks2"] == nil {
+		t.Errorf("Errors = %v", graph.Errors)
+	}
+
+	// a corrupted SrvVSchema is
+	if _, err := zkts.GetZConn().Set("/zk/test/vt/vschema", "not json", -1); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if graph, err := zkts.GetCellServingGraph(ctx, "test"); err == nil || !strings.Contains(err.Error(), "GetSrvVSchema(test) failed") {
+		t.Errorf("GetCellServingGraph(corrupted SrvVSchema) = %v %v", graph, err)
+	}
+}
+
+// conflictingConn is a zk.Conn where the first conflicts calls to Set
+// fail with ErrBadVersion, as if the node had been changed.
+type conflictingConn struct {
+	zk.Conn
+	conflicts int
+	calls     int
+}
+
+func (conn *conflictingConn) Set(path, value string, version int32) (*zookeeper.Stat, error) {
+	conn.calls++
+	if conn.calls <= conn.conflicts {
+		return nil, zookeeper.ErrBadVersion
+	}
+	return conn.Conn.Set(path, value, version)
+}
+
+// getCountingConn is a zk.Conn counting the calls to Get.
+type getCountingConn struct {
+	zk.Conn
+	gets int
+}
+
+func (conn *getCountingConn) Get(path string) (string, *zookeeper.Stat, error) {
+	conn.gets++
+	return conn.Conn.Get(path)
+}
+
+// TestSrvKeyspaceCache is a ZK specific unit test
+func TestSrvKeyspaceCache(t *testing.T) {
+	ctx := context.Background()
+	conn := &getCountingConn{Conn: fakezk.NewConn()}
+	zkts := zktopo.NewServer(conn).(*zktopo.Server)
+	zkts.EnableSrvKeyspaceCache()
+
+	if _, err := zkts.GetSrvKeyspace(ctx, "cache_cell", "test_keyspace"); err != topo.ErrNoNode {
+		t.Errorf("GetSrvKeyspace(missing) = %v, want ErrNoNode", err)
+	}
+
+	srvKeyspace := &topodatapb.SrvKeyspace{ShardingColumnName: "user_id"}
+	if err := zkts.UpdateSrvKeyspace(ctx, "cache_cell", "test_keyspace", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+
+	// the second read only checks the version
+	conn.gets = 0
+	for i := 0; i < 2; i++ {
+		got, err := zkts.GetSrvKeyspace(ctx, "cache_cell", "test_keyspace")
+		if err != nil || !proto.Equal(got, srvKeyspace) {
+			t.Fatalf("GetSrvKeyspace() = %v %v", got, err)
+		}
+		// callers can't change the cached value
+		got.ShardingColumnName = "changed"
+	}
+	if conn.gets != 1 {
+		t.Errorf("got %v calls to Get, want 1", conn.gets)
+	}
+
+	// a new version is read again
+	srvKeyspace.ShardingColumnName = "other_id"
+	if err := zkts.UpdateSrvKeyspace(ctx, "cache_cell", "test_keyspace", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	conn.gets = 0
+	got, stat, err := zkts.GetSrvKeyspaceWithStat(ctx, "cache_cell", "test_keyspace")
+	if err != nil || !proto.Equal(got, srvKeyspace) || stat.Version != 1 {
+		t.Errorf("GetSrvKeyspaceWithStat() = %v %v %v", got, stat, err)
+	}
+	if conn.gets != 1 {
+		t.Errorf("got %v calls to Get, want 1", conn.gets)
+	}
+
+	// a deleted node is not served from the cache
+	if err := zkts.DeleteSrvKeyspace(ctx, "cache_cell", "test_keyspace"); err != nil {
+		t.Fatalf("DeleteSrvKeyspace: %v", err)
+	}
+	if _, err := zkts.GetSrvKeyspace(ctx, "cache_cell", "test_keyspace"); err != topo.ErrNoNode {
+		t.Errorf("GetSrvKeyspace(deleted) = %v, want ErrNoNode", err)
+	}
+
+	stats := expvar.Get("ZkTopoSrvKeyspaceCache").String()
+	for _, want := range []string{"\"cache_cell.Hit\": 1", "\"cache_cell.Miss\": 2"} {
+		if !strings.Contains(stats, want) {
+			t.Errorf("ZkTopoSrvKeyspaceCache doesn't contain %v: %v", want, stats)
+		}
+	}
+
+	// a node deleted and created again by another process, with the
+	// same version, is read again
+	old := &topodatapb.SrvKeyspace{ShardingColumnName: "old"}
+	if err := zkts.UpdateSrvKeyspace(ctx, "cache_cell", "test_keyspace", old); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	if got, err := zkts.GetSrvKeyspace(ctx, "cache_cell", "test_keyspace"); err != nil || !proto.Equal(got, old) {
+		t.Fatalf("GetSrvKeyspace() = %v %v", got, err)
+	}
+	other := zktopo.NewServer(conn.Conn).(*zktopo.Server)
+	if err := other.DeleteSrvKeyspace(ctx, "cache_cell", "test_keyspace"); err != nil {
+		t.Fatalf("DeleteSrvKeyspace: %v", err)
+	}
+	recreated := &topodatapb.SrvKeyspace{ShardingColumnName: "new"}
+	if err := other.UpdateSrvKeyspace(ctx, "cache_cell", "test_keyspace", recreated); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	got, stat, err = zkts.GetSrvKeyspaceWithStat(ctx, "cache_cell", "test_keyspace")
+	if err != nil || !proto.Equal(got, recreated) || stat.Version != 0 {
+		t.Errorf("GetSrvKeyspaceWithStat(recreated) = %v %v %v", got, stat, err)
+	}
+}
+
+// TestUpdateSrvVSchemaFunc is a ZK specific unit test
+func TestUpdateSrvVSchemaFunc(t *testing.T) {
+	ctx := context.Background()
+	addKeyspace := func(name string) func(*vschemapb.SrvVSchema) error {
+		return func(srvVSchema *vschemapb.SrvVSchema) error {
+			if srvVSchema.Keyspaces == nil {
+				srvVSchema.Keyspaces = make(map[string]*vschemapb.Keyspace)
+			}
+			srvVSchema.Keyspaces[name] = &vschemapb.Keyspace{}
+			return nil
+		}
+	}
+
+	conn := &conflictingConn{Conn: fakezk.NewConn()}
+	zkts := zktopo.NewServer(conn).(*zktopo.Server)
+
+	// the node is created if missing
+	if err := zkts.UpdateSrvVSchemaFunc(ctx, "test", addKeyspace("ks1")); err != nil {
+		t.Fatalf("UpdateSrvVSchemaFunc(missing) = %v", err)
+	}
+
+	// conflicts are retried
+	conn.conflicts = 2
+	if err := zkts.UpdateSrvVSchemaFunc(ctx, "test", addKeyspace("ks2")); err != nil {
+		t.Fatalf("UpdateSrvVSchemaFunc(conflicts) = %v", err)
+	}
+	if conn.calls != 3 {
+		t.Errorf("got %v calls to Set, want 3", conn.calls)
+	}
+	srvVSchema, err := zkts.GetSrvVSchema(ctx, "test")
+	if err != nil || len(srvVSchema.Keyspaces) != 2 || srvVSchema.Keyspaces["ks1"] == nil || srvVSchema.Keyspaces["ks2"] == nil {
+		t.Errorf("GetSrvVSchema = %v %v", srvVSchema, err)
+	}
+
+	// but not forever
+	conn.calls = 0
+	conn.conflicts = 100
+	if err := zkts.UpdateSrvVSchemaFunc(ctx, "test", addKeyspace("ks3")); err == nil || !strings.Contains(err.Error(), "changed concurrently 5 times") {
+		t.Errorf("UpdateSrvVSchemaFunc(always conflicting) = %v", err)
+	}
+	conn.conflicts = 0
+
+	// an error from the update aborts it
+	abort := fmt.Errorf("abort")
+	if err := zkts.UpdateSrvVSchemaFunc(ctx, "test", func(srvVSchema *vschemapb.SrvVSchema) error {
+		srvVSchema.Keyspaces = nil
+		return abort
+	}); err != abort {
+		t.Errorf("UpdateSrvVSchemaFunc(abort) = %v", err)
+	}
+	if got, err := zkts.GetSrvVSchema(ctx, "test"); err != nil || !proto.Equal(got, srvVSchema) {
+		t.Errorf("aborted update was stored: %v %v", got, err)
+	}
+}
+
+// TestCheckSrvKeyspaceKeyRangeCoverage is a ZK specific unit test
+func TestCheckSrvKeyspaceKeyRangeCoverage(t *testing.T) {
+	full := &topodatapb.SrvKeyspace{
+		Partitions: []*topodatapb.SrvKeyspace_KeyspacePartition{
+			{
+				ServedType: topodatapb.TabletType_MASTER,
+				ShardReferences: []*topodatapb.ShardReference{
+					shardReference("80-", []byte{0x80}, nil),
+					shardReference("-80", nil, []byte{0x80}),
+				},
+			},
+			{
+				// unsharded
+				ServedType:      topodatapb.TabletType_REPLICA,
+				ShardReferences: []*topodatapb.ShardReference{{Name: "0"}},
+			},
+		},
+	}
+	if errs := zktopo.CheckSrvKeyspaceKeyRangeCoverage(full); len(errs) != 0 {
+		t.Errorf("CheckSrvKeyspaceKeyRangeCoverage(full) = %v", errs)
+	}
+
+	broken := &topodatapb.SrvKeyspace{
+		Partitions: []*topodatapb.SrvKeyspace_KeyspacePartition{
+			{
+				ServedType: topodatapb.TabletType_MASTER,
+				ShardReferences: []*topodatapb.ShardReference{
+					shardReference("10-40", []byte{0x10}, []byte{0x40}),
+					shardReference("50-a0", []byte{0x50}, []byte{0xa0}),
+					shardReference("90-c0", []byte{0x90}, []byte{0xc0}),
+				},
+			},
+			{
+				ServedType: topodatapb.TabletType_REPLICA,
+			},
+			{
+				ServedType: topodatapb.TabletType_RDONLY,
+				ShardReferences: []*topodatapb.ShardReference{
+					shardReference("-80", nil, []byte{0x80}),
+					{Name: "80-"},
+				},
+			},
+		},
+	}
+	var got []string
+	for _, err := range zktopo.CheckSrvKeyspaceKeyRangeCoverage(broken) {
+		got = append(got, err.Error())
+	}
+	want := []string{
+		"KeyRange for MASTER starts at 10 with shard 10-40, not at the minimum",
+		"gap in KeyRange values for MASTER between shards 10-40 and 50-a0: 40 != 50",
+		"overlap in KeyRange values for MASTER between shards 50-a0 and 90-c0: a0 > 90",
+		"KeyRange for MASTER ends at c0 with shard 90-c0, not at the maximum",
+		"partition for REPLICA has no shard",
+		"partition for RDONLY has shards with and without KeyRange",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("CheckSrvKeyspaceKeyRangeCoverage(broken) =\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// it is optional in UpdateSrvKeyspaceWithOptions
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+	partial := &topodatapb.SrvKeyspace{
+		Partitions: []*topodatapb.SrvKeyspace_KeyspacePartition{
+			{
+				ServedType: topodatapb.TabletType_MASTER,
+				ShardReferences: []*topodatapb.ShardReference{
+					shardReference("-80", nil, []byte{0x80}),
+				},
+			},
+		},
+	}
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", partial); err != nil {
+		t.Errorf("UpdateSrvKeyspace(partial) = %v", err)
+	}
+	opts := zktopo.UpdateSrvKeyspaceOptions{CheckKeyRangeCoverage: true}
+	if err := zkts.UpdateSrvKeyspaceWithOptions(ctx, "test", "test_keyspace", partial, opts); err == nil || !strings.Contains(err.Error(), "KeyRange for MASTER ends at 80 with shard -80, not at the maximum") {
+		t.Errorf("UpdateSrvKeyspaceWithOptions(partial, CheckKeyRangeCoverage) = %v", err)
+	}
+	if err := zkts.UpdateSrvKeyspaceWithOptions(ctx, "test", "test_keyspace", full, opts); err != nil {
+		t.Errorf("UpdateSrvKeyspaceWithOptions(full, CheckKeyRangeCoverage) = %v", err)
+	}
+}
+
+// TestCellExists is a ZK specific unit test
+func TestCellExists(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	// an existing cell without keyspaces
+	if exists, err := zkts.CellExists(ctx, "test"); err != nil || !exists {
+		t.Errorf("CellExists(test) = %v %v", exists, err)
+	}
+	if names, err := zkts.GetSrvKeyspaceNames(ctx, "test"); err != nil || names != nil {
+		t.Errorf("GetSrvKeyspaceNames(test) = %v %v", names, err)
+	}
+
+	// a cell that doesn't exist
+	if exists, err := zkts.CellExists(ctx, "tset"); err != nil || exists {
+		t.Errorf("CellExists(tset) = %v %v", exists, err)
+	}
+	if names, err := zkts.GetSrvKeyspaceNames(ctx, "tset"); err != nil || names != nil {
+		t.Errorf("GetSrvKeyspaceNames(tset) = %v %v", names, err)
+	}
+
+	if _, err := zkts.CellExists(ctx, "test/.."); err == nil {
+		t.Errorf("CellExists(invalid) worked")
+	}
+}
+
+// TestAddSrvKeyspacePartitionShards is a ZK specific unit test
+func TestAddSrvKeyspacePartitionShards(t *testing.T) {
+	ctx := context.Background()
+	conn := &conflictingConn{Conn: fakezk.NewConn()}
+	zkts := zktopo.NewServer(conn).(*zktopo.Server)
+
+	if err := zkts.AddSrvKeyspacePartitionShards(ctx, "test", "test_keyspace", topodatapb.TabletType_MASTER, nil); err != topo.ErrNoNode {
+		t.Errorf("AddSrvKeyspacePartitionShards(missing) = %v, want ErrNoNode", err)
+	}
+
+	srvKeyspace := &topodatapb.SrvKeyspace{
+		Partitions: []*topodatapb.SrvKeyspace_KeyspacePartition{
+			{
+				ServedType: topodatapb.TabletType_MASTER,
+				ShardReferences: []*topodatapb.ShardReference{
+					shardReference("80-", []byte{0x80}, nil),
+				},
+			},
+		},
+	}
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+
+	// shards are added in KeyRange order, even after a conflict
+	conn.calls = 0
+	conn.conflicts = 1
+	if err := zkts.AddSrvKeyspacePartitionShards(ctx, "test", "test_keyspace", topodatapb.TabletType_MASTER, []*topodatapb.ShardReference{
+		shardReference("40-80", []byte{0x40}, []byte{0x80}),
+		shardReference("-40", nil, []byte{0x40}),
+	}); err != nil {
+		t.Fatalf("AddSrvKeyspacePartitionShards = %v", err)
+	}
+	conn.conflicts = 0
+	if conn.calls != 2 {
+		t.Errorf("got %v calls to Set, want 2", conn.calls)
+	}
+	got, err := zkts.GetSrvKeyspace(ctx, "test", "test_keyspace")
+	if err != nil {
+		t.Fatalf("GetSrvKeyspace: %v", err)
+	}
+	want := &topodatapb.SrvKeyspace{
+		Partitions: []*topodatapb.SrvKeyspace_KeyspacePartition{
+			{
+				ServedType: topodatapb.TabletType_MASTER,
+				ShardReferences: []*topodatapb.ShardReference{
+					shardReference("-40", nil, []byte{0x40}),
+					shardReference("40-80", []byte{0x40}, []byte{0x80}),
+					shardReference("80-", []byte{0x80}, nil),
+				},
+			},
+		},
+	}
+	if !proto.Equal(got, want) {
+		t.Errorf("GetSrvKeyspace = %v, want %v", got, want)
+	}
+
+	// a new partition is created if needed, and has to cover the
+	// whole keyspace id range
+	if err := zkts.AddSrvKeyspacePartitionShards(ctx, "test", "test_keyspace", topodatapb.TabletType_REPLICA, []*topodatapb.ShardReference{
+		shardReference("-80", nil, []byte{0x80}),
+	}); err == nil || !strings.Contains(err.Error(), "not at the maximum") {
+		t.Errorf("AddSrvKeyspacePartitionShards(partial new partition) = %v", err)
+	}
+	if err := zkts.AddSrvKeyspacePartitionShards(ctx, "test", "test_keyspace", topodatapb.TabletType_REPLICA, []*topodatapb.ShardReference{
+		shardReference("0", nil, nil),
+	}); err != nil {
+		t.Errorf("AddSrvKeyspacePartitionShards(new partition) = %v", err)
+	}
+
+	// overlaps and gaps are rejected, and nothing is written
+	for _, shard := range []*topodatapb.ShardReference{
+		shardReference("-80", nil, []byte{0x80}),
+		shardReference("60-c0", []byte{0x60}, []byte{0xc0}),
+	} {
+		if err := zkts.AddSrvKeyspacePartitionShards(ctx, "test", "test_keyspace", topodatapb.TabletType_REPLICA, []*topodatapb.ShardReference{shard}); err == nil || !strings.Contains(err.Error(), "cannot add shards to the REPLICA partition") {
+			t.Errorf("AddSrvKeyspacePartitionShards(%v) = %v", shard.Name, err)
+		}
+	}
+	got, err = zkts.GetSrvKeyspace(ctx, "test", "test_keyspace")
+	if err != nil || len(got.Partitions) != 2 || len(got.Partitions[1].ShardReferences) != 1 || got.Partitions[1].ShardReferences[0].Name != "0" {
+		t.Errorf("GetSrvKeyspace after rejected adds = %v %v", got, err)
+	}
+
+	// the shards covered by the new ones are replaced
+	if err := zkts.AddSrvKeyspacePartitionShards(ctx, "test", "test_keyspace", topodatapb.TabletType_REPLICA, []*topodatapb.ShardReference{
+		shardReference("80-", []byte{0x80}, nil),
+		shardReference("-80", nil, []byte{0x80}),
+	}); err != nil {
+		t.Fatalf("AddSrvKeyspacePartitionShards(split) = %v", err)
+	}
+	if err := zkts.AddSrvKeyspacePartitionShards(ctx, "test", "test_keyspace", topodatapb.TabletType_REPLICA, []*topodatapb.ShardReference{
+		shardReference("-40", nil, []byte{0x40}),
+		shardReference("40-80", []byte{0x40}, []byte{0x80}),
+	}); err != nil {
+		t.Fatalf("AddSrvKeyspacePartitionShards(split -80) = %v", err)
+	}
+	got, err = zkts.GetSrvKeyspace(ctx, "test", "test_keyspace")
+	if err != nil {
+		t.Fatalf("GetSrvKeyspace: %v", err)
+	}
+	wantReplica := &topodatapb.SrvKeyspace_KeyspacePartition{
+		ServedType:      topodatapb.TabletType_REPLICA,
+		ShardReferences: want.Partitions[0].ShardReferences,
+	}
+	if !proto.Equal(got.Partitions[1], wantReplica) {
+		t.Errorf("REPLICA partition after splits = %v, want %v", got.Partitions[1], wantReplica)
+	}
+}
+
+// TestUpdateSrvKeyspacePartition is a ZK specific unit test
+func TestUpdateSrvKeyspacePartition(t *testing.T) {
+	ctx := context.Background()
+	conn := &conflictingConn{Conn: fakezk.NewConn()}
+	zkts := zktopo.NewServer(conn).(*zktopo.Server)
+
+	if err := zkts.UpdateSrvKeyspacePartition(ctx, "test", "test_keyspace", topodatapb.TabletType_MASTER, nil); err != topo.ErrNoNode {
+		t.Errorf("UpdateSrvKeyspacePartition(missing) = %v, want ErrNoNode", err)
+	}
+
+	srvKeyspace := &topodatapb.SrvKeyspace{
+		Partitions: []*topodatapb.SrvKeyspace_KeyspacePartition{
+			{
+				ServedType: topodatapb.TabletType_MASTER,
+				ShardReferences: []*topodatapb.ShardReference{
+					shardReference("0", nil, nil),
+				},
+			},
+			{
+				ServedType: topodatapb.TabletType_REPLICA,
+				ShardReferences: []*topodatapb.ShardReference{
+					shardReference("0", nil, nil),
+				},
+			},
+		},
+		ShardingColumnName: "id",
+	}
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+
+	// the REPLICA partition is replaced, even after a conflict
+	conn.calls = 0
+	conn.conflicts = 1
+	replica := &topodatapb.SrvKeyspace_KeyspacePartition{
+		ShardReferences: []*topodatapb.ShardReference{
+			shardReference("-80", nil, []byte{0x80}),
+			shardReference("80-", []byte{0x80}, nil),
+		},
+	}
+	if err := zkts.UpdateSrvKeyspacePartition(ctx, "test", "test_keyspace", topodatapb.TabletType_REPLICA, replica); err != nil {
+		t.Fatalf("UpdateSrvKeyspacePartition = %v", err)
+	}
+	conn.conflicts = 0
+	if conn.calls != 2 {
+		t.Errorf("got %v calls to Set, want 2", conn.calls)
+	}
+	if replica.ServedType != topodatapb.TabletType_UNKNOWN {
+		t.Errorf("UpdateSrvKeyspacePartition changed the ServedType of its argument to %v", replica.ServedType)
+	}
+	want := proto.Clone(srvKeyspace).(*topodatapb.SrvKeyspace)
+	want.Partitions[1].ShardReferences = replica.ShardReferences
+	if got, err := zkts.GetSrvKeyspace(ctx, "test", "test_keyspace"); err != nil || !proto.Equal(got, want) {
+		t.Errorf("GetSrvKeyspace = %v %v, want %v", got, err, want)
+	}
+
+	// a new partition is added, and a nil one removes the partition
+	rdonly := &topodatapb.SrvKeyspace_KeyspacePartition{
+		ShardReferences: []*topodatapb.ShardReference{
+			shardReference("0", nil, nil),
+		},
+	}
+	if err := zkts.UpdateSrvKeyspacePartition(ctx, "test", "test_keyspace", topodatapb.TabletType_RDONLY, rdonly); err != nil {
+		t.Errorf("UpdateSrvKeyspacePartition(RDONLY) = %v", err)
+	}
+	if err := zkts.UpdateSrvKeyspacePartition(ctx, "test", "test_keyspace", topodatapb.TabletType_MASTER, nil); err != nil {
+		t.Errorf("UpdateSrvKeyspacePartition(nil MASTER) = %v", err)
+	}
+	want.Partitions = append(want.Partitions[1:], &topodatapb.SrvKeyspace_KeyspacePartition{
+		ServedType:      topodatapb.TabletType_RDONLY,
+		ShardReferences: rdonly.ShardReferences,
+	})
+	if got, err := zkts.GetSrvKeyspace(ctx, "test", "test_keyspace"); err != nil || !proto.Equal(got, want) {
+		t.Errorf("GetSrvKeyspace = %v %v, want %v", got, err, want)
+	}
+
+	// invalid partitions are rejected
+	invalid := &topodatapb.SrvKeyspace_KeyspacePartition{
+		ShardReferences: []*topodatapb.ShardReference{
+			shardReference("-80", nil, []byte{0x80}),
+			shardReference("40-", []byte{0x40}, nil),
+		},
+	}
+	if err := zkts.UpdateSrvKeyspacePartition(ctx, "test", "test_keyspace", topodatapb.TabletType_REPLICA, invalid); err == nil || !strings.Contains(err.Error(), "cannot update the REPLICA partition of SrvKeyspace test_keyspace in cell test") {
+		t.Errorf("UpdateSrvKeyspacePartition(invalid) = %v", err)
+	}
+	if got, err := zkts.GetSrvKeyspace(ctx, "test", "test_keyspace"); err != nil || !proto.Equal(got, want) {
+		t.Errorf("GetSrvKeyspace after invalid update = %v %v, want %v", got, err, want)
+	}
+}
+
+// TestServingGraphMaxDataSize is a ZK specific unit test
+func TestServingGraphMaxDataSize(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+
+	srvKeyspace := &topodatapb.SrvKeyspace{ShardingColumnName: strings.Repeat("a", 1000)}
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "plain", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	// compresses to less than 100 bytes
+	if err := zkts.UpdateSrvKeyspaceWithOptions(ctx, "test", "compressed", srvKeyspace, zktopo.UpdateSrvKeyspaceOptions{Compress: true}); err != nil {
+		t.Fatalf("UpdateSrvKeyspaceWithOptions: %v", err)
+	}
+	if _, err := zk.CreateRecursive(zkts.GetZConn(), "/zk/test/vt/ns/malformed", `{"partitions": [{"served_type": `, 0, zookeeper.WorldACL(zookeeper.PermAll)); err != nil {
+		t.Fatalf("CreateRecursive: %v", err)
+	}
+
+	if err := flag.Set("zk_max_serving_graph_data_size", "100"); err != nil {
+		t.Fatalf("flag.Set: %v", err)
+	}
+	defer flag.Set("zk_max_serving_graph_data_size", fmt.Sprintf("%v", 16*1024*1024))
+
+	for _, tc := range []struct {
+		keyspace string
+		want     string
+	}{
+		{"plain", "node data is too big"},
+		{"compressed", "uncompressed node data is too big: more than the maximum of 100 bytes"},
+		{"malformed", "unexpected end of JSON input"},
+	} {
+		_, err := zkts.GetSrvKeyspace(ctx, "test", tc.keyspace)
+		if _, ok := err.(*zktopo.SrvGraphUnmarshalError); !ok || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("GetSrvKeyspace(%v) = %v, want a SrvGraphUnmarshalError containing %q", tc.keyspace, err, tc.want)
+		}
+	}
+
+	if err := zkts.UpdateSrvVSchema(ctx, "test", &vschemapb.SrvVSchema{Keyspaces: map[string]*vschemapb.Keyspace{strings.Repeat("k", 200): {}}}); err != nil {
+		t.Fatalf("UpdateSrvVSchema: %v", err)
+	}
+	if _, err := zkts.GetSrvVSchema(ctx, "test"); err == nil || !strings.Contains(err.Error(), "node data is too big") {
+		t.Errorf("GetSrvVSchema(too big) = %v", err)
+	}
+}
+
+// TestGetSrvKeyspaceCached is a ZK specific unit test
+func TestGetSrvKeyspaceCached(t *testing.T) {
+	ctx := context.Background()
+	conn := &getCountingConn{Conn: fakezk.NewConn()}
+	zkts := zktopo.NewServer(conn).(*zktopo.Server)
+
+	if _, err := zkts.GetSrvKeyspaceCached(ctx, "stale_cell", "test_keyspace", time.Hour); err != topo.ErrNoNode {
+		t.Errorf("GetSrvKeyspaceCached(missing) = %v, want ErrNoNode", err)
+	}
+
+	srvKeyspace := &topodatapb.SrvKeyspace{ShardingColumnName: "user_id"}
+	if err := zkts.UpdateSrvKeyspace(ctx, "stale_cell", "test_keyspace", srvKeyspace); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	conn.gets = 0
+	for i := 0; i < 3; i++ {
+		got, err := zkts.GetSrvKeyspaceCached(ctx, "stale_cell", "test_keyspace", time.Hour)
+		if err != nil || !proto.Equal(got, srvKeyspace) {
+			t.Errorf("GetSrvKeyspaceCached() = %v %v", got, err)
+		}
+		// callers can't change the cached value
+		got.ShardingColumnName = "changed"
+	}
+	if conn.gets != 1 {
+		t.Errorf("got %v calls to Get, want 1", conn.gets)
+	}
+
+	// a stale value is served within the budget, and read again
+	// once it is older
+	updated := &topodatapb.SrvKeyspace{ShardingColumnName: "other_id"}
+	if err := zkts.UpdateSrvKeyspace(ctx, "stale_cell", "test_keyspace", updated); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	if got, err := zkts.GetSrvKeyspaceCached(ctx, "stale_cell", "test_keyspace", time.Hour); err != nil || !proto.Equal(got, srvKeyspace) {
+		t.Errorf("GetSrvKeyspaceCached(within budget) = %v %v", got, err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if got, err := zkts.GetSrvKeyspaceCached(ctx, "stale_cell", "test_keyspace", time.Millisecond); err != nil || !proto.Equal(got, updated) {
+		t.Errorf("GetSrvKeyspaceCached(stale) = %v %v", got, err)
+	}
+	if got, err := zkts.GetSrvKeyspaceCached(ctx, "stale_cell", "test_keyspace", 0); err != nil || !proto.Equal(got, updated) {
+		t.Errorf("GetSrvKeyspaceCached(0) = %v %v", got, err)
+	}
+
+	stats := expvar.Get("ZkTopoSrvKeyspaceStaleCache").String()
+	for _, want := range []string{"\"stale_cell.Hit\": 3", "\"stale_cell.Miss\": 4"} {
+		if !strings.Contains(stats, want) {
+			t.Errorf("ZkTopoSrvKeyspaceStaleCache doesn't contain %v: %v", want, stats)
+		}
+	}
+}
+
+// recordingLogger is a zktopo.Logger keeping all the operations.
+type recordingLogger struct {
+	mu  sync.Mutex
+	ops []*zktopo.ServingGraphOperation
+}
+
+func (l *recordingLogger) LogServingGraphOperation(op *zktopo.ServingGraphOperation) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ops = append(l.ops, op)
+}
+
+// TestLogger is a ZK specific unit test
+func TestLogger(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestServer(t, []string{"test"})
+	defer ts.Close()
+	zkts := ts.(*TestServer).Impl.(*zktopo.Server)
+	logger := &recordingLogger{}
+	zkts.SetLogger(logger)
+
+	if err := zkts.UpdateSrvKeyspace(ctx, "test", "test_keyspace", &topodatapb.SrvKeyspace{}); err != nil {
+		t.Fatalf("UpdateSrvKeyspace: %v", err)
+	}
+	if _, err := zkts.GetSrvKeyspace(ctx, "test", "test_keyspace"); err != nil {
+		t.Fatalf("GetSrvKeyspace: %v", err)
+	}
+	if err := zkts.DeleteSrvKeyspace(ctx, "test", "test_keyspace"); err != nil {
+		t.Fatalf("DeleteSrvKeyspace: %v", err)
+	}
+	if _, err := zkts.GetSrvVSchema(ctx, "test"); err != topo.ErrNoNode {
+		t.Fatalf("GetSrvVSchema: %v", err)
+	}
+
+	var got []string
+	for _, op := range logger.ops {
+		if op.Duration < 0 {
+			t.Errorf("negative duration: %v", op)
+		}
+		got = append(got, fmt.Sprintf("%v %v %v %v", op.Operation, op.Cell, op.Keyspace, op.Err))
+	}
+	want := []string{
+		"UpdateSrvKeyspace test test_keyspace <nil>",
+		"GetSrvKeyspace test test_keyspace <nil>",
+		"DeleteSrvKeyspace test test_keyspace <nil>",
+		"GetSrvVSchema test  node doesn't exist",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("logged operations =\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// without a logger, nothing is logged
+	zkts.SetLogger(nil)
+	if _, err := zkts.GetSrvKeyspaceNames(ctx, "test"); err != nil {
+		t.Fatalf("GetSrvKeyspaceNames: %v", err)
+	}
+	if len(logger.ops) != len(want) {
+		t.Errorf("unexpected operations after SetLogger(nil): %v", logger.ops[len(want):])
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"path"
 	"strings"
 	"sync"
 	"time"
@@ -188,7 +189,11 @@ func (conn *zconn) ExistsW(zkPath string) (stat *zookeeper.Stat, watch <-chan zo
 func (conn *zconn) Create(zkPath, value string, flags int, aclv []zookeeper.ACL) (zkPathCreated string, err error) {
 	conn.mu.Lock()
 	defer conn.mu.Unlock()
+	return conn.create(zkPath, value, flags, aclv)
+}
 
+// create is Create, with conn.mu held.
+func (conn *zconn) create(zkPath, value string, flags int, aclv []zookeeper.ACL) (zkPathCreated string, err error) {
 	parent, _, rest, err := conn.getNode(zkPath, "create")
 	if err != nil {
 		return "", err
@@ -252,7 +257,11 @@ func (conn *zconn) Create(zkPath, value string, flags int, aclv []zookeeper.ACL)
 func (conn *zconn) Set(zkPath, value string, version int32) (stat *zookeeper.Stat, err error) {
 	conn.mu.Lock()
 	defer conn.mu.Unlock()
+	return conn.set(zkPath, value, version)
+}
 
+// set is Set, with conn.mu held.
+func (conn *zconn) set(zkPath, value string, version int32) (stat *zookeeper.Stat, err error) {
 	node, _, rest, err := conn.getNode(zkPath, "set")
 	if err != nil {
 		return nil, err
@@ -267,6 +276,8 @@ func (conn *zconn) Set(zkPath, value string, version int32) (stat *zookeeper.Sta
 	}
 	node.content = value
 	node.stat.Version++
+	node.stat.Mzxid = conn.getZxid()
+	node.stat.Mtime = zk.ZkTime(time.Now())
 	for _, watch := range node.changeWatches {
 		watch <- zookeeper.Event{
 			Type:  zookeeper.EventNodeDataChanged,
@@ -281,7 +292,11 @@ func (conn *zconn) Set(zkPath, value string, version int32) (stat *zookeeper.Sta
 func (conn *zconn) Delete(zkPath string, version int32) (err error) {
 	conn.mu.Lock()
 	defer conn.mu.Unlock()
+	return conn.delete(zkPath, version)
+}
 
+// delete is Delete, with conn.mu held.
+func (conn *zconn) delete(zkPath string, version int32) (err error) {
 	node, parent, rest, err := conn.getNode(zkPath, "delete")
 	if err != nil {
 		return err
@@ -321,6 +336,145 @@ func (conn *zconn) Delete(zkPath string, version int32) (err error) {
 	return nil
 }
 
+// Multi is part of the zk.MultiConn interface. The operations are
+// first checked in order, each against the tree as the previous ones
+// left it, and only applied if they all pass, so they all succeed or
+// none does.
+func (conn *zconn) Multi(ops ...interface{}) ([]zookeeper.MultiResponse, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	view := &multiView{conn: conn, nodes: make(map[string]*multiViewNode)}
+	for _, op := range ops {
+		if err := view.apply(op); err != nil {
+			return nil, err
+		}
+	}
+	result := make([]zookeeper.MultiResponse, len(ops))
+	for i, op := range ops {
+		switch op := op.(type) {
+		case *zookeeper.CreateRequest:
+			result[i].String, result[i].Error = conn.create(op.Path, string(op.Data), int(op.Flags), op.Acl)
+		case *zookeeper.SetDataRequest:
+			result[i].Stat, result[i].Error = conn.set(op.Path, string(op.Data), op.Version)
+		case *zookeeper.DeleteRequest:
+			result[i].Error = conn.delete(op.Path, op.Version)
+		}
+	}
+	return result, nil
+}
+
+// multiView is the state of the nodes changed by the operations of a
+// Multi call, as they are checked. The other nodes are read from the
+// tree.
+type multiView struct {
+	conn  *zconn
+	nodes map[string]*multiViewNode
+}
+
+type multiViewNode struct {
+	exists   bool
+	version  int32
+	children int
+}
+
+// get returns the state of a node, which is added to the view.
+func (v *multiView) get(zkPath string) (*multiViewNode, error) {
+	if n, ok := v.nodes[zkPath]; ok {
+		return n, nil
+	}
+	n := &multiViewNode{}
+	if zkPath == "/" {
+		n.exists = true
+		n.children = len(v.conn.root.children)
+	} else {
+		node, _, rest, err := v.conn.getNode(zkPath, "multi")
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) == 0 {
+			n.exists = true
+			n.version = node.stat.Version
+			n.children = len(node.children)
+		}
+	}
+	v.nodes[zkPath] = n
+	return n, nil
+}
+
+// checkVersion returns the node at zkPath if it exists and has the
+// version, -1 meaning any version.
+func (v *multiView) checkVersion(zkPath string, version int32) (*multiViewNode, error) {
+	n, err := v.get(zkPath)
+	if err != nil {
+		return nil, err
+	}
+	if !n.exists {
+		return nil, zookeeper.ErrNoNode
+	}
+	if version != -1 && n.version != version {
+		return nil, zookeeper.ErrBadVersion
+	}
+	return n, nil
+}
+
+// apply checks a multi operation, and records its changes in the
+// view. It returns the error the operation would fail with.
+func (v *multiView) apply(op interface{}) error {
+	switch op := op.(type) {
+	case *zookeeper.CreateRequest:
+		parent, err := v.get(path.Dir(op.Path))
+		if err != nil {
+			return err
+		}
+		if !parent.exists {
+			return zookeeper.ErrNoNode
+		}
+		if (op.Flags & zookeeper.FlagSequence) != 0 {
+			// The name of the node is only known when it is
+			// created, it can't conflict with anything.
+			parent.children++
+			return nil
+		}
+		n, err := v.get(op.Path)
+		if err != nil {
+			return err
+		}
+		if n.exists {
+			return zookeeper.ErrNodeExists
+		}
+		*n = multiViewNode{exists: true}
+		parent.children++
+		return nil
+	case *zookeeper.SetDataRequest:
+		n, err := v.checkVersion(op.Path, op.Version)
+		if err != nil {
+			return err
+		}
+		n.version++
+		return nil
+	case *zookeeper.DeleteRequest:
+		n, err := v.checkVersion(op.Path, op.Version)
+		if err != nil {
+			return err
+		}
+		if n.children > 0 {
+			return zookeeper.ErrNotEmpty
+		}
+		parent, err := v.get(path.Dir(op.Path))
+		if err != nil {
+			return err
+		}
+		*n = multiViewNode{}
+		parent.children--
+		return nil
+	case *zookeeper.CheckVersionRequest:
+		_, err := v.checkVersion(op.Path, op.Version)
+		return err
+	}
+	return fmt.Errorf("unknown multi operation type %T", op)
+}
+
 func (conn *zconn) Close() error {
 	conn.mu.Lock()
 	defer conn.mu.Unlock()
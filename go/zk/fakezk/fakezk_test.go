@@ -86,6 +86,102 @@ func TestBasic(t *testing.T) {
 
 }
 
+func TestMulti(t *testing.T) {
+	conn := NewConn()
+	defer conn.Close()
+
+	multiConn, ok := conn.(zk.MultiConn)
+	if !ok {
+		t.Fatalf("fakezk doesn't implement zk.MultiConn")
+	}
+	acl := zookeeper.WorldACL(zookeeper.PermAll)
+	if _, err := conn.Create("/zk", "", 0, acl); err != nil {
+		t.Fatalf("conn.Create: %v", err)
+	}
+	if _, err := conn.Create("/zk/foo", "foo", 0, acl); err != nil {
+		t.Fatalf("conn.Create: %v", err)
+	}
+
+	// A failing operation means none is applied.
+	if _, err := multiConn.Multi(
+		&zookeeper.CreateRequest{Path: "/zk/bar", Data: []byte("bar"), Acl: acl},
+		&zookeeper.SetDataRequest{Path: "/zk/foo", Data: []byte("foo2"), Version: 5},
+	); err != zookeeper.ErrBadVersion {
+		t.Errorf("conn.Multi with a wrong version: got %v, wanted %v", err, zookeeper.ErrBadVersion)
+	}
+	if stat, err := conn.Exists("/zk/bar"); err != nil || stat != nil {
+		t.Errorf("/zk/bar should not be created, got: %v %v", stat, err)
+	}
+	if data, _, err := conn.Get("/zk/foo"); err != nil || data != "foo" {
+		t.Errorf("conn.Get: got %q %v, wanted %q", data, err, "foo")
+	}
+
+	if _, err := multiConn.Multi(
+		&zookeeper.CreateRequest{Path: "/zk/bar", Data: []byte("bar"), Acl: acl},
+		&zookeeper.SetDataRequest{Path: "/zk/foo", Data: []byte("foo2"), Version: 0},
+	); err != nil {
+		t.Fatalf("conn.Multi: %v", err)
+	}
+	if data, _, err := conn.Get("/zk/bar"); err != nil || data != "bar" {
+		t.Errorf("conn.Get: got %q %v, wanted %q", data, err, "bar")
+	}
+	if data, _, err := conn.Get("/zk/foo"); err != nil || data != "foo2" {
+		t.Errorf("conn.Get: got %q %v, wanted %q", data, err, "foo2")
+	}
+
+	// the operations are checked against the changes of the
+	// previous ones
+	if _, err := multiConn.Multi(
+		&zookeeper.CreateRequest{Path: "/zk/baz", Data: []byte("baz"), Acl: acl},
+		&zookeeper.CreateRequest{Path: "/zk/baz", Data: []byte("baz2"), Acl: acl},
+	); err != zookeeper.ErrNodeExists {
+		t.Errorf("conn.Multi with two creates of a node: got %v, wanted %v", err, zookeeper.ErrNodeExists)
+	}
+	if _, err := multiConn.Multi(
+		&zookeeper.SetDataRequest{Path: "/zk/foo", Data: []byte("foo3"), Version: 1},
+		&zookeeper.SetDataRequest{Path: "/zk/foo", Data: []byte("foo4"), Version: 1},
+	); err != zookeeper.ErrBadVersion {
+		t.Errorf("conn.Multi with two sets at the same version: got %v, wanted %v", err, zookeeper.ErrBadVersion)
+	}
+	if _, err := multiConn.Multi(
+		&zookeeper.CreateRequest{Path: "/zk/baz", Data: []byte("baz"), Acl: acl},
+		&zookeeper.DeleteRequest{Path: "/zk/bar", Version: -1},
+		&zookeeper.DeleteRequest{Path: "/zk", Version: -1},
+	); err != zookeeper.ErrNotEmpty {
+		t.Errorf("conn.Multi with a delete of a non-empty node: got %v, wanted %v", err, zookeeper.ErrNotEmpty)
+	}
+	if stat, err := conn.Exists("/zk/baz"); err != nil || stat != nil {
+		t.Errorf("/zk/baz should not be created, got: %v %v", stat, err)
+	}
+	if data, _, err := conn.Get("/zk/foo"); err != nil || data != "foo2" {
+		t.Errorf("conn.Get: got %q %v, wanted %q", data, err, "foo2")
+	}
+	if _, err := multiConn.Multi(
+		&zookeeper.CreateRequest{Path: "/zk/baz", Data: []byte(""), Acl: acl},
+		&zookeeper.CreateRequest{Path: "/zk/baz/qux", Data: []byte("qux"), Acl: acl},
+		&zookeeper.SetDataRequest{Path: "/zk/foo", Data: []byte("foo3"), Version: 1},
+		&zookeeper.SetDataRequest{Path: "/zk/foo", Data: []byte("foo4"), Version: 2},
+	); err != nil {
+		t.Fatalf("conn.Multi with dependent operations: %v", err)
+	}
+	if data, _, err := conn.Get("/zk/baz/qux"); err != nil || data != "qux" {
+		t.Errorf("conn.Get: got %q %v, wanted %q", data, err, "qux")
+	}
+	if data, _, err := conn.Get("/zk/foo"); err != nil || data != "foo4" {
+		t.Errorf("conn.Get: got %q %v, wanted %q", data, err, "foo4")
+	}
+
+	if _, err := multiConn.Multi(
+		&zookeeper.CheckVersionRequest{Path: "/zk/foo", Version: 3},
+		&zookeeper.DeleteRequest{Path: "/zk/bar", Version: -1},
+	); err != nil {
+		t.Fatalf("conn.Multi: %v", err)
+	}
+	if stat, err := conn.Exists("/zk/bar"); err != nil || stat != nil {
+		t.Errorf("/zk/bar should be deleted, got: %v %v", stat, err)
+	}
+}
+
 func TestChildren(t *testing.T) {
 	conn := NewConn()
 	defer conn.Close()
@@ -5,6 +5,7 @@
 package zk
 
 import (
+	"fmt"
 	"math/rand"
 	"strings"
 	"time"
@@ -38,6 +39,15 @@ type Conn interface {
 	SetACL(path string, aclv []zookeeper.ACL, version int32) error
 }
 
+// MultiConn is implemented by the Conn that can run several
+// operations in a single transaction, as the zookeeper library Multi
+// does: either all the operations are applied, or none is. The
+// operations are *zookeeper.CreateRequest, *zookeeper.SetDataRequest,
+// *zookeeper.DeleteRequest or *zookeeper.CheckVersionRequest.
+type MultiConn interface {
+	Multi(ops ...interface{}) ([]zookeeper.MultiResponse, error)
+}
+
 // Smooth API to talk to any zk path in the global system.  Emulates
 // "/zk/local" paths by guessing and substituting the correct cell for
 // your current environment.
@@ -277,6 +287,96 @@ func (conn *MetaConn) SetACL(path string, aclv []zookeeper.ACL, version int32) (
 	return
 }
 
+// Multi implements MultiConn. All the operations have to be in the
+// same cell, as they are sent to a single zookeeper cluster.
+func (conn *MetaConn) Multi(ops ...interface{}) ([]zookeeper.MultiResponse, error) {
+	if len(ops) == 0 {
+		return nil, nil
+	}
+	firstPath, err := multiOpPath(ops[0])
+	if err != nil {
+		return nil, err
+	}
+	firstCell, err := ZkCellFromZkPath(firstPath)
+	if err != nil {
+		return nil, err
+	}
+	var zconn Conn
+	for i := 0; i < maxAttempts; i++ {
+		zconn, err = conn.connCache.ConnForPath(firstPath)
+		if err != nil {
+			return nil, err
+		}
+		multiConn, ok := zconn.(MultiConn)
+		if !ok {
+			return nil, fmt.Errorf("connection for cell %v doesn't support multi operations", firstCell)
+		}
+		resolved := make([]interface{}, len(ops))
+		for j, op := range ops {
+			resolved[j], err = resolveMultiOp(op, firstCell)
+			if err != nil {
+				return nil, err
+			}
+		}
+		var result []zookeeper.MultiResponse
+		result, err = multiConn.Multi(resolved...)
+		if !shouldRetry(err) {
+			return result, err
+		}
+	}
+	return nil, err
+}
+
+// multiOpPath returns the path of a multi operation.
+func multiOpPath(op interface{}) (string, error) {
+	switch op := op.(type) {
+	case *zookeeper.CreateRequest:
+		return op.Path, nil
+	case *zookeeper.SetDataRequest:
+		return op.Path, nil
+	case *zookeeper.DeleteRequest:
+		return op.Path, nil
+	case *zookeeper.CheckVersionRequest:
+		return op.Path, nil
+	}
+	return "", fmt.Errorf("unknown multi operation type %T", op)
+}
+
+// resolveMultiOp returns a copy of a multi operation with its
+// /zk/local path resolved. It fails if the operation is not in cell.
+func resolveMultiOp(op interface{}, cell string) (interface{}, error) {
+	path, err := multiOpPath(op)
+	if err != nil {
+		return nil, err
+	}
+	opCell, err := ZkCellFromZkPath(path)
+	if err != nil {
+		return nil, err
+	}
+	if opCell != cell {
+		return nil, fmt.Errorf("multi operation on %v is not in cell %v", path, cell)
+	}
+	path = resolveZkPath(path)
+	switch op := op.(type) {
+	case *zookeeper.CreateRequest:
+		resolved := *op
+		resolved.Path = path
+		return &resolved, nil
+	case *zookeeper.SetDataRequest:
+		resolved := *op
+		resolved.Path = path
+		return &resolved, nil
+	case *zookeeper.DeleteRequest:
+		resolved := *op
+		resolved.Path = path
+		return &resolved, nil
+	default:
+		resolved := *op.(*zookeeper.CheckVersionRequest)
+		resolved.Path = path
+		return &resolved, nil
+	}
+}
+
 // NewMetaConn creates a MetaConn.
 func NewMetaConn() *MetaConn {
 	return &MetaConn{NewConnCache()}
@@ -328,6 +328,18 @@ func (conn *ZkConn) Delete(path string, version int32) (err error) {
 	return c.Delete(path, version)
 }
 
+// Multi is part of the MultiConn interface.
+func (conn *ZkConn) Multi(ops ...interface{}) ([]zookeeper.MultiResponse, error) {
+	c := conn.getConn()
+	if c == nil {
+		return nil, ErrConnectionClosed
+	}
+
+	sem.Acquire()
+	defer sem.Release()
+	return c.Multi(ops...)
+}
+
 // Close will close the connection asynchronously.  It will never
 // fail, even though closing the connection might fail in the
 // background.  Accessing this ZkConn after Close has been called will
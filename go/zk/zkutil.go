@@ -54,7 +54,9 @@ func IsDirectory(aclv []zookeeper.ACL) bool {
 }
 
 // CreateRecursive creates a path and any pieces required, think mkdir -p.
-// Intermediate znodes are always created empty.
+// Intermediate znodes are always created empty. An intermediate znode
+// created by a concurrent caller is not an error, but the final one
+// still returns zookeeper.ErrNodeExists if it already exists.
 func CreateRecursive(zconn Conn, zkPath, value string, flags int, aclv []zookeeper.ACL) (pathCreated string, err error) {
 	parts := strings.Split(zkPath, "/")
 	if parts[1] != MagicPrefix {